@@ -0,0 +1,100 @@
+package lxcri
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuOnlineFile is the list of online CPUs.
+var cpuOnlineFile = "/sys/devices/system/cpu/online"
+
+// maxCPUs is the number of CPUs that fit into unix.CPUSet.
+const maxCPUs = len(unix.CPUSet{}) * 64
+
+// parseCPUList parses a CPU list (e.g "0-3,6") as used by cpusets
+// and /sys/devices/system/cpu, see `man 7 cpuset`.
+func parseCPUList(list string) (unix.CPUSet, error) {
+	var set unix.CPUSet
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return set, fmt.Errorf("empty CPU list")
+	}
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return set, fmt.Errorf("invalid CPU list %q: %w", list, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return set, fmt.Errorf("invalid CPU list %q: %w", list, err)
+			}
+		}
+		if first < 0 || last < first || last >= maxCPUs {
+			return set, fmt.Errorf("invalid CPU list %q: invalid range %q", list, item)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return set, nil
+}
+
+// execCPUSet returns the CPU set from ExecOptions.CPUs or nil if it is empty.
+// All CPUs must be online.
+func execCPUSet(execOpts *ExecOptions) (*unix.CPUSet, error) {
+	if execOpts == nil || execOpts.CPUs == "" {
+		return nil, nil
+	}
+	set, err := parseCPUList(execOpts.CPUs)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(cpuOnlineFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read online CPUs: %w", err)
+	}
+	online, err := parseCPUList(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse online CPUs: %w", err)
+	}
+	for cpu := 0; cpu < maxCPUs; cpu++ {
+		if set.IsSet(cpu) && !online.IsSet(cpu) {
+			return nil, fmt.Errorf("CPU %d is not online (online CPUs: %s)", cpu, strings.TrimSpace(string(data)))
+		}
+	}
+	return &set, nil
+}
+
+// withCPUAffinity calls fn on a thread that is pinned to the given CPU set.
+// Processes forked by fn (e.g by liblxc attach) inherit the CPU affinity.
+// The CPU affinity of the thread is restored when fn returns.
+// fn is called without pinning if set is nil.
+func withCPUAffinity(set *unix.CPUSet, fn func()) error {
+	if set == nil {
+		fn()
+		return nil
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var orig unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &orig); err != nil {
+		return fmt.Errorf("failed to get CPU affinity: %w", err)
+	}
+	if err := unix.SchedSetaffinity(0, set); err != nil {
+		return fmt.Errorf("failed to set CPU affinity: %w", err)
+	}
+	fn()
+	if err := unix.SchedSetaffinity(0, &orig); err != nil {
+		return fmt.Errorf("failed to restore CPU affinity: %w", err)
+	}
+	return nil
+}
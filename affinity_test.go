@@ -0,0 +1,42 @@
+package lxcri
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUList(t *testing.T) {
+	set, err := parseCPUList("0-3,6\n")
+	require.NoError(t, err)
+	require.Equal(t, 5, set.Count())
+	for _, cpu := range []int{0, 1, 2, 3, 6} {
+		require.True(t, set.IsSet(cpu), cpu)
+	}
+
+	for _, list := range []string{"", "a", "3-1", "-1", "0,", "0-x", "4096"} {
+		_, err := parseCPUList(list)
+		require.Error(t, err, list)
+	}
+}
+
+func TestExecCPUSet(t *testing.T) {
+	online := filepath.Join(t.TempDir(), "online")
+	require.NoError(t, os.WriteFile(online, []byte("0-1\n"), 0644))
+	defer func(f string) { cpuOnlineFile = f }(cpuOnlineFile)
+	cpuOnlineFile = online
+
+	set, err := execCPUSet(nil)
+	require.NoError(t, err)
+	require.Nil(t, set)
+
+	set, err = execCPUSet(&ExecOptions{CPUs: "1"})
+	require.NoError(t, err)
+	require.Equal(t, 1, set.Count())
+	require.True(t, set.IsSet(1))
+
+	_, err = execCPUSet(&ExecOptions{CPUs: "0-2"})
+	require.Error(t, err)
+}
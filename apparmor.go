@@ -0,0 +1,317 @@
+package lxcri
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// apparmorProfileFileAnnotation references an apparmor profile file within the bundle,
+// that is loaded into the kernel before the container is created.
+const apparmorProfileFileAnnotation = "org.linuxcontainers.lxcri.apparmor.profile-file"
+
+// apparmorProfileCopy is the copy of the loaded profile in the container runtime directory.
+// It is used to unload the profile when the container is deleted.
+const apparmorProfileCopy = "apparmor.profile"
+
+var apparmorParser = "apparmor_parser"
+
+// apparmorParse runs apparmor_parser with the given arguments
+// and the profile passed on stdin.
+func apparmorParse(profile []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(apparmorParser, args...)
+	cmd.Stdin = bytes.NewReader(profile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w: %s", apparmorParser, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// apparmorProfileNames returns the names of the profiles defined in the given profile.
+func apparmorProfileNames(profile []byte) ([]string, error) {
+	out, err := apparmorParse(profile, "--names")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if name := strings.TrimSpace(sc.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("apparmor profile defines no profile name")
+	}
+	return names, sc.Err()
+}
+
+// apparmorProfilePath returns the resolved path of the profile file name
+// relative to the bundle directory.
+func apparmorProfilePath(bundle string, name string) (string, error) {
+	if bundle == "" {
+		return "", fmt.Errorf("bundle path is not set")
+	}
+	dir, err := filepath.EvalSymlinks(bundle)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve bundle dir: %w", err)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve apparmor profile %q: %w", name, err)
+	}
+	if !strings.HasPrefix(p, dir+"/") {
+		return "", fmt.Errorf("apparmor profile %q is not within the bundle dir %s", name, bundle)
+	}
+	return p, nil
+}
+
+// loadApparmorProfile loads the profile file referenced by the apparmorProfileFileAnnotation
+// and returns the profile name for the container process.
+// The name is spec.Process.ApparmorProfile if set, which must be defined in the profile file,
+// otherwise the first profile defined in the profile file.
+// Profiles with the same name that were loaded by the runtime for another container are replaced.
+// It is an error if the profile file defines a profile that is already loaded
+// but was not loaded by the runtime (e.g a host profile).
+func (rt *Runtime) loadApparmorProfile(c *Container, name string) (string, error) {
+	if !rt.LoadApparmorProfiles {
+		return "", fmt.Errorf("loading apparmor profiles is disabled")
+	}
+	if !rt.isPrivileged() {
+		return "", fmt.Errorf("loading apparmor profiles requires root privileges")
+	}
+	filename, err := apparmorProfilePath(c.BundlePath, name)
+	if err != nil {
+		return "", err
+	}
+	profile, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read apparmor profile: %w", err)
+	}
+	names, err := apparmorProfileNames(profile)
+	if err != nil {
+		return "", err
+	}
+	aaprofile := c.Spec.Process.ApparmorProfile
+	if aaprofile == "" {
+		aaprofile = names[0]
+	} else if !containsString(names, aaprofile) {
+		return "", fmt.Errorf("apparmor profile %q is not defined in %s", aaprofile, name)
+	}
+	if err := rt.checkApparmorProfileOwner(c.ContainerID, names); err != nil {
+		return "", err
+	}
+
+	// Record the profile before it is loaded, so it is unloaded by Runtime.Delete
+	// even if the create fails afterwards.
+	if err := os.WriteFile(c.RuntimePath(apparmorProfileCopy), profile, 0440); err != nil {
+		return "", fmt.Errorf("failed to record apparmor profile: %w", err)
+	}
+	if _, err := apparmorParse(profile, "--replace"); err != nil {
+		return "", err
+	}
+	c.Log.Info().Str("file", filename).Str("profile", aaprofile).Msg("loaded apparmor profile")
+	return aaprofile, nil
+}
+
+// unloadApparmorProfile unloads the given profile loaded for the deleted container,
+// unless a profile with the same name is still used by another container.
+func (rt *Runtime) unloadApparmorProfile(containerID string, profile []byte) error {
+	names, err := apparmorProfileNames(profile)
+	if err != nil {
+		return err
+	}
+	id, name, err := rt.apparmorProfileUser(containerID, names)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		rt.Log.Info().Str("profile", name).Str("cid", id).Msg("apparmor profile is still in use")
+		return nil
+	}
+	if _, err := apparmorParse(profile, "--remove"); err != nil {
+		return err
+	}
+	rt.Log.Info().Strs("profiles", names).Msg("unloaded apparmor profile")
+	return nil
+}
+
+// apparmorProfileUser returns the ID of a container, other than containerID,
+// that has loaded one of the given profiles and the name of the profile.
+// An empty container ID is returned if the profiles are not used by another container.
+func (rt *Runtime) apparmorProfileUser(containerID string, names []string) (string, string, error) {
+	ids, err := rt.List()
+	if err != nil {
+		return "", "", err
+	}
+	for _, id := range ids {
+		if id == containerID {
+			continue
+		}
+		other, err := os.ReadFile(filepath.Join(rt.Root, id, apparmorProfileCopy))
+		if err != nil {
+			continue
+		}
+		otherNames, err := apparmorProfileNames(other)
+		if err != nil {
+			continue
+		}
+		for _, name := range otherNames {
+			if containsString(names, name) {
+				return id, name, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// checkApparmorProfileOwner returns an error if one of the given profiles is loaded,
+// but was not loaded by the runtime for a container other than containerID.
+// This prevents that a profile file from a bundle replaces (and unloads on delete)
+// a profile that is managed by the host.
+func (rt *Runtime) checkApparmorProfileOwner(containerID string, names []string) error {
+	for _, name := range names {
+		loaded, err := apparmorProfileLoaded(name)
+		if err != nil {
+			return err
+		}
+		if !loaded {
+			continue
+		}
+		id, _, err := rt.apparmorProfileUser(containerID, []string{name})
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return fmt.Errorf("apparmor profile %q is already loaded and was not loaded by the runtime", name)
+		}
+	}
+	return nil
+}
+
+// apparmorProfilesFile lists the profiles loaded into the kernel.
+var apparmorProfilesFile = "/sys/kernel/security/apparmor/profiles"
+
+// apparmorProfileLoaded returns true if the profile with the given name is loaded.
+func apparmorProfileLoaded(name string) (bool, error) {
+	f, err := os.Open(apparmorProfilesFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read loaded apparmor profiles: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if parseApparmorLabel(sc.Text()) == name {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// apparmorProfileNameRegexp matches the profile names that can be generated.
+var apparmorProfileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// defaultApparmorProfileTemplate is a baseline profile for containers,
+// modelled after the liblxc profile lxc-container-default-cgns.
+const defaultApparmorProfileTemplate = `#include <tunables/global>
+
+profile %s flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+  signal,
+  ptrace,
+  unix,
+  pivot_root,
+
+  # filesystems the container may mount
+  mount fstype=proc -> /proc/,
+  mount fstype=sysfs -> /sys/,
+  mount fstype=cgroup2 -> /sys/fs/cgroup/{,**},
+  mount fstype=tmpfs,
+  mount fstype=mqueue,
+  mount fstype=devpts,
+  mount options=(rw,bind),
+  mount options=(ro,remount,bind),
+  mount options=(ro,remount,bind,nosuid,nodev,noexec),
+  mount options=(rw,make-slave) -> **,
+  mount options=(rw,make-rslave) -> **,
+  mount options=(rw,make-private) -> **,
+  mount options=(rw,make-rprivate) -> **,
+
+  # deny writes to the host kernel configuration
+  deny @{PROC}/sys/fs/** wklx,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/kcore rwklx,
+  deny @{PROC}/sys/kernel/{?,??,[^s][^h][^m]**} wklx,
+  deny @{PROC}/sys/kernel/*/** wklx,
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+}
+`
+
+// defaultApparmorProfile returns the baseline profile with the given name.
+func defaultApparmorProfile(name string) ([]byte, error) {
+	if !apparmorProfileNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid apparmor profile name %q", name)
+	}
+	return []byte(fmt.Sprintf(defaultApparmorProfileTemplate, name)), nil
+}
+
+// generateApparmorProfile generates and loads the baseline profile (see defaultApparmorProfile)
+// with the given name, if no profile with this name is loaded.
+// Like a profile loaded from a profile file, the generated profile is unloaded
+// by Runtime.Delete when it is no longer used by any container.
+func (rt *Runtime) generateApparmorProfile(c *Container, name string) error {
+	loaded, err := apparmorProfileLoaded(name)
+	if err != nil {
+		return err
+	}
+	if loaded {
+		// Record the usage of a profile that was loaded by the runtime for another container,
+		// so it is not unloaded while this container is still using it.
+		id, _, err := rt.apparmorProfileUser(c.ContainerID, []string{name})
+		if err != nil || id == "" {
+			return err
+		}
+		other, err := os.ReadFile(filepath.Join(rt.Root, id, apparmorProfileCopy))
+		if err != nil {
+			return fmt.Errorf("failed to read apparmor profile of container %s: %w", id, err)
+		}
+		return os.WriteFile(c.RuntimePath(apparmorProfileCopy), other, 0440)
+	}
+
+	if !rt.isPrivileged() {
+		return fmt.Errorf("generating apparmor profile %q requires root privileges", name)
+	}
+	profile, err := defaultApparmorProfile(name)
+	if err != nil {
+		return err
+	}
+	// Record the profile before it is loaded, so it is unloaded by Runtime.Delete
+	// even if the create fails afterwards.
+	if err := os.WriteFile(c.RuntimePath(apparmorProfileCopy), profile, 0440); err != nil {
+		return fmt.Errorf("failed to record apparmor profile: %w", err)
+	}
+	if _, err := apparmorParse(profile, "--replace"); err != nil {
+		return err
+	}
+	c.Log.Info().Str("profile", name).Msg("generated and loaded default apparmor profile")
+	return nil
+}
@@ -0,0 +1,210 @@
+package lxcri
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApparmorProfilePath(t *testing.T) {
+	dir := t.TempDir()
+
+	bundle := filepath.Join(dir, "bundle")
+	require.NoError(t, os.MkdirAll(filepath.Join(bundle, "sub"), 0755))
+	for _, p := range []string{"outside.profile", "bundle/default.profile", "bundle/sub/strict.profile"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p), nil, 0600))
+	}
+	require.NoError(t, os.Symlink("../outside.profile", filepath.Join(bundle, "link.profile")))
+
+	_, err := apparmorProfilePath("", "default.profile")
+	require.Error(t, err, "bundle path is not set")
+
+	p, err := apparmorProfilePath(bundle, "default.profile")
+	require.NoError(t, err)
+	require.Equal(t, "default.profile", filepath.Base(p))
+
+	_, err = apparmorProfilePath(bundle, "sub/strict.profile")
+	require.NoError(t, err)
+
+	for _, name := range []string{"../outside.profile", "sub/../../outside.profile", "link.profile", "missing.profile", "", "."} {
+		_, err = apparmorProfilePath(bundle, name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestLoadApparmorProfileDisabled(t *testing.T) {
+	c := &Container{ContainerConfig: &ContainerConfig{BundlePath: t.TempDir()}}
+	rtProfile := Runtime{}
+	_, err := rtProfile.loadApparmorProfile(c, "default.profile")
+	require.Error(t, err)
+}
+
+const testApparmorProfile = `
+#include <tunables/global>
+
+profile lxcri-test-profile flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+  file,
+  capability,
+  network,
+  mount,
+  umount,
+  pivot_root,
+  signal,
+  ptrace,
+  unix,
+}
+`
+
+func apparmorLoaded(t *testing.T, name string) bool {
+	data, err := os.ReadFile("/sys/kernel/security/apparmor/profiles")
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(data), "\n") {
+		if parseApparmorLabel(line) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckApparmorProfileOwner(t *testing.T) {
+	if _, err := exec.LookPath(apparmorParser); err != nil {
+		t.Skipf("%s is not available", apparmorParser)
+	}
+
+	profiles := filepath.Join(t.TempDir(), "profiles")
+	err := os.WriteFile(profiles, []byte("host-profile (enforce)\nlxcri-test-profile (enforce)\n"), 0600)
+	require.NoError(t, err)
+	defer func(p string) { apparmorProfilesFile = p }(apparmorProfilesFile)
+	apparmorProfilesFile = profiles
+
+	rtX := *rt
+	rtX.Root = t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(rtX.Root, "other"), 0755))
+	err = os.WriteFile(filepath.Join(rtX.Root, "other", apparmorProfileCopy), []byte(testApparmorProfile), 0440)
+	require.NoError(t, err)
+
+	// A profile that is not loaded by the runtime must not be replaced.
+	err = rtX.checkApparmorProfileOwner("c1", []string{"lxcri-test-profile", "host-profile"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host-profile")
+
+	// A profile loaded by the runtime for another container can be replaced.
+	require.NoError(t, rtX.checkApparmorProfileOwner("c1", []string{"lxcri-test-profile"}))
+	require.Error(t, rtX.checkApparmorProfileOwner("other", []string{"lxcri-test-profile"}))
+
+	require.NoError(t, rtX.checkApparmorProfileOwner("c1", []string{"not-loaded"}))
+}
+
+func TestApparmorProfileFileAnnotation(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+	if !apparmorSupported() {
+		t.Skipf("apparmor is not enabled")
+	}
+	if _, err := exec.LookPath(apparmorParser); err != nil {
+		t.Skipf("%s is not available", apparmorParser)
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	cfg.BundlePath = t.TempDir()
+	err := os.WriteFile(filepath.Join(cfg.BundlePath, "apparmor.profile"), []byte(testApparmorProfile), 0600)
+	require.NoError(t, err)
+	cfg.Spec.Annotations = map[string]string{apparmorProfileFileAnnotation: "apparmor.profile"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtProfile := *rt
+	rtProfile.Features.Apparmor = true
+
+	_, err = rtProfile.Create(ctx, cfg)
+	require.Error(t, err, "loading apparmor profiles is disabled")
+	require.NoError(t, rtProfile.Delete(ctx, cfg.ContainerID, true))
+
+	rtProfile.LoadApparmorProfiles = true
+	c, err := rtProfile.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.True(t, apparmorLoaded(t, "lxcri-test-profile"))
+
+	err = rtProfile.Start(ctx, c)
+	require.NoError(t, err)
+
+	profile, err := apparmorProfile(c.LinuxContainer.InitPid())
+	require.NoError(t, err)
+	require.Equal(t, "lxcri-test-profile", profile)
+
+	err = rtProfile.Delete(ctx, c.ContainerID, true)
+	require.NoError(t, err)
+	require.False(t, apparmorLoaded(t, "lxcri-test-profile"))
+}
+
+func TestDefaultApparmorProfile(t *testing.T) {
+	_, err := defaultApparmorProfile("lxcri/../default")
+	require.Error(t, err)
+
+	profile, err := defaultApparmorProfile("lxcri-default")
+	require.NoError(t, err)
+	require.Contains(t, string(profile), "profile lxcri-default flags=")
+
+	if _, err := exec.LookPath(apparmorParser); err != nil {
+		t.Skipf("%s is not available", apparmorParser)
+	}
+	names, err := apparmorProfileNames(profile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"lxcri-default"}, names)
+}
+
+func TestGenerateApparmorProfile(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+	if !apparmorSupported() {
+		t.Skipf("apparmor is not enabled")
+	}
+	if _, err := exec.LookPath(apparmorParser); err != nil {
+		t.Skipf("%s is not available", apparmorParser)
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Process.ApparmorProfile = "lxcri-test-generated"
+	require.False(t, apparmorLoaded(t, "lxcri-test-generated"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtProfile := *rt
+	rtProfile.Features.Apparmor = true
+	rtProfile.GenerateApparmorProfiles = true
+
+	c, err := rtProfile.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.True(t, apparmorLoaded(t, "lxcri-test-generated"))
+
+	err = rtProfile.Start(ctx, c)
+	require.NoError(t, err)
+
+	profile, err := apparmorProfile(c.LinuxContainer.InitPid())
+	require.NoError(t, err)
+	require.Equal(t, "lxcri-test-generated", profile)
+
+	err = rtProfile.Delete(ctx, c.ContainerID, true)
+	require.NoError(t, err)
+	require.False(t, apparmorLoaded(t, "lxcri-test-generated"))
+}
@@ -0,0 +1,140 @@
+package lxcri
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"golang.org/x/sys/unix"
+)
+
+// The container files written to the BackupConfigDir.
+var backupConfigSuffixes = []string{
+	".config.json", // the container spec (written by Create)
+	".config",      // the liblxc container config (written by runStartCmd)
+}
+
+// backupConfigID returns the container ID for the given backup file name.
+func backupConfigID(name string) (string, bool) {
+	for _, suffix := range backupConfigSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// checkBackupConfigDir creates the backup directory dir
+// if it does not exist and checks that it is writable.
+func checkBackupConfigDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("backup config dir %q is not an absolute path", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create backup config dir: %w", err)
+	}
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return fmt.Errorf("backup config dir %q is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+// backupSpec writes the container spec to the BackupConfigDir.
+// An existing backup from a previous container with the same ID is replaced.
+func (rt *Runtime) backupSpec(cfg *ContainerConfig) error {
+	specPath := filepath.Join(rt.BackupConfigDir, cfg.ContainerID+".config.json")
+	if err := os.Remove(specPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove previous spec backup: %w", err)
+	}
+	if err := specki.EncodeJSONFile(specPath, cfg.Spec, os.O_EXCL|os.O_CREATE, 0444); err != nil {
+		return fmt.Errorf("failed to backup spec: %w", err)
+	}
+	return nil
+}
+
+// backupConfigFile copies the liblxc container config file to the BackupConfigDir.
+func (rt *Runtime) backupConfigFile(c *Container) error {
+	data, err := os.ReadFile(c.ConfigFilePath())
+	if err != nil {
+		return fmt.Errorf("failed to backup config file: %w", err)
+	}
+	configPath := filepath.Join(rt.BackupConfigDir, c.ContainerID+".config")
+	if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove previous config file backup: %w", err)
+	}
+	if err := os.WriteFile(configPath, data, 0444); err != nil {
+		return fmt.Errorf("failed to backup config file: %w", err)
+	}
+	return nil
+}
+
+// removeBackupConfig removes the backup files of the container with the given ID.
+func (rt *Runtime) removeBackupConfig(containerID string) error {
+	for _, suffix := range backupConfigSuffixes {
+		err := os.Remove(filepath.Join(rt.BackupConfigDir, containerID+suffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type backupConfig struct {
+	containerID string
+	modTime     time.Time
+}
+
+// pruneBackupConfig removes the backup files of containers that are older than
+// BackupConfigMaxAge, and the backup files of the oldest containers that exceed BackupConfigMaxCount.
+func (rt *Runtime) pruneBackupConfig(now time.Time) error {
+	if rt.BackupConfigMaxCount == 0 && rt.BackupConfigMaxAge == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(rt.BackupConfigDir)
+	if err != nil {
+		return err
+	}
+
+	backups := make(map[string]time.Time)
+	for _, e := range entries {
+		id, ok := backupConfigID(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// The file was removed concurrently.
+			continue
+		}
+		if info.ModTime().After(backups[id]) {
+			backups[id] = info.ModTime()
+		}
+	}
+
+	sorted := make([]backupConfig, 0, len(backups))
+	for id, t := range backups {
+		sorted = append(sorted, backupConfig{containerID: id, modTime: t})
+	}
+	// newest first
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].modTime.After(sorted[j].modTime)
+	})
+
+	maxAge := time.Duration(rt.BackupConfigMaxAge) * time.Second
+	for i, b := range sorted {
+		expired := maxAge > 0 && now.Sub(b.modTime) > maxAge
+		exceeded := rt.BackupConfigMaxCount > 0 && i >= int(rt.BackupConfigMaxCount)
+		if !expired && !exceeded {
+			continue
+		}
+		rt.Log.Debug().Str("cid", b.containerID).Time("modified", b.modTime).Msg("removing backup config")
+		if err := rt.removeBackupConfig(b.containerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package lxcri
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBackupConfig(t *testing.T, dir string, id string, modTime time.Time) {
+	for _, suffix := range backupConfigSuffixes {
+		p := filepath.Join(dir, id+suffix)
+		require.NoError(t, os.WriteFile(p, []byte("{}"), 0444))
+		require.NoError(t, os.Chtimes(p, modTime, modTime))
+	}
+}
+
+func listBackupConfig(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPruneBackupConfig(t *testing.T) {
+	now := time.Now()
+
+	newRuntime := func() *Runtime {
+		dir := t.TempDir()
+		writeBackupConfig(t, dir, "c1", now.Add(-time.Hour*3))
+		writeBackupConfig(t, dir, "c2", now.Add(-time.Hour*2))
+		writeBackupConfig(t, dir, "c3", now.Add(-time.Hour))
+		// unrelated files are ignored
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), nil, 0444))
+		return &Runtime{BackupConfigDir: dir, Log: rt.Log}
+	}
+
+	// retention is disabled by default
+	r := newRuntime()
+	require.NoError(t, r.pruneBackupConfig(now))
+	require.Len(t, listBackupConfig(t, r.BackupConfigDir), 7)
+
+	r = newRuntime()
+	r.BackupConfigMaxCount = 2
+	require.NoError(t, r.pruneBackupConfig(now))
+	require.Equal(t, []string{"README", "c2.config", "c2.config.json", "c3.config", "c3.config.json"},
+		listBackupConfig(t, r.BackupConfigDir))
+
+	r = newRuntime()
+	r.BackupConfigMaxAge = uint((time.Minute * 90).Seconds())
+	require.NoError(t, r.pruneBackupConfig(now))
+	require.Equal(t, []string{"README", "c3.config", "c3.config.json"},
+		listBackupConfig(t, r.BackupConfigDir))
+
+	r = newRuntime()
+	r.BackupConfigMaxCount = 1
+	r.BackupConfigMaxAge = uint((time.Minute * 30).Seconds())
+	require.NoError(t, r.pruneBackupConfig(now))
+	require.Equal(t, []string{"README"}, listBackupConfig(t, r.BackupConfigDir))
+}
+
+func TestDeleteBackupConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeBackupConfig(t, dir, "c1", time.Now())
+	writeBackupConfig(t, dir, "c2", time.Now())
+
+	r := &Runtime{BackupConfigDir: dir, Log: rt.Log}
+	r.deleteBackupConfig("c1")
+	require.Len(t, listBackupConfig(t, dir), 4)
+
+	r.DeleteBackupConfig = true
+	r.deleteBackupConfig("c1")
+	require.Equal(t, []string{"c2.config", "c2.config.json"}, listBackupConfig(t, dir))
+
+	// a missing backup is not an error
+	require.NoError(t, r.removeBackupConfig("c1"))
+}
+
+func TestCheckBackupConfigDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backup")
+	require.NoError(t, checkBackupConfigDir(dir))
+	require.DirExists(t, dir)
+
+	err := checkBackupConfigDir("relative/backup")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not an absolute path")
+
+	if os.Getuid() != 0 {
+		require.NoError(t, os.Chmod(dir, 0500))
+		err = checkBackupConfigDir(dir)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is not writable")
+	}
+}
+
+func TestBackupConfig(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	rtBackup := *rt
+	rtBackup.BackupConfigDir = t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rtBackup.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	spec, err := specki.LoadSpecJSON(filepath.Join(rtBackup.BackupConfigDir, cfg.ContainerID+".config.json"))
+	require.NoError(t, err)
+	require.Equal(t, cfg.Spec.Process.Args, spec.Process.Args)
+	require.FileExists(t, filepath.Join(rtBackup.BackupConfigDir, cfg.ContainerID+".config"))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
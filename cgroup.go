@@ -2,10 +2,12 @@ package lxcri
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +18,10 @@ import (
 
 var cgroupRoot = "/sys/fs/cgroup"
 
+// cgroupV1Root is the mount point of the cgroup v1 controller hierarchies
+// on hosts with a hybrid cgroup layout.
+var cgroupV1Root = "/sys/fs/cgroup"
+
 // liblxc itself does cgroup root detection in cgfsng
 func detectCgroupRoot(rt *Runtime) (string, error) {
 	var cgroupRoot string
@@ -57,17 +63,111 @@ func getProcessCgroup() (string, error) {
 }
 
 // checkCgroup checks if the cgroup of the container is non-empty.
-func checkCgroup(c *Container) error {
+// A cgroup that does not exist is recorded as owned by the runtime (see recordOwnedCgroup),
+// because it is created by liblxc for the container.
+// An existing empty cgroup that is owned by the runtime was left over by a
+// previous create, and is deleted so that it is recreated by liblxc.
+// Existing empty cgroups that are not owned by the runtime are not modified.
+func checkCgroup(root string, c *Container) error {
 	ev, err := parseCgroupEvents(filepath.Join(cgroupRoot, c.CgroupDir, "cgroup.events"))
-	if err != nil && !os.IsNotExist(err) {
+	if os.IsNotExist(err) {
+		return recordOwnedCgroup(root, c)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to parse cgroup events: %w", err)
 	}
-	if err == nil && ev.populated {
-		return fmt.Errorf("container cgroup %s is not empty", c.CgroupDir)
+	if ev.populated {
+		return fmt.Errorf("%w: %s", ErrCgroupNotEmpty, c.CgroupDir)
+	}
+	if !isOwnedCgroup(root, c.CgroupDir) {
+		return nil
+	}
+	c.Log.Info().Str("cgroup", c.CgroupDir).Msg("deleting empty cgroup left over by a previous create")
+	if err := deleteCgroup(c.CgroupDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete left over cgroup %s: %w", c.CgroupDir, err)
+	}
+	return nil
+}
+
+// ownedCgroupPath returns the path of the file in the runtime root directory,
+// that records that the cgroup was created by the runtime.
+// The record is removed when the container is deleted.
+func ownedCgroupPath(root string, cgroupDir string) string {
+	return filepath.Join(root, ".cgroups", fmt.Sprintf("%x", sha256.Sum256([]byte(cgroupDir))))
+}
+
+func recordOwnedCgroup(root string, c *Container) error {
+	p := ownedCgroupPath(root, c.CgroupDir)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("failed to record cgroup: %w", err)
+	}
+	if err := os.WriteFile(p, []byte(c.CgroupDir), 0600); err != nil {
+		return fmt.Errorf("failed to record cgroup: %w", err)
 	}
 	return nil
 }
 
+func isOwnedCgroup(root string, cgroupDir string) bool {
+	_, err := os.Stat(ownedCgroupPath(root, cgroupDir))
+	return err == nil
+}
+
+// removeOwnedCgroup removes the record created by recordOwnedCgroup.
+// The runtime root is the parent directory of the container runtime directory.
+func (c *Container) removeOwnedCgroup() {
+	p := ownedCgroupPath(filepath.Dir(c.runtimeDir), c.CgroupDir)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		c.Log.Warn().Err(err).Str("cgroup", c.CgroupDir).Msg("failed to remove cgroup record")
+	}
+}
+
+// lockCgroup acquires an exclusive lock for the container cgroup.
+// The lock serializes concurrent creates that target the same cgroup,
+// from the cgroup check until the container init process populates the cgroup.
+// The lock file is created in the runtime root directory and
+// is removed by Container.unlockCgroup.
+func lockCgroup(root string, c *Container) error {
+	name := fmt.Sprintf(".cgroup-%x.lock", sha256.Sum256([]byte(c.CgroupDir)))
+	p := filepath.Join(root, name)
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open cgroup lock file: %w", err)
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to lock cgroup %s: %w", c.CgroupDir, err)
+		}
+		// The lock file may have been removed by the previous lock holder,
+		// while we were waiting for the lock.
+		var st1, st2 unix.Stat_t
+		if err := unix.Fstat(int(f.Fd()), &st1); err != nil {
+			f.Close()
+			return err
+		}
+		if err := unix.Stat(p, &st2); err == nil && st1.Ino == st2.Ino && st1.Dev == st2.Dev {
+			c.cgroupLock = f
+			return nil
+		}
+		f.Close()
+	}
+}
+
+// unlockCgroup removes and releases the cgroup lock acquired with lockCgroup.
+func (c *Container) unlockCgroup() {
+	if c.cgroupLock == nil {
+		return
+	}
+	// Remove the lock file before releasing the lock (see lockCgroup).
+	if err := os.Remove(c.cgroupLock.Name()); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to remove cgroup lock file")
+	}
+	if err := c.cgroupLock.Close(); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to release cgroup lock")
+	}
+	c.cgroupLock = nil
+}
+
 // https://github.com/opencontainers/runtime-spec/blob/v1.0.2/config-linux.md
 // TODO New spec will contain a property Unified for cgroupv2 properties
 // https://github.com/opencontainers/runtime-spec/blob/master/config-linux.md#unified
@@ -76,7 +176,11 @@ func configureCgroup(rt *Runtime, c *Container) error {
 		return err
 	}
 
-	if err := checkCgroup(c); err != nil {
+	if err := lockCgroup(rt.Root, c); err != nil {
+		return err
+	}
+
+	if err := checkCgroup(rt.Root, c); err != nil {
 		return err
 	}
 
@@ -92,22 +196,30 @@ func configureCgroup(rt *Runtime, c *Container) error {
 	}
 
 	if mem := c.Spec.Linux.Resources.Memory; mem != nil {
-		c.Log.Debug().Msg("TODO cgroup memory controller not implemented")
+		if err := configureMemoryController(c, mem); err != nil {
+			return err
+		}
 	}
 
 	if cpu := c.Spec.Linux.Resources.CPU; cpu != nil {
-		if err := configureCPUController(rt, cpu); err != nil {
+		if err := configureCPUController(rt, c, cpu); err != nil {
 			return err
 		}
 	}
 
 	if pids := c.Spec.Linux.Resources.Pids; pids != nil {
-		if err := c.setConfigItem("lxc.cgroup2.pids.max", fmt.Sprintf("%d", pids.Limit)); err != nil {
+		max, err := pidsMax(pids.Limit)
+		if err != nil {
+			return err
+		}
+		if err := c.setConfigItem("lxc.cgroup2.pids.max", max); err != nil {
 			return err
 		}
 	}
 	if blockio := c.Spec.Linux.Resources.BlockIO; blockio != nil {
-		c.Log.Debug().Msg("TODO cgroup blockio controller not implemented")
+		if err := configureIOController(c, blockio); err != nil {
+			return err
+		}
 	}
 
 	if hugetlb := c.Spec.Linux.Resources.HugepageLimits; hugetlb != nil {
@@ -115,14 +227,133 @@ func configureCgroup(rt *Runtime, c *Container) error {
 		c.Log.Debug().Msg("TODO cgroup hugetlb controller not implemented")
 	}
 	if net := c.Spec.Linux.Resources.Network; net != nil {
-		c.Log.Debug().Msg("TODO cgroup network controller not implemented")
+		if err := configureNetworkController(c, net); err != nil {
+			return err
+		}
+	}
+
+	// Unified must be configured last, to override
+	// the values set for the same files by the controllers above.
+	if unified := c.Spec.Linux.Resources.Unified; len(unified) > 0 {
+		if err := configureUnified(c, unified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configureUnified(c *Container, unified map[string]string) error {
+	// The container cgroup does not exist yet, so check the parent cgroup.
+	parentDir := filepath.Join(cgroupRoot, filepath.Dir(c.CgroupDir))
+	controllers, err := cgroupControllers(parentDir)
+	if err != nil {
+		return err
+	}
+	items, err := unifiedConfigItems(unified, controllers)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := c.setConfigItem(item[0], item[1]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// cgroupSubtreeControl returns true if the controller is enabled for the
+// child cgroups of the given cgroup directory (cgroup.subtree_control).
+func cgroupSubtreeControl(cgroupDir string, controller string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupDir, "cgroup.subtree_control"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read enabled cgroup controllers: %w", err)
+	}
+	for _, c := range strings.Fields(string(data)) {
+		if c == controller {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cgroupControllers returns the controllers available in the given cgroup directory.
+func cgroupControllers(cgroupDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupDir, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read available cgroup controllers: %w", err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// unifiedConfigItems returns the config items (key, value) for the unified
+// cgroup2 resources from the spec, sorted by key.
+// A unified key is the name of a file in the cgroup directory,
+// and it's controller (the key prefix e.g 'memory' for 'memory.high')
+// must be one of the given available controllers.
+// Keys of the cgroup core interface files (e.g 'cgroup.max.depth') have no controller.
+func unifiedConfigItems(unified map[string]string, controllers []string) ([][2]string, error) {
+	keys := make([]string, 0, len(unified))
+	for key := range unified {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([][2]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.ContainsRune(key, '/') || strings.HasPrefix(key, ".") {
+			return nil, fmt.Errorf("invalid unified cgroup key %q", key)
+		}
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid unified cgroup key %q: expected <controller>.<file>", key)
+		}
+		if ctrl := parts[0]; ctrl != "cgroup" && !containsString(controllers, ctrl) {
+			return nil, fmt.Errorf("unified cgroup key %q: controller %q is not available", key, ctrl)
+		}
+		items = append(items, [2]string{"lxc.cgroup2." + key, unified[key]})
+	}
+	return items, nil
+}
+
+// configureNetworkController applies the network class and priorities
+// from the spec. There are no cgroup2 equivalents for the cgroup v1
+// net_cls and net_prio controllers, so they are only applied if the
+// controllers are mounted (hybrid cgroup layout).
+func configureNetworkController(c *Container, net *specs.LinuxNetwork) error {
+	for _, item := range networkConfigItems(net) {
+		ctrl := strings.SplitN(strings.TrimPrefix(item[0], "lxc.cgroup."), ".", 2)[0]
+		if err := isFilesystem(filepath.Join(cgroupV1Root, ctrl), "cgroup"); err != nil {
+			c.Log.Warn().Str("controller", ctrl).Msgf("cgroup v1 controller is not available - ignoring %s", item[0])
+			continue
+		}
+		if err := c.setConfigItem(item[0], item[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkConfigItems returns the cgroup v1 config items (key, value)
+// for the network class and interface priorities from the spec.
+func networkConfigItems(net *specs.LinuxNetwork) [][2]string {
+	items := make([][2]string, 0, len(net.Priorities)+1)
+	if net.ClassID != nil {
+		items = append(items, [2]string{"lxc.cgroup.net_cls.classid", fmt.Sprintf("%d", *net.ClassID)})
+	}
+	// Each write to net_prio.ifpriomap sets the priority of a single interface.
+	for _, p := range net.Priorities {
+		items = append(items, [2]string{"lxc.cgroup.net_prio.ifpriomap", fmt.Sprintf("%s %d", p.Name, p.Priority)})
+	}
+	return items
+}
+
 func configureCgroupPath(rt *Runtime, c *Container) error {
 	if c.SystemdCgroup {
-		c.CgroupDir = parseSystemdCgroupPath(c.Spec.Linux.CgroupsPath)
+		cgroupDir, err := parseSystemdCgroupPath(c.Spec.Linux.CgroupsPath)
+		if err != nil {
+			return err
+		}
+		c.CgroupDir = cgroupDir
 	} else {
 		c.CgroupDir = c.Spec.Linux.CgroupsPath
 	}
@@ -225,38 +456,231 @@ func configureDeviceController(c *Container) error {
 	return nil
 }
 
-func configureCPUController(clxc *Runtime, slinux *specs.LinuxCPU) error {
-	// CPU resource restriction configuration
-	// use strconv.FormatUint(n, 10) instead of fmt.Sprintf ?
-	clxc.Log.Debug().Msg("TODO configure cgroup cpu controller")
-	/*
-		if cpu.Shares != nil && *cpu.Shares > 0 {
-				if err := clxc.setConfigItem("lxc.cgroup2.cpu.shares", fmt.Sprintf("%d", *cpu.Shares)); err != nil {
-					return err
-				}
+func configureMemoryController(c *Container, mem *specs.LinuxMemory) error {
+	if mem.Limit != nil && *mem.Limit != 0 {
+		if err := c.setConfigItem("lxc.cgroup2.memory.max", cgroupLimit(*mem.Limit)); err != nil {
+			return err
 		}
-		if cpu.Quota != nil && *cpu.Quota > 0 {
-			if err := clxc.setConfigItem("lxc.cgroup2.cpu.cfs_quota_us", fmt.Sprintf("%d", *cpu.Quota)); err != nil {
+	}
+	if mem.Reservation != nil && *mem.Reservation != 0 {
+		if err := c.setConfigItem("lxc.cgroup2.memory.low", cgroupLimit(*mem.Reservation)); err != nil {
+			return err
+		}
+	}
+
+	swapMax, err := memorySwapMax(mem)
+	if err != nil {
+		return err
+	}
+	if swapMax != "" {
+		// The container cgroup does not exist yet, so check the parent cgroup.
+		parentDir := filepath.Join(cgroupRoot, filepath.Dir(c.CgroupDir))
+		if swapAccounting(parentDir) {
+			if err := c.setConfigItem("lxc.cgroup2.memory.swap.max", swapMax); err != nil {
 				return err
 			}
+		} else {
+			c.Log.Warn().Str("swap", swapMax).Msg("swap accounting is not available - ignoring swap limit")
+		}
+	}
+
+	if mem.Swappiness != nil {
+		// There is no cgroup2 equivalent for memory.swappiness.
+		c.Log.Warn().Uint64("swappiness", *mem.Swappiness).Msg("memory swappiness is not supported by cgroup2 - ignoring")
+	}
+	return nil
+}
+
+// swapAccounting returns true if the memory controller in the given
+// cgroup directory provides memory.swap.max. The file does not exist if the
+// kernel is built without swap accounting (CONFIG_MEMCG_SWAP) or it is disabled
+// (e.g swapaccount=0 on the kernel commandline).
+func swapAccounting(cgroupDir string) bool {
+	_, err := os.Stat(filepath.Join(cgroupDir, "memory.swap.max"))
+	return err == nil
+}
+
+// cgroupLimit returns the cgroup2 value for the given limit.
+// A negative limit means unlimited.
+func cgroupLimit(limit int64) string {
+	if limit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// pidsMax returns the cgroup2 pids.max value for the given spec pids limit.
+// A limit of 0 or -1 means unlimited ("max").
+func pidsMax(limit int64) (string, error) {
+	if limit < -1 {
+		return "", fmt.Errorf("invalid pids limit %d", limit)
+	}
+	if limit <= 0 {
+		return "max", nil
+	}
+	return strconv.FormatInt(limit, 10), nil
+}
+
+// memorySwapMax returns the cgroup2 memory.swap.max value
+// for the given spec memory limits, or an empty string if the swap limit is unset.
+// The spec (like cgroup1 memory.memsw.limit_in_bytes) defines
+// Swap as the combined memory and swap limit,
+// whereas cgroup2 memory.swap.max is the swap limit only.
+func memorySwapMax(mem *specs.LinuxMemory) (string, error) {
+	if mem.Swap == nil || *mem.Swap == 0 {
+		return "", nil
+	}
+	swap := *mem.Swap
+	if swap < 0 {
+		return "max", nil
+	}
+	if mem.Limit == nil || *mem.Limit <= 0 {
+		return "", fmt.Errorf("memory swap limit %d requires a memory limit", swap)
+	}
+	limit := *mem.Limit
+	if swap < limit {
+		return "", fmt.Errorf("memory swap limit %d must be greater than or equal to the memory limit %d", swap, limit)
+	}
+	return strconv.FormatInt(swap-limit, 10), nil
+}
+
+func configureIOController(c *Container, blkio *specs.LinuxBlockIO) error {
+	if blkio.LeafWeight != nil {
+		c.Log.Warn().Uint16("weight", *blkio.LeafWeight).Msg("blkio leaf weight is not supported by cgroup2 - ignoring")
+	}
+
+	if blkio.Weight != nil && *blkio.Weight != 0 {
+		val := fmt.Sprintf("default %d", blkioWeightToIOWeight(*blkio.Weight))
+		if err := c.setConfigItem("lxc.cgroup2.io.weight", val); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range blkio.WeightDevice {
+		if dev.Weight == nil || *dev.Weight == 0 {
+			continue
+		}
+		if err := checkBlockDevice(dev.Major, dev.Minor); err != nil {
+			return err
 		}
-			if cpu.Period != nil && *cpu.Period != 0 {
-				if err := clxc.setConfigItem("lxc.cgroup2.cpu.cfs_period_us", fmt.Sprintf("%d", *cpu.Period)); err != nil {
+		val := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, blkioWeightToIOWeight(*dev.Weight))
+		if err := c.setConfigItem("lxc.cgroup2.io.weight", val); err != nil {
+			return err
+		}
+	}
+
+	lines, err := ioMaxLines(blkio, checkBlockDevice)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err := c.setConfigItem("lxc.cgroup2.io.max", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blkioWeightToIOWeight converts the cgroup1 blkio weight [10-1000]
+// from the spec to the cgroup2 io.weight [1-10000].
+func blkioWeightToIOWeight(weight uint16) uint64 {
+	if weight < 10 {
+		weight = 10
+	}
+	return 1 + (uint64(weight)-10)*9999/990
+}
+
+// checkBlockDevice returns an error if the block device major:minor does not exist.
+func checkBlockDevice(major int64, minor int64) error {
+	p := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("block device %d:%d does not exist: %w", major, minor, err)
+	}
+	return nil
+}
+
+// ioMaxLines returns the cgroup2 io.max lines for the block io throttle limits.
+// The limits are combined into a single line per device e.g '8:0 rbps=1048576 wiops=100'.
+// checkDevice is called once for each device.
+func ioMaxLines(blkio *specs.LinuxBlockIO, checkDevice func(major int64, minor int64) error) ([]string, error) {
+	type device struct{ major, minor int64 }
+	var devices []device
+	limits := make(map[device][]string)
+
+	add := func(key string, throttle []specs.LinuxThrottleDevice) error {
+		for _, t := range throttle {
+			dev := device{t.Major, t.Minor}
+			if _, exist := limits[dev]; !exist {
+				if err := checkDevice(t.Major, t.Minor); err != nil {
 					return err
 				}
+				devices = append(devices, dev)
 			}
-		if cpu.Cpus != "" {
-			if err := clxc.setConfigItem("lxc.cgroup2.cpuset.cpus", cpu.Cpus); err != nil {
-				return err
-			}
+			limits[dev] = append(limits[dev], fmt.Sprintf("%s=%d", key, t.Rate))
 		}
-		if cpu.RealtimePeriod != nil && *cpu.RealtimePeriod > 0 {
-			if err := clxc.setConfigItem("lxc.cgroup2.cpu.rt_period_us", fmt.Sprintf("%d", *cpu.RealtimePeriod)); err != nil {
-				return err
-			}
+		return nil
+	}
+
+	if err := add("rbps", blkio.ThrottleReadBpsDevice); err != nil {
+		return nil, err
+	}
+	if err := add("wbps", blkio.ThrottleWriteBpsDevice); err != nil {
+		return nil, err
+	}
+	if err := add("riops", blkio.ThrottleReadIOPSDevice); err != nil {
+		return nil, err
+	}
+	if err := add("wiops", blkio.ThrottleWriteIOPSDevice); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		lines = append(lines, fmt.Sprintf("%d:%d %s", dev.major, dev.minor, strings.Join(limits[dev], " ")))
+	}
+	return lines, nil
+}
+
+func configureCPUController(clxc *Runtime, c *Container, slinux *specs.LinuxCPU) error {
+	// The container cgroup does not exist yet, so check the parent cgroup.
+	parentDir := filepath.Join(cgroupRoot, filepath.Dir(c.CgroupDir))
+
+	weight := slinux.Shares != nil && *slinux.Shares > 0
+	max := cpuMax(slinux)
+	if weight || max != "" {
+		enabled, err := cgroupSubtreeControl(parentDir, "cpu")
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			c.Log.Warn().Str("cgroup", parentDir).Msg("cpu controller is not enabled in the parent cgroup - ignoring cpu shares and quota")
+			weight = false
+			max = ""
+		}
+	}
+	if weight {
+		if err := c.setConfigItem("lxc.cgroup2.cpu.weight", cpuWeight(*slinux.Shares)); err != nil {
+			return err
 		}
-		if cpu.RealtimeRuntime != nil && *cpu.RealtimeRuntime > 0 {
-			if err := clxc.setConfigItem("lxc.cgroup2.cpu.rt_runtime_us", fmt.Sprintf("%d", *cpu.RealtimeRuntime)); err != nil {
+	}
+	if max != "" {
+		if err := c.setConfigItem("lxc.cgroup2.cpu.max", max); err != nil {
+			return err
+		}
+	}
+
+	items, err := cpuRealtimeConfigItems(slinux, parentDir)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := c.setConfigItem(item[0], item[1]); err != nil {
+			return err
+		}
+	}
+	/*
+		if cpu.Cpus != "" {
+			if err := clxc.setConfigItem("lxc.cgroup2.cpuset.cpus", cpu.Cpus); err != nil {
 				return err
 			}
 		}
@@ -265,6 +689,68 @@ func configureCPUController(clxc *Runtime, slinux *specs.LinuxCPU) error {
 	return nil
 }
 
+// defaultCPUPeriod is the default cgroup2 cpu.max period in microseconds.
+const defaultCPUPeriod = 100000
+
+// cpuMax returns the cgroup2 cpu.max value "$QUOTA $PERIOD" for the
+// cpu quota and period (in microseconds) from the spec.
+// An empty string is returned if neither the quota nor the period is set.
+func cpuMax(cpu *specs.LinuxCPU) string {
+	quota := "max"
+	if cpu.Quota != nil && *cpu.Quota > 0 {
+		quota = strconv.FormatInt(*cpu.Quota, 10)
+	}
+	period := uint64(defaultCPUPeriod)
+	if cpu.Period != nil && *cpu.Period > 0 {
+		period = *cpu.Period
+	} else if quota == "max" {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", quota, period)
+}
+
+// cpuWeight converts the (cgroup1) cpu shares [2-262144]
+// to the cgroup2 cpu.weight [1-10000].
+// The conversion is the same as in runc and crun.
+func cpuWeight(shares uint64) string {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return strconv.FormatUint(1+((shares-2)*9999)/262142, 10)
+}
+
+// cpuRealtimeConfigItems returns the config items (key, value) for the
+// realtime (RT bandwidth) period and runtime of the cpu controller.
+// RT bandwidth control is only available if the kernel is built with
+// CONFIG_RT_GROUP_SCHED and the cpu controller in the cgroupDir provides
+// the cpu.rt_period_us and cpu.rt_runtime_us files.
+// The cgroup2 cpu controller does not provide them (as of linux 5.15),
+// so an error is returned if a realtime value is set but unsupported.
+func cpuRealtimeConfigItems(cpu *specs.LinuxCPU, cgroupDir string) ([][2]string, error) {
+	var items [][2]string
+	// The period must be set before the runtime, since the runtime must not exceed the period.
+	if cpu.RealtimePeriod != nil && *cpu.RealtimePeriod > 0 {
+		items = append(items, [2]string{"cpu.rt_period_us", strconv.FormatUint(*cpu.RealtimePeriod, 10)})
+	}
+	if cpu.RealtimeRuntime != nil && *cpu.RealtimeRuntime != 0 {
+		items = append(items, [2]string{"cpu.rt_runtime_us", strconv.FormatInt(*cpu.RealtimeRuntime, 10)})
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	for i, item := range items {
+		if _, err := os.Stat(filepath.Join(cgroupDir, item[0])); err != nil {
+			return nil, fmt.Errorf("cpu realtime scheduling is not supported by cgroup %s: %w", cgroupDir, err)
+		}
+		items[i][0] = "lxc.cgroup2." + item[0]
+	}
+	return items, nil
+}
+
 // FIXME Register containers using the systemd DBUS API see https://systemd.io/CGROUP_DELEGATION/
 // Using the systemd DBUS API is the only way for proper support of unprivileged containers.
 // `systemd-run --user --scope cat /proc/self/cgroup`
@@ -276,21 +762,46 @@ func configureCPUController(clxc *Runtime, slinux *specs.LinuxCPU) error {
 // kubepods-burstable-pod9da3b2a14682e1fb23be3c2492753207.slice:crio:fe018d944f87b227b3b7f86226962639020e99eac8991463bf7126ef8e929589
 // https://github.com/cri-o/cri-o/issues/2632
 // TODO Where is the systemd cgroup path encoding officially documented?
-func parseSystemdCgroupPath(s string) string {
+//
+// parseSystemdCgroupPath expands a systemd encoded cgroup path
+// of the form `slice:prefix:name` into a cgroup path `slice/prefix-name.scope`.
+// The slice is expanded into the slice hierarchy (e.g `a-b.slice` to `a.slice/a-b.slice`)
+// and defaults to `system.slice` if empty.
+func parseSystemdCgroupPath(s string) (string, error) {
 	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid systemd cgroup path %q: expected format 'slice:prefix:name'", s)
+	}
+	slice, prefix, name := parts[0], parts[1], parts[2]
 
-	var cgPath []string
+	if slice == "" {
+		slice = "system.slice"
+	}
+	if !strings.HasSuffix(slice, ".slice") || slice == ".slice" {
+		return "", fmt.Errorf("invalid systemd cgroup path %q: invalid slice name %q", s, slice)
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid systemd cgroup path %q: empty scope name", s)
+	}
 
-	for i, r := range parts[0] {
-		if r == '-' && i > 0 {
-			cgPath = append(cgPath, parts[0][0:i]+".slice")
+	var cgPath []string
+	// the root slice '-.slice' is not expanded
+	if slice != "-.slice" {
+		sliceName := strings.TrimSuffix(slice, ".slice")
+		for i, r := range sliceName {
+			if r == '-' && i > 0 {
+				cgPath = append(cgPath, sliceName[0:i]+".slice")
+			}
 		}
+		cgPath = append(cgPath, slice)
 	}
-	cgPath = append(cgPath, parts[0])
-	if len(parts) > 1 {
-		cgPath = append(cgPath, strings.Join(parts[1:], "-")+".scope")
+
+	scope := name + ".scope"
+	if prefix != "" {
+		scope = prefix + "-" + scope
 	}
-	return filepath.Join(cgPath...)
+	cgPath = append(cgPath, scope)
+	return filepath.Join(cgPath...), nil
 }
 
 // killCgroup freezes the cgroups of the given container
@@ -324,6 +835,9 @@ func killCgroup(ctx context.Context, c *Container, sig unix.Signal) error {
 		return err
 	}
 
+	// Processes that can not be signaled are skipped,
+	// but the first error is returned after the cgroup is thawed again.
+	var killErr error
 	err = filepath.Walk(rootDir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -357,9 +871,12 @@ func killCgroup(ctx context.Context, c *Container, sig unix.Signal) error {
 			}
 
 			c.Log.Debug().Msgf("killing process: %d", pid)
-			err = unix.Kill(pid, sig)
-			if err != nil && err != unix.ESRCH {
+			err = killProcess(pid, sig)
+			if err != nil {
 				c.Log.Error().Msgf("failed to kill %d: %s", pid, err)
+				if killErr == nil {
+					killErr = fmt.Errorf("failed to kill %d: %w", pid, err)
+				}
 				continue
 			}
 		}
@@ -375,7 +892,18 @@ func killCgroup(ctx context.Context, c *Container, sig unix.Signal) error {
 		return err
 	}
 
-	return nil
+	return killErr
+}
+
+// killProcess sends the signal sig to the process with the given pid.
+// A process that does no longer exist (ESRCH) is not an error,
+// because it may have exited after it was read from cgroup.procs.
+func killProcess(pid int, sig unix.Signal) error {
+	err := unix.Kill(pid, sig)
+	if err == unix.ESRCH {
+		return nil
+	}
+	return err
 }
 
 type cgroupEvents struct {
@@ -405,6 +933,36 @@ func parseCgroupEvents(filename string) (cgroupEvents, error) {
 	return ev, nil
 }
 
+// cgroupOOMKilled returns true if the memory.events file of the given cgroup
+// has a non-zero oom_kill or oom_group_kill counter.
+func cgroupOOMKilled(cgroupDir string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, cgroupDir, "memory.events"))
+	if err != nil {
+		return false, err
+	}
+	return parseMemoryEventsOOMKilled(string(data))
+}
+
+func parseMemoryEventsOOMKilled(data string) (bool, error) {
+	for _, line := range strings.Split(data, "\n") {
+		vals := strings.Fields(line)
+		if len(vals) != 2 {
+			continue
+		}
+		if vals[0] != "oom_kill" && vals[0] != "oom_group_kill" {
+			continue
+		}
+		n, err := strconv.ParseUint(vals[1], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse memory.events %q: %w", line, err)
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func cgroupFreeze(filename string, freeze bool) error {
 	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
 	if err != nil {
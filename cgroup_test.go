@@ -1,13 +1,505 @@
 package lxcri
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestParseSystemCgroupPath(t *testing.T) {
 	s := "kubepods-burstable-123.slice:crio:ABC"
-	cg := parseSystemdCgroupPath(s)
+	cg, err := parseSystemdCgroupPath(s)
+	require.NoError(t, err)
 	require.Equal(t, "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-123.slice/crio-ABC.scope", cg)
+
+	cg, err = parseSystemdCgroupPath("system.slice:crio:ABC")
+	require.NoError(t, err)
+	require.Equal(t, "system.slice/crio-ABC.scope", cg)
+
+	cg, err = parseSystemdCgroupPath(":crio:ABC")
+	require.NoError(t, err)
+	require.Equal(t, "system.slice/crio-ABC.scope", cg)
+
+	cg, err = parseSystemdCgroupPath("-.slice::ABC")
+	require.NoError(t, err)
+	require.Equal(t, "ABC.scope", cg)
+
+	for _, invalid := range []string{
+		"", "system.slice", "system.slice:crio", "system.slice:crio:ABC:DEF",
+		"system:crio:ABC", ".slice:crio:ABC", "system.slice:crio:",
+	} {
+		_, err := parseSystemdCgroupPath(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestKillProcessExited(t *testing.T) {
+	// Simulate a process that exits right before the signal is sent.
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+
+	err := killProcess(cmd.Process.Pid, unix.SIGTERM)
+	require.NoError(t, err)
+}
+
+func TestKillProcessPermissionDenied(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skipf("This test only runs as non-root")
+	}
+	err := killProcess(1, unix.Signal(0))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, unix.EPERM))
+}
+
+func TestParseMemoryEventsOOMKilled(t *testing.T) {
+	events := "low 0\nhigh 0\nmax 12\noom 1\noom_kill 0\n"
+	yes, err := parseMemoryEventsOOMKilled(events)
+	require.NoError(t, err)
+	require.False(t, yes)
+
+	yes, err = parseMemoryEventsOOMKilled(events + "oom_group_kill 1\n")
+	require.NoError(t, err)
+	require.True(t, yes)
+
+	yes, err = parseMemoryEventsOOMKilled("low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n")
+	require.NoError(t, err)
+	require.True(t, yes)
+
+	_, err = parseMemoryEventsOOMKilled("oom_kill x\n")
+	require.Error(t, err)
+}
+
+func TestMemorySwapMax(t *testing.T) {
+	int64p := func(v int64) *int64 { return &v }
+
+	swapMax := func(limit *int64, swap *int64) (string, error) {
+		return memorySwapMax(&specs.LinuxMemory{Limit: limit, Swap: swap})
+	}
+
+	// swap includes memory
+	v, err := swapMax(int64p(256<<20), int64p(512<<20))
+	require.NoError(t, err)
+	require.Equal(t, "268435456", v)
+
+	// swap disabled
+	v, err = swapMax(int64p(256<<20), int64p(256<<20))
+	require.NoError(t, err)
+	require.Equal(t, "0", v)
+
+	// unlimited swap
+	v, err = swapMax(int64p(256<<20), int64p(-1))
+	require.NoError(t, err)
+	require.Equal(t, "max", v)
+
+	// unset swap
+	v, err = swapMax(int64p(256<<20), nil)
+	require.NoError(t, err)
+	require.Equal(t, "", v)
+
+	// swap must be greater than or equal to memory
+	_, err = swapMax(int64p(512<<20), int64p(256<<20))
+	require.Error(t, err)
+
+	// swap requires a memory limit
+	_, err = swapMax(nil, int64p(256<<20))
+	require.Error(t, err)
+	_, err = swapMax(int64p(-1), int64p(256<<20))
+	require.Error(t, err)
+}
+
+func TestIOMaxLines(t *testing.T) {
+	throttle := func(major, minor int64, rate uint64) specs.LinuxThrottleDevice {
+		dev := specs.LinuxThrottleDevice{Rate: rate}
+		dev.Major = major
+		dev.Minor = minor
+		return dev
+	}
+
+	var checked []string
+	checkDevice := func(major int64, minor int64) error {
+		checked = append(checked, fmt.Sprintf("%d:%d", major, minor))
+		return nil
+	}
+
+	blkio := &specs.LinuxBlockIO{
+		ThrottleReadBpsDevice:   []specs.LinuxThrottleDevice{throttle(8, 0, 1048576)},
+		ThrottleWriteIOPSDevice: []specs.LinuxThrottleDevice{throttle(8, 0, 100), throttle(8, 16, 200)},
+	}
+	lines, err := ioMaxLines(blkio, checkDevice)
+	require.NoError(t, err)
+	require.Equal(t, []string{"8:0 rbps=1048576 wiops=100", "8:16 wiops=200"}, lines)
+	require.Equal(t, []string{"8:0", "8:16"}, checked)
+
+	errNotExist := fmt.Errorf("no such device")
+	_, err = ioMaxLines(blkio, func(major int64, minor int64) error { return errNotExist })
+	require.True(t, errors.Is(err, errNotExist))
+}
+
+func TestBlkioWeightToIOWeight(t *testing.T) {
+	require.Equal(t, uint64(1), blkioWeightToIOWeight(10))
+	require.Equal(t, uint64(10000), blkioWeightToIOWeight(1000))
+	require.Equal(t, uint64(4950), blkioWeightToIOWeight(500))
+}
+
+func TestSwapAccounting(t *testing.T) {
+	cgroupDir := t.TempDir()
+	require.False(t, swapAccounting(cgroupDir))
+	err := os.WriteFile(filepath.Join(cgroupDir, "memory.swap.max"), []byte("max\n"), 0644)
+	require.NoError(t, err)
+	require.True(t, swapAccounting(cgroupDir))
+}
+
+func TestCPURealtimeConfigItems(t *testing.T) {
+	cgroupDir, err := os.MkdirTemp("", "lxcri-test-cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(cgroupDir)
+
+	period := uint64(1000000)
+	runtime := int64(950000)
+	cpu := &specs.LinuxCPU{RealtimePeriod: &period, RealtimeRuntime: &runtime}
+
+	// unset realtime values are ignored
+	items, err := cpuRealtimeConfigItems(&specs.LinuxCPU{}, cgroupDir)
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	// cgroup without RT bandwidth control
+	_, err = cpuRealtimeConfigItems(cpu, cgroupDir)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	// cgroup with RT bandwidth control (CONFIG_RT_GROUP_SCHED)
+	for _, name := range []string{"cpu.rt_period_us", "cpu.rt_runtime_us"} {
+		err := os.WriteFile(filepath.Join(cgroupDir, name), []byte("0\n"), 0644)
+		require.NoError(t, err)
+	}
+	items, err = cpuRealtimeConfigItems(cpu, cgroupDir)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"lxc.cgroup2.cpu.rt_period_us", "1000000"},
+		{"lxc.cgroup2.cpu.rt_runtime_us", "950000"},
+	}, items)
+}
+
+func TestUnifiedConfigItems(t *testing.T) {
+	controllers := []string{"cpu", "memory", "pids"}
+
+	items, err := unifiedConfigItems(map[string]string{
+		"memory.high":      "64M",
+		"cgroup.max.depth": "2",
+		"pids.max":         "100",
+	}, controllers)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"lxc.cgroup2.cgroup.max.depth", "2"},
+		{"lxc.cgroup2.memory.high", "64M"},
+		{"lxc.cgroup2.pids.max", "100"},
+	}, items)
+
+	for _, key := range []string{"../memory.high", "memory/high", "memory", "memory.", ".memory", "io.max"} {
+		_, err := unifiedConfigItems(map[string]string{key: "1"}, controllers)
+		require.Error(t, err, key)
+	}
+}
+
+func TestUnifiedMemoryHigh(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	limit := int64(128 << 20)
+	cfg.Spec.Linux.Resources = &specs.LinuxResources{
+		// memory.max is overridden by unified
+		Memory:  &specs.LinuxMemory{Limit: &limit},
+		Unified: map[string]string{"memory.high": "67108864", "memory.max": "268435456"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	val, err := os.ReadFile(filepath.Join(cgroupRoot, c.CgroupDir, "memory.high"))
+	require.NoError(t, err)
+	require.Equal(t, "67108864\n", string(val))
+
+	val, err = os.ReadFile(filepath.Join(cgroupRoot, c.CgroupDir, "memory.max"))
+	require.NoError(t, err)
+	require.Equal(t, "268435456\n", string(val))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestNetworkConfigItems(t *testing.T) {
+	classID := uint32(0x100001)
+	items := networkConfigItems(&specs.LinuxNetwork{
+		ClassID: &classID,
+		Priorities: []specs.LinuxInterfacePriority{
+			{Name: "eth0", Priority: 5},
+			{Name: "lo", Priority: 1},
+		},
+	})
+	require.Equal(t, [][2]string{
+		{"lxc.cgroup.net_cls.classid", "1048577"},
+		{"lxc.cgroup.net_prio.ifpriomap", "eth0 5"},
+		{"lxc.cgroup.net_prio.ifpriomap", "lo 1"},
+	}, items)
+
+	require.Empty(t, networkConfigItems(&specs.LinuxNetwork{}))
+}
+
+func TestNetClassID(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+	netCls := filepath.Join(cgroupV1Root, "net_cls")
+	if err := isFilesystem(netCls, "cgroup"); err != nil {
+		t.Skipf("cgroup v1 net_cls controller is not available: %s", err)
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	classID := uint32(0x100001)
+	cfg.Spec.Linux.Resources = &specs.LinuxResources{
+		Network: &specs.LinuxNetwork{ClassID: &classID},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	val, err := os.ReadFile(filepath.Join(netCls, c.CgroupDir, "net_cls.classid"))
+	require.NoError(t, err)
+	require.Equal(t, "1048577\n", string(val))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestPidsMax(t *testing.T) {
+	for limit, expected := range map[int64]string{-1: "max", 0: "max", 1: "1", 100: "100"} {
+		max, err := pidsMax(limit)
+		require.NoError(t, err)
+		require.Equal(t, expected, max, "limit %d", limit)
+	}
+	_, err := pidsMax(-2)
+	require.Error(t, err)
+}
+
+func TestCPUMax(t *testing.T) {
+	quota := int64(150000)
+	period := uint64(50000)
+	require.Equal(t, "", cpuMax(&specs.LinuxCPU{}))
+	require.Equal(t, "150000 100000", cpuMax(&specs.LinuxCPU{Quota: &quota}))
+	require.Equal(t, "150000 50000", cpuMax(&specs.LinuxCPU{Quota: &quota, Period: &period}))
+	require.Equal(t, "max 50000", cpuMax(&specs.LinuxCPU{Period: &period}))
+}
+
+func TestCgroupSubtreeControl(t *testing.T) {
+	cgroupDir := t.TempDir()
+	_, err := cgroupSubtreeControl(cgroupDir, "cpu")
+	require.Error(t, err)
+
+	err = os.WriteFile(filepath.Join(cgroupDir, "cgroup.subtree_control"), []byte("cpuset memory pids\n"), 0644)
+	require.NoError(t, err)
+	enabled, err := cgroupSubtreeControl(cgroupDir, "cpu")
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	err = os.WriteFile(filepath.Join(cgroupDir, "cgroup.subtree_control"), []byte("cpuset cpu memory pids\n"), 0644)
+	require.NoError(t, err)
+	enabled, err = cgroupSubtreeControl(cgroupDir, "cpu")
+	require.NoError(t, err)
+	require.True(t, enabled)
+}
+
+func TestCPUWeight(t *testing.T) {
+	for shares, expected := range map[uint64]string{0: "1", 2: "1", 1024: "39", 262144: "10000", 300000: "10000"} {
+		require.Equal(t, expected, cpuWeight(shares), "shares %d", shares)
+	}
+}
+
+func TestLockCgroup(t *testing.T) {
+	root := t.TempDir()
+	c1 := &Container{ContainerConfig: &ContainerConfig{Log: rt.Log}}
+	c1.CgroupDir = "test.slice/a.scope"
+	c2 := &Container{ContainerConfig: &ContainerConfig{Log: rt.Log}}
+	c2.CgroupDir = c1.CgroupDir
+
+	require.NoError(t, lockCgroup(root, c1))
+
+	locked := make(chan error, 1)
+	go func() {
+		locked <- lockCgroup(root, c2)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("cgroup lock acquired twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c1.unlockCgroup()
+	require.NoError(t, <-locked)
+	require.NotNil(t, c2.cgroupLock)
+	c2.unlockCgroup()
+	require.Nil(t, c2.cgroupLock)
+
+	// lock files are removed
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestConcurrentCreateSameCgroup(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	cfgs := make([]*ContainerConfig, 2)
+	for i := range cfgs {
+		cfgs[i] = newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+		defer removeAll(t, cfgs[i].Spec.Root.Path)
+		cfgs[i].Spec.Process.Env = []string{"SLEEP=30"}
+	}
+	cfgs[1].Spec.Linux.CgroupsPath = cfgs[0].Spec.Linux.CgroupsPath
+
+	type result struct {
+		c   *Container
+		err error
+	}
+	results := make(chan result, len(cfgs))
+	for _, cfg := range cfgs {
+		go func(cfg *ContainerConfig) {
+			c, err := rt.Create(ctx, cfg)
+			results <- result{c, err}
+		}(cfg)
+	}
+
+	var created *Container
+	var failed []error
+	for range cfgs {
+		r := <-results
+		if r.err != nil {
+			failed = append(failed, r.err)
+			// the loser must be cleaned up with Delete
+			if r.c != nil {
+				require.NoError(t, r.c.Release())
+				require.NoError(t, rt.Delete(ctx, r.c.ContainerID, true))
+				require.NoDirExists(t, filepath.Join(rt.Root, r.c.ContainerID))
+			}
+			continue
+		}
+		created = r.c
+	}
+	require.Len(t, failed, 1)
+	require.True(t, errors.Is(failed[0], ErrCgroupNotEmpty), failed[0])
+	require.NotNil(t, created)
+
+	state, err := created.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreated, state.SpecState.Status)
+	require.NoError(t, created.Delete(ctx, true))
+}
+
+func TestOwnedCgroup(t *testing.T) {
+	root := t.TempDir()
+	c := &Container{ContainerConfig: &ContainerConfig{Log: rt.Log}}
+	c.CgroupDir = "test.slice/a.scope"
+	c.runtimeDir = filepath.Join(root, "c1")
+
+	require.False(t, isOwnedCgroup(root, c.CgroupDir))
+	require.NoError(t, recordOwnedCgroup(root, c))
+	require.True(t, isOwnedCgroup(root, c.CgroupDir))
+	require.False(t, isOwnedCgroup(root, "test.slice/b.scope"))
+
+	c.removeOwnedCgroup()
+	require.False(t, isOwnedCgroup(root, c.CgroupDir))
+	// removing a non-existing record is a noop
+	c.removeOwnedCgroup()
+}
+
+func TestCheckCgroup(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+	root := t.TempDir()
+	c := &Container{ContainerConfig: &ContainerConfig{Log: rt.Log}}
+	c.CgroupDir = filepath.Base(root) + ".slice"
+	dir := filepath.Join(cgroupRoot, c.CgroupDir)
+
+	// A cgroup that does not exist is recorded.
+	require.NoError(t, checkCgroup(root, c))
+	require.True(t, isOwnedCgroup(root, c.CgroupDir))
+
+	// An empty cgroup that is owned by the runtime is deleted.
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, checkCgroup(root, c))
+	require.NoDirExists(t, dir)
+
+	// An empty cgroup that is not owned by the runtime is not modified.
+	require.NoError(t, os.Mkdir(dir, 0755))
+	defer unix.Rmdir(dir)
+	require.NoError(t, checkCgroup(t.TempDir(), c))
+	require.DirExists(t, dir)
+}
+
+func TestCreateLeftoverCgroup(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	// A previous failed create left an empty cgroup owned by the runtime.
+	leftover := &Container{ContainerConfig: &ContainerConfig{Log: rt.Log}}
+	leftover.CgroupDir = cfg.Spec.Linux.CgroupsPath
+	dir := filepath.Join(cgroupRoot, leftover.CgroupDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, recordOwnedCgroup(rt.Root, leftover))
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.Equal(t, leftover.CgroupDir, c.CgroupDir)
+
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreated, state.SpecState.Status)
+	require.NoError(t, c.Release())
+
+	require.NoError(t, rt.Delete(ctx, c.ContainerID, true))
+	require.NoDirExists(t, dir)
+	require.False(t, isOwnedCgroup(rt.Root, leftover.CgroupDir))
 }
@@ -10,7 +10,15 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+var version = "undefined"
+
 func main() {
+	// used by the runtime to check the version of the runtime executables
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
 	rootfs, _, spec, err := specki.InitHook(os.Stdin)
 	if err != nil {
 		panic(err)
@@ -20,12 +20,22 @@ func init() {
 	os.Stderr = os.Stdout
 }
 
+var version = "undefined"
+
 func main() {
 	var timeout int
+	var printVersion bool
 	// Individual hooks should set a timeout lower than the overall timeout.
 	flag.IntVar(&timeout, "timeout", 30, "maximum run time in seconds allowed for all hooks")
+	// used by the runtime to check the version of the runtime executables
+	flag.BoolVar(&printVersion, "version", false, "print version and exit")
 	flag.Parse()
 
+	if printVersion {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
 
@@ -82,10 +92,12 @@ func ociHooksAndState(t HookType, hooks *specs.Hooks) ([]specs.Hook, specs.Conta
 		// quote from https://github.com/opencontainers/runtime-spec/blob/master/config.md#posix-platform-hooks
 		// > For runtimes that implement the deprecated prestart hooks as createRuntime hooks,
 		// > createRuntime hooks MUST be called after the prestart hooks.
-		if len(hooks.CreateRuntime) > 0 {
-			return append(hooks.Prestart, hooks.CreateRuntime...), specs.StateCreating, nil
-		}
-		return hooks.Prestart, specs.StateCreating, nil
+		// The pre-mount hook runs after the container namespaces are created,
+		// but before the rootfs is mounted and pivot_root is called.
+		preMount := make([]specs.Hook, 0, len(hooks.Prestart)+len(hooks.CreateRuntime))
+		preMount = append(preMount, hooks.Prestart...)
+		preMount = append(preMount, hooks.CreateRuntime...)
+		return preMount, specs.StateCreating, nil
 	case HookMount:
 		return hooks.CreateContainer, specs.StateCreating, nil
 	//case HookStart:
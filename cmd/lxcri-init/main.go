@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/lxc/lxcri/pkg/specki"
@@ -14,7 +18,15 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+var version = "undefined"
+
 func main() {
+	// used by the runtime to check the version of the runtime executables
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
 	// TODO use environment variable for runtime dir
 	runtimeDir, err := os.Getwd()
 	if err != nil {
@@ -86,6 +98,12 @@ func doInit(runtimeDir string, spec *specs.Spec) error {
 		addEnvHome(spec)
 	}
 
+	if spec.Process.Terminal && spec.Process.ConsoleSize != nil {
+		if err := setConsoleSize(spec.Process.ConsoleSize); err != nil {
+			return err
+		}
+	}
+
 	err = unix.Chdir(spec.Process.Cwd)
 	if err != nil {
 		return fmt.Errorf("failed to change cwd to %s: %w", spec.Process.Cwd, err)
@@ -107,6 +125,26 @@ func doInit(runtimeDir string, spec *specs.Spec) error {
 	unix.Unmount("/.lxcri/lxcri-init", unix.MNT_DETACH)
 	unix.Unmount("/.lxcri", unix.MNT_DETACH)
 
+	// The runtime sets this if liblxc does not support lxc.init.groups,
+	// or if the supplementary groups must be resolved.
+	if _, ok := os.LookupEnv("LXCRI_INIT_SET_USER"); ok {
+		u := spec.Process.User
+		if spec.Annotations[resolveGroupsAnnotation] == "true" {
+			gids, err := userGroups("/etc/group", u.Username)
+			if err != nil {
+				return fmt.Errorf("failed to resolve groups for user %q: %w", u.Username, err)
+			}
+			u.AdditionalGids = appendGids(u.AdditionalGids, gids...)
+		}
+		if err := setUser(u); err != nil {
+			return err
+		}
+	}
+
+	if spec.Process.User.Umask != nil {
+		unix.Umask(int(*spec.Process.User.Umask))
+	}
+
 	unix.Exec(cmdPath, spec.Process.Args, spec.Process.Env)
 	if err != nil {
 		return fmt.Errorf("exec failed: %w", err)
@@ -114,6 +152,97 @@ func doInit(runtimeDir string, spec *specs.Spec) error {
 	return nil
 }
 
+// resolveGroupsAnnotation must match the annotation in the runtime (see init.go).
+const resolveGroupsAnnotation = "org.linuxcontainers.lxcri.groups.resolve"
+
+// userGroups returns the IDs of the groups from the given group file (see `man 5 group`)
+// that list the given user name as a member.
+func userGroups(groupFile string, userName string) ([]uint32, error) {
+	f, err := os.Open(groupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var gids []uint32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// group_name:password:GID:user_list
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 {
+			continue
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == userName {
+				gids = append(gids, uint32(gid))
+				break
+			}
+		}
+	}
+	return gids, scanner.Err()
+}
+
+// appendGids appends the given gids to the list, if they are not already in the list.
+func appendGids(list []uint32, gids ...uint32) []uint32 {
+	for _, gid := range gids {
+		found := false
+		for _, v := range list {
+			if v == gid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, gid)
+		}
+	}
+	return list
+}
+
+// setUser sets the supplementary groups, the GID and the UID
+// of the process to the values of the given user.
+// NOTE The syscall package is used because the credentials
+// must be changed for all threads (unix.Setuid only changes the current thread).
+func setUser(user specs.User) error {
+	groups := make([]int, len(user.AdditionalGids))
+	for i, gid := range user.AdditionalGids {
+		groups[i] = int(gid)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set supplementary groups %v: %w", groups, err)
+	}
+	if err := syscall.Setgid(int(user.GID)); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", user.GID, err)
+	}
+	if err := syscall.Setuid(int(user.UID)); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", user.UID, err)
+	}
+	return nil
+}
+
+// setConsoleSize sets the window size of the terminal connected to stdin.
+// This is required if the terminal is allocated by liblxc.
+func setConsoleSize(size *specs.Box) error {
+	ws := &unix.Winsize{Row: uint16(size.Height), Col: uint16(size.Width)}
+	err := unix.IoctlSetWinsize(0, unix.TIOCSWINSZ, ws)
+	// stdin is not a terminal
+	if err == unix.ENOTTY {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set console size %dx%d: %w", size.Width, size.Height, err)
+	}
+	return nil
+}
+
 func readSyncfifo(filename string) error {
 	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
 	if err != nil {
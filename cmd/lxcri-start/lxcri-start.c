@@ -16,6 +16,11 @@
 */
 #define ENABLE_LXCINIT 0
 
+/* The lxcri version, set at build time. */
+#ifndef VERSION
+#define VERSION "undefined"
+#endif
+
 #define ERROR(format, ...)                                                     \
 	{                                                                      \
 		fprintf(stderr, "[lxcri-start] " format, ##__VA_ARGS__);       \
@@ -37,6 +42,11 @@ int main(int argc, char **argv)
 	setvbuf(stderr, NULL, _IOLBF, -1);
 	errno = 0;
 
+	if (argc == 2 && strcmp(argv[1], "--version") == 0) {
+		printf("%s\n", VERSION);
+		return EXIT_SUCCESS;
+	}
+
 	if (argc != 4)
 		ERROR("invalid argument count, usage: "
 		      "$0 <container_name> <lxcpath> <config_path>\n");
@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -14,6 +19,7 @@ import (
 	"github.com/lxc/lxcri/pkg/specki"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
 	"sigs.k8s.io/yaml"
 )
 
@@ -26,6 +32,17 @@ type app struct {
 
 	command     string
 	containerID string
+
+	// stopSignals restores the default behavior for
+	// the signals that cancel the command context.
+	stopSignals context.CancelFunc
+
+	verbose bool
+	quiet   bool
+
+	// daemonSocket is the socket of the runtime daemon
+	// that executes the daemonCommands.
+	daemonSocket string
 }
 
 var clxc app
@@ -65,17 +82,42 @@ func main() {
 	app.ExitErrHandler = func(context *cli.Context, err error) {}
 	app.Commands = []*cli.Command{
 		stateCmd(),
+		healthCmd(),
 		createCmd(),
 		startCmd(),
+		restartCmd(),
 		killCmd(),
+		stopCmd(),
 		deleteCmd(),
 		execCmd(),
 		inspectCmd(),
 		listCmd(),
 		configCmd(),
+		pruneCmd(),
+		daemonCmd(),
+		exportCmd(),
+		importCmd(),
+	}
+
+	// The default version flag alias '-v' is used by the verbose flag.
+	cli.VersionFlag = &cli.BoolFlag{
+		Name:  "version",
+		Usage: "print the version",
 	}
 
 	app.Flags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:        "verbose",
+			Aliases:     []string{"v"},
+			Usage:       "set the runtime (lxcri) log level to debug, or to trace if it is already debug, for this invocation",
+			Destination: &clxc.verbose,
+		},
+		&cli.BoolFlag{
+			Name:        "quiet",
+			Aliases:     []string{"q"},
+			Usage:       "set the runtime (lxcri) log level to error for this invocation",
+			Destination: &clxc.quiet,
+		},
 		&cli.StringFlag{
 			Name:        "log-level",
 			Usage:       "set the runtime (lxcri) log level (trace|debug|info|warn|error)",
@@ -111,6 +153,13 @@ func main() {
 			Value:       clxc.LogConfig.ContainerLogFile,
 			Destination: &clxc.LogConfig.ContainerLogFile,
 		},
+		&cli.StringFlag{
+			Name:        "log-format",
+			Usage:       "set the runtime (lxcri) log format (json|console), defaults to console if --log-console is enabled and json otherwise",
+			EnvVars:     []string{"LXCRI_LOG_FORMAT"},
+			Value:       clxc.LogConfig.LogFormat,
+			Destination: &clxc.LogConfig.LogFormat,
+		},
 		&cli.BoolFlag{
 			Name:        "log-console",
 			Usage:       "write log output to stderr (defaults to true if fd 0 is a tty, --log-file and --container-log-file options are ignored)",
@@ -171,33 +220,147 @@ func main() {
 			Value:       clxc.Features.Seccomp,
 			Destination: &clxc.Features.Seccomp,
 		},
-		&cli.UintFlag{
-			Name:        "create-timeout",
-			Usage:       "maximum duration in seconds for create to complete",
-			EnvVars:     []string{"LXCRI_CREATE_TIMEOUT"},
-			Value:       clxc.Timeouts.CreateTimeout,
-			Destination: &clxc.Timeouts.CreateTimeout,
+		&cli.StringFlag{
+			Name:        "default-seccomp-profile",
+			Usage:       "path to the seccomp profile (OCI JSON) for containers without a seccomp profile",
+			EnvVars:     []string{"LXCRI_DEFAULT_SECCOMP_PROFILE"},
+			Value:       clxc.DefaultSeccompProfile,
+			Destination: &clxc.DefaultSeccompProfile,
 		},
-		&cli.UintFlag{
-			Name:        "start-timeout",
-			Usage:       "maximum duration in seconds for start to complete",
-			EnvVars:     []string{"LXCRI_START_TIMEOUT"},
-			Value:       clxc.Timeouts.StartTimeout,
-			Destination: &clxc.Timeouts.StartTimeout,
+		&cli.StringFlag{
+			Name:        "seccomp-profile-dir",
+			Usage:       "directory of the seccomp profiles (OCI JSON) that can be referenced by annotation",
+			EnvVars:     []string{"LXCRI_SECCOMP_PROFILE_DIR"},
+			Value:       clxc.SeccompProfileDir,
+			Destination: &clxc.SeccompProfileDir,
+		},
+		&cli.StringFlag{
+			Name:        "backup-config-dir",
+			Usage:       "directory (absolute path) to backup the container spec and liblxc config to (for debugging)",
+			EnvVars:     []string{"LXCRI_BACKUP_CONFIG_DIR"},
+			Value:       clxc.BackupConfigDir,
+			Destination: &clxc.BackupConfigDir,
+		},
+		&cli.StringFlag{
+			Name:        "init-cmd",
+			Usage:       "path to an alternative (statically linked) container init, that implements the lxcri-init protocol",
+			EnvVars:     []string{"LXCRI_INIT_CMD"},
+			Value:       clxc.InitCmd,
+			Destination: &clxc.InitCmd,
+		},
+		&cli.StringFlag{
+			Name:        "default-tmpfs-size",
+			Usage:       "size (e.g 64m) of tmpfs mounts without a size option (defaults to half of the host memory)",
+			EnvVars:     []string{"LXCRI_DEFAULT_TMPFS_SIZE"},
+			Value:       clxc.DefaultTmpfsSize,
+			Destination: &clxc.DefaultTmpfsSize,
+		},
+		&cli.StringFlag{
+			Name:        "duplicate-mounts",
+			Usage:       "policy for spec mounts with the same destination (last-wins|error)",
+			EnvVars:     []string{"LXCRI_DUPLICATE_MOUNTS"},
+			Value:       clxc.DuplicateMounts,
+			Destination: &clxc.DuplicateMounts,
+		},
+		&cli.BoolFlag{
+			Name:        "create-cwd",
+			Usage:       "create the process working directory if it does not exist in the rootfs",
+			EnvVars:     []string{"LXCRI_CREATE_CWD"},
+			Value:       clxc.CreateCwd,
+			Destination: &clxc.CreateCwd,
+		},
+		&cli.BoolFlag{
+			Name:        "keep-all-capabilities-if-unset",
+			Usage:       "keep all capabilities for containers without capabilities in the spec (default is to drop all)",
+			EnvVars:     []string{"LXCRI_KEEP_ALL_CAPABILITIES_IF_UNSET"},
+			Value:       clxc.KeepAllCapabilitiesIfUnset,
+			Destination: &clxc.KeepAllCapabilitiesIfUnset,
 		},
 		&cli.UintFlag{
-			Name:        "kill-timeout",
-			Usage:       "timeout for killing all processes in container cgroup",
-			EnvVars:     []string{"LXCRI_KILL_TIMEOUT"},
-			Value:       clxc.Timeouts.KillTimeout,
-			Destination: &clxc.Timeouts.KillTimeout,
+			Name:        "max-concurrent-creates",
+			Usage:       "maximum number of concurrent creates, further creates wait until the create timeout (0 is unlimited)",
+			EnvVars:     []string{"LXCRI_MAX_CONCURRENT_CREATES"},
+			Value:       clxc.MaxConcurrentCreates,
+			Destination: &clxc.MaxConcurrentCreates,
 		},
 		&cli.UintFlag{
-			Name:        "delete-timeout",
-			Usage:       "maximum duration in seconds for delete to complete",
-			EnvVars:     []string{"LXCRI_DELETE_TIMEOUT"},
-			Value:       clxc.Timeouts.DeleteTimeout,
-			Destination: &clxc.Timeouts.DeleteTimeout,
+			Name:        "max-containers",
+			Usage:       "maximum number of containers in the runtime root, further creates are rejected (0 is unlimited)",
+			EnvVars:     []string{"LXCRI_MAX_CONTAINERS"},
+			Value:       clxc.MaxContainers,
+			Destination: &clxc.MaxContainers,
+		},
+		&cli.BoolFlag{
+			Name:        "load-apparmor-profiles",
+			Usage:       "load the apparmor profile files referenced by annotation (requires root)",
+			EnvVars:     []string{"LXCRI_LOAD_APPARMOR_PROFILES"},
+			Value:       clxc.LoadApparmorProfiles,
+			Destination: &clxc.LoadApparmorProfiles,
+		},
+		&cli.BoolFlag{
+			Name:        "generate-apparmor-profiles",
+			Usage:       "generate and load a default apparmor profile if the container profile is not loaded (requires root)",
+			EnvVars:     []string{"LXCRI_GENERATE_APPARMOR_PROFILES"},
+			Value:       clxc.GenerateApparmorProfiles,
+			Destination: &clxc.GenerateApparmorProfiles,
+		},
+		&cli.BoolFlag{
+			Name:        "strict-spec-version",
+			Usage:       "reject containers with an incompatible spec version (ociVersion) instead of logging a warning",
+			EnvVars:     []string{"LXCRI_STRICT_SPEC_VERSION"},
+			Value:       clxc.StrictSpecVersion,
+			Destination: &clxc.StrictSpecVersion,
+		},
+		&cli.BoolFlag{
+			Name:        "strict-shared-namespaces",
+			Usage:       "reject containers that join a cgroup, ipc, network or uts namespace of the runtime by path instead of logging a warning",
+			EnvVars:     []string{"LXCRI_STRICT_SHARED_NAMESPACES"},
+			Value:       clxc.StrictSharedNamespaces,
+			Destination: &clxc.StrictSharedNamespaces,
+		},
+		&cli.GenericFlag{
+			Name:    "create-timeout",
+			Usage:   "maximum duration (e.g 30s, 2m or seconds) for create to complete",
+			EnvVars: []string{"LXCRI_CREATE_TIMEOUT"},
+			Value:   &clxc.Timeouts.CreateTimeout,
+		},
+		&cli.GenericFlag{
+			Name:    "start-timeout",
+			Usage:   "maximum duration (e.g 30s, 2m or seconds) for start to complete",
+			EnvVars: []string{"LXCRI_START_TIMEOUT"},
+			Value:   &clxc.Timeouts.StartTimeout,
+		},
+		&cli.GenericFlag{
+			Name:    "kill-timeout",
+			Usage:   "timeout (e.g 10s, 500ms or seconds) for killing all processes in container cgroup",
+			EnvVars: []string{"LXCRI_KILL_TIMEOUT"},
+			Value:   &clxc.Timeouts.KillTimeout,
+		},
+		&cli.GenericFlag{
+			Name:    "delete-timeout",
+			Usage:   "maximum duration (e.g 30s, 2m or seconds) for delete to complete",
+			EnvVars: []string{"LXCRI_DELETE_TIMEOUT"},
+			Value:   &clxc.Timeouts.DeleteTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "hook-annotations",
+			Usage:       "comma separated list of annotation keys (suffix '*' matches the key prefix) passed as LXCRI_ANNOTATION_<KEY> environment variables to the OCI hooks",
+			EnvVars:     []string{"LXCRI_HOOK_ANNOTATIONS"},
+			Value:       clxc.HookAnnotations,
+			Destination: &clxc.HookAnnotations,
+		},
+		&cli.StringFlag{
+			Name:        "kill-sequence",
+			Usage:       "signals to stop the container with 'stop' and 'delete --force' e.g 'SIGTERM:10s,SIGINT:5s' (SIGKILL is sent after the last step)",
+			EnvVars:     []string{"LXCRI_KILL_SEQUENCE"},
+			Value:       clxc.KillSequence,
+			Destination: &clxc.KillSequence,
+		},
+		&cli.StringFlag{
+			Name:        "daemon-socket",
+			Usage:       "send the commands create, start, kill, stop, delete and state to the runtime daemon listening on this socket (see 'lxcri daemon')",
+			EnvVars:     []string{"LXCRI_DAEMON_SOCKET"},
+			Destination: &clxc.daemonSocket,
 		},
 	}
 
@@ -221,8 +384,17 @@ func main() {
 	}
 
 	setupCmd := func(ctx *cli.Context) error {
+		// The adjusted log level must not be written by the 'config' command.
+		if clxc.command != "config" {
+			level, err := adjustLogLevel(clxc.LogConfig.LogLevel, clxc.verbose, clxc.quiet)
+			if err != nil {
+				return err
+			}
+			clxc.LogConfig.LogLevel = level
+		}
+
 		switch clxc.command {
-		case "list":
+		case "list", "import":
 			if err := clxc.ConfigureLogger(); err != nil {
 				return err
 			}
@@ -235,6 +407,13 @@ func main() {
 				return err
 			}
 			clxc.Runtime.LogConfig = logCfg
+		case "prune", "daemon":
+			clxc.LogConfig.LogContext = map[string]string{
+				"cmd": clxc.command,
+			}
+			if err := clxc.Init(); err != nil {
+				return err
+			}
 		default:
 			containerID := ctx.Args().Get(0)
 			if len(containerID) == 0 {
@@ -246,7 +425,12 @@ func main() {
 				"cmd": clxc.command,
 				"cid": clxc.containerID,
 			}
-			if err := clxc.Init(); err != nil {
+			// The runtime is initialized by the daemon.
+			if clxc.useDaemon() {
+				if err := clxc.ConfigureLogger(); err != nil {
+					return err
+				}
+			} else if err := clxc.Init(); err != nil {
 				return err
 			}
 		}
@@ -266,7 +450,12 @@ func main() {
 		cmd.OnUsageError = errUsage
 	}
 
-	err := app.Run(os.Args)
+	// SIGTERM and SIGINT cancel the command context, so that in-progress
+	// operations are aborted and cleaned up e.g a failed create is deleted.
+	ctx, stop := signal.NotifyContext(context.Background(), unix.SIGTERM, unix.SIGINT)
+	clxc.stopSignals = stop
+	err := app.RunContext(ctx, os.Args)
+	stop()
 
 	cmdDuration := time.Since(startTime)
 
@@ -307,20 +496,68 @@ func createCmd() *cli.Command {
 				Name:  "console-socket",
 				Usage: "send container pty master fd to this socket path",
 			},
+			&cli.IntFlag{
+				Name:  "console-socket-fd",
+				Usage: "send container pty master fd to this inherited unix socket fd (alternative to --console-socket)",
+			},
+			&cli.StringFlag{
+				Name:  "console-log",
+				Usage: "additionally write the console output to this file (requires --console-socket)",
+			},
 			&cli.StringFlag{
 				Name:  "pid-file",
 				Usage: "path to write container PID",
 			},
+			&cli.IntFlag{
+				Name:  "ready-fd",
+				Usage: "write a byte to this inherited fd (and close it) when the container is created",
+			},
+			&cli.BoolFlag{
+				Name:  "print-json",
+				Usage: "print the create result (id, pid, bundle, created) as JSON to stdout",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mount",
+				Usage: "add a mount to the container spec e.g 'type=bind,source=/src,destination=/dst,options=ro:nosuid' (repeatable)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "env",
+				Aliases: []string{"e"},
+				Usage:   "set environment variable KEY=VALUE of the container process (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "pid-ns",
+				Usage: "join the PID namespace at this path (e.g /proc/<pid>/ns/pid) instead of creating a new one",
+			},
+			&cli.StringFlag{
+				Name:  "memory",
+				Usage: "set the memory limit (e.g 512m) in bytes with an optional suffix k, m or g",
+			},
+			&cli.StringFlag{
+				Name:  "cpus",
+				Usage: "set the number of CPUs (e.g 1.5) the container can use (sets the cpu quota and period)",
+			},
+			&cli.Uint64Flag{
+				Name:  "cpu-shares",
+				Usage: "set the relative cpu weight in shares [2-262144]",
+			},
+			&cli.Int64Flag{
+				Name:  "pids-limit",
+				Usage: "set the maximum number of processes (-1 for unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "annotations-file",
+				Usage: "add the annotations from this file (JSON object or key=value lines) to the container spec",
+			},
 			&cli.BoolFlag{
 				Name:  "no-new-keyring",
 				Usage: "unused -required by buildah",
 			},
-			&cli.UintFlag{
-				Name:        "timeout",
-				Usage:       "maximum duration in seconds for create to complete",
-				EnvVars:     []string{"LXCRI_CREATE_TIMEOUT"},
-				Value:       clxc.Timeouts.CreateTimeout,
-				Destination: &clxc.Timeouts.CreateTimeout,
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "maximum duration (e.g 30s, 2m or seconds) for create to complete",
+				EnvVars: []string{"LXCRI_CREATE_TIMEOUT"},
+				Value:   &clxc.Timeouts.CreateTimeout,
 			},
 		},
 	}
@@ -331,12 +568,35 @@ func doCreate(ctxcli *cli.Context) error {
 		ContainerID:   clxc.containerID,
 		BundlePath:    ctxcli.String("bundle"),
 		ConsoleSocket: ctxcli.String("console-socket"),
+		ConsoleLog:    ctxcli.String("console-log"),
 		SystemdCgroup: ctxcli.Bool("systemd-cgroup"),
 		Log:           clxc.Runtime.Log,
 		LogFile:       clxc.LogConfig.ContainerLogFile,
 		LogLevel:      clxc.LogConfig.ContainerLogLevel,
 	}
 
+	var ready *os.File
+	if ctxcli.IsSet("ready-fd") {
+		f, err := readyFile(ctxcli.Int("ready-fd"))
+		if err != nil {
+			return err
+		}
+		ready = f
+		defer ready.Close()
+	}
+
+	if ctxcli.IsSet("console-socket-fd") {
+		if clxc.useDaemon() {
+			return fmt.Errorf("--console-socket-fd is not supported with --daemon-socket")
+		}
+		fd := ctxcli.Int("console-socket-fd")
+		if fd < 0 {
+			return fmt.Errorf("invalid console socket fd %d", fd)
+		}
+		cfg.ConsoleSocketFile = os.NewFile(uintptr(fd), "console-socket")
+		defer cfg.ConsoleSocketFile.Close()
+	}
+
 	specPath := filepath.Join(cfg.BundlePath, lxcri.BundleConfigFile)
 	spec, err := specki.LoadSpecJSON(specPath)
 	if err != nil {
@@ -345,37 +605,119 @@ func doCreate(ctxcli *cli.Context) error {
 	cfg.Spec = spec
 	pidFile := ctxcli.String("pid-file")
 
-	timeout := time.Duration(clxc.Timeouts.CreateTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if p := ctxcli.String("annotations-file"); p != "" {
+		annotations, err := loadAnnotationsFile(p)
+		if err != nil {
+			return err
+		}
+		if spec.Annotations == nil {
+			spec.Annotations = make(map[string]string, len(annotations))
+		}
+		// annotations from the file take precedence
+		for k, v := range annotations {
+			spec.Annotations[k] = v
+		}
+	}
+
+	if err := addMounts(spec, ctxcli.StringSlice("mount")); err != nil {
+		return err
+	}
+
+	if err := addEnv(spec, ctxcli.StringSlice("env")); err != nil {
+		return err
+	}
+
+	resources := resourceOverrides{
+		Memory: ctxcli.String("memory"),
+		CPUs:   ctxcli.String("cpus"),
+	}
+	if ctxcli.IsSet("cpu-shares") {
+		shares := ctxcli.Uint64("cpu-shares")
+		resources.CPUShares = &shares
+	}
+	if ctxcli.IsSet("pids-limit") {
+		limit := ctxcli.Int64("pids-limit")
+		resources.PidsLimit = &limit
+	}
+	if err := setResources(spec, resources); err != nil {
+		return err
+	}
+
+	if p := ctxcli.String("pid-ns"); p != "" {
+		specki.SetNamespace(spec, specs.LinuxNamespace{Type: specs.PIDNamespace, Path: p})
+	}
+
+	timeout := clxc.Timeouts.CreateTimeout.Duration()
+	ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
 	defer cancel()
 
-	err = doCreateInternal(ctx, &cfg, pidFile)
+	err = doCreateInternal(ctx, &cfg, pidFile, ctxcli.Bool("print-json"))
 	if err != nil {
 		clxc.Log.Error().Msgf("failed to create container: %s", err)
-		// Create a new context because create may fail with a timeout.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(clxc.Timeouts.DeleteTimeout)*time.Second)
+		// The daemon deletes the container if create failed.
+		if clxc.useDaemon() {
+			return err
+		}
+		// Create a new context because create may fail with a timeout
+		// or may have been cancelled by a signal.
+		ctx, cancel := context.WithTimeout(context.Background(), clxc.Timeouts.DeleteTimeout.Duration())
 		defer cancel()
 		if err := clxc.Delete(ctx, clxc.containerID, true); err != nil {
 			clxc.Log.Error().Err(err).Msg("failed to destroy container")
 		}
 		return err
 	}
+	if ready != nil {
+		return notifyReady(ready)
+	}
 	return nil
 }
 
-func doCreateInternal(ctx context.Context, cfg *lxcri.ContainerConfig, pidFile string) error {
-	c, err := clxc.Create(ctx, cfg)
-	if err != nil {
-		return err
+// createResult is printed by create --print-json.
+type createResult struct {
+	ID      string    `json:"id"`
+	Pid     int       `json:"pid"`
+	Bundle  string    `json:"bundle"`
+	Created time.Time `json:"created"`
+}
+
+func doCreateInternal(ctx context.Context, cfg *lxcri.ContainerConfig, pidFile string, printJSON bool) error {
+	var pid int
+	var created time.Time
+	if clxc.useDaemon() {
+		// The daemon resolves relative paths against its own working directory.
+		if err := absConfigPaths(cfg); err != nil {
+			return err
+		}
+		resp, err := callDaemon(ctx, clxc.daemonSocket, &daemonRequest{Command: "create", ContainerID: cfg.ContainerID, Config: cfg})
+		if err != nil {
+			return err
+		}
+		pid, created = resp.Pid, resp.CreatedAt
+	} else {
+		c, err := clxc.Create(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer clxc.releaseContainer(c)
+		pid, created = c.Pid, c.CreatedAt
 	}
-	defer clxc.releaseContainer(c)
 
 	if pidFile != "" {
-		err := createPidFile(pidFile, c.Pid)
+		err := createPidFile(pidFile, pid)
 		if err != nil {
 			return err
 		}
 	}
+
+	if printJSON {
+		j, err := json.Marshal(createResult{ID: cfg.ContainerID, Pid: pid, Bundle: cfg.BundlePath, Created: created})
+		if err != nil {
+			return fmt.Errorf("failed to marshal json: %w", err)
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(j))
+		return err
+	}
 	return nil
 }
 
@@ -389,12 +731,15 @@ func startCmd() *cli.Command {
 starts <containerID>
 `,
 		Flags: []cli.Flag{
-			&cli.UintFlag{
-				Name:        "timeout",
-				Usage:       "maximum duration in seconds for start to complete",
-				EnvVars:     []string{"LXCRI_START_TIMEOUT"},
-				Value:       clxc.Timeouts.StartTimeout,
-				Destination: &clxc.Timeouts.StartTimeout,
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "maximum duration (e.g 30s, 2m or seconds) for start to complete",
+				EnvVars: []string{"LXCRI_START_TIMEOUT"},
+				Value:   &clxc.Timeouts.StartTimeout,
+			},
+			&cli.BoolFlag{
+				Name:  "wait",
+				Usage: "wait until the container process is running (within the start timeout)",
 			},
 		},
 	}
@@ -402,16 +747,91 @@ starts <containerID>
 
 func doStart(ctxcli *cli.Context) error {
 
-	timeout := time.Duration(clxc.Timeouts.StartTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	timeout := clxc.Timeouts.StartTimeout.Duration()
+	ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
 	defer cancel()
 
+	if clxc.useDaemon() {
+		_, err := callDaemon(ctx, clxc.daemonSocket, &daemonRequest{Command: "start", ContainerID: clxc.containerID, Wait: ctxcli.Bool("wait")})
+		return err
+	}
+
 	c, err := clxc.loadContainer(clxc.containerID)
 	if err != nil {
 		return err
 	}
 	defer clxc.releaseContainer(c)
-	return clxc.Start(ctx, c)
+	if err := clxc.Start(ctx, c); err != nil {
+		return err
+	}
+	if ctxcli.Bool("wait") {
+		if err := c.WaitRunning(ctx); err != nil {
+			return fmt.Errorf("failed to wait for container running: %w", err)
+		}
+	}
+	return nil
+}
+
+func restartCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "restart",
+		Usage:  "deletes and recreates a container from the spec it was created with, and starts it",
+		Action: doRestart,
+		ArgsUsage: `[containerID]
+
+<containerID> is the ID of the container to restart.
+The container is recreated with the same ID and config.
+`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "kill the container if it is running",
+			},
+			&cli.StringFlag{
+				Name:  "pid-file",
+				Usage: "path to write the container PID",
+			},
+		},
+	}
+}
+
+func doRestart(ctxcli *cli.Context) error {
+	c, err := clxc.loadContainer(clxc.containerID)
+	if err != nil {
+		return err
+	}
+	cfg, err := c.CreateConfig()
+	clxc.releaseContainer(c)
+	if err != nil {
+		return err
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctxcli.Context, clxc.Timeouts.DeleteTimeout.Duration())
+	defer cancel()
+	if err := clxc.Delete(deleteCtx, clxc.containerID, ctxcli.Bool("force")); err != nil {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+
+	createCtx, cancel := context.WithTimeout(ctxcli.Context, clxc.Timeouts.CreateTimeout.Duration())
+	defer cancel()
+	if err := doCreateInternal(createCtx, cfg, ctxcli.String("pid-file"), false); err != nil {
+		clxc.Log.Error().Msgf("failed to recreate container: %s", err)
+		ctx, cancel := context.WithTimeout(context.Background(), clxc.Timeouts.DeleteTimeout.Duration())
+		defer cancel()
+		if err := clxc.Delete(ctx, clxc.containerID, true); err != nil {
+			clxc.Log.Error().Err(err).Msg("failed to destroy container")
+		}
+		return err
+	}
+
+	startCtx, cancel := context.WithTimeout(ctxcli.Context, clxc.Timeouts.StartTimeout.Duration())
+	defer cancel()
+	c, err = clxc.loadContainer(clxc.containerID)
+	if err != nil {
+		return err
+	}
+	defer clxc.releaseContainer(c)
+	return clxc.Start(startCtx, c)
 }
 
 func stateCmd() *cli.Command {
@@ -427,21 +847,66 @@ func stateCmd() *cli.Command {
 	}
 }
 
-func doState(unused *cli.Context) error {
+func doState(ctxcli *cli.Context) error {
+	var state *specs.State
+	if clxc.useDaemon() {
+		resp, err := callDaemon(ctxcli.Context, clxc.daemonSocket, &daemonRequest{Command: "state", ContainerID: clxc.containerID})
+		if err != nil {
+			return err
+		}
+		state = resp.State
+	} else {
+		c, err := clxc.loadContainer(clxc.containerID)
+		if err != nil {
+			return err
+		}
+		defer clxc.releaseContainer(c)
+		s, err := c.State()
+		if err != nil {
+			return err
+		}
+		state = &s.SpecState
+	}
+	j, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %w", err)
+	}
+	clxc.Log.Trace().RawJSON("state", j).Msg("container state")
+	_, err = fmt.Fprint(os.Stdout, string(j))
+	return err
+}
+
+func healthCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "health",
+		Usage:  "checks the liveness of the container processes",
+		Action: doHealth,
+		ArgsUsage: `[containerID]
+
+<containerID> is the ID of the container to check.
+
+The health status is one of:
+running        the monitor and the container init process are alive
+monitor-dead   the monitor process is dead but container processes are still running
+stopped        the container processes are not running
+`,
+	}
+}
+
+func doHealth(unused *cli.Context) error {
 	c, err := clxc.loadContainer(clxc.containerID)
 	if err != nil {
 		return err
 	}
 	defer clxc.releaseContainer(c)
-	state, err := c.State()
+	health, err := c.Health()
 	if err != nil {
 		return err
 	}
-	j, err := json.Marshal(state.SpecState)
+	j, err := json.Marshal(health)
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %w", err)
 	}
-	clxc.Log.Trace().RawJSON("state", j).Msg("container state")
 	_, err = fmt.Fprint(os.Stdout, string(j))
 	return err
 }
@@ -457,12 +922,11 @@ func killCmd() *cli.Command {
 [signal] signal name or numerical value (e.g [9|kill|KILL|sigkill|SIGKILL])
 `,
 		Flags: []cli.Flag{
-			&cli.UintFlag{
-				Name:        "timeout",
-				Usage:       "timeout for killing all processes in container cgroup",
-				EnvVars:     []string{"LXCRI_KILL_TIMEOUT"},
-				Value:       clxc.Timeouts.KillTimeout,
-				Destination: &clxc.Timeouts.KillTimeout,
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "timeout (e.g 10s, 500ms or seconds) for killing all processes in container cgroup",
+				EnvVars: []string{"LXCRI_KILL_TIMEOUT"},
+				Value:   &clxc.Timeouts.KillTimeout,
 			},
 		},
 	}
@@ -475,25 +939,73 @@ func doKill(ctxcli *cli.Context) error {
 		return fmt.Errorf("invalid signal param %q", sig)
 	}
 
+	timeout := clxc.Timeouts.KillTimeout.Duration()
+	ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
+	defer cancel()
+
+	if clxc.useDaemon() {
+		_, err := callDaemon(ctx, clxc.daemonSocket, &daemonRequest{Command: "kill", ContainerID: clxc.containerID, Signal: signum})
+		return err
+	}
+
 	c, err := clxc.loadContainer(clxc.containerID)
 	if err != nil {
 		return err
 	}
 	defer clxc.releaseContainer(c)
 
-	timeout := time.Duration(clxc.Timeouts.KillTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return clxc.Kill(ctx, c, signum)
+}
+
+func stopCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "stop",
+		Usage:  "stops a container with the kill sequence",
+		Action: doStop,
+		ArgsUsage: `[containerID]
+
+<containerID> is the ID of the container to stop
+
+The signals from --kill-sequence are sent to the container processes,
+until the container is stopped. The container is killed with SIGKILL
+if it is still running after the last signal.
+`,
+		Flags: []cli.Flag{
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "maximum duration (e.g 30s, 2m or seconds) for stop to complete",
+				EnvVars: []string{"LXCRI_DELETE_TIMEOUT"},
+				Value:   &clxc.Timeouts.DeleteTimeout,
+			},
+		},
+	}
+}
+
+func doStop(ctxcli *cli.Context) error {
+	timeout := clxc.Timeouts.DeleteTimeout.Duration()
+	ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
 	defer cancel()
 
-	return clxc.Kill(ctx, c, signum)
+	if clxc.useDaemon() {
+		_, err := callDaemon(ctx, clxc.daemonSocket, &daemonRequest{Command: "stop", ContainerID: clxc.containerID})
+		return err
+	}
+
+	c, err := clxc.loadContainer(clxc.containerID)
+	if err != nil {
+		return err
+	}
+	defer clxc.releaseContainer(c)
+
+	return clxc.Stop(ctx, c)
 }
 
 func deleteCmd() *cli.Command {
 	return &cli.Command{
 		Name:   "delete",
-		Usage:  "deletes a container",
+		Usage:  "deletes one or more containers",
 		Action: doDelete,
-		ArgsUsage: `[containerID]
+		ArgsUsage: `[containerID...]
 
 <containerID> is the ID of the container to delete
 `,
@@ -502,37 +1014,80 @@ func deleteCmd() *cli.Command {
 				Name:  "force",
 				Usage: "force deletion",
 			},
-			&cli.UintFlag{
-				Name:        "timeout",
-				Usage:       "maximum duration in seconds for delete to complete",
-				EnvVars:     []string{"LXCRI_DELETE_TIMEOUT"},
-				Value:       clxc.Timeouts.DeleteTimeout,
-				Destination: &clxc.Timeouts.DeleteTimeout,
+			&cli.BoolFlag{
+				Name:        "keep-cgroup",
+				Usage:       "do not delete the container cgroup (for debugging, cleanup with 'prune')",
+				EnvVars:     []string{"LXCRI_KEEP_CGROUP"},
+				Value:       clxc.KeepCgroup,
+				Destination: &clxc.KeepCgroup,
+			},
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "maximum duration (e.g 30s, 2m or seconds) for delete to complete",
+				EnvVars: []string{"LXCRI_DELETE_TIMEOUT"},
+				Value:   &clxc.Timeouts.DeleteTimeout,
 			},
 		},
 	}
 }
 
 func doDelete(ctxcli *cli.Context) error {
-	timeout := time.Duration(clxc.Timeouts.DeleteTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	timeout := clxc.Timeouts.DeleteTimeout.Duration()
+	force := ctxcli.Bool("force")
 
-	err := clxc.Delete(ctx, clxc.containerID, ctxcli.Bool("force"))
 	// Deleting a non-existing container is a noop,
 	// otherwise cri-o / kubelet log warnings about that.
-	if err == lxcri.ErrNotExist {
-		return nil
+	return deleteAll(ctxcli.Args().Slice(), func(id string) error {
+		ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
+		defer cancel()
+
+		var err error
+		if clxc.useDaemon() {
+			_, err = callDaemon(ctx, clxc.daemonSocket, &daemonRequest{Command: "delete", ContainerID: id, Force: force})
+		} else {
+			err = clxc.Delete(ctx, id, force)
+		}
+		if err != nil && !errors.Is(err, lxcri.ErrNotExist) {
+			clxc.Log.Error().Err(err).Str("cid", id).Msg("failed to delete container")
+		}
+		return err
+	})
+}
+
+func pruneCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "prune",
+		Usage:  "deletes the container cgroups kept by 'delete --keep-cgroup'",
+		Action: doPrune,
+		Flags: []cli.Flag{
+			&cli.GenericFlag{
+				Name:    "timeout",
+				Usage:   "maximum duration (e.g 30s, 2m or seconds) for prune to complete",
+				EnvVars: []string{"LXCRI_DELETE_TIMEOUT"},
+				Value:   &clxc.Timeouts.DeleteTimeout,
+			},
+		},
 	}
-	return err
+}
+
+func doPrune(ctxcli *cli.Context) error {
+	timeout := clxc.Timeouts.DeleteTimeout.Duration()
+	ctx, cancel := context.WithTimeout(ctxcli.Context, timeout)
+	defer cancel()
+
+	return clxc.Prune(ctx)
 }
 
 func execCmd() *cli.Command {
 	return &cli.Command{
-		Name:      "exec",
-		Usage:     "execute a new process in a running container",
-		ArgsUsage: "<containerID> [COMMAND] [args...]",
-		Action:    doExec,
+		Name:  "exec",
+		Usage: "execute a new process in a running container",
+		ArgsUsage: `<containerID> [COMMAND] [args...]
+
+The process is loaded from --process or created from COMMAND and args.
+The flags --cwd, --env, --uid and --gid override the values of the process.
+`,
+		Action: doExec,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "process",
@@ -540,6 +1095,35 @@ func execCmd() *cli.Command {
 				Usage:   "path to process json - cmd and args are ignored if set",
 				Value:   "",
 			},
+			&cli.StringFlag{
+				Name:  "cwd",
+				Usage: "current working directory of the process (overrides --process)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "env",
+				Aliases: []string{"e"},
+				Usage:   "set environment variable KEY=VALUE (overrides --process)",
+			},
+			&cli.UintFlag{
+				Name:  "uid",
+				Usage: "user ID of the process (overrides --process)",
+			},
+			&cli.UintFlag{
+				Name:  "gid",
+				Usage: "group ID of the process (overrides --process)",
+			},
+			&cli.StringFlag{
+				Name:  "apparmor",
+				Usage: "apparmor profile of the process (must match the container profile)",
+			},
+			&cli.StringFlag{
+				Name:  "cpu-affinity",
+				Usage: "pin the process to the given list of online CPUs e.g 0-3,6",
+			},
+			&cli.BoolFlag{
+				Name:  "no-new-privs",
+				Usage: "set (or unset with --no-new-privs=false) no_new_privs for the process, instead of the container setting",
+			},
 			&cli.StringFlag{
 				Name:  "pid-file",
 				Usage: "file to write the process id to",
@@ -609,20 +1193,57 @@ func (e execError) Error() string {
 	}
 }
 
-// loadSpecProcess calls ReadSpecProcessJSON if the given specProcessPath is not empty,
-// otherwise it creates a new specs.Process from the given args.
-// It's an error if both values are empty.
-func loadSpecProcess(specProcessPath string, args []string) (*specs.Process, error) {
+// processOverrides are the values from the exec flags
+// that override the values of the loaded process.
+type processOverrides struct {
+	Cwd string
+	// Env variables (KEY=VALUE) replace variables with the same name.
+	Env []string
+	UID *uint32
+	GID *uint32
+}
+
+// loadSpecProcess loads the process from the process JSON file specProcessPath,
+// or creates a new process from args if specProcessPath is empty.
+// The values from overrides are applied to the process.
+func loadSpecProcess(specProcessPath string, args []string, overrides processOverrides) (*specs.Process, error) {
+	var proc *specs.Process
 	if specProcessPath != "" {
-		return specki.LoadSpecProcessJSON(specProcessPath)
+		p, err := specki.LoadSpecProcessJSON(specProcessPath)
+		if err != nil {
+			return nil, err
+		}
+		proc = p
+	} else {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("spec process path and args are empty")
+		}
+		proc = &specs.Process{Cwd: "/", Args: args}
+	}
+
+	if overrides.Cwd != "" {
+		proc.Cwd = overrides.Cwd
+	}
+	for _, kv := range overrides.Env {
+		if err := validateEnv(kv); err != nil {
+			return nil, err
+		}
+		proc.Env, _ = specki.Setenv(proc.Env, kv, true)
+	}
+	if overrides.UID != nil {
+		proc.User.UID = *overrides.UID
 	}
-	if len(args) == 0 {
-		return nil, fmt.Errorf("spec process path and args are empty")
+	if overrides.GID != nil {
+		proc.User.GID = *overrides.GID
 	}
-	return &specs.Process{Cwd: "/", Args: args}, nil
+	return proc, nil
 }
 
 func doExec(ctxcli *cli.Context) error {
+	// Signals must not be captured by the runtime while
+	// the process is executed in the container.
+	clxc.stopSignals()
+
 	var args []string
 	if ctxcli.Args().Len() > 1 {
 		args = ctxcli.Args().Slice()[1:]
@@ -635,7 +1256,24 @@ func doExec(ctxcli *cli.Context) error {
 		clxc.Log.Warn().Msg("detaching process but pid-file value is unset")
 	}
 
-	procSpec, err := loadSpecProcess(ctxcli.String("process"), args)
+	if ctxcli.String("process") != "" && len(args) > 0 {
+		clxc.Log.Warn().Strs("args", args).Msg("cmd and args are ignored because --process is set")
+	}
+
+	overrides := processOverrides{
+		Cwd: ctxcli.String("cwd"),
+		Env: ctxcli.StringSlice("env"),
+	}
+	if ctxcli.IsSet("uid") {
+		uid := uint32(ctxcli.Uint("uid"))
+		overrides.UID = &uid
+	}
+	if ctxcli.IsSet("gid") {
+		gid := uint32(ctxcli.Uint("gid"))
+		overrides.GID = &gid
+	}
+
+	procSpec, err := loadSpecProcess(ctxcli.String("process"), args, overrides)
 	if err != nil {
 		return err
 	}
@@ -646,7 +1284,14 @@ func doExec(ctxcli *cli.Context) error {
 	}
 	defer clxc.releaseContainer(c)
 
-	opts := lxcri.ExecOptions{}
+	opts := lxcri.ExecOptions{
+		ApparmorProfile: ctxcli.String("apparmor"),
+		CPUs:            ctxcli.String("cpu-affinity"),
+	}
+	if ctxcli.IsSet("no-new-privs") {
+		noNewPrivs := ctxcli.Bool("no-new-privs")
+		opts.NoNewPrivileges = &noNewPrivs
+	}
 
 	if ctxcli.Bool("cgroup") {
 		opts.Namespaces = append(opts.Namespaces, specs.CgroupNamespace)
@@ -679,7 +1324,10 @@ func doExec(ctxcli *cli.Context) error {
 		Str("namespaces", fmt.Sprintf("%s", opts.Namespaces)).Msg("execute cmd")
 
 	if detach {
-		pid, err := c.ExecDetached(procSpec, &opts)
+		if fd, ok := os.LookupEnv(execWaitEnv); ok {
+			return execWait(c, procSpec, &opts, fd)
+		}
+		pid, err := spawnExecWait()
 		if err != nil {
 			return err
 		}
@@ -698,6 +1346,100 @@ func doExec(ctxcli *cli.Context) error {
 	return nil
 }
 
+// execWaitEnv is set for the lxcri process that is re-executed by exec --detach
+// to wait for the detached process and record its exit status.
+// The value is the file descriptor that the process pid is written to.
+const execWaitEnv = "LXCRI_EXEC_WAIT_FD"
+
+// spawnExecWait re-executes lxcri in a new session to execute the detached process,
+// because the exit status can only be retrieved by the parent of the process.
+// It returns the pid of the detached process.
+func spawnExecWait() (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// #nosec
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Env = append(os.Environ(), execWaitEnv+"=3")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start exec wait process: %w", err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read exec pid: %w", err)
+	}
+	if len(data) == 0 {
+		// The process exits without writing the pid if exec failed.
+		if err := cmd.Wait(); err != nil {
+			return 0, fmt.Errorf("exec wait process failed: %w", err)
+		}
+		return 0, fmt.Errorf("exec wait process exited without pid")
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid exec pid %q: %w", data, err)
+	}
+	return pid, cmd.Process.Release()
+}
+
+// execWait executes the detached process, writes its pid to the file descriptor fd
+// and waits for the process to exit to record its exit status.
+func execWait(c *lxcri.Container, procSpec *specs.Process, opts *lxcri.ExecOptions, fd string) error {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s value %q: %w", execWaitEnv, fd, err)
+	}
+	f := os.NewFile(uintptr(n), "exec-pid")
+	pid, err := c.ExecDetached(procSpec, opts)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d", pid)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write exec pid: %w", err)
+	}
+	// The detached process has its own copy of the stdio file descriptors.
+	// Release them in the wait process, otherwise the caller of exec --detach
+	// blocks on the output pipes until the detached process exits.
+	if err := nullStdio(); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to redirect stdio of exec wait process")
+	}
+	status, err := c.WaitExec(pid)
+	if err != nil {
+		return err
+	}
+	c.Log.Info().Int("pid", pid).Int("status", status).Msg("detached process exited")
+	return nil
+}
+
+// nullStdio redirects stdin, stdout and stderr to /dev/null.
+func nullStdio() error {
+	f, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for fd := 0; fd < 3; fd++ {
+		if err := unix.Dup3(int(f.Fd()), fd, 0); err != nil {
+			return fmt.Errorf("failed to redirect fd %d: %w", fd, err)
+		}
+	}
+	return nil
+}
+
 func inspectCmd() *cli.Command {
 	return &cli.Command{
 		Name:   "inspect",
@@ -712,11 +1454,24 @@ func inspectCmd() *cli.Command {
 				Name:  "template",
 				Usage: "Use this go template to format the output.",
 			},
+			&cli.BoolFlag{
+				Name:  "show-config",
+				Usage: "print the generated liblxc config next to the spec fields it was translated from",
+			},
 		},
 	}
 }
 
 func doInspect(ctxcli *cli.Context) (err error) {
+	if ctxcli.Bool("show-config") {
+		for _, id := range ctxcli.Args().Slice() {
+			if err := showContainerConfig(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	var t *template.Template
 	tmpl := ctxcli.String("template")
 	if tmpl != "" {
@@ -814,6 +1569,21 @@ func inspectContainer(id string, t *template.Template) error {
 	return err
 }
 
+func showContainerConfig(id string) error {
+	c, err := clxc.loadContainer(id)
+	if err != nil {
+		return err
+	}
+	defer clxc.releaseContainer(c)
+
+	config, err := os.ReadFile(c.ConfigFilePath())
+	if err != nil {
+		return fmt.Errorf("failed to read container config: %w", err)
+	}
+	fmt.Printf("# container %s config %s\n", c.ContainerID, c.ConfigFilePath())
+	return writeConfigDump(os.Stdout, c.Spec, config)
+}
+
 func configCmd() *cli.Command {
 	return &cli.Command{
 		Name:   "config",
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri"
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// TestMain runs the lxcri main function instead of the tests
+// if the test binary is executed with LXCRI_TEST_MAIN=1.
+// This is used to test the CLI in a subprocess.
+func TestMain(m *testing.M) {
+	if os.Getenv("LXCRI_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// newCLITestBundle creates a temporary runtime root and a bundle for a container
+// that runs lxcri-test with the environment SLEEP=30.
+// The optional modify function is called with the spec before it is written to the bundle.
+// It returns a function that runs the lxcri CLI (in a subprocess) with the runtime root,
+// the path of the runtime root, the bundle directory and the container ID.
+// The test is skipped unless it runs as root with LIBEXEC_DIR set.
+func newCLITestBundle(t *testing.T, modify func(spec *specs.Spec)) (run func(args ...string) *exec.Cmd, root string, bundle string, id string) {
+	t.Helper()
+	libexecDir := os.Getenv("LIBEXEC_DIR")
+	if os.Getuid() != 0 || libexecDir == "" {
+		t.Skipf("This tests only runs as root with LIBEXEC_DIR set")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "lxcri-test-cli")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	root = filepath.Join(tmpDir, "root")
+	bundle = filepath.Join(tmpDir, "bundle")
+	rootfs := filepath.Join(bundle, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0711))
+
+	cmd := filepath.Join(libexecDir, "lxcri-test")
+	spec := specki.NewSpec(rootfs, "/lxcri-test")
+	spec.Process.Env = []string{"SLEEP=30"}
+	spec.Mounts = append(spec.Mounts, specki.BindMount(cmd, "/lxcri-test"))
+	id = filepath.Base(tmpDir)
+	spec.Linux.CgroupsPath = id + ".slice"
+	if modify != nil {
+		modify(spec)
+	}
+	err = specki.EncodeJSONFile(filepath.Join(bundle, "config.json"), spec, os.O_EXCL|os.O_CREATE, 0444)
+	require.NoError(t, err)
+
+	run = func(args ...string) *exec.Cmd {
+		// #nosec
+		cmd := exec.Command(os.Args[0], append([]string{"--root", root, "--libexec", libexecDir, "--log-console"}, args...)...)
+		cmd.Env = append(os.Environ(), "LXCRI_TEST_MAIN=1")
+		cmd.Stderr = os.Stderr
+		return cmd
+	}
+	return run, root, bundle, id
+}
+
+func TestCreateSignalCleanup(t *testing.T) {
+	run, root, bundle, id := newCLITestBundle(t, func(spec *specs.Spec) {
+		// Block create long enough to send the signal.
+		spec.Hooks = &specs.Hooks{
+			CreateRuntime: []specs.Hook{{Path: "/bin/sleep", Args: []string{"sleep", "10"}}},
+		}
+	})
+
+	lxcri := run("create", "--bundle", bundle, "--timeout", "30", id)
+	lxcri.Stdout = os.Stdout
+	require.NoError(t, lxcri.Start())
+
+	time.Sleep(time.Second * 2)
+	require.NoError(t, lxcri.Process.Signal(unix.SIGTERM))
+
+	err := lxcri.Wait()
+	require.Error(t, err, "create must fail if cancelled")
+
+	_, err = os.Stat(filepath.Join(root, id))
+	require.True(t, os.IsNotExist(err), "runtime directory was not removed")
+}
+
+func TestVerboseFlag(t *testing.T) {
+	root, err := os.MkdirTemp("", "lxcri-test-verbose")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	run := func(args ...string) string {
+		args = append([]string{"--log-console", "--log-level", "info", "--root", root}, args...)
+		// #nosec
+		lxcri := exec.Command(os.Args[0], append(args, "list")...)
+		lxcri.Env = append(os.Environ(), "LXCRI_TEST_MAIN=1")
+		out, err := lxcri.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+
+	require.NotContains(t, run(), "started with")
+	require.Contains(t, run("-v"), "started with")
+	require.NotContains(t, run("-q", "--log-level", "debug"), "started with")
+}
+
+func TestLoadSpecProcessOverrides(t *testing.T) {
+	base := &specs.Process{
+		Cwd:  "/",
+		Args: []string{"/bin/sh"},
+		Env:  []string{"PATH=/bin", "HOME=/root"},
+		User: specs.User{UID: 0, GID: 0},
+	}
+	processFile := filepath.Join(t.TempDir(), "process.json")
+	require.NoError(t, specki.EncodeJSONFile(processFile, base, os.O_CREATE|os.O_EXCL, 0600))
+
+	// The process JSON is loaded unmodified without overrides.
+	proc, err := loadSpecProcess(processFile, nil, processOverrides{})
+	require.NoError(t, err)
+	require.Equal(t, base, proc)
+
+	uid := uint32(1000)
+	proc, err = loadSpecProcess(processFile, []string{"ignored"}, processOverrides{
+		Cwd: "/tmp",
+		Env: []string{"HOME=/home/user", "FOO=bar"},
+		UID: &uid,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/tmp", proc.Cwd)
+	require.Equal(t, []string{"/bin/sh"}, proc.Args)
+	require.Equal(t, []string{"PATH=/bin", "HOME=/home/user", "FOO=bar"}, proc.Env)
+	require.Equal(t, uint32(1000), proc.User.UID)
+	require.Equal(t, uint32(0), proc.User.GID)
+
+	proc, err = loadSpecProcess("", []string{"/bin/true"}, processOverrides{Cwd: "/tmp"})
+	require.NoError(t, err)
+	require.Equal(t, &specs.Process{Cwd: "/tmp", Args: []string{"/bin/true"}}, proc)
+
+	_, err = loadSpecProcess("", []string{"/bin/true"}, processOverrides{Env: []string{"FOO"}})
+	require.Error(t, err)
+
+	_, err = loadSpecProcess("", nil, processOverrides{})
+	require.Error(t, err)
+}
+
+func TestStartWait(t *testing.T) {
+	lxcri, _, bundle, id := newCLITestBundle(t, nil)
+
+	require.NoError(t, lxcri("create", "--bundle", bundle, id).Run())
+	defer lxcri("delete", "--force", id).Run()
+
+	require.NoError(t, lxcri("start", "--wait", id).Run())
+
+	// The container must be running when start --wait returns.
+	out, err := lxcri("state", id).Output()
+	require.NoError(t, err)
+	var state specs.State
+	require.NoError(t, json.Unmarshal(out, &state))
+	require.Equal(t, specs.StateRunning, state.Status)
+}
+
+func TestRestart(t *testing.T) {
+	run, root, bundle, id := newCLITestBundle(t, nil)
+	state := func() specs.State {
+		out, err := run("state", id).Output()
+		require.NoError(t, err)
+		var state specs.State
+		require.NoError(t, json.Unmarshal(out, &state))
+		return state
+	}
+
+	require.NoError(t, run("create", "--bundle", bundle, id).Run())
+	defer run("delete", "--force", id).Run()
+	require.NoError(t, run("start", id).Run())
+
+	createSpec, err := os.ReadFile(filepath.Join(root, id, lxcri.CreateSpecFile))
+	require.NoError(t, err)
+	before := state()
+	require.Equal(t, specs.StateRunning, before.Status)
+
+	// A running container is only restarted with --force
+	require.Error(t, run("restart", id).Run())
+	require.NoError(t, run("restart", "--force", id).Run())
+
+	after := state()
+	require.Equal(t, specs.StateRunning, after.Status)
+	require.Equal(t, id, after.ID)
+	require.NotEqual(t, before.Pid, after.Pid)
+
+	// The container is recreated from the same spec.
+	restartSpec, err := os.ReadFile(filepath.Join(root, id, lxcri.CreateSpecFile))
+	require.NoError(t, err)
+	require.Equal(t, createSpec, restartSpec)
+}
+
+func TestCreatePrintJSON(t *testing.T) {
+	run, _, bundle, id := newCLITestBundle(t, nil)
+	tmpDir := t.TempDir()
+
+	// The container process inherits stdout, so a file is used
+	// instead of a pipe, which is held open by the container.
+	stdout, err := os.Create(filepath.Join(tmpDir, "stdout"))
+	require.NoError(t, err)
+	defer stdout.Close()
+
+	pidFile := filepath.Join(tmpDir, "pid")
+	create := run("create", "--bundle", bundle, "--pid-file", pidFile, "--print-json", id)
+	create.Stdout = stdout
+	require.NoError(t, create.Run())
+	defer run("delete", "--force", id).Run()
+
+	out, err := os.ReadFile(stdout.Name())
+	require.NoError(t, err)
+	var result createResult
+	require.NoError(t, json.Unmarshal(out, &result))
+	require.Equal(t, id, result.ID)
+	require.Equal(t, bundle, result.Bundle)
+	require.False(t, result.Created.IsZero())
+
+	pid, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(result.Pid), string(pid))
+}
+
+func TestCreateReadyFd(t *testing.T) {
+	run, _, bundle, id := newCLITestBundle(t, nil)
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The first extra file is fd 3 in the child process.
+	create := run("create", "--bundle", bundle, "--ready-fd", "3", id)
+	create.ExtraFiles = []*os.File{w}
+	require.NoError(t, create.Run())
+	defer run("delete", "--force", id).Run()
+	require.NoError(t, w.Close())
+
+	// A single byte is written and the fd is closed (by all processes).
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+
+	out, err := run("state", id).Output()
+	require.NoError(t, err)
+	var state specs.State
+	require.NoError(t, json.Unmarshal(out, &state))
+	require.Equal(t, specs.StateCreated, state.Status)
+}
+
+func TestEnvFlag(t *testing.T) {
+	run, root, bundle, id := newCLITestBundle(t, func(spec *specs.Spec) {
+		spec.Process.Env = []string{"SLEEP=3"}
+	})
+
+	require.Error(t, run("create", "--bundle", bundle, "--env", "SLEEP", id).Run())
+
+	require.NoError(t, run("create", "--bundle", bundle, "--env", "SLEEP=30", id).Run())
+	defer run("delete", "--force", id).Run()
+	require.NoError(t, run("start", id).Run())
+
+	// The --env value overrides the value from the bundle spec.
+	runtimeSpec, err := specki.LoadSpecJSON(filepath.Join(root, id, lxcri.BundleConfigFile))
+	require.NoError(t, err)
+	require.Equal(t, []string{"SLEEP=30"}, runtimeSpec.Process.Env)
+
+	out, err := run("exec", "--env", "SLEEP=0", id, "/lxcri-test").Output()
+	require.NoError(t, err, string(out))
+	require.Contains(t, string(out), "using env SLEEP value 0")
+}
+
+func TestExecDetachStatus(t *testing.T) {
+	run, root, bundle, id := newCLITestBundle(t, nil)
+	tmpDir := t.TempDir()
+
+	require.NoError(t, run("create", "--bundle", bundle, id).Run())
+	defer run("delete", "--force", id).Run()
+	require.NoError(t, run("start", id).Run())
+
+	// lxcri-test panics (exit status 2) because the file already exists.
+	pidFile := filepath.Join(tmpDir, "exec.pid")
+	require.NoError(t, run("exec", "--detach", "--pid-file", pidFile,
+		"--env", "SLEEP=0", "--env", "CREATE_FILE=/lxcri-test", id, "/lxcri-test").Run())
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(string(data))
+	require.NoError(t, err)
+
+	// The exit status is recorded by the lxcri process that waits for the detached process.
+	statusFile := filepath.Join(root, id, fmt.Sprintf("exec-%d.status", pid))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(statusFile)
+		return err == nil
+	}, time.Second*10, time.Millisecond*100)
+
+	status, err := os.ReadFile(statusFile)
+	require.NoError(t, err)
+	require.Equal(t, "2", string(status))
+
+	// The wait process (the parent of the detached process) releases the stdio
+	// of the caller after the pid is passed, so that the caller does not block on it.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	pidFile = filepath.Join(tmpDir, "exec-sleep.pid")
+	execSleep := run("exec", "--detach", "--pid-file", pidFile, "--env", "SLEEP=10", id, "/lxcri-test")
+	execSleep.Stdout = w
+	require.NoError(t, execSleep.Run())
+	require.NoError(t, w.Close())
+
+	data, err = os.ReadFile(pidFile)
+	require.NoError(t, err)
+	procStatus, err := os.ReadFile(fmt.Sprintf("/proc/%s/status", data))
+	require.NoError(t, err)
+	var ppid int
+	for _, line := range strings.Split(string(procStatus), "\n") {
+		if strings.HasPrefix(line, "PPid:") {
+			ppid, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "PPid:")))
+			require.NoError(t, err)
+		}
+	}
+	require.Greater(t, ppid, 1)
+	require.Eventually(t, func() bool {
+		stdout, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/1", ppid))
+		return err == nil && stdout == os.DevNull
+	}, time.Second*5, time.Millisecond*100)
+}
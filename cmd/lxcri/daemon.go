@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxcri"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// daemonCommands are the commands that are sent to the runtime daemon
+// if the --daemon-socket flag is set. All other commands run in the CLI process.
+var daemonCommands = map[string]bool{
+	"create": true,
+	"start":  true,
+	"kill":   true,
+	"stop":   true,
+	"delete": true,
+	"state":  true,
+}
+
+// daemonRequest is sent by the CLI to the runtime daemon.
+// A connection carries a single request and response (JSON encoded).
+type daemonRequest struct {
+	Command     string
+	ContainerID string
+	// Config is the container config for the create command.
+	Config *lxcri.ContainerConfig `json:",omitempty"`
+	// Signal is the signal for the kill command.
+	Signal unix.Signal `json:",omitempty"`
+	// Force is the force flag of the delete command.
+	Force bool `json:",omitempty"`
+	// Wait is the wait flag of the start command.
+	Wait bool `json:",omitempty"`
+	// Timeout is the maximum duration of the command.
+	// The daemon does not limit the duration if the value is 0.
+	Timeout time.Duration `json:",omitempty"`
+}
+
+// daemonResponse is the response of the runtime daemon to a daemonRequest.
+type daemonResponse struct {
+	Error string `json:",omitempty"`
+	// NotExist is true if the command failed because the container does not exist.
+	NotExist bool `json:",omitempty"`
+
+	// Pid and CreatedAt are set by the create command.
+	Pid       int       `json:",omitempty"`
+	CreatedAt time.Time `json:",omitempty"`
+
+	// State is set by the state command.
+	State *specs.State `json:",omitempty"`
+}
+
+// err returns the error from the response.
+func (resp *daemonResponse) err() error {
+	if resp.NotExist {
+		return lxcri.ErrNotExist
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// useDaemon returns true if the current command is sent to the runtime daemon.
+func (app *app) useDaemon() bool {
+	return app.daemonSocket != "" && daemonCommands[app.command]
+}
+
+// callDaemon sends the request to the runtime daemon and returns the response.
+// The request timeout is set from the context deadline.
+func callDaemon(ctx context.Context, socket string, req *daemonRequest) (*daemonResponse, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to runtime daemon: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+		// Give the daemon the chance to respond with the timeout error.
+		if err := conn.SetDeadline(deadline.Add(daemonResponseGrace)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to runtime daemon: %w", err)
+	}
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response from runtime daemon: %w", err)
+	}
+	return &resp, resp.err()
+}
+
+// daemonResponseGrace is the additional time the client waits for a response
+// after the request timeout has expired.
+const daemonResponseGrace = time.Second * 2
+
+func daemonCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "daemon",
+		Usage:  "runs the runtime as daemon that executes the commands sent by 'lxcri --daemon-socket'",
+		Action: doDaemon,
+		Description: `The daemon initializes the runtime once and executes the commands
+create, start, kill, stop, delete and state sent by the CLI.
+The runtime configuration of the daemon applies to all commands.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "socket",
+				Usage:    "path to the unix socket to listen on",
+				Required: true,
+			},
+		},
+	}
+}
+
+func doDaemon(ctxcli *cli.Context) error {
+	socket := ctxcli.String("socket")
+	// Remove the socket of a previous daemon instance.
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	// The daemon is a long running process, so it must support log rotation.
+	clxc.ReopenLogFileOnSignal(ctxcli.Context)
+	clxc.Log.Info().Str("socket", socket).Msg("runtime daemon started")
+	return serveDaemon(ctxcli.Context, l, handleDaemonRequest)
+}
+
+// serveDaemon handles the requests from connections accepted by l with handle,
+// until the context is done.
+// Requests for the same container are handled one after another.
+func serveDaemon(ctx context.Context, l net.Listener, handle func(context.Context, *daemonRequest) *daemonResponse) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	var locks containerLocks
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var req daemonRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				clxc.Log.Error().Err(err).Msg("failed to decode daemon request")
+				return
+			}
+			reqCtx := ctx
+			if req.Timeout > 0 {
+				var cancel context.CancelFunc
+				reqCtx, cancel = context.WithTimeout(ctx, req.Timeout)
+				defer cancel()
+			}
+			var resp *daemonResponse
+			unlock, err := locks.lock(reqCtx, req.ContainerID)
+			if err != nil {
+				resp = &daemonResponse{Error: fmt.Sprintf("failed to wait for pending requests of container %s: %s", req.ContainerID, err)}
+			} else {
+				resp = handle(reqCtx, &req)
+				unlock()
+			}
+			if err := json.NewEncoder(conn).Encode(resp); err != nil {
+				clxc.Log.Error().Err(err).Str("cmd", req.Command).Msg("failed to send daemon response")
+			}
+		}()
+	}
+}
+
+// containerLocks serializes the daemon requests for the same container.
+type containerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*containerLock
+}
+
+type containerLock struct {
+	ch chan struct{}
+	// refs is the number of requests that hold or wait for the lock.
+	refs int
+}
+
+// lock waits until the lock for the container with the given ID is acquired,
+// or until the context is done. The returned function releases the lock.
+func (l *containerLocks) lock(ctx context.Context, id string) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*containerLock)
+	}
+	cl, ok := l.locks[id]
+	if !ok {
+		cl = &containerLock{ch: make(chan struct{}, 1)}
+		l.locks[id] = cl
+	}
+	cl.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		cl.refs--
+		if cl.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case cl.ch <- struct{}{}:
+		return func() {
+			<-cl.ch
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// handleDaemonRequest executes the command from the request with the daemon runtime.
+func handleDaemonRequest(ctx context.Context, req *daemonRequest) *daemonResponse {
+	log := clxc.Log.With().Str("cmd", req.Command).Str("cid", req.ContainerID).Logger()
+	log.Debug().Msg("handle daemon request")
+
+	resp := new(daemonResponse)
+	err := execDaemonRequest(ctx, req, resp)
+	if err != nil {
+		log.Error().Err(err).Msg("daemon request failed")
+		resp.Error = err.Error()
+		resp.NotExist = errors.Is(err, lxcri.ErrNotExist)
+	}
+	return resp
+}
+
+func execDaemonRequest(ctx context.Context, req *daemonRequest, resp *daemonResponse) error {
+	switch req.Command {
+	case "create":
+		return daemonCreate(ctx, req, resp)
+	case "delete":
+		return clxc.Delete(ctx, req.ContainerID, req.Force)
+	}
+
+	if !daemonCommands[req.Command] {
+		return fmt.Errorf("unsupported command %q", req.Command)
+	}
+
+	c, err := clxc.loadContainer(req.ContainerID)
+	if err != nil {
+		return err
+	}
+	defer clxc.releaseContainer(c)
+
+	switch req.Command {
+	case "start":
+		if err := clxc.Start(ctx, c); err != nil {
+			return err
+		}
+		if req.Wait {
+			if err := c.WaitRunning(ctx); err != nil {
+				return fmt.Errorf("failed to wait for container running: %w", err)
+			}
+		}
+	case "kill":
+		return clxc.Kill(ctx, c, req.Signal)
+	case "stop":
+		return clxc.Stop(ctx, c)
+	case "state":
+		state, err := c.State()
+		if err != nil {
+			return err
+		}
+		resp.State = &state.SpecState
+	}
+	return nil
+}
+
+func daemonCreate(ctx context.Context, req *daemonRequest, resp *daemonResponse) error {
+	if req.Config == nil {
+		return fmt.Errorf("missing container config")
+	}
+	cfg := req.Config
+	if err := checkConfigPaths(cfg); err != nil {
+		return err
+	}
+	cfg.Log = clxc.Log.With().Str("cid", cfg.ContainerID).Logger()
+
+	c, err := clxc.Create(ctx, cfg)
+	if err != nil {
+		// Create a new context because create may fail with a timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), clxc.Timeouts.DeleteTimeout.Duration())
+		defer cancel()
+		if err := clxc.Delete(ctx, cfg.ContainerID, true); err != nil {
+			cfg.Log.Error().Err(err).Msg("failed to destroy container")
+		}
+		return err
+	}
+	defer clxc.releaseContainer(c)
+	resp.Pid = c.Pid
+	resp.CreatedAt = c.CreatedAt
+	return nil
+}
+
+// absConfigPaths converts the paths of the container config to absolute paths.
+// A relative rootfs path is resolved against the bundle path.
+func absConfigPaths(cfg *lxcri.ContainerConfig) error {
+	for _, p := range []*string{&cfg.BundlePath, &cfg.ConsoleSocket, &cfg.ConsoleLog, &cfg.LogFile} {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return err
+		}
+		*p = abs
+	}
+	if cfg.Spec != nil && cfg.Spec.Root != nil && !filepath.IsAbs(cfg.Spec.Root.Path) {
+		cfg.Spec.Root.Path = filepath.Join(cfg.BundlePath, cfg.Spec.Root.Path)
+	}
+	return nil
+}
+
+// checkConfigPaths returns an error if a path of the container config is relative.
+func checkConfigPaths(cfg *lxcri.ContainerConfig) error {
+	paths := [][2]string{
+		{"bundle", cfg.BundlePath},
+		{"console socket", cfg.ConsoleSocket},
+		{"console log", cfg.ConsoleLog},
+		{"log file", cfg.LogFile},
+	}
+	if cfg.Spec != nil && cfg.Spec.Root != nil {
+		paths = append(paths, [2]string{"rootfs", cfg.Spec.Root.Path})
+	}
+	for _, p := range paths {
+		if p[1] != "" && !filepath.IsAbs(p[1]) {
+			return fmt.Errorf("%s path %q is not absolute", p[0], p[1])
+		}
+	}
+	return nil
+}
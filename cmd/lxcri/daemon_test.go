@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCallDaemon(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveDaemon(ctx, l, func(ctx context.Context, req *daemonRequest) *daemonResponse {
+			switch req.ContainerID {
+			case "missing":
+				return &daemonResponse{Error: lxcri.ErrNotExist.Error(), NotExist: true}
+			case "failed":
+				return &daemonResponse{Error: "failed to " + req.Command}
+			}
+			return &daemonResponse{Pid: int(req.Signal), State: &specs.State{ID: req.ContainerID}}
+		})
+	}()
+
+	resp, err := callDaemon(context.Background(), socket, &daemonRequest{Command: "kill", ContainerID: "c1", Signal: unix.SIGTERM})
+	require.NoError(t, err)
+	require.Equal(t, int(unix.SIGTERM), resp.Pid)
+	require.Equal(t, "c1", resp.State.ID)
+
+	_, err = callDaemon(context.Background(), socket, &daemonRequest{Command: "delete", ContainerID: "missing"})
+	require.True(t, errors.Is(err, lxcri.ErrNotExist))
+
+	_, err = callDaemon(context.Background(), socket, &daemonRequest{Command: "start", ContainerID: "failed"})
+	require.EqualError(t, err, "failed to start")
+
+	// The request timeout is set from the context deadline.
+	tctx, tcancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer tcancel()
+	req := &daemonRequest{Command: "state", ContainerID: "c1"}
+	_, err = callDaemon(tctx, socket, req)
+	require.NoError(t, err)
+	require.Greater(t, req.Timeout, time.Second*9)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	_, err = callDaemon(context.Background(), socket, &daemonRequest{Command: "state", ContainerID: "c1"})
+	require.Error(t, err)
+}
+
+func TestContainerLocks(t *testing.T) {
+	var locks containerLocks
+	ctx := context.Background()
+
+	unlock, err := locks.lock(ctx, "c1")
+	require.NoError(t, err)
+
+	// Requests for other containers are not blocked.
+	unlock2, err := locks.lock(ctx, "c2")
+	require.NoError(t, err)
+	unlock2()
+
+	// A request for the same container waits until the lock is released or the context is done.
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer tcancel()
+	_, err = locks.lock(tctx, "c1")
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	acquired := make(chan func(), 1)
+	go func() {
+		unlock, _ := locks.lock(ctx, "c1")
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock was acquired concurrently")
+	case <-time.After(time.Millisecond * 100):
+	}
+	unlock()
+	(<-acquired)()
+
+	// Released locks are removed.
+	require.Empty(t, locks.locks)
+}
+
+func TestAbsConfigPaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	cfg := &lxcri.ContainerConfig{
+		BundlePath: ".",
+		ConsoleLog: "console.log",
+		Spec:       &specs.Spec{Root: &specs.Root{Path: "rootfs"}},
+	}
+	require.Error(t, checkConfigPaths(cfg))
+
+	require.NoError(t, absConfigPaths(cfg))
+	require.Equal(t, cwd, cfg.BundlePath)
+	require.Equal(t, filepath.Join(cwd, "console.log"), cfg.ConsoleLog)
+	require.Equal(t, filepath.Join(cwd, "rootfs"), cfg.Spec.Root.Path)
+	// Unset paths are not modified.
+	require.Empty(t, cfg.ConsoleSocket)
+	require.NoError(t, checkConfigPaths(cfg))
+
+	cfg.Spec.Root.Path = "rootfs"
+	require.EqualError(t, checkConfigPaths(cfg), `rootfs path "rootfs" is not absolute`)
+}
+
+func TestDaemon(t *testing.T) {
+	run, root, bundle, id := newCLITestBundle(t, nil)
+	tmpDir := t.TempDir()
+
+	socket := filepath.Join(tmpDir, "daemon.sock")
+	logFile := filepath.Join(tmpDir, "daemon.log")
+	daemon := run("--log-console=false", "--log-file", logFile, "--log-level", "debug", "daemon", "--socket", socket)
+	require.NoError(t, daemon.Start())
+	defer func() {
+		require.NoError(t, daemon.Process.Signal(unix.SIGTERM))
+		require.NoError(t, daemon.Wait())
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, time.Second*10, time.Millisecond*100)
+
+	client := func(args ...string) *exec.Cmd {
+		return run(append([]string{"--daemon-socket", socket}, args...)...)
+	}
+	state := func() specs.State {
+		out, err := client("state", id).Output()
+		require.NoError(t, err)
+		var state specs.State
+		require.NoError(t, json.Unmarshal(out, &state))
+		return state
+	}
+
+	pidFile := filepath.Join(tmpDir, "pid")
+	require.NoError(t, client("create", "--bundle", bundle, "--pid-file", pidFile, id).Run())
+	defer run("delete", "--force", id).Run()
+	pid, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+
+	s := state()
+	require.Equal(t, specs.StateCreated, s.Status)
+	require.Equal(t, string(pid), fmt.Sprintf("%d", s.Pid))
+
+	require.NoError(t, client("start", "--wait", id).Run())
+	require.Equal(t, specs.StateRunning, state().Status)
+
+	// The daemon reopens the log file on SIGHUP (e.g after logrotate).
+	rotated := logFile + ".1"
+	require.NoError(t, os.Rename(logFile, rotated))
+	require.NoError(t, daemon.Process.Signal(unix.SIGHUP))
+	require.Eventually(t, func() bool {
+		// The signal is handled asynchronously, so the requests are logged
+		// to the rotated file until the log file is reopened.
+		if err := client("state", id).Run(); err != nil {
+			return false
+		}
+		data, err := os.ReadFile(logFile)
+		return err == nil && strings.Contains(string(data), "handle daemon request")
+	}, time.Second*10, time.Millisecond*100)
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "runtime daemon started")
+
+	require.Error(t, client("delete", id).Run(), "a running container is only deleted with --force")
+	require.NoError(t, client("delete", "--force", id).Run())
+
+	_, err = os.Stat(filepath.Join(root, id))
+	require.True(t, os.IsNotExist(err), "runtime directory was not removed")
+	// Deleting a non-existing container is a noop.
+	require.NoError(t, client("delete", id).Run())
+}
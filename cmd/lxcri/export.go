@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxcri"
+	"github.com/urfave/cli/v2"
+)
+
+// exportFiles are the files from the container runtime directory
+// that are added to the export archive. Files that do not exist are skipped.
+var exportFiles = []string{
+	"config",
+	lxcri.BundleConfigFile,
+	lxcri.CreateSpecFile,
+	"hooks.json",
+	"state.json",
+	"lxcri.json",
+	"seccomp.conf",
+	"apparmor.profile",
+}
+
+// scrubbedValue replaces the values of scrubbed environment variables.
+const scrubbedValue = "<scrubbed>"
+
+func exportCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "export",
+		Usage:  "exports the generated configuration of a container to a tar.gz archive",
+		Action: doExport,
+		ArgsUsage: `[containerID]
+
+<containerID> is the ID of the container to export.
+
+The archive contains the liblxc config, the container spec, the hooks
+and the container state from the runtime directory for offline analysis.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "write the archive to this file instead of stdout",
+			},
+			&cli.BoolFlag{
+				Name:  "scrub-env",
+				Usage: "replace the values of all environment variables in the exported files",
+			},
+		},
+	}
+}
+
+func doExport(ctxcli *cli.Context) error {
+	dir := filepath.Join(clxc.Root, clxc.containerID)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return lxcri.ErrNotExist
+		}
+		return err
+	}
+
+	out := ctxcli.String("output")
+	if out == "" {
+		return exportContainer(os.Stdout, dir, clxc.containerID, ctxcli.Bool("scrub-env"))
+	}
+	// #nosec
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := exportContainer(f, dir, clxc.containerID, ctxcli.Bool("scrub-env")); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+// exportContainer writes the exportFiles from the container runtime directory dir
+// as gzip compressed tar archive to w. The files are stored in the directory id.
+// If scrub is true the values of all environment variables are replaced.
+func exportContainer(w io.Writer, dir string, id string, scrub bool) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range exportFiles {
+		// #nosec
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if scrub {
+			data, err = scrubEnv(name, data)
+			if err != nil {
+				return fmt.Errorf("failed to scrub environment from %s: %w", name, err)
+			}
+		}
+		hdr := &tar.Header{
+			Name:    filepath.Join(id, name),
+			Mode:    0640,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// scrubEnv replaces the values of the environment variables in the given file data.
+// These are the `lxc.environment` items of the liblxc config, and all "env" lists
+// of the JSON files e.g the process and hook environment of the spec.
+func scrubEnv(name string, data []byte) ([]byte, error) {
+	if name == "config" {
+		return scrubConfigEnv(data)
+	}
+	if filepath.Ext(name) != ".json" {
+		return data, nil
+	}
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(scrubJSONEnv(val), "", "  ")
+}
+
+func scrubConfigEnv(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "lxc.environment" {
+			line = kv[0] + "= " + scrubEnvVar(strings.TrimSpace(kv[1]))
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), sc.Err()
+}
+
+func scrubJSONEnv(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if env, ok := item.([]interface{}); ok && strings.EqualFold(k, "env") {
+				for i, kv := range env {
+					if s, ok := kv.(string); ok {
+						env[i] = scrubEnvVar(s)
+					}
+				}
+				continue
+			}
+			v[k] = scrubJSONEnv(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = scrubJSONEnv(item)
+		}
+	}
+	return val
+}
+
+// scrubEnvVar replaces the value of the environment variable kv (KEY=VALUE).
+func scrubEnvVar(kv string) string {
+	if i := strings.IndexByte(kv, '='); i >= 0 {
+		return kv[:i+1] + scrubbedValue
+	}
+	return kv
+}
+
+func importCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "import",
+		Usage:  "extracts an archive created by 'export' for offline analysis",
+		Action: doImport,
+		ArgsUsage: `[archive]
+
+<archive> is the path to the archive created by 'export'.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "extract the archive into this directory",
+				Value: ".",
+			},
+		},
+	}
+}
+
+func doImport(ctxcli *cli.Context) error {
+	archive := ctxcli.Args().Get(0)
+	if archive == "" {
+		return fmt.Errorf("missing archive")
+	}
+	// #nosec
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := importArchive(f, ctxcli.String("dir"))
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		fmt.Fprintln(os.Stdout, p)
+	}
+	return nil
+}
+
+// importArchive extracts the archive created by exportContainer into dir
+// and returns the paths of the extracted files.
+// Only regular files are extracted and the paths must not escape from dir.
+func importArchive(r io.Reader, dir string) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var files []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return files, fmt.Errorf("invalid archive entry %q: not a regular file", hdr.Name)
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return files, fmt.Errorf("invalid archive entry %q: path escapes from %s", hdr.Name, dir)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+			return files, err
+		}
+		// #nosec
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err != nil {
+			return files, err
+		}
+		// #nosec
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, p)
+	}
+}
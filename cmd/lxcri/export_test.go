@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	id := "c1"
+	dir := filepath.Join(t.TempDir(), id)
+	require.NoError(t, os.MkdirAll(dir, 0750))
+
+	spec := specki.NewSpec("/rootfs", "/bin/sh")
+	spec.Process.Env = []string{"PATH=/bin", "PASSWORD=secret"}
+	spec.Hooks = &specs.Hooks{Poststop: []specs.Hook{{Path: "/bin/true", Env: []string{"TOKEN=secret"}}}}
+	for _, name := range []string{"config.json", "create.json"} {
+		require.NoError(t, specki.EncodeJSONFile(filepath.Join(dir, name), spec, os.O_CREATE|os.O_EXCL, 0440))
+	}
+	require.NoError(t, specki.EncodeJSONFile(filepath.Join(dir, "hooks.json"), spec.Hooks, os.O_CREATE|os.O_EXCL, 0440))
+	require.NoError(t, specki.EncodeJSONFile(filepath.Join(dir, "state.json"), specs.State{ID: id}, os.O_CREATE|os.O_EXCL, 0440))
+	require.NoError(t, specki.EncodeJSONFile(filepath.Join(dir, "lxcri.json"), map[string]interface{}{"Spec": spec}, os.O_CREATE|os.O_EXCL, 0440))
+	config := "lxc.uts.name = c1\nlxc.environment = LXCRI_INIT_SET_USER=1\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0440))
+	// Files that are not in exportFiles are not exported.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "syncfifo"), nil, 0440))
+
+	var buf bytes.Buffer
+	require.NoError(t, exportContainer(&buf, dir, id, false))
+	archive := buf.Bytes()
+
+	importDir := t.TempDir()
+	files, err := importArchive(bytes.NewReader(archive), importDir)
+	require.NoError(t, err)
+	var names []string
+	for _, p := range files {
+		names = append(names, filepath.Base(p))
+		require.Equal(t, filepath.Join(importDir, id), filepath.Dir(p))
+	}
+	require.Equal(t, []string{"config", "config.json", "create.json", "hooks.json", "state.json", "lxcri.json"}, names)
+
+	// The files are exported unmodified.
+	for _, name := range names {
+		expected, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		data, err := os.ReadFile(filepath.Join(importDir, id, name))
+		require.NoError(t, err)
+		require.Equal(t, expected, data, name)
+	}
+
+	// Files are not overwritten.
+	_, err = importArchive(bytes.NewReader(archive), importDir)
+	require.Error(t, err)
+
+	// The values of the environment variables are scrubbed.
+	buf.Reset()
+	require.NoError(t, exportContainer(&buf, dir, id, true))
+	importDir = t.TempDir()
+	_, err = importArchive(&buf, importDir)
+	require.NoError(t, err)
+
+	imported, err := specki.LoadSpecJSON(filepath.Join(importDir, id, "config.json"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"PATH=<scrubbed>", "PASSWORD=<scrubbed>"}, imported.Process.Env)
+	require.Equal(t, []string{"TOKEN=<scrubbed>"}, imported.Hooks.Poststop[0].Env)
+	require.Equal(t, spec.Process.Args, imported.Process.Args)
+
+	for _, name := range []string{"config", "create.json", "hooks.json", "lxcri.json"} {
+		data, err := os.ReadFile(filepath.Join(importDir, id, name))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secret", name)
+	}
+	data, err := os.ReadFile(filepath.Join(importDir, id, "config"))
+	require.NoError(t, err)
+	require.Equal(t, "lxc.uts.name = c1\nlxc.environment = LXCRI_INIT_SET_USER=<scrubbed>\n", string(data))
+}
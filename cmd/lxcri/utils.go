@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/lxc/lxcri"
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
 )
 
@@ -27,6 +37,56 @@ func parseSignal(sig string) unix.Signal {
 	return unix.SignalNum(s)
 }
 
+// adjustLogLevel returns the log level for the verbose and quiet flags.
+// verbose sets the level to debug, or to trace if the level is already debug.
+// quiet sets the level to error.
+func adjustLogLevel(level string, verbose bool, quiet bool) (string, error) {
+	if verbose && quiet {
+		return level, fmt.Errorf("--verbose and --quiet are mutually exclusive")
+	}
+	if quiet {
+		return "error", nil
+	}
+	if !verbose {
+		return level, nil
+	}
+	l, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return level, fmt.Errorf("failed to parse log level: %w", err)
+	}
+	if l > zerolog.DebugLevel {
+		return "debug", nil
+	}
+	return "trace", nil
+}
+
+// readyFile returns the file for the given inherited ready fd.
+// The fd must be open for writing.
+func readyFile(fd int) (*os.File, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid ready fd %d", fd)
+	}
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ready fd %d: %w", fd, err)
+	}
+	if mode := flags & unix.O_ACCMODE; mode != unix.O_WRONLY && mode != unix.O_RDWR {
+		return nil, fmt.Errorf("ready fd %d is not writable", fd)
+	}
+	// The fd must not be inherited by the monitor process.
+	unix.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), "ready-fd"), nil
+}
+
+// notifyReady writes a single byte to the given ready file and closes it.
+func notifyReady(f *os.File) error {
+	if _, err := f.Write([]byte{0}); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to ready fd %d: %w", f.Fd(), err)
+	}
+	return f.Close()
+}
+
 // createPidFile atomically creates a pid file for the given pid at the given path
 func createPidFile(path string, pid int) error {
 	tmpDir := filepath.Dir(path)
@@ -57,3 +117,370 @@ func isTerminal(fd int) bool {
 	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
 	return err == nil
 }
+
+// deleteAll calls del for each of the given container IDs.
+// Deleting a non-existing container is a noop.
+// It continues past errors and returns an error
+// that lists all containers that failed to delete.
+func deleteAll(ids []string, del func(id string) error) error {
+	var failed []string
+	for _, id := range ids {
+		err := del(id)
+		if err == nil || errors.Is(err, lxcri.ErrNotExist) {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %s", id, err))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %d of %d containers: %s", len(failed), len(ids), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// loadAnnotationsFile loads annotations from the given file.
+// The file is either a JSON object with string values
+// or a list of key=value lines. Empty lines and lines starting with '#' are ignored.
+func loadAnnotationsFile(path string) (map[string]string, error) {
+	// #nosec
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read annotations file: %w", err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseAnnotationsJSON(path, data)
+	}
+	return parseAnnotationsLines(path, data)
+}
+
+func parseAnnotationsJSON(path string, data []byte) (map[string]string, error) {
+	annotations := make(map[string]string)
+	err := json.Unmarshal(data, &annotations)
+	if err == nil {
+		return annotations, nil
+	}
+	var errSyntax *json.SyntaxError
+	if errors.As(err, &errSyntax) {
+		line := bytes.Count(data[:errSyntax.Offset], []byte("\n")) + 1
+		return nil, fmt.Errorf("%s:%d: invalid JSON: %w", path, line, err)
+	}
+	var errType *json.UnmarshalTypeError
+	if errors.As(err, &errType) {
+		return nil, fmt.Errorf("%s: annotation %q must be a string but is a %s", path, errType.Field, errType.Value)
+	}
+	return nil, fmt.Errorf("%s: %w", path, err)
+}
+
+func parseAnnotationsLines(path string, data []byte) (map[string]string, error) {
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key=value but got %q", path, n, line)
+		}
+		key := strings.TrimSpace(kv[0])
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: empty annotation key", path, n)
+		}
+		annotations[key] = kv[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read annotations file: %w", err)
+	}
+	return annotations, nil
+}
+
+// configSection groups the liblxc config items
+// with the spec field they are translated from.
+type configSection struct {
+	name string
+	// prefixes of the liblxc config keys
+	prefixes []string
+	// spec returns the spec field
+	spec func(*specs.Spec) interface{}
+}
+
+var configSections = []configSection{
+	{"mounts", []string{"lxc.mount.", "lxc.rootfs."},
+		func(s *specs.Spec) interface{} { return s.Mounts }},
+	{"namespaces", []string{"lxc.namespace."},
+		func(s *specs.Spec) interface{} { return s.Linux.Namespaces }},
+	{"idmap", []string{"lxc.idmap"},
+		func(s *specs.Spec) interface{} {
+			return map[string]interface{}{"UIDMappings": s.Linux.UIDMappings, "GIDMappings": s.Linux.GIDMappings}
+		}},
+	{"cgroup", []string{"lxc.cgroup"},
+		func(s *specs.Spec) interface{} { return s.Linux.Resources }},
+	{"capabilities", []string{"lxc.cap."},
+		func(s *specs.Spec) interface{} { return s.Process.Capabilities }},
+	{"seccomp", []string{"lxc.seccomp."},
+		func(s *specs.Spec) interface{} { return s.Linux.Seccomp }},
+	{"init", []string{"lxc.init.", "lxc.environment", "lxc.execute."},
+		func(s *specs.Spec) interface{} { return s.Process }},
+}
+
+// writeConfigDump writes the liblxc container config items
+// grouped by section to w. Each section is preceded by the
+// spec field it is translated from (as comment).
+// Config items that do not belong to a section are written last.
+func writeConfigDump(w io.Writer, spec *specs.Spec, config []byte) error {
+	sections := make([][]string, len(configSections))
+	var other []string
+
+	sc := bufio.NewScanner(bytes.NewReader(config))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := -1
+		for i, s := range configSections {
+			for _, prefix := range s.prefixes {
+				if strings.HasPrefix(line, prefix) {
+					idx = i
+					break
+				}
+			}
+			if idx >= 0 {
+				break
+			}
+		}
+		if idx < 0 {
+			other = append(other, line)
+			continue
+		}
+		sections[idx] = append(sections[idx], line)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	for i, s := range configSections {
+		fmt.Fprintf(w, "\n## %s\n", s.name)
+		var val interface{}
+		if spec != nil && spec.Linux != nil && spec.Process != nil {
+			val = s.spec(spec)
+		}
+		j, err := json.MarshalIndent(val, "# ", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal spec for section %s: %w", s.name, err)
+		}
+		fmt.Fprintf(w, "# spec: %s\n", j)
+		for _, line := range sections[i] {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	fmt.Fprintf(w, "\n## other\n")
+	for _, line := range other {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// parseMountFlag parses a mount definition in the format
+// 'type=bind,source=/src,destination=/dst,options=ro:nosuid'.
+// The type defaults to 'bind' and the source defaults to the type
+// for other filesystem types (e.g 'type=tmpfs,destination=/tmp').
+// Mount options are separated by a colon, because the comma is the field separator.
+// The flag 'readonly' (or 'ro') is a shortcut for the mount option 'ro'.
+func parseMountFlag(val string) (specs.Mount, error) {
+	var m specs.Mount
+	var opts []string
+	for _, field := range strings.Split(val, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) == 1 {
+			switch key {
+			case "readonly", "ro":
+				opts = append(opts, "ro")
+				continue
+			}
+			return m, fmt.Errorf("invalid mount %q: field %q is not a key=value pair", val, field)
+		}
+		value := kv[1]
+		switch key {
+		case "type":
+			m.Type = value
+		case "source", "src":
+			m.Source = value
+		case "destination", "dst", "target":
+			m.Destination = value
+		case "options", "o":
+			for _, o := range strings.Split(value, ":") {
+				if o != "" {
+					opts = append(opts, o)
+				}
+			}
+		default:
+			return m, fmt.Errorf("invalid mount %q: unknown key %q", val, key)
+		}
+	}
+
+	if m.Destination == "" {
+		return m, fmt.Errorf("invalid mount %q: destination is required", val)
+	}
+	if !filepath.IsAbs(m.Destination) {
+		return m, fmt.Errorf("invalid mount %q: destination must be an absolute path", val)
+	}
+	if m.Type == "" {
+		m.Type = "bind"
+	}
+	if m.Type == "bind" {
+		if m.Source == "" {
+			return m, fmt.Errorf("invalid mount %q: source is required for bind mounts", val)
+		}
+		src, err := filepath.Abs(m.Source)
+		if err != nil {
+			return m, fmt.Errorf("invalid mount %q: %w", val, err)
+		}
+		return specki.BindMount(src, m.Destination, opts...), nil
+	}
+	if m.Source == "" {
+		m.Source = m.Type
+	}
+	m.Options = opts
+	return m, nil
+}
+
+// addMounts appends the mounts parsed with parseMountFlag to the spec mounts.
+func addMounts(spec *specs.Spec, vals []string) error {
+	for _, val := range vals {
+		m, err := parseMountFlag(val)
+		if err != nil {
+			return err
+		}
+		spec.Mounts = append(spec.Mounts, m)
+	}
+	return nil
+}
+
+// validateEnv returns an error if kv is not an environment variable
+// in the format KEY=VALUE with a non-empty KEY.
+func validateEnv(kv string) error {
+	if i := strings.IndexByte(kv, '='); i < 1 {
+		return fmt.Errorf("invalid environment variable %q: must be KEY=VALUE", kv)
+	}
+	return nil
+}
+
+// addEnv appends the environment variables (KEY=VALUE) to the spec process.
+// Duplicates are removed when the container is created,
+// so the values from vals take precedence over the spec values.
+func addEnv(spec *specs.Spec, vals []string) error {
+	for _, kv := range vals {
+		if err := validateEnv(kv); err != nil {
+			return err
+		}
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	if spec.Process == nil {
+		return fmt.Errorf("spec process is nil")
+	}
+	spec.Process.Env = append(spec.Process.Env, vals...)
+	return nil
+}
+
+// resourceOverrides are the values from the create resource flags
+// that override the resources of the container spec.
+type resourceOverrides struct {
+	// Memory limit in bytes with an optional suffix k, m or g.
+	Memory string
+	// CPUs is the (fractional) number of CPUs e.g '1.5'.
+	CPUs      string
+	CPUShares *uint64
+	PidsLimit *int64
+}
+
+// cpuPeriod is the cpu period in microseconds used to convert
+// the number of CPUs to the cpu quota.
+const cpuPeriod = 100000
+
+// setResources validates the given resource overrides and sets them
+// in spec.Linux.Resources.
+func setResources(spec *specs.Spec, o resourceOverrides) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	res := spec.Linux.Resources
+
+	if o.Memory != "" {
+		limit, err := parseMemorySize(o.Memory)
+		if err != nil {
+			return err
+		}
+		if res.Memory == nil {
+			res.Memory = &specs.LinuxMemory{}
+		}
+		res.Memory.Limit = &limit
+	}
+
+	if o.CPUs != "" || o.CPUShares != nil {
+		if res.CPU == nil {
+			res.CPU = &specs.LinuxCPU{}
+		}
+	}
+	if o.CPUs != "" {
+		cpus, err := strconv.ParseFloat(o.CPUs, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cpus %q: %w", o.CPUs, err)
+		}
+		quota := int64(math.Round(cpus * cpuPeriod))
+		// The kernel requires a quota of at least 1ms.
+		if quota < 1000 {
+			return fmt.Errorf("invalid cpus %q: must be at least 0.01", o.CPUs)
+		}
+		period := uint64(cpuPeriod)
+		res.CPU.Quota = &quota
+		res.CPU.Period = &period
+	}
+	if o.CPUShares != nil {
+		if *o.CPUShares < 2 || *o.CPUShares > 262144 {
+			return fmt.Errorf("invalid cpu shares %d: must be in range [2-262144]", *o.CPUShares)
+		}
+		res.CPU.Shares = o.CPUShares
+	}
+
+	if o.PidsLimit != nil {
+		if *o.PidsLimit < -1 {
+			return fmt.Errorf("invalid pids limit %d: must be -1 (unlimited) or greater", *o.PidsLimit)
+		}
+		res.Pids = &specs.LinuxPids{Limit: *o.PidsLimit}
+	}
+	return nil
+}
+
+// parseMemorySize parses a size in bytes with an optional
+// (binary) suffix k, m or g e.g '512m'.
+func parseMemorySize(s string) (int64, error) {
+	num := strings.TrimRight(s, "kKmMgG")
+	var shift uint
+	switch strings.ToLower(s[len(num):]) {
+	case "":
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	default:
+		return 0, fmt.Errorf("invalid memory size %q: invalid suffix", s)
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q: %w", s, err)
+	}
+	if n <= 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid memory size %q: out of range", s)
+	}
+	return n << shift, nil
+}
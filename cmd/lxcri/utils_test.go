@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/lxc/lxcri"
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 
 	"github.com/stretchr/testify/require"
@@ -30,3 +39,242 @@ func TestParseSignal(t *testing.T) {
 	sig = parseSignal("66")
 	require.Equal(t, unix.Signal(66), sig)
 }
+
+func TestDeleteAll(t *testing.T) {
+	errDelete := fmt.Errorf("delete failed")
+	var deleted []string
+	del := func(id string) error {
+		deleted = append(deleted, id)
+		switch id {
+		case "notexist":
+			return lxcri.ErrNotExist
+		case "fail1", "fail2":
+			return errDelete
+		}
+		return nil
+	}
+
+	err := deleteAll([]string{"c1", "notexist", "c2"}, del)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c1", "notexist", "c2"}, deleted)
+
+	deleted = nil
+	err = deleteAll([]string{"fail1", "c1", "notexist", "fail2"}, del)
+	require.Error(t, err)
+	// all containers must be deleted, even if a delete failed
+	require.Equal(t, []string{"fail1", "c1", "notexist", "fail2"}, deleted)
+	require.Contains(t, err.Error(), "2 of 4")
+	require.Contains(t, err.Error(), "fail1: delete failed")
+	require.Contains(t, err.Error(), "fail2: delete failed")
+	require.NotContains(t, err.Error(), "notexist")
+}
+
+func TestAdjustLogLevel(t *testing.T) {
+	level, err := adjustLogLevel("info", false, false)
+	require.NoError(t, err)
+	require.Equal(t, "info", level)
+
+	level, err = adjustLogLevel("warn", true, false)
+	require.NoError(t, err)
+	require.Equal(t, "debug", level)
+
+	level, err = adjustLogLevel("debug", true, false)
+	require.NoError(t, err)
+	require.Equal(t, "trace", level)
+
+	level, err = adjustLogLevel("trace", true, false)
+	require.NoError(t, err)
+	require.Equal(t, "trace", level)
+
+	level, err = adjustLogLevel("debug", false, true)
+	require.NoError(t, err)
+	require.Equal(t, "error", level)
+
+	_, err = adjustLogLevel("info", true, true)
+	require.Error(t, err)
+}
+
+func TestLoadAnnotationsFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lxcri-test-annotations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	load := func(content string) (map[string]string, error) {
+		p := filepath.Join(dir, "annotations")
+		require.NoError(t, os.WriteFile(p, []byte(content), 0600))
+		return loadAnnotationsFile(p)
+	}
+
+	expected := map[string]string{
+		"org.linuxcontainers.lxcri.umask": "0027",
+		"io.kubernetes.cri-o.foo":         "a=b",
+	}
+
+	a, err := load(`{"org.linuxcontainers.lxcri.umask": "0027", "io.kubernetes.cri-o.foo": "a=b"}`)
+	require.NoError(t, err)
+	require.Equal(t, expected, a)
+
+	a, err = load("# comment\norg.linuxcontainers.lxcri.umask=0027\n\nio.kubernetes.cri-o.foo=a=b\n")
+	require.NoError(t, err)
+	require.Equal(t, expected, a)
+
+	_, err = load("{\n\"a\": \"b\",\n\"c\"\n}")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ":4: invalid JSON")
+
+	_, err = load(`{"a": 1}`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `annotation "a" must be a string`)
+
+	_, err = load("a=b\nnovalue\n")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `:2: expected key=value but got "novalue"`)
+
+	_, err = load("=b\n")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ":1: empty annotation key")
+}
+
+func TestWriteConfigDump(t *testing.T) {
+	spec := specki.NewSpec("/rootfs", "/bin/sh")
+	spec.Mounts = append(spec.Mounts, specki.BindMount("/etc/hosts", "/etc/hosts", "ro"))
+
+	config := `lxc.uts.name = test
+lxc.rootfs.path = dir:/rootfs
+lxc.mount.entry = proc proc proc rw,nosuid,nodev,noexec,relatime,create=dir 0 0
+lxc.mount.entry = /etc/hosts etc/hosts none bind,nosuid,nodev,relatime,ro,create=file 0 0
+lxc.namespace.clone = pid mount ipc uts cgroup net
+lxc.init.cwd = /
+`
+	var buf bytes.Buffer
+	require.NoError(t, writeConfigDump(&buf, spec, []byte(config)))
+	out := buf.String()
+
+	mounts := out[strings.Index(out, "## mounts"):strings.Index(out, "## namespaces")]
+	require.Contains(t, mounts, `"destination": "/etc/hosts"`)
+	require.Contains(t, mounts, "lxc.rootfs.path = dir:/rootfs\n")
+	require.Contains(t, mounts, "lxc.mount.entry = proc proc proc rw,nosuid,nodev,noexec,relatime,create=dir 0 0\n")
+	require.Contains(t, mounts, "lxc.mount.entry = /etc/hosts etc/hosts none bind,nosuid,nodev,relatime,ro,create=file 0 0\n")
+
+	namespaces := out[strings.Index(out, "## namespaces"):strings.Index(out, "## idmap")]
+	require.Contains(t, namespaces, "lxc.namespace.clone = pid mount ipc uts cgroup net\n")
+
+	other := out[strings.Index(out, "## other"):]
+	require.Equal(t, "## other\nlxc.uts.name = test\n", other)
+}
+
+func TestParseMountFlag(t *testing.T) {
+	m, err := parseMountFlag("type=bind,source=/var/data,destination=/data,options=ro:noexec")
+	require.NoError(t, err)
+	require.Equal(t, specs.Mount{
+		Type: "bind", Source: "/var/data", Destination: "/data",
+		Options: []string{"bind", "nosuid", "nodev", "relatime", "ro", "noexec"},
+	}, m)
+
+	spec := specki.NewSpec("/rootfs", "/bin/true")
+	require.NoError(t, addMounts(spec, []string{"type=bind,source=/var/data,destination=/data,options=ro:noexec"}))
+	require.Equal(t, m, spec.Mounts[len(spec.Mounts)-1])
+	require.Error(t, addMounts(spec, []string{"type=bind"}))
+
+	// bind is the default type
+	m, err = parseMountFlag("src=/var/data,dst=/data,readonly")
+	require.NoError(t, err)
+	require.Equal(t, "bind", m.Type)
+	require.Contains(t, m.Options, "ro")
+
+	m, err = parseMountFlag("type=tmpfs,destination=/tmp,o=size=64m")
+	require.NoError(t, err)
+	require.Equal(t, specs.Mount{Type: "tmpfs", Source: "tmpfs", Destination: "/tmp", Options: []string{"size=64m"}}, m)
+
+	for _, val := range []string{
+		"type=bind,source=/var/data",            // missing destination
+		"type=bind,source=/var/data,dst=data",   // relative destination
+		"type=bind,destination=/data",           // missing bind source
+		"type=bind,src=/var/data,dst=/data,foo", // invalid field
+		"type=bind,src=/var/data,dst=/data,x=y", // unknown key
+	} {
+		_, err := parseMountFlag(val)
+		require.Error(t, err, val)
+	}
+}
+
+func TestSetResources(t *testing.T) {
+	spec := specki.NewSpec("/rootfs", "/bin/true")
+	shares := uint64(1024)
+	limit := int64(100)
+	err := setResources(spec, resourceOverrides{Memory: "512m", CPUs: "1.5", CPUShares: &shares, PidsLimit: &limit})
+	require.NoError(t, err)
+
+	res := spec.Linux.Resources
+	require.Equal(t, int64(512<<20), *res.Memory.Limit)
+	// cpu.max = "150000 100000"
+	require.Equal(t, int64(150000), *res.CPU.Quota)
+	require.Equal(t, uint64(100000), *res.CPU.Period)
+	require.Equal(t, uint64(1024), *res.CPU.Shares)
+	require.Equal(t, int64(100), res.Pids.Limit)
+
+	shares = 1
+	limit = -2
+	for _, o := range []resourceOverrides{
+		{Memory: "0"},
+		{Memory: "512x"},
+		{Memory: "-1m"},
+		{CPUs: "0"},
+		{CPUs: "0.001"},
+		{CPUs: "abc"},
+		{CPUShares: &shares},
+		{PidsLimit: &limit},
+	} {
+		require.Error(t, setResources(spec, o), "%#v", o)
+	}
+}
+
+func TestAddEnv(t *testing.T) {
+	spec := specki.NewSpec("/rootfs", "/bin/true")
+	spec.Process.Env = []string{"PATH=/bin"}
+	require.NoError(t, addEnv(spec, []string{"FOO=bar", "PATH=/usr/bin", "EMPTY="}))
+	require.Equal(t, []string{"PATH=/bin", "FOO=bar", "PATH=/usr/bin", "EMPTY="}, spec.Process.Env)
+
+	for _, kv := range []string{"FOO", "=bar", ""} {
+		require.Error(t, addEnv(spec, []string{kv}), kv)
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	for s, expected := range map[string]int64{"1024": 1024, "1k": 1 << 10, "64M": 64 << 20, "2g": 2 << 30} {
+		n, err := parseMemorySize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, n, s)
+	}
+	for _, s := range []string{"", "m", "1mb", "1t", "9223372036854775807g"} {
+		_, err := parseMemorySize(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestReadyFile(t *testing.T) {
+	var fds [2]int
+	require.NoError(t, unix.Pipe2(fds[:], unix.O_CLOEXEC))
+	r := os.NewFile(uintptr(fds[0]), "r")
+	defer r.Close()
+
+	_, err := readyFile(-1)
+	require.Error(t, err)
+
+	// The read end of a pipe is not writable.
+	_, err = readyFile(int(r.Fd()))
+	require.Error(t, err)
+
+	f, err := readyFile(fds[1])
+	require.NoError(t, err)
+	require.NoError(t, notifyReady(f))
+
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// The write end is closed by notifyReady.
+	_, err = r.Read(buf)
+	require.Equal(t, io.EOF, err)
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lxc/go-lxc"
@@ -37,6 +40,16 @@ type ContainerConfig struct {
 
 	ConsoleSocket string `json:",omitempty"`
 
+	// ConsoleSocketFile is an already connected unix socket,
+	// e.g inherited through systemd socket activation.
+	// It is used instead of the ConsoleSocket path to send the PTY to.
+	ConsoleSocketFile *os.File `json:"-"`
+
+	// ConsoleLog is the path to a file where the console output is written to.
+	// The console output is still available through the PTY
+	// that is sent to the console socket, which must be set.
+	ConsoleLog string `json:",omitempty"`
+
 	// MonitorCgroupDir is the cgroup directory path
 	// for the liblxc monitor process `lxcri-start`
 	// relative to the cgroup root.
@@ -82,7 +95,21 @@ type Container struct {
 	// Pid is the process ID of the liblxc monitor process ( see ExecStart )
 	Pid int
 
+	// StateVersion is the StateVersion of the runtime that created the container.
+	StateVersion int `json:",omitempty"`
+	// RuntimeVersion is the Version of the runtime that created the container.
+	RuntimeVersion string `json:",omitempty"`
+	// RuntimeLibexecDir is the Runtime.LibexecDir of the runtime that created the container.
+	RuntimeLibexecDir string `json:",omitempty"`
+
 	runtimeDir string
+	// cgroupLock is held by Runtime.Create until the container cgroup is populated.
+	cgroupLock *os.File
+
+	// stateMu protects the state cached by State.
+	stateMu     sync.Mutex
+	cachedState *State
+	cachedAt    time.Time
 }
 
 func (c *Container) create() error {
@@ -135,6 +162,54 @@ func (c *Container) load() error {
 	return nil
 }
 
+// CreateConfig returns a copy of the ContainerConfig with the spec that was passed
+// to Runtime.Create, before it was modified by the runtime.
+// It can be used to recreate the container after it was deleted.
+func (c *Container) CreateConfig() (*ContainerConfig, error) {
+	spec, err := specki.LoadSpecJSON(c.RuntimePath(CreateSpecFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load create spec: %w", err)
+	}
+	cfg := *c.ContainerConfig
+	cfg.Spec = spec
+	// The cgroup directories are set by Runtime.Create
+	cfg.CgroupDir = ""
+	cfg.MonitorCgroupDir = ""
+	return &cfg, nil
+}
+
+// loadIncomplete loads a container without lxcri.json from the spec
+// and the liblxc config file in the runtime directory.
+// The loaded container has no monitor process (Pid) and is
+// only sufficient to delete the container.
+func (c *Container) loadIncomplete(containerID string) error {
+	c.Log.Warn().Msg("container runtime state lxcri.json is missing - loading incomplete container")
+	c.ContainerID = containerID
+
+	spec, err := specki.LoadSpecJSON(c.RuntimePath(BundleConfigFile))
+	if err != nil {
+		return fmt.Errorf("failed to load incomplete container spec: %w", err)
+	}
+	c.Spec = spec
+
+	c.LinuxContainer, err = lxc.NewContainer(c.ContainerID, filepath.Dir(c.runtimeDir))
+	if err != nil {
+		return fmt.Errorf("failed to create lxc container: %w", err)
+	}
+	if err := c.LinuxContainer.LoadConfigFile(c.ConfigFilePath()); err != nil {
+		if err := c.LinuxContainer.Release(); err != nil {
+			c.Log.Error().Msgf("failed to release container: %s", err)
+		}
+		return fmt.Errorf("failed to load incomplete container config file: %w", err)
+	}
+
+	c.CgroupDir = c.getConfigItem("lxc.cgroup.dir.container")
+	if c.CgroupDir == "" {
+		c.CgroupDir = c.getConfigItem("lxc.cgroup.dir")
+	}
+	return nil
+}
+
 func (c *Container) waitMonitorStopped(ctx context.Context) error {
 	for {
 		select {
@@ -228,17 +303,85 @@ func (c *Container) waitStarted(ctx context.Context) error {
 	}
 }
 
+// WaitRunning blocks until the container init process has executed
+// the container process (see Runtime.Start), or the given context is done.
+// In contrast to Runtime.Create, which returns when the container
+// is created, WaitRunning returns when the container is running.
+// An error is returned if the container is stopped.
+func (c *Container) WaitRunning(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			state, err := c.ContainerState()
+			if err != nil {
+				return err
+			}
+			switch state {
+			case specs.StateRunning:
+				return nil
+			case specs.StateStopped:
+				return fmt.Errorf("container is stopped")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
 // State wraps specs.State and adds runtime specific state.
 type State struct {
 	ContainerState string
 	RuntimePath    string
 	SpecState      specs.State
+
+	// CgroupPath is the absolute path of the container cgroup
+	// within the cgroup filesystem e.g /sys/fs/cgroup/lxcri.slice/123.scope
+	CgroupPath string `json:",omitempty"`
+
+	// OOMKilled is true if the container is stopped and a
+	// container process was killed by the OOM killer.
+	OOMKilled bool `json:",omitempty"`
 }
 
+// stateCacheTTL is the maximum age of the state cached by Container.State.
+// It limits how long a state change that is not caused by the runtime
+// (e.g the container process exits) may go unnoticed.
+var stateCacheTTL = time.Millisecond * 100
+
 // State returns the runtime state of the containers process.
 // The State.Pid value is the PID of the liblxc
 // container monitor process (lxcri-start).
+// The state is cached for a short time (see stateCacheTTL),
+// the cache is invalidated by the lifecycle operations (create, start, kill, delete).
 func (c *Container) State() (*State, error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.cachedState == nil || time.Since(c.cachedAt) >= stateCacheTTL {
+		state, err := readState(c)
+		if err != nil {
+			return nil, err
+		}
+		c.cachedState, c.cachedAt = state, time.Now()
+	}
+	// Return a copy so that callers can not modify the cached state.
+	state := *c.cachedState
+	return &state, nil
+}
+
+// invalidateState discards the state cached by State.
+// It must be called after a lifecycle transition of the container.
+func (c *Container) invalidateState() {
+	c.stateMu.Lock()
+	c.cachedState = nil
+	c.stateMu.Unlock()
+}
+
+// readState reads the current state of the container.
+// It is a variable to be able to count the state reads in tests.
+var readState = (*Container).readState
+
+func (c *Container) readState() (*State, error) {
 	status, err := c.ContainerState()
 	if err != nil {
 		return nil, errorf("failed go get container status: %w", err)
@@ -257,9 +400,118 @@ func (c *Container) State() (*State, error) {
 		},
 	}
 
+	if c.CgroupDir != "" {
+		state.CgroupPath = filepath.Join(cgroupRoot, c.CgroupDir)
+	}
+
+	if status == specs.StateStopped {
+		state.OOMKilled = c.oomKilled()
+	}
+
 	return state, nil
 }
 
+// Health status values.
+const (
+	// HealthRunning means the monitor and the container init process are alive.
+	HealthRunning = "running"
+	// HealthMonitorDead means the monitor process is dead (or a zombie)
+	// but the container cgroup is still populated, the container is orphaned.
+	HealthMonitorDead = "monitor-dead"
+	// HealthStopped means the container processes are not running.
+	HealthStopped = "stopped"
+)
+
+// Health is the liveness of the container processes.
+type Health struct {
+	Status string
+	// MonitorPid is the pid of the liblxc monitor process (lxcri-start).
+	MonitorPid   int
+	MonitorAlive bool
+	// InitPid is the pid of the container init process
+	// or -1 if it can not be retrieved from the monitor process.
+	InitPid         int
+	InitAlive       bool
+	CgroupPopulated bool
+}
+
+// Health checks the liveness of the monitor process, the container init
+// process and whether the container cgroup is populated.
+func (c *Container) Health() (*Health, error) {
+	h := &Health{MonitorPid: c.Pid, InitPid: -1}
+	h.MonitorAlive = isProcessAlive(c.Pid)
+	if h.MonitorAlive {
+		// The init pid is retrieved from the monitor process.
+		h.InitPid = c.LinuxContainer.InitPid()
+		h.InitAlive = isProcessAlive(h.InitPid)
+	}
+
+	if c.CgroupDir != "" {
+		ev, err := parseCgroupEvents(filepath.Join(cgroupRoot, c.CgroupDir, "cgroup.events"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to parse cgroup events: %w", err)
+		}
+		h.CgroupPopulated = ev.populated
+	}
+
+	switch {
+	case h.MonitorAlive && h.InitAlive:
+		h.Status = HealthRunning
+	case !h.MonitorAlive && h.CgroupPopulated:
+		h.Status = HealthMonitorDead
+	default:
+		h.Status = HealthStopped
+	}
+	return h, nil
+}
+
+// isProcessAlive returns true if the process with the given pid
+// exists and is not a zombie.
+func isProcessAlive(pid int) bool {
+	if pid < 1 {
+		return false
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The process state follows the command name in parentheses,
+	// which may contain spaces and parentheses itself.
+	// e.g '1234 (lxcri-start) S 1 ...'
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 || i+2 >= len(data) {
+		return false
+	}
+	state := data[i+2]
+	return state != 'Z' && state != 'X'
+}
+
+// oomKilled returns true if a container process was killed by the OOM killer.
+// A positive result is persisted in the runtime directory, because the
+// cgroup (and the memory.events file) is removed when the container is deleted.
+func (c *Container) oomKilled() bool {
+	marker := c.RuntimePath("oom_killed")
+	if _, err := os.Stat(marker); err == nil {
+		return true
+	}
+	if c.CgroupDir == "" {
+		return false
+	}
+	yes, err := cgroupOOMKilled(c.CgroupDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.Log.Warn().Msgf("failed to check cgroup for OOM kills: %s", err)
+		}
+		return false
+	}
+	if yes {
+		if err := touchFile(marker, 0444); err != nil {
+			c.Log.Warn().Msgf("failed to persist OOM kill: %s", err)
+		}
+	}
+	return yes
+}
+
 // ContainerState returns the current state of the container process,
 // as defined by the OCI runtime spec.
 func (c *Container) ContainerState() (specs.ContainerState, error) {
@@ -307,6 +559,7 @@ func (c *Container) getContainerInitState() (specs.ContainerState, error) {
 
 func (c *Container) kill(ctx context.Context, signum unix.Signal) error {
 	c.Log.Info().Int("signum", int(signum)).Msg("killing container processes")
+	defer c.invalidateState()
 
 	// From `man pid_namespaces`: If the "init" process of a PID namespace terminates, the kernel
 	// terminates all of the processes in the namespace via a SIGKILL signal.
@@ -323,12 +576,98 @@ func (c *Container) kill(ctx context.Context, signum unix.Signal) error {
 	if errors.Is(err, unix.ENODEV) {
 		return nil
 	}
+	// The init process may have exited after the container state was checked.
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to kill group: %s", err)
+		return fmt.Errorf("failed to kill group: %w", err)
 	}
 	return nil
 }
 
+// killStep is a step of the Runtime.KillSequence.
+type killStep struct {
+	signal unix.Signal
+	wait   time.Duration
+}
+
+// parseKillSequence parses the kill sequence e.g 'SIGTERM:10s,SIGINT:5s'.
+// A step without a duration waits until the context is done.
+func parseKillSequence(s string) ([]killStep, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var seq []killStep
+	for _, val := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(val), ":", 2)
+		step := killStep{signal: parseSignalName(kv[0])}
+		if step.signal == 0 {
+			return nil, fmt.Errorf("invalid signal %q", kv[0])
+		}
+		if len(kv) == 2 {
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("invalid duration %q: must be greater than zero", kv[1])
+			}
+			step.wait = d
+		}
+		seq = append(seq, step)
+	}
+	return seq, nil
+}
+
+// parseSignalName returns the signal for the given signal number or name
+// e.g '15', 'TERM' or 'SIGTERM'. It returns 0 if the signal is invalid.
+func parseSignalName(s string) unix.Signal {
+	if num, err := strconv.Atoi(s); err == nil {
+		if num <= 0 || unix.SignalName(unix.Signal(num)) == "" {
+			return 0
+		}
+		return unix.Signal(num)
+	}
+	s = strings.ToUpper(s)
+	if !strings.HasPrefix(s, "SIG") {
+		s = "SIG" + s
+	}
+	return unix.SignalNum(s)
+}
+
+// stop sends the signals from the kill sequence seq to the container processes.
+// After each signal it waits for the step duration until the container is stopped,
+// before the next step is applied. The container is killed with SIGKILL
+// if it is still running after the last step.
+func (c *Container) stop(ctx context.Context, seq []killStep) error {
+	return runKillSequence(ctx, seq, c.kill, c.waitMonitorStopped)
+}
+
+// runKillSequence applies the kill sequence seq using the given kill and wait functions.
+// wait must return nil if the container is stopped, or the context error.
+func runKillSequence(ctx context.Context, seq []killStep,
+	kill func(context.Context, unix.Signal) error, wait func(context.Context) error) error {
+	for _, step := range seq {
+		if err := kill(ctx, step.signal); err != nil {
+			return err
+		}
+		waitCtx, cancel := ctx, context.CancelFunc(func() {})
+		if step.wait > 0 {
+			waitCtx, cancel = context.WithTimeout(ctx, step.wait)
+		}
+		err := wait(waitCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return kill(ctx, unix.SIGKILL)
+}
+
 // getConfigItem is a wrapper function and returns the
 // first value returned by lxc.Container.ConfigItem
 func (c *Container) getConfigItem(key string) string {
@@ -344,11 +683,20 @@ func (c *Container) getConfigItem(key string) string {
 	return ""
 }
 
+// ErrUnsupportedConfigItem is returned by setConfigItem
+// if the config item is not supported by liblxc.
+// Callers can check for it to ignore optional config items.
+var ErrUnsupportedConfigItem = errors.New("unsupported config item")
+
 // setConfigItem is a wrapper for lxc.Container.setConfigItem.
 // and only adds additional logging.
+// ErrUnsupportedConfigItem is returned if liblxc does not support the config item.
 func (c *Container) setConfigItem(key, value string) error {
 	err := c.LinuxContainer.SetConfigItem(key, value)
 	if err != nil {
+		if lxc.VersionAtLeast(4, 0, 6) && !lxc.IsSupportedConfigItem(key) {
+			err = ErrUnsupportedConfigItem
+		}
 		return fmt.Errorf("failed to set config item '%s=%s': %w", key, value, err)
 	}
 	c.Log.Debug().Str(key, value).Msg("set config item")
@@ -377,9 +725,11 @@ func (c *Container) Release() error {
 	return c.LinuxContainer.Release()
 }
 
+// start notifies the container init process to execute the container process,
+// by opening the sync fifo for writing.
 func (c *Container) start(ctx context.Context) error {
-	// #nosec
-	fifo, err := os.OpenFile(c.syncFifoPath(), os.O_WRONLY, 0)
+	defer c.invalidateState()
+	fifo, err := openSyncFifo(ctx, c.syncFifoPath(), c.ContainerState)
 	if err != nil {
 		return err
 	}
@@ -389,16 +739,68 @@ func (c *Container) start(ctx context.Context) error {
 	return c.waitStarted(ctx)
 }
 
+// syncFifoRetryInterval is the interval for retrying to open the sync fifo.
+const syncFifoRetryInterval = time.Millisecond * 10
+
+// openSyncFifo opens the sync fifo for writing, when the init process has
+// opened it for reading. A blocking open can not be cancelled and would
+// block forever if init exits, so the fifo is opened non-blocking and the
+// open is retried while init is not ready, until the context is done.
+// The given state func returns the current container state.
+// ErrInitExited is returned if init has exited.
+func openSyncFifo(ctx context.Context, p string, state func() (specs.ContainerState, error)) (*os.File, error) {
+	for {
+		// #nosec
+		fifo, err := os.OpenFile(p, os.O_WRONLY|unix.O_NONBLOCK, 0)
+		if err == nil {
+			return fifo, nil
+		}
+		// ENXIO means that the fifo has not been opened for reading (yet).
+		if !errors.Is(err, unix.ENXIO) {
+			return nil, err
+		}
+		s, err := state()
+		if err != nil {
+			return nil, err
+		}
+		switch s {
+		case specs.StateStopped:
+			return nil, fmt.Errorf("%w before start", ErrInitExited)
+		case specs.StateRunning:
+			return nil, fmt.Errorf("container process is already started")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("init is not ready to start: %w", ctx.Err())
+		case <-time.After(syncFifoRetryInterval):
+		}
+	}
+}
+
 // ExecOptions contains options for Container.Exec and Container.ExecDetached
 type ExecOptions struct {
 	// Namespaces is the list of container namespaces that the process is attached to.
 	// The process will is attached to all container namespaces if Namespaces is empty.
 	Namespaces []specs.LinuxNamespaceType
+
+	// NoNewPrivileges overrides the container no_new_privs setting
+	// (spec.Process.NoNewPrivileges) for the process if not nil.
+	NoNewPrivileges *bool
+
+	// ApparmorProfile is the apparmor profile of the process.
+	// liblxc applies the profile of the container init process
+	// to the process, so a different profile is rejected.
+	ApparmorProfile string
+
+	// CPUs is the list of CPUs (e.g "0-3,6") the process is pinned to.
+	// The CPUs must be online. The process is not pinned if CPUs is empty.
+	CPUs string
 }
 
 // ExecDetached executes the given process spec within the container.
 // The given process is started and the process PID is returned.
-// It's up to the caller to wait for the process to exit using the returned PID.
+// It's up to the caller to wait for the process to exit using the returned PID
+// e.g with WaitExec, which records the exit status for ExecStatus.
 // The container state must be either specs.StateCreated or specs.StateRunning
 // The given ExecOptions execOpts, control the execution environment of the the process.
 func (c *Container) ExecDetached(proc *specs.Process, execOpts *ExecOptions) (pid int, err error) {
@@ -407,7 +809,17 @@ func (c *Container) ExecDetached(proc *specs.Process, execOpts *ExecOptions) (pi
 		return 0, errorf("failed to create attach options: %w", err)
 	}
 
-	pid, err = c.LinuxContainer.RunCommandNoWait(proc.Args, opts)
+	cpus, err := execCPUSet(execOpts)
+	if err != nil {
+		return 0, errorf("invalid CPU affinity: %w", err)
+	}
+	var runErr error
+	err = withCPUAffinity(cpus, func() {
+		pid, runErr = c.LinuxContainer.RunCommandNoWait(proc.Args, opts)
+	})
+	if runErr != nil {
+		return pid, errorf("failed to run exec cmd detached: %w", runErr)
+	}
 	if err != nil {
 		return pid, errorf("failed to run exec cmd detached: %w", err)
 	}
@@ -423,13 +835,111 @@ func (c *Container) Exec(proc *specs.Process, execOpts *ExecOptions) (exitStatus
 	if err != nil {
 		return 0, errorf("failed to create attach options: %w", err)
 	}
-	exitStatus, err = c.LinuxContainer.RunCommandStatus(proc.Args, opts)
+
+	cpus, err := execCPUSet(execOpts)
+	if err != nil {
+		return 0, errorf("invalid CPU affinity: %w", err)
+	}
+	var runErr error
+	err = withCPUAffinity(cpus, func() {
+		exitStatus, runErr = c.LinuxContainer.RunCommandStatus(proc.Args, opts)
+	})
+	if runErr != nil {
+		return exitStatus, errorf("failed to run exec cmd: %w", runErr)
+	}
 	if err != nil {
 		return exitStatus, errorf("failed to run exec cmd: %w", err)
 	}
 	return exitStatus, nil
 }
 
+// ErrExecNotExited is returned by Container.ExecStatus if no exit status
+// is recorded for the detached process (yet).
+var ErrExecNotExited = errors.New("exec process has not exited")
+
+func (c *Container) execStatusPath(pid int) string {
+	return c.RuntimePath(fmt.Sprintf("exec-%d.status", pid))
+}
+
+// WaitExec waits for the process with the given pid, started by ExecDetached,
+// to exit and returns its exit status. The process must be a child of the calling process.
+// The exit status is recorded in the container runtime directory,
+// where it can be retrieved with ExecStatus.
+// The exit status of a process terminated by a signal is 128 + signal number.
+func (c *Container) WaitExec(pid int) (exitStatus int, err error) {
+	var ws unix.WaitStatus
+	for {
+		_, err = unix.Wait4(pid, &ws, 0, nil)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return -1, errorf("failed to wait for exec process %d: %w", pid, err)
+	}
+	exitStatus = ws.ExitStatus()
+	if ws.Signaled() {
+		exitStatus = 128 + int(ws.Signal())
+	}
+
+	// The status file is written atomically, so ExecStatus never reads a partial file.
+	p := c.execStatusPath(pid)
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p))
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(exitStatus)), 0440); err != nil {
+		return exitStatus, errorf("failed to write exec status: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return exitStatus, errorf("failed to rename exec status file: %w", err)
+	}
+	return exitStatus, nil
+}
+
+// ExecStatus returns the exit status of the detached process with the given pid,
+// recorded by WaitExec. ErrExecNotExited is returned if no exit status is recorded.
+func (c *Container) ExecStatus(pid int) (int, error) {
+	data, err := os.ReadFile(c.execStatusPath(pid))
+	if os.IsNotExist(err) {
+		return -1, ErrExecNotExited
+	}
+	if err != nil {
+		return -1, errorf("failed to read exec status: %w", err)
+	}
+	status, err := strconv.Atoi(string(data))
+	if err != nil {
+		return -1, errorf("invalid exec status %q: %w", data, err)
+	}
+	return status, nil
+}
+
+var apparmorEnabledFile = "/sys/module/apparmor/parameters/enabled"
+
+// apparmorProfile returns the apparmor profile of the process with the given pid.
+// The profile is "unconfined" if apparmor is not enabled.
+func apparmorProfile(pid int) (string, error) {
+	if !apparmorSupported() {
+		return "unconfined", nil
+	}
+	// The apparmor specific attr file is available since linux 5.8
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/attr/apparmor/current", pid))
+	if os.IsNotExist(err) {
+		data, err = os.ReadFile(fmt.Sprintf("/proc/%d/attr/current", pid))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read apparmor profile: %w", err)
+	}
+	return parseApparmorLabel(string(data)), nil
+}
+
+// parseApparmorLabel returns the profile name from the apparmor
+// label e.g 'lxc-container-default-cgns (enforce)'.
+func parseApparmorLabel(label string) string {
+	label = strings.TrimRight(label, "\x00\n")
+	if i := strings.LastIndex(label, " ("); i > 0 {
+		return label[:i]
+	}
+	return label
+}
+
 func (c *Container) attachOptions(procSpec *specs.Process, execOpts *ExecOptions) (lxc.AttachOptions, error) {
 	opts := lxc.AttachOptions{
 		StdinFd:  0,
@@ -465,6 +975,27 @@ func (c *Container) attachOptions(procSpec *specs.Process, execOpts *ExecOptions
 	}
 	c.Log.Debug().Msgf("attaching to namespaces %#v\n", execOpts.Namespaces)
 
+	if execOpts.NoNewPrivileges != nil {
+		// The in-memory config of the loaded container is used by liblxc attach.
+		val := "0"
+		if *execOpts.NoNewPrivileges {
+			val = "1"
+		}
+		if err := c.setConfigItem("lxc.no_new_privs", val); err != nil {
+			return opts, err
+		}
+	}
+
+	if execOpts.ApparmorProfile != "" {
+		profile, err := apparmorProfile(c.LinuxContainer.InitPid())
+		if err != nil {
+			return opts, err
+		}
+		if execOpts.ApparmorProfile != profile {
+			return opts, fmt.Errorf("apparmor profile %q differs from the container profile %q: liblxc applies the container profile to the process", execOpts.ApparmorProfile, profile)
+		}
+	}
+
 	for _, n := range c.Spec.Linux.Namespaces {
 		for _, t := range execOpts.Namespaces {
 			if n.Type == t {
@@ -512,6 +1043,68 @@ func (c *Container) SetLog(filename string, level string) error {
 	return nil
 }
 
+// ErrNoConsole is returned by Container.ReadConsoleLog if the container
+// process has no terminal or the ConsoleLog is not configured.
+var ErrNoConsole = fmt.Errorf("no console")
+
+// ReadConsoleLog returns a reader for the console output of the container,
+// that is written to ContainerConfig.ConsoleLog.
+// If follow is true, the reader blocks on the end of the console log
+// and waits for further output until the container monitor process has exited
+// or the reader is closed.
+func (c *Container) ReadConsoleLog(follow bool) (io.ReadCloser, error) {
+	if !c.Spec.Process.Terminal {
+		return nil, fmt.Errorf("%w: container process has no terminal", ErrNoConsole)
+	}
+	if c.ContainerConfig.ConsoleLog == "" {
+		return nil, fmt.Errorf("%w: console log is not configured", ErrNoConsole)
+	}
+	// #nosec
+	f, err := os.Open(c.ContainerConfig.ConsoleLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open console log: %w", err)
+	}
+	if !follow {
+		return f, nil
+	}
+	return &followReader{file: f, isRunning: c.isMonitorRunning, done: make(chan struct{})}, nil
+}
+
+// followReader reads from a file that is appended to, like `tail -f`.
+type followReader struct {
+	file      *os.File
+	isRunning func() bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.file.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if !r.isRunning() {
+			// read the output written before the monitor process exited
+			n, err := r.file.Read(p)
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+func (r *followReader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return r.file.Close()
+}
+
 func parseContainerLogLevel(level string) lxc.LogLevel {
 	switch strings.ToLower(level) {
 	case "trace":
@@ -0,0 +1,563 @@
+package lxcri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lxc/go-lxc"
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetConfigItemError(t *testing.T) {
+	if !lxc.VersionAtLeast(4, 0, 6) {
+		t.Skipf("lxc.IsSupportedConfigItem is broken in liblxc < 4.0.6")
+	}
+	dir, err := os.MkdirTemp("", "lxcri-test")
+	require.NoError(t, err)
+	defer removeAll(t, dir)
+
+	c := &Container{
+		ContainerConfig: &ContainerConfig{ContainerID: filepath.Base(dir), Log: rt.Log},
+	}
+	c.LinuxContainer, err = lxc.NewContainer(c.ContainerID, filepath.Dir(dir))
+	require.NoError(t, err)
+	defer c.Release()
+
+	err = c.setConfigItem("lxc.no.such.item", "foobar")
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrUnsupportedConfigItem))
+	require.Contains(t, err.Error(), "lxc.no.such.item=foobar")
+
+	err = c.setConfigItem("lxc.uts.name", "foobar")
+	require.NoError(t, err)
+}
+
+func TestReadConsoleLogNoTerminal(t *testing.T) {
+	c := &Container{ContainerConfig: &ContainerConfig{
+		Spec:       specki.NewSpec("/tmp", "/bin/true"),
+		ConsoleLog: "/tmp/console.log",
+	}}
+	_, err := c.ReadConsoleLog(false)
+	require.True(t, errors.Is(err, ErrNoConsole))
+
+	c.Spec.Process.Terminal = true
+	c.ContainerConfig.ConsoleLog = ""
+	_, err = c.ReadConsoleLog(false)
+	require.True(t, errors.Is(err, ErrNoConsole))
+}
+
+func TestFollowReader(t *testing.T) {
+	f, err := os.CreateTemp("", "lxcri-test-console")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	running := int32(1)
+	// #nosec
+	rf, err := os.Open(f.Name())
+	require.NoError(t, err)
+	r := &followReader{file: rf, done: make(chan struct{}),
+		isRunning: func() bool { return atomic.LoadInt32(&running) == 1 },
+	}
+
+	go func() {
+		f.WriteString("hello ")
+		time.Sleep(time.Millisecond * 200)
+		f.WriteString("world")
+		atomic.StoreInt32(&running, 0)
+	}()
+
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(out))
+	require.NoError(t, r.Close())
+}
+
+func TestIsProcessAlive(t *testing.T) {
+	require.True(t, isProcessAlive(os.Getpid()))
+	require.False(t, isProcessAlive(0))
+	require.False(t, isProcessAlive(-1))
+
+	cmd := exec.Command("/bin/true")
+	require.NoError(t, cmd.Start())
+	// wait until the process is a zombie
+	for i := 0; i < 100 && isProcessAlive(cmd.Process.Pid); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	require.False(t, isProcessAlive(cmd.Process.Pid), "zombie is alive")
+	require.NoError(t, cmd.Wait())
+	require.False(t, isProcessAlive(cmd.Process.Pid))
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	h, err := c.Health()
+	require.NoError(t, err)
+	require.Equal(t, HealthRunning, h.Status)
+	require.True(t, h.MonitorAlive)
+	require.True(t, h.InitAlive)
+	require.True(t, h.CgroupPopulated)
+
+	// The monitor process is not reaped, it remains a zombie.
+	err = unix.Kill(c.Pid, unix.SIGKILL)
+	require.NoError(t, err)
+	for i := 0; i < 100 && isProcessAlive(c.Pid); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	h, err = c.Health()
+	require.NoError(t, err)
+	require.Equal(t, HealthMonitorDead, h.Status)
+	require.False(t, h.MonitorAlive)
+	require.True(t, h.CgroupPopulated)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestStateCgroupPath(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(cgroupRoot, c.CgroupDir), state.CgroupPath)
+	require.True(t, strings.HasPrefix(state.CgroupPath, cgroupRoot+"/"))
+	require.FileExists(t, filepath.Join(state.CgroupPath, "cgroup.procs"))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestOpenSyncFifo(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "syncfifo")
+	require.NoError(t, unix.Mkfifo(p, 0600))
+
+	created := func() (specs.ContainerState, error) { return specs.StateCreated, nil }
+	stopped := func() (specs.ContainerState, error) { return specs.StateStopped, nil }
+
+	// Start is called before init opened the fifo for reading.
+	opened := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		f, err := os.OpenFile(p, os.O_RDONLY, 0)
+		if err == nil {
+			f.Close()
+		}
+		opened <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	f, err := openSyncFifo(ctx, p, created)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, <-opened)
+
+	// init exited without opening the fifo
+	_, err = openSyncFifo(ctx, p, stopped)
+	require.True(t, errors.Is(err, ErrInitExited), err)
+
+	// init does not open the fifo
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = openSyncFifo(ctx, p, created)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+}
+
+func TestStartInitExited(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	initPid := c.LinuxContainer.InitPid()
+	require.True(t, initPid > 1)
+	require.NoError(t, unix.Kill(initPid, unix.SIGKILL))
+	for i := 0; i < 100 && isProcessAlive(initPid); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	err = rt.Start(ctx, c)
+	require.True(t, errors.Is(err, ErrInitExited), err)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestParseApparmorLabel(t *testing.T) {
+	require.Equal(t, "unconfined", parseApparmorLabel("unconfined\n"))
+	require.Equal(t, "lxc-container-default-cgns", parseApparmorLabel("lxc-container-default-cgns (enforce)\n"))
+	require.Equal(t, "lxc-container-default-cgns", parseApparmorLabel("lxc-container-default-cgns (enforce)\x00"))
+}
+
+func TestApparmorProfileDisabled(t *testing.T) {
+	enabled := apparmorEnabledFile
+	defer func() { apparmorEnabledFile = enabled }()
+
+	apparmorEnabledFile = filepath.Join(t.TempDir(), "enabled")
+	require.NoError(t, os.WriteFile(apparmorEnabledFile, []byte("N\n"), 0644))
+	profile, err := apparmorProfile(os.Getpid())
+	require.NoError(t, err)
+	require.Equal(t, "unconfined", profile)
+}
+
+func TestExecApparmorUnconfined(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Process.ApparmorProfile = "unconfined"
+	cfg.Spec.Process.NoNewPrivileges = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	profile, err := apparmorProfile(c.LinuxContainer.InitPid())
+	require.NoError(t, err)
+	require.Equal(t, "unconfined", profile)
+
+	proc := specki.NewSpecProcess("/lxcri-test")
+	proc.Env = []string{"SLEEP=0"}
+	noNewPrivs := false
+	status, err := c.Exec(proc, &ExecOptions{ApparmorProfile: "unconfined", NoNewPrivileges: &noNewPrivs})
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+	require.Equal(t, "0", c.getConfigItem("lxc.no_new_privs"))
+
+	_, err = c.Exec(proc, &ExecOptions{ApparmorProfile: "lxcri-test-profile"})
+	require.Error(t, err)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestStateCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lxcri-test")
+	require.NoError(t, err)
+	defer removeAll(t, dir)
+
+	c := &Container{
+		ContainerConfig: &ContainerConfig{ContainerID: filepath.Base(dir), Spec: specki.NewSpec("/tmp", "/bin/true"), Log: rt.Log},
+		runtimeDir:      dir,
+	}
+	c.LinuxContainer, err = lxc.NewContainer(c.ContainerID, filepath.Dir(dir))
+	require.NoError(t, err)
+	defer c.Release()
+
+	reads := 0
+	status := specs.StateCreated
+	defer func(f func(*Container) (*State, error)) { readState = f }(readState)
+	readState = func(c *Container) (*State, error) {
+		reads++
+		return &State{SpecState: specs.State{ID: c.ContainerID, Status: status}}, nil
+	}
+
+	for i := 0; i < 10; i++ {
+		state, err := c.State()
+		require.NoError(t, err)
+		require.Equal(t, specs.StateCreated, state.SpecState.Status)
+		// The cached state is not modified by the caller.
+		state.SpecState.Status = specs.StateStopped
+	}
+	require.Equal(t, 1, reads)
+
+	// A lifecycle transition invalidates the cached state.
+	status = specs.StateRunning
+	c.invalidateState()
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state.SpecState.Status)
+	require.Equal(t, 2, reads)
+
+	// The cached state expires.
+	status = specs.StateStopped
+	c.cachedAt = time.Now().Add(-stateCacheTTL)
+	state, err = c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateStopped, state.SpecState.Status)
+	require.Equal(t, 3, reads)
+}
+
+func TestStateTransitions(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreated, state.SpecState.Status)
+
+	// The state is not stale after start.
+	require.NoError(t, rt.Start(ctx, c))
+	state, err = c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state.SpecState.Status)
+
+	require.NoError(t, rt.Stop(ctx, c))
+	state, err = c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateStopped, state.SpecState.Status)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestExecStatus(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	// lxcri-test panics (exit status 2) because the file already exists.
+	proc := specki.NewSpecProcess("/lxcri-test")
+	proc.Env = []string{"SLEEP=0", "CREATE_FILE=/lxcri-test"}
+	pid, err := c.ExecDetached(proc, nil)
+	require.NoError(t, err)
+
+	_, err = c.ExecStatus(pid)
+	require.ErrorIs(t, err, ErrExecNotExited)
+
+	status, err := c.WaitExec(pid)
+	require.NoError(t, err)
+	require.Equal(t, 2, status)
+
+	status, err = c.ExecStatus(pid)
+	require.NoError(t, err)
+	require.Equal(t, 2, status)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestExecCPUAffinity(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	proc := specki.NewSpecProcess("/lxcri-test")
+	proc.Env = []string{"SLEEP=3"}
+	pid, err := c.ExecDetached(proc, &ExecOptions{CPUs: "0"})
+	require.NoError(t, err)
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^Cpus_allowed_list:\s+0$`, string(status))
+
+	_, err = c.WaitExec(pid)
+	require.NoError(t, err)
+
+	_, err = c.ExecDetached(proc, &ExecOptions{CPUs: "100000"})
+	require.Error(t, err)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestParseKillSequence(t *testing.T) {
+	seq, err := parseKillSequence("")
+	require.NoError(t, err)
+	require.Nil(t, seq)
+
+	seq, err = parseKillSequence("SIGTERM:10s, int:500ms,1")
+	require.NoError(t, err)
+	require.Equal(t, []killStep{
+		{signal: unix.SIGTERM, wait: time.Second * 10},
+		{signal: unix.SIGINT, wait: time.Millisecond * 500},
+		{signal: unix.SIGHUP},
+	}, seq)
+
+	for _, s := range []string{"SIGFOO", "TERM:", "TERM:10", "TERM:-1s", "0", ",TERM"} {
+		_, err := parseKillSequence(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRunKillSequence(t *testing.T) {
+	seq := []killStep{
+		{signal: unix.SIGTERM, wait: time.Millisecond * 200},
+		{signal: unix.SIGINT, wait: time.Millisecond * 300},
+	}
+
+	type sent struct {
+		signal unix.Signal
+		after  time.Duration
+	}
+	run := func(stopOn unix.Signal) []sent {
+		var signals []sent
+		var stopped bool
+		start := time.Now()
+		kill := func(ctx context.Context, sig unix.Signal) error {
+			signals = append(signals, sent{sig, time.Since(start)})
+			stopped = sig == stopOn
+			return nil
+		}
+		wait := func(ctx context.Context) error {
+			if stopped {
+				return nil
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		require.NoError(t, runKillSequence(context.Background(), seq, kill, wait))
+		return signals
+	}
+
+	// The container does not stop until it is killed with SIGKILL.
+	signals := run(unix.SIGKILL)
+	require.Len(t, signals, 3)
+	require.Equal(t, unix.SIGTERM, signals[0].signal)
+	require.Less(t, signals[0].after, time.Millisecond*100)
+	require.Equal(t, unix.SIGINT, signals[1].signal)
+	require.GreaterOrEqual(t, signals[1].after, time.Millisecond*200)
+	require.Equal(t, unix.SIGKILL, signals[2].signal)
+	require.GreaterOrEqual(t, signals[2].after, time.Millisecond*500)
+
+	// The sequence ends when the container stops.
+	signals = run(unix.SIGTERM)
+	require.Len(t, signals, 1)
+	require.Equal(t, unix.SIGTERM, signals[0].signal)
+
+	// The container is killed immediately without a sequence.
+	seq = nil
+	signals = run(unix.SIGKILL)
+	require.Len(t, signals, 1)
+	require.Equal(t, unix.SIGKILL, signals[0].signal)
+}
+
+func TestCreateConfig(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	mounts := len(cfg.Spec.Mounts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	// The runtime adds mounts e.g for lxcri-init.
+	require.Greater(t, len(c.Spec.Mounts), mounts)
+
+	createCfg, err := c.CreateConfig()
+	require.NoError(t, err)
+	require.Equal(t, c.ContainerID, createCfg.ContainerID)
+	require.Len(t, createCfg.Spec.Mounts, mounts)
+	require.Equal(t, c.Spec.Process.Args, createCfg.Spec.Process.Args)
+	require.Empty(t, createCfg.CgroupDir)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
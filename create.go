@@ -2,10 +2,13 @@ package lxcri
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/lxc/lxcri/pkg/specki"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -22,41 +25,92 @@ func (rt *Runtime) Create(ctx context.Context, cfg *ContainerConfig) (*Container
 		return nil, err
 	}
 
-	c := &Container{ContainerConfig: cfg}
+	slot, err := rt.acquireCreateSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if slot != nil {
+		defer slot.Close()
+	}
+
+	// The spec is modified by the runtime, so the original spec
+	// is saved to recreate the container (see Container.CreateConfig).
+	createSpec, err := json.Marshal(cfg.Spec)
+	if err != nil {
+		return nil, errorf("failed to serialize spec: %w", err)
+	}
+
+	for i, hook := range rt.SpecHooks {
+		if err := hook(cfg.Spec); err != nil {
+			return nil, errorf("spec hook #%d failed: %w", i, err)
+		}
+	}
+	// The spec hooks may have invalidated the spec.
+	if len(rt.SpecHooks) > 0 {
+		if err := rt.checkSpec(cfg.Spec); err != nil {
+			return nil, errorf("invalid spec after spec hooks: %w", err)
+		}
+	}
+
+	if err := rt.checkLibexecVersion(ctx, Version); err != nil {
+		return nil, errorf("incompatible runtime executables: %w", err)
+	}
+
+	c := &Container{
+		ContainerConfig:   cfg,
+		StateVersion:      StateVersion,
+		RuntimeVersion:    Version,
+		RuntimeLibexecDir: rt.LibexecDir,
+	}
 	c.runtimeDir = filepath.Join(rt.Root, c.ContainerID)
+	// The cgroup is populated when the container init process is created.
+	defer c.unlockCgroup()
 
 	if cfg.Spec.Annotations == nil {
 		cfg.Spec.Annotations = make(map[string]string)
 	}
 	cfg.Spec.Annotations["org.linuxcontainers.lxc.ConfigFile"] = c.RuntimePath("config")
 
-	if err := c.create(); err != nil {
+	// The container directory is created while the lock is held,
+	// so that concurrent creates can not exceed MaxContainers.
+	maxLock, err := rt.lockMaxContainers()
+	if err != nil {
+		return nil, err
+	}
+	err = c.create()
+	if maxLock != nil {
+		maxLock.Close()
+	}
+	if err != nil {
 		return c, errorf("failed to create container: %w", err)
 	}
 
+	if err := os.WriteFile(c.RuntimePath(CreateSpecFile), createSpec, 0444); err != nil {
+		return c, errorf("failed to write %s: %w", CreateSpecFile, err)
+	}
+
+	start := time.Now()
 	if err := configureContainer(rt, c); err != nil {
 		return c, errorf("failed to configure container: %w", err)
 	}
+	logPhase(rt.Log, "configure", start)
 
 	cleanenv(c, true)
 
 	// Serialize the modified spec.Spec separately, to make it available for
 	// runtime hooks.
 	specPath := c.RuntimePath(BundleConfigFile)
-	err := specki.EncodeJSONFile(specPath, cfg.Spec, os.O_EXCL|os.O_CREATE, 0444)
+	err = specki.EncodeJSONFile(specPath, cfg.Spec, os.O_EXCL|os.O_CREATE, 0444)
 	if err != nil {
 		return c, err
 	}
 
 	if rt.BackupConfigDir != "" {
-		err := os.MkdirAll(rt.BackupConfigDir, 0700)
-		if err != nil {
-			rt.Log.Warn().Err(err).Str("dir", rt.BackupConfigDir).Msg("failed to create backup dir")
+		if err := rt.backupSpec(cfg); err != nil {
+			return c, err
 		}
-		specPath := filepath.Join(rt.BackupConfigDir, cfg.ContainerID+".config.json")
-		err = specki.EncodeJSONFile(specPath, cfg.Spec, os.O_EXCL|os.O_CREATE, 0444)
-		if err != nil {
-			rt.Log.Warn().Err(err).Str("file", specPath).Msg("failed to backup spec")
+		if err := rt.pruneBackupConfig(time.Now()); err != nil {
+			rt.Log.Warn().Err(err).Str("dir", rt.BackupConfigDir).Msg("failed to prune backup dir")
 		}
 	}
 
@@ -73,26 +127,61 @@ func (rt *Runtime) Create(ctx context.Context, cfg *ContainerConfig) (*Container
 		return c, err
 	}
 
-	if err := rt.runStartCmd(ctx, c); err != nil {
+	start = time.Now()
+	err = rt.runStartCmd(ctx, c)
+	c.invalidateState()
+	if err != nil {
 		return c, errorf("failed to run container process: %w", err)
 	}
+	logPhase(rt.Log, "run", start)
 	return c, nil
 }
 
-func configureUserNamespace(rt *Runtime, c *Container) {
-	if rt.usernsConfigured {
-		namesp := c.Spec.Linux.Namespaces
-		for i, n := range namesp {
-			if n.Type == specs.UserNamespace {
-				rt.Log.Warn().Msg("Preconfigured user namespace is removed from the namespace list.")
-				c.Spec.Linux.Namespaces = append(namesp[0:i], namesp[i+1:]...)
+// createSlotPollInterval is the interval to check for a free create slot.
+var createSlotPollInterval = time.Millisecond * 50
+
+// acquireCreateSlot acquires one of the Runtime.MaxConcurrentCreates slots.
+// A slot is an exclusive lock on a slot file in the runtime root,
+// so the limit applies to all runtime processes with the same root.
+// The slot is released by closing the returned file.
+// No slot file is returned if the number of creates is not limited.
+func (rt *Runtime) acquireCreateSlot(ctx context.Context) (*os.File, error) {
+	if rt.MaxConcurrentCreates == 0 {
+		return nil, nil
+	}
+	start := time.Now()
+	for {
+		for i := uint(0); i < rt.MaxConcurrentCreates; i++ {
+			p := filepath.Join(rt.Root, fmt.Sprintf(".create-slot-%d.lock", i))
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+			if err != nil {
+				return nil, errorf("failed to open create slot file: %w", err)
+			}
+			err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+			if err == nil {
+				rt.Log.Debug().Uint("slot", i).Dur("waited", time.Since(start)).Msg("acquired create slot")
+				return f, nil
+			}
+			f.Close()
+			if err != unix.EWOULDBLOCK {
+				return nil, errorf("failed to lock create slot file %s: %w", p, err)
 			}
 		}
-		return
+		select {
+		case <-ctx.Done():
+			return nil, errorf("no create slot available (max %d concurrent creates): %w", rt.MaxConcurrentCreates, ctx.Err())
+		case <-time.After(createSlotPollInterval):
+		}
+	}
+}
+
+func configureUserNamespace(rt *Runtime, c *Container) error {
+	if rt.usernsConfigured {
+		return configureNestedUserNamespace(rt, c)
 	}
 
 	if isNamespaceEnabled(c.Spec, specs.UserNamespace) {
-		return
+		return nil
 	}
 
 	enableUserNamespace := false
@@ -123,6 +212,37 @@ func configureUserNamespace(rt *Runtime, c *Container) {
 		c.Spec.Linux.Namespaces = append(c.Spec.Linux.Namespaces,
 			specs.LinuxNamespace{Type: specs.UserNamespace})
 	}
+	return nil
+}
+
+// configureNestedUserNamespace translates the spec id mappings, which are relative
+// to the parent of the preconfigured runtime user namespace, into the runtime user namespace.
+// If the runtime user namespace already provides the mappings (e.g it was created
+// by buildah from the spec), the translated mappings are the identity
+// and the user namespace is removed from the namespace list.
+// Otherwise a nested user namespace with the translated mappings is created.
+func configureNestedUserNamespace(rt *Runtime, c *Container) error {
+	if !isNamespaceEnabled(c.Spec, specs.UserNamespace) {
+		return nil
+	}
+	uidMappings, err := cascadeIDMappings(c.Spec.Linux.UIDMappings, rt.uidMappings)
+	if err != nil {
+		return fmt.Errorf("failed to translate uid mappings: %w", err)
+	}
+	gidMappings, err := cascadeIDMappings(c.Spec.Linux.GIDMappings, rt.gidMappings)
+	if err != nil {
+		return fmt.Errorf("failed to translate gid mappings: %w", err)
+	}
+	c.Spec.Linux.UIDMappings = uidMappings
+	c.Spec.Linux.GIDMappings = gidMappings
+
+	if isIdentityIDMapping(uidMappings) && isIdentityIDMapping(gidMappings) {
+		rt.Log.Warn().Msg("Preconfigured user namespace is removed from the namespace list.")
+		removeNamespace(c.Spec, specs.UserNamespace)
+		return nil
+	}
+	rt.Log.Info().Msg("creating nested user namespace within the preconfigured user namespace")
+	return nil
 }
 
 func bindMountDevices(rt *Runtime, c *Container) {
@@ -169,9 +289,11 @@ func configureContainer(rt *Runtime, c *Container) error {
 		return err
 	}
 
+	start := time.Now()
 	if err := configureRootfs(rt, c); err != nil {
 		return fmt.Errorf("failed to configure rootfs: %w", err)
 	}
+	logPhase(rt.Log, "rootfs", start)
 
 	if err := os.MkdirAll(filepath.Join(c.Spec.Root.Path, "run"), 0755); err != nil {
 		return err
@@ -180,7 +302,9 @@ func configureContainer(rt *Runtime, c *Container) error {
 		return err
 	}
 
-	configureUserNamespace(rt, c)
+	if err := configureUserNamespace(rt, c); err != nil {
+		return err
+	}
 
 	/*
 		c.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
@@ -195,9 +319,11 @@ func configureContainer(rt *Runtime, c *Container) error {
 		return fmt.Errorf("failed to configure namespaces: %w", err)
 	}
 
+	start = time.Now()
 	if err := configureInit(rt, c); err != nil {
 		return fmt.Errorf("failed to configure init: %w", err)
 	}
+	logPhase(rt.Log, "init", start)
 
 	if c.Spec.Process.OOMScoreAdj != nil {
 		if err := c.setConfigItem("lxc.proc.oom_score_adj", fmt.Sprintf("%d", *c.Spec.Process.OOMScoreAdj)); err != nil {
@@ -211,35 +337,34 @@ func configureContainer(rt *Runtime, c *Container) error {
 		}
 	}
 
+	start = time.Now()
 	if rt.Features.Apparmor {
-		if err := configureApparmor(c); err != nil {
+		if err := configureApparmor(rt, c); err != nil {
 			return fmt.Errorf("failed to configure apparmor: %w", err)
 		}
 	} else {
+		if _, ok := c.Spec.Annotations[apparmorProfileFileAnnotation]; ok {
+			rt.Log.Warn().Msg("apparmor feature is disabled - profile file is not loaded")
+		}
 		rt.Log.Warn().Msg("apparmor feature is disabled - profile is set to unconfined")
 	}
 
 	if rt.Features.Seccomp {
-		if c.Spec.Linux.Seccomp != nil && len(c.Spec.Linux.Seccomp.Syscalls) > 0 {
-			profilePath := c.RuntimePath("seccomp.conf")
-			if err := writeSeccompProfile(profilePath, c.Spec.Linux.Seccomp); err != nil {
-				return err
-			}
-			if err := c.setConfigItem("lxc.seccomp.profile", profilePath); err != nil {
-				return err
-			}
+		if err := configureSeccomp(rt, c); err != nil {
+			return fmt.Errorf("failed to configure seccomp: %w", err)
 		}
 	} else {
 		rt.Log.Warn().Msg("seccomp feature is disabled - all system calls are allowed")
 	}
 
 	if rt.Features.Capabilities {
-		if err := configureCapabilities(c); err != nil {
+		if err := configureCapabilities(rt, c); err != nil {
 			return fmt.Errorf("failed to configure capabilities: %w", err)
 		}
 	} else {
 		rt.Log.Warn().Msg("capabilities feature is disabled - container inherits privileges of the runtime process")
 	}
+	logPhase(rt.Log, "security", start)
 
 	// make sure autodev is disabled
 	if err := c.setConfigItem("lxc.autodev", "0"); err != nil {
@@ -255,18 +380,20 @@ func configureContainer(rt *Runtime, c *Container) error {
 
 	bindMountDevices(rt, c)
 
+	start = time.Now()
 	if err := configureHooks(rt, c); err != nil {
 		return err
 	}
+	logPhase(rt.Log, "hooks", start)
 
+	start = time.Now()
 	if err := configureCgroup(rt, c); err != nil {
 		return fmt.Errorf("failed to configure cgroups: %w", err)
 	}
+	logPhase(rt.Log, "cgroup", start)
 
-	for key, val := range c.Spec.Linux.Sysctl {
-		if err := c.setConfigItem("lxc.sysctl."+key, val); err != nil {
-			return err
-		}
+	if err := configureSysctls(c); err != nil {
+		return err
 	}
 
 	// `man lxc.container.conf`: "A resource with no explicitly configured limitation will be inherited
@@ -286,6 +413,11 @@ func configureContainer(rt *Runtime, c *Container) error {
 		}
 	}
 
+	if addDevptsMount(c.Spec) {
+		c.Log.Info().Msg("added devpts mount on /dev/pts for terminal")
+	}
+
+	start = time.Now()
 	if err := configureMounts(rt, c); err != nil {
 		return fmt.Errorf("failed to configure mounts: %w", err)
 	}
@@ -293,6 +425,81 @@ func configureContainer(rt *Runtime, c *Container) error {
 	if err := configureReadonlyPaths(c); err != nil {
 		return fmt.Errorf("failed to configure read-only paths: %w", err)
 	}
+	logPhase(rt.Log, "mounts", start)
+
+	if err := checkReadonlyRootfs(c); err != nil {
+		return fmt.Errorf("read-only rootfs check failed: %w", err)
+	}
+
+	if err := configureRawConfigItems(c); err != nil {
+		return fmt.Errorf("failed to configure raw config items: %w", err)
+	}
+	return nil
+}
+
+// rawConfigItemAnnotationPrefix is the prefix of annotations
+// that set a raw liblxc config item, e.g
+// `org.linuxcontainers.lxcri.config.lxc.net.0.type=none`
+const rawConfigItemAnnotationPrefix = "org.linuxcontainers.lxcri.config."
+
+// deniedRawConfigItems are liblxc config item prefixes that can not be set
+// through annotations, because they are security relevant or managed by lxcri.
+var deniedRawConfigItems = []string{
+	"lxc.apparmor.",
+	"lxc.autodev",
+	"lxc.cap.",
+	"lxc.cgroup.",
+	"lxc.cgroup2.devices.",
+	"lxc.console.",
+	"lxc.ephemeral",
+	"lxc.hook.",
+	"lxc.idmap",
+	"lxc.include",
+	"lxc.init.",
+	"lxc.mount.",
+	"lxc.namespace.",
+	"lxc.no_new_privs",
+	"lxc.rootfs.",
+	"lxc.seccomp.",
+	"lxc.selinux.",
+}
+
+func isRawConfigItemAllowed(key string) bool {
+	if !strings.HasPrefix(key, "lxc.") {
+		return false
+	}
+	for _, prefix := range deniedRawConfigItems {
+		if strings.HasPrefix(key, prefix) || key == strings.TrimSuffix(prefix, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// configureRawConfigItems sets the raw liblxc config items defined by annotations.
+// It must be called after all other config items are set,
+// so the raw config items take precedence.
+func configureRawConfigItems(c *Container) error {
+	keys := make([]string, 0)
+	for a := range c.Spec.Annotations {
+		if strings.HasPrefix(a, rawConfigItemAnnotationPrefix) {
+			keys = append(keys, a)
+		}
+	}
+	// apply config items in a stable order
+	sort.Strings(keys)
+
+	for _, a := range keys {
+		key := strings.TrimPrefix(a, rawConfigItemAnnotationPrefix)
+		if !isRawConfigItemAllowed(key) {
+			return fmt.Errorf("config item %q is not allowed in annotation %q", key, a)
+		}
+		val := c.Spec.Annotations[a]
+		c.Log.Info().Str("annotation", a).Str(key, val).Msg("set raw config item")
+		if err := c.setConfigItem(key, val); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -331,8 +538,22 @@ func configureRootfs(rt *Runtime, c *Container) error {
 		rootfs = filepath.Join(c.BundlePath, rootfs)
 	}
 
-	if os.Getuid() != 0 {
-		if err := unix.Chmod(rootfs, 0777); err != nil {
+	// The rootfs may already be a mountpoint (e.g an image snapshot).
+	// liblxc bind mounts the rootfs, so the bind mount inherits
+	// the flags of the existing mount.
+	mountOpts, err := mountOptions(rootfs)
+	if err != nil {
+		return fmt.Errorf("failed to read mount options of rootfs %q: %w", rootfs, err)
+	}
+	isMountpoint := mountOpts != nil
+	if isMountpoint {
+		c.Log.Info().Str("rootfs", rootfs).Strs("options", mountOpts).Msg("rootfs is a mountpoint")
+	}
+
+	// The chmod is skipped for a mountpoint, because it changes
+	// the mode of the mounted filesystem root, not the mountpoint.
+	if os.Getuid() != 0 && !isMountpoint {
+		if err := chmodRootfs(c, rootfs); err != nil {
 			return err
 		}
 	}
@@ -341,6 +562,17 @@ func configureRootfs(rt *Runtime, c *Container) error {
 		return err
 	}
 
+	// This is only a warning, because the command lookup may fail
+	// for commands that are valid at runtime e.g if the command
+	// is on a filesystem that is mounted by a hook.
+	if err := checkProcessCommand(rootfs, c.Spec); err != nil {
+		c.Log.Warn().Err(err).Msg("container process command may not be executable")
+	}
+
+	if err := checkProcessCwd(rt, c, rootfs); err != nil {
+		return err
+	}
+
 	if err := c.setConfigItem("lxc.rootfs.mount", rootfs); err != nil {
 		return err
 	}
@@ -360,6 +592,11 @@ func configureRootfs(rt *Runtime, c *Container) error {
 	}
 	if c.Spec.Root.Readonly {
 		rootfsOptions = append(rootfsOptions, "ro")
+	} else if containsString(mountOpts, "ro") {
+		// Preserve the read-only flag of the existing mount,
+		// otherwise the rootfs bind mount is writable.
+		c.Log.Warn().Str("rootfs", rootfs).Msg("rootfs is a read-only mount - the container rootfs is read-only")
+		rootfsOptions = append(rootfsOptions, "ro")
 	}
 	if err := c.setConfigItem("lxc.rootfs.options", strings.Join(rootfsOptions, ",")); err != nil {
 		return err
@@ -367,6 +604,150 @@ func configureRootfs(rt *Runtime, c *Container) error {
 	return nil
 }
 
+// defaultPath is the PATH used to lookup the process command
+// if PATH is not set in the process environment.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// checkProcessCommand checks whether the process command spec.Process.Args[0]
+// is an executable file within the given rootfs.
+// A command without a slash is looked up in the PATH from spec.Process.Env.
+// A relative command path is relative to spec.Process.Cwd.
+// Commands that are provided by a mount from the spec can not be checked
+// and are assumed to be executable.
+func checkProcessCommand(rootfs string, spec *specs.Spec) error {
+	cmd := spec.Process.Args[0]
+
+	var candidates []string
+	switch {
+	case filepath.IsAbs(cmd):
+		candidates = []string{cmd}
+	case strings.Contains(cmd, "/"):
+		candidates = []string{filepath.Join(spec.Process.Cwd, cmd)}
+	default:
+		path, exist := specki.Getenv(spec.Process.Env, "PATH")
+		if !exist {
+			path = defaultPath
+		}
+		for _, dir := range filepath.SplitList(path) {
+			if filepath.IsAbs(dir) {
+				candidates = append(candidates, filepath.Join(dir, cmd))
+			}
+		}
+	}
+
+	for _, p := range candidates {
+		if isMountDestination(spec.Mounts, p) {
+			return nil
+		}
+		resolved, err := resolveMountDestination(rootfs, p)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			return fmt.Errorf("command %q (%s) is not an executable file", cmd, p)
+		}
+		return nil
+	}
+	return fmt.Errorf("command %q not found in rootfs %s (candidates %s)", cmd, rootfs, strings.Join(candidates, ":"))
+}
+
+const createCwdAnnotation = "org.linuxcontainers.lxcri.cwd.create"
+
+// checkProcessCwd checks that the process working directory spec.Process.Cwd
+// is a directory within the given rootfs, instead of failing later on with
+// a chdir error in lxcri-init.
+// A missing working directory is created (like runc does) if enabled by
+// Runtime.CreateCwd or the cwd create annotation (which takes precedence).
+// A working directory that is provided by a mount from the spec can not be checked.
+func checkProcessCwd(rt *Runtime, c *Container, rootfs string) error {
+	cwd := filepath.Join("/", c.Spec.Process.Cwd)
+	if isMountDestination(c.Spec.Mounts, cwd) {
+		return nil
+	}
+
+	create := rt.CreateCwd
+	if val, ok := c.Spec.Annotations[createCwdAnnotation]; ok {
+		create = val == "true"
+	}
+
+	p, err := resolveMountDestination(rootfs, cwd)
+	if err == nil {
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("failed to stat process cwd %q: %w", cwd, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("process cwd %q is not a directory", cwd)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to resolve process cwd %q: %w", cwd, err)
+	}
+	if !create {
+		return fmt.Errorf("process cwd %q does not exist in rootfs %s (set annotation %s=true to create it)", cwd, rootfs, createCwdAnnotation)
+	}
+
+	c.Log.Info().Str("cwd", cwd).Msg("creating process cwd")
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return fmt.Errorf("failed to create process cwd %q: %w", cwd, err)
+	}
+	// The working directory is owned by the process user (like in runc).
+	// The rootless runtime can not change the owner.
+	if os.Getuid() == 0 {
+		uid := specki.UnmapContainerID(c.Spec.Process.User.UID, c.Spec.Linux.UIDMappings)
+		gid := specki.UnmapContainerID(c.Spec.Process.User.GID, c.Spec.Linux.GIDMappings)
+		if err := os.Chown(p, int(uid), int(gid)); err != nil {
+			return fmt.Errorf("failed to chown process cwd %q: %w", cwd, err)
+		}
+	}
+	return nil
+}
+
+// isMountDestination returns true if the given path is
+// the destination of a mount or a path below a mount destination.
+func isMountDestination(mounts []specs.Mount, p string) bool {
+	for _, ms := range mounts {
+		dst := filepath.Join("/", ms.Destination)
+		if p == dst || strings.HasPrefix(p, dst+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+const rootfsChmodAnnotation = "org.linuxcontainers.lxcri.rootfs.chmod"
+
+// chmodRootfs makes the rootfs accessible for the container root user
+// if the runtime is not running as root.
+// The chmod is skipped if the rootfs is already owned by the (mapped) container root user,
+// or if it is disabled by the rootfs chmod annotation, e.g because the
+// rootfs is a mount (e.g overlay) on a different filesystem where the
+// chmod is denied or breaks the mount.
+func chmodRootfs(c *Container, rootfs string) error {
+	if c.Spec.Annotations[rootfsChmodAnnotation] == "false" {
+		c.Log.Info().Str("rootfs", rootfs).Msgf("rootfs chmod disabled by annotation %s", rootfsChmodAnnotation)
+		return nil
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(rootfs, &st); err != nil {
+		return fmt.Errorf("failed to stat rootfs %q: %w", rootfs, err)
+	}
+	rootUID := specki.UnmapContainerID(0, c.Spec.Linux.UIDMappings)
+	if st.Uid == rootUID {
+		c.Log.Info().Str("rootfs", rootfs).Uint32("uid", st.Uid).Msg("rootfs is owned by the container root user - skipping chmod")
+		return nil
+	}
+
+	c.Log.Info().Str("rootfs", rootfs).Uint32("uid", st.Uid).Uint32("root-uid", rootUID).Msg("rootfs is not owned by the container root user - chmod 0777")
+	return unix.Chmod(rootfs, 0777)
+}
+
 func configureReadonlyPaths(c *Container) error {
 	rootmnt := c.getConfigItem("lxc.rootfs.mount")
 	if rootmnt == "" {
@@ -381,12 +762,80 @@ func configureReadonlyPaths(c *Container) error {
 	return nil
 }
 
-func configureApparmor(c *Container) error {
+// checkReadonlyRootfs checks the configuration of a read-only rootfs (spec.Root.Readonly).
+// liblxc mounts the rootfs read-only before the mount entries are processed,
+// so it can not create missing mount destinations (create=dir|file) within the rootfs.
+// All mount destinations must have been created by createMountDestination.
+func checkReadonlyRootfs(c *Container) error {
+	if !c.Spec.Root.Readonly {
+		return nil
+	}
+	opts := strings.Split(c.getConfigItem("lxc.rootfs.options"), ",")
+	if !containsString(opts, "ro") {
+		return fmt.Errorf("lxc.rootfs.options %q lacks the 'ro' option", c.getConfigItem("lxc.rootfs.options"))
+	}
+	for _, ms := range c.Spec.Mounts {
+		// The destination of an optional bind mount without source is not created.
+		if containsString(ms.Options, "optional") {
+			continue
+		}
+		dst, err := resolveMountDestination(c.Spec.Root.Path, ms.Destination)
+		if err != nil {
+			return fmt.Errorf("mount destination %s does not exist in read-only rootfs: %w", ms.Destination, err)
+		}
+		if _, err := os.Lstat(dst); err != nil {
+			return fmt.Errorf("mount destination %s does not exist in read-only rootfs: %w", ms.Destination, err)
+		}
+	}
+	c.Log.Debug().Msg("all mount destinations exist in read-only rootfs")
+	return nil
+}
+
+// checkRootfsReadonlyMounted logs an error if the rootfs of a container with
+// spec.Root.Readonly is writable. The per-mount options of the container root mount
+// are read from the mountinfo of the container init process.
+func checkRootfsReadonlyMounted(c *Container) {
+	if !c.Spec.Root.Readonly {
+		return
+	}
+	// c.Pid is the container monitor process, which runs in the host mount namespace.
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mountinfo", c.LinuxContainer.InitPid()))
+	if err != nil {
+		c.Log.Warn().Err(err).Msg("failed to verify read-only rootfs")
+		return
+	}
+	defer f.Close()
+	opts, err := parseMountInfo(f, "/")
+	if err != nil {
+		c.Log.Warn().Err(err).Msg("failed to verify read-only rootfs")
+		return
+	}
+	if !containsString(opts, "ro") {
+		c.Log.Error().Strs("options", opts).Msg("rootfs is writable although spec.Root.Readonly is set")
+		return
+	}
+	c.Log.Debug().Msg("rootfs is mounted read-only")
+}
+
+func configureApparmor(rt *Runtime, c *Container) error {
 	// The value *apparmor_profile*  from crio.conf is used if no profile is defined by the container.
 	aaprofile := c.Spec.Process.ApparmorProfile
+	if name, ok := c.Spec.Annotations[apparmorProfileFileAnnotation]; ok {
+		p, err := rt.loadApparmorProfile(c, name)
+		if err != nil {
+			return err
+		}
+		aaprofile = p
+	}
 	if aaprofile == "" {
 		aaprofile = "unconfined"
 	}
+	_, hasProfileFile := c.Spec.Annotations[apparmorProfileFileAnnotation]
+	if rt.GenerateApparmorProfiles && !hasProfileFile && aaprofile != "unconfined" {
+		if err := rt.generateApparmorProfile(c, aaprofile); err != nil {
+			return err
+		}
+	}
 	return c.setConfigItem("lxc.apparmor.profile", aaprofile)
 }
 
@@ -394,28 +843,62 @@ func configureApparmor(c *Container) error {
 // See `man lxc.container.conf` lxc.cap.drop and lxc.cap.keep for details.
 // https://blog.container-solutions.com/linux-capabilities-in-practice
 // https://blog.container-solutions.com/linux-capabilities-why-they-exist-and-how-they-work
-func configureCapabilities(c *Container) error {
-	keepCaps := "none"
-	if c.Spec.Process.Capabilities != nil {
-		var caps []string
-		for _, c := range c.Spec.Process.Capabilities.Permitted {
-			lcCapName := strings.TrimPrefix(strings.ToLower(c), "cap_")
-			caps = append(caps, lcCapName)
+func configureCapabilities(rt *Runtime, c *Container) error {
+	keepCaps, ok := capabilitiesKeep(rt, c)
+	if !ok {
+		c.Log.Info().Msg("capabilities are unset - container keeps all capabilities")
+		return nil
+	}
+	return c.setConfigItem("lxc.cap.keep", keepCaps)
+}
+
+const keepAllCapabilitiesAnnotation = "org.linuxcontainers.lxcri.capabilities.keep-all"
+
+// capabilitiesKeep returns the lxc.cap.keep value for the permitted capabilities.
+// If the capabilities are unset (spec.Process.Capabilities is nil), all capabilities
+// are dropped, unless Runtime.KeepAllCapabilitiesIfUnset or the keep-all annotation
+// (which takes precedence) is set. Then false is returned and lxc.cap.keep must not be set.
+func capabilitiesKeep(rt *Runtime, c *Container) (string, bool) {
+	if c.Spec.Process.Capabilities == nil {
+		keepAll := rt.KeepAllCapabilitiesIfUnset
+		if val, ok := c.Spec.Annotations[keepAllCapabilitiesAnnotation]; ok {
+			keepAll = val == "true"
 		}
-		if len(caps) > 0 {
-			keepCaps = strings.Join(caps, " ")
+		if keepAll {
+			return "", false
 		}
+		return "none", true
 	}
 
-	return c.setConfigItem("lxc.cap.keep", keepCaps)
+	var caps []string
+	for _, c := range c.Spec.Process.Capabilities.Permitted {
+		lcCapName := strings.TrimPrefix(strings.ToLower(c), "cap_")
+		caps = append(caps, lcCapName)
+	}
+	if len(caps) == 0 {
+		return "none", true
+	}
+	return strings.Join(caps, " "), true
 }
 
 // NOTE keep in sync with cmd/lxcri-hook#ociHooksAndState
+const builtinHookAnnotation = "org.linuxcontainers.lxcri.hook-builtin"
+
 func configureHooks(rt *Runtime, c *Container) error {
 
 	//  prepend runtime OCI hooks to container hooks
 	hooks := rt.Hooks
 
+	if c.Spec.Annotations[builtinHookAnnotation] == "false" {
+		hooks.CreateContainer = withoutHook(hooks.CreateContainer, rt.libexec(ExecHookBuiltin))
+		c.Log.Info().Msgf("builtin hook %s disabled by annotation %s", ExecHookBuiltin, builtinHookAnnotation)
+		// The builtin hook creates the devices and masks the paths from the spec.
+		if len(c.Spec.Linux.Devices) > 0 || len(c.Spec.Linux.MaskedPaths) > 0 {
+			c.Log.Warn().Int("devices", len(c.Spec.Linux.Devices)).Int("masked-paths", len(c.Spec.Linux.MaskedPaths)).
+				Msg("builtin hook is disabled - devices and masked paths from the spec must be setup by the container")
+		}
+	}
+
 	if c.Spec.Hooks != nil {
 		if len(c.Spec.Hooks.Prestart) > 0 {
 			hooks.Prestart = append(hooks.Prestart, c.Spec.Hooks.Prestart...)
@@ -437,6 +920,16 @@ func configureHooks(rt *Runtime, c *Container) error {
 		}
 	}
 
+	if env := hookAnnotationEnv(c.Spec.Annotations, rt.HookAnnotations); len(env) > 0 {
+		c.Log.Debug().Strs("env", env).Msg("pass annotations to hooks")
+		hooks.Prestart = withHookEnv(hooks.Prestart, env)
+		hooks.CreateRuntime = withHookEnv(hooks.CreateRuntime, env)
+		hooks.CreateContainer = withHookEnv(hooks.CreateContainer, env)
+		hooks.StartContainer = withHookEnv(hooks.StartContainer, env)
+		hooks.Poststart = withHookEnv(hooks.Poststart, env)
+		hooks.Poststop = withHookEnv(hooks.Poststop, env)
+	}
+
 	c.Spec.Hooks = &hooks
 
 	// pass context information as environment variables to hook scripts
@@ -444,6 +937,9 @@ func configureHooks(rt *Runtime, c *Container) error {
 		return err
 	}
 
+	// OCI hooks are mapped to liblxc hooks (see cmd/lxcri-hook#ociHooksAndState):
+	// Prestart and CreateRuntime (in this order) -> lxc.hook.pre-mount
+	// CreateContainer -> lxc.hook.mount
 	if len(c.Spec.Hooks.Prestart) > 0 || len(c.Spec.Hooks.CreateRuntime) > 0 {
 		if err := c.setConfigItem("lxc.hook.pre-mount", rt.libexec(ExecHook)); err != nil {
 			return err
@@ -462,6 +958,95 @@ func configureHooks(rt *Runtime, c *Container) error {
 	return nil
 }
 
+// withoutHook returns a copy of hooks without the hooks with the given path.
+func withoutHook(hooks []specs.Hook, path string) []specs.Hook {
+	filtered := make([]specs.Hook, 0, len(hooks))
+	for _, h := range hooks {
+		if h.Path != path {
+			filtered = append(filtered, h)
+		}
+	}
+	return filtered
+}
+
+// hookAnnotationEnvPrefix is the prefix of the hook environment variables
+// for the annotations selected by Runtime.HookAnnotations.
+const hookAnnotationEnvPrefix = "LXCRI_ANNOTATION_"
+
+// hookAnnotationEnv returns the environment variables (sorted by name)
+// for the annotations that match the comma separated list of annotation keys.
+// A key with the suffix '*' matches all annotations with the key prefix.
+// The variable name is the annotation key in upper case, with all characters
+// except letters and digits replaced by '_' and prefixed with hookAnnotationEnvPrefix.
+// If multiple keys map to the same variable name, the value of the first key (in sorted order) is used.
+// e.g the annotation `io.kubernetes.cri-o.CNI` is passed as `LXCRI_ANNOTATION_IO_KUBERNETES_CRI_O_CNI`.
+func hookAnnotationEnv(annotations map[string]string, keys string) []string {
+	if keys == "" || len(annotations) == 0 {
+		return nil
+	}
+	matched := make(map[string]bool)
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		prefix := strings.TrimSuffix(key, "*")
+		for k := range annotations {
+			if k == key || (prefix != key && strings.HasPrefix(k, prefix)) {
+				matched[k] = true
+			}
+		}
+	}
+	matchedKeys := make([]string, 0, len(matched))
+	for k := range matched {
+		matchedKeys = append(matchedKeys, k)
+	}
+	sort.Strings(matchedKeys)
+	env := make([]string, 0, len(matchedKeys))
+	for _, k := range matchedKeys {
+		// Keys that only differ in non-alphanumeric characters (e.g 'a.b' and 'a_b')
+		// map to the same variable name. The first key (in sorted order) wins.
+		name := hookAnnotationEnvName(k)
+		if _, exist := specki.Getenv(env, name); !exist {
+			env = append(env, name+"="+annotations[k])
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+func hookAnnotationEnvName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+	return hookAnnotationEnvPrefix + strings.ToUpper(name)
+}
+
+// withHookEnv returns a copy of hooks with env appended to the environment of each hook.
+// Variables that are already defined in the hook environment are not overwritten.
+// A hook without environment (nil Env) only gets the variables from env.
+func withHookEnv(hooks []specs.Hook, env []string) []specs.Hook {
+	if len(hooks) == 0 {
+		return hooks
+	}
+	hooksEnv := make([]specs.Hook, 0, len(hooks))
+	for _, h := range hooks {
+		hookEnv := make([]string, len(h.Env), len(h.Env)+len(env))
+		copy(hookEnv, h.Env)
+		for _, kv := range env {
+			if _, exist := specki.Getenv(h.Env, specki.EnvKey(kv)); !exist {
+				hookEnv = append(hookEnv, kv)
+			}
+		}
+		h.Env = hookEnv
+		hooksEnv = append(hooksEnv, h)
+	}
+	return hooksEnv
+}
+
 // cleanenv removes duplicates from spec.Process.Env.
 // If overwrite is false the first defined value takes precedence,
 // if overwrite is true, the last defined value overwrites previously
@@ -476,8 +1061,7 @@ func cleanenv(c *Container, overwrite bool) {
 	for _, kv := range env {
 		newEnv, exist = specki.Setenv(newEnv, kv, overwrite)
 		if exist {
-			vals := strings.Split(kv, "=")
-			c.Log.Warn().Msgf("duplicate environment variable %s (overwrite=%t)", vals[0], overwrite)
+			c.Log.Warn().Msgf("duplicate environment variable %s (overwrite=%t)", specki.EnvKey(kv), overwrite)
 		}
 	}
 	c.Spec.Process.Env = newEnv
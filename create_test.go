@@ -0,0 +1,838 @@
+package lxcri
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxc/go-lxc"
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRawConfigItemAllowed(t *testing.T) {
+	require.True(t, isRawConfigItemAllowed("lxc.net.0.type"))
+	require.True(t, isRawConfigItemAllowed("lxc.uts.name"))
+	require.True(t, isRawConfigItemAllowed("lxc.cgroup2.memory.high"))
+
+	require.False(t, isRawConfigItemAllowed("net.0.type"))
+	require.False(t, isRawConfigItemAllowed("lxc.apparmor.profile"))
+	require.False(t, isRawConfigItemAllowed("lxc.cap.keep"))
+	require.False(t, isRawConfigItemAllowed("lxc.idmap"))
+	require.False(t, isRawConfigItemAllowed("lxc.no_new_privs"))
+	require.False(t, isRawConfigItemAllowed("lxc.seccomp.profile"))
+	require.False(t, isRawConfigItemAllowed("lxc.cgroup2.devices.allow"))
+}
+
+func TestRawConfigItemAnnotation(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Annotations = map[string]string{
+		rawConfigItemAnnotationPrefix + "lxc.uts.name": "lxcri-raw-config",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	require.Equal(t, "lxcri-raw-config", c.getConfigItem("lxc.uts.name"))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestRawConfigItemAnnotationDenied(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Annotations = map[string]string{
+		rawConfigItemAnnotationPrefix + "lxc.apparmor.profile": "unconfined",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.Error(t, err)
+	t.Logf("expected create error: %s", err)
+	require.NotNil(t, c)
+
+	err = c.Release()
+	require.NoError(t, err)
+	err = rt.Delete(ctx, c.ContainerID, true)
+	require.NoError(t, err)
+}
+
+func TestSpecHooks(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	setRootlessIDMappings(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtHook := *rt
+	rtHook.SpecHooks = []func(*specs.Spec) error{
+		func(spec *specs.Spec) error {
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: "/hooked", Source: "tmpfs", Type: "tmpfs",
+				Options: []string{"rw", "nosuid", "nodev"},
+			})
+			return nil
+		},
+	}
+
+	c, err := rtHook.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	found := false
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.Contains(entry, "/hooked") {
+			found = true
+		}
+	}
+	require.True(t, found, "mount added by spec hook is missing")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestSpecHooksError(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	rtHook := *rt
+	rtHook.SpecHooks = []func(*specs.Spec) error{
+		func(spec *specs.Spec) error {
+			return fmt.Errorf("rejected by hook")
+		},
+	}
+
+	c, err := rtHook.Create(context.Background(), cfg)
+	require.Error(t, err)
+	require.Nil(t, c)
+}
+
+func TestSpecHooksInvalidSpec(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	rtHook := *rt
+	rtHook.SpecHooks = []func(*specs.Spec) error{
+		func(spec *specs.Spec) error {
+			spec.Process = nil
+			return nil
+		},
+	}
+
+	c, err := rtHook.Create(context.Background(), cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid spec after spec hooks")
+	require.Nil(t, c)
+}
+
+func TestChmodRootfs(t *testing.T) {
+	rootfs, err := os.MkdirTemp("", "lxcri-test-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	c := &Container{ContainerConfig: &ContainerConfig{
+		Spec: specki.NewSpec(rootfs, "/bin/true"),
+		Log:  rt.Log,
+	}}
+
+	stat := func() os.FileMode {
+		info, err := os.Stat(rootfs)
+		require.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	// The rootfs is already owned by the mapped container root user.
+	c.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: uint32(os.Getuid()), Size: 1},
+	}
+	require.NoError(t, chmodRootfs(c, rootfs))
+	require.Equal(t, os.FileMode(0700), stat())
+
+	// The rootfs is not owned by the mapped container root user.
+	c.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: uint32(os.Getuid()) + 20000, Size: 1},
+	}
+	c.Spec.Annotations = map[string]string{rootfsChmodAnnotation: "false"}
+	require.NoError(t, chmodRootfs(c, rootfs))
+	require.Equal(t, os.FileMode(0700), stat())
+
+	c.Spec.Annotations = nil
+	require.NoError(t, chmodRootfs(c, rootfs))
+	require.Equal(t, os.FileMode(0777), stat())
+}
+
+func TestBuiltinHookDisabled(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	setRootlessIDMappings(cfg)
+	cfg.Spec.Annotations = map[string]string{builtinHookAnnotation: "false"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	for _, h := range c.Spec.Hooks.CreateContainer {
+		require.NotEqual(t, rt.libexec(ExecHookBuiltin), h.Path)
+	}
+	require.Empty(t, c.getConfigItem("lxc.hook.mount"))
+
+	// the runtime hooks are not modified
+	require.Equal(t, rt.libexec(ExecHookBuiltin), rt.Hooks.CreateContainer[0].Path)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestWithoutHook(t *testing.T) {
+	hooks := []specs.Hook{{Path: "/a"}, {Path: "/b"}, {Path: "/a"}}
+	filtered := withoutHook(hooks, "/a")
+	require.Equal(t, []specs.Hook{{Path: "/b"}}, filtered)
+	require.Len(t, hooks, 3)
+}
+
+func TestCheckProcessCommand(t *testing.T) {
+	rootfs, err := os.MkdirTemp("", "lxcri-test-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "usr/bin"), 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(rootfs, "bin")))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "usr/bin/sh"), nil, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "usr/bin/noexec"), nil, 0644))
+
+	check := func(cmd string, env ...string) error {
+		spec := specki.NewSpec(rootfs, cmd)
+		spec.Process.Env = env
+		return checkProcessCommand(rootfs, spec)
+	}
+
+	require.NoError(t, check("/bin/sh"))
+	require.NoError(t, check("sh"))
+	require.NoError(t, check("sh", "PATH=/usr/bin"))
+	require.Error(t, check("sh", "PATH=/sbin"))
+	require.Error(t, check("/bin/missing"))
+	require.Error(t, check("missing"))
+	require.Error(t, check("/usr/bin/noexec"))
+	require.Error(t, check("/usr/bin"))
+
+	// relative to cwd
+	spec := specki.NewSpec(rootfs, "./sh")
+	spec.Process.Cwd = "/usr/bin"
+	require.NoError(t, checkProcessCommand(rootfs, spec))
+
+	// command provided by a mount
+	spec = specki.NewSpec(rootfs, "/lxcri-test")
+	require.Error(t, checkProcessCommand(rootfs, spec))
+	spec.Mounts = append(spec.Mounts, specki.BindMount("/usr/bin/true", "/lxcri-test"))
+	require.NoError(t, checkProcessCommand(rootfs, spec))
+}
+
+func TestCheckProcessCwd(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "usr/src"), 0755))
+	require.NoError(t, os.Symlink("usr/src", filepath.Join(rootfs, "src")))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "file"), nil, 0644))
+
+	rtCwd := *rt
+	c := &Container{ContainerConfig: &ContainerConfig{
+		Spec: specki.NewSpec(rootfs, "/bin/true"),
+		Log:  rt.Log,
+	}}
+	check := func(cwd string) error {
+		c.Spec.Process.Cwd = cwd
+		return checkProcessCwd(&rtCwd, c, rootfs)
+	}
+
+	require.NoError(t, check("/"))
+	require.NoError(t, check("/usr/src"))
+	require.NoError(t, check("/src"))
+	require.Error(t, check("/file"))
+
+	// provided by a mount
+	c.Spec.Mounts = append(c.Spec.Mounts, specki.BindMount("/tmp", "/data"))
+	require.NoError(t, check("/data/work"))
+	c.Spec.Mounts = nil
+
+	// missing cwd is not created by default
+	require.Error(t, check("/src/missing"))
+	_, err := os.Stat(filepath.Join(rootfs, "usr/src/missing"))
+	require.True(t, os.IsNotExist(err))
+
+	rtCwd.CreateCwd = true
+	require.NoError(t, check("/src/missing"))
+	info, err := os.Stat(filepath.Join(rootfs, "usr/src/missing"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	// annotation overrides the runtime setting
+	c.Spec.Annotations = map[string]string{createCwdAnnotation: "false"}
+	require.Error(t, check("/work"))
+
+	rtCwd.CreateCwd = false
+	c.Spec.Annotations[createCwdAnnotation] = "true"
+	require.NoError(t, check("/work"))
+	require.DirExists(t, filepath.Join(rootfs, "work"))
+}
+
+func TestHookOrder(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	marker := filepath.Join(t.TempDir(), "hooks")
+	hook := func(name string) specs.Hook {
+		return specs.Hook{Path: "/bin/sh", Args: []string{"sh", "-c", "echo " + name + " >> " + marker}}
+	}
+	cfg.Spec.Hooks = &specs.Hooks{
+		// The order of the hook types is reversed
+		// to ensure that the execution order does not depend on it.
+		CreateContainer: []specs.Hook{hook("createContainer")},
+		CreateRuntime:   []specs.Hook{hook("createRuntime1"), hook("createRuntime2")},
+		Prestart:        []specs.Hook{hook("prestart1"), hook("prestart2")},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	require.Equal(t, "prestart1\nprestart2\ncreateRuntime1\ncreateRuntime2\ncreateContainer\n", string(data))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestCreateRuntimeHookFailure(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Hooks = &specs.Hooks{
+		CreateRuntime: []specs.Hook{{Path: "/bin/false"}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.Error(t, err)
+	if c != nil {
+		require.NoError(t, c.Delete(ctx, true))
+	}
+}
+
+func TestNewRootlessSpec(t *testing.T) {
+	uidMappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	gidMappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	spec := specki.NewRootlessSpec("/tmp/rootfs", []string{"/bin/sleep", "10"}, uidMappings, gidMappings)
+
+	require.NoError(t, rt.checkSpec(spec))
+
+	require.Equal(t, []string{"/bin/sleep", "10"}, spec.Process.Args)
+	require.True(t, isNamespaceEnabled(spec, specs.UserNamespace))
+	require.Equal(t, uidMappings, spec.Linux.UIDMappings)
+	require.Equal(t, gidMappings, spec.Linux.GIDMappings)
+
+	var destinations []string
+	for _, m := range spec.Mounts {
+		destinations = append(destinations, m.Destination)
+	}
+	require.Equal(t, []string{"/proc", "/dev", "/sys", "/dev/pts", "/dev/shm"}, destinations)
+
+	// NewSpec must not be modified by NewRootlessSpec
+	require.False(t, isNamespaceEnabled(specki.NewSpec("/tmp/rootfs", "/bin/true"), specs.UserNamespace))
+
+	spec = specki.NewRootlessSpec("/tmp/rootfs", nil, uidMappings, gidMappings)
+	require.Error(t, rt.checkSpec(spec))
+}
+
+func TestCheckSpecVersion(t *testing.T) {
+	spec := specki.NewSpec("/tmp/rootfs", "/bin/true")
+	spec.Version = "2.0.0"
+
+	rtStrict := *rt
+	rtStrict.StrictSpecVersion = false
+	require.NoError(t, rtStrict.checkSpec(spec))
+
+	rtStrict.StrictSpecVersion = true
+	err := rtStrict.checkSpec(spec)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, specki.ErrUnsupportedSpecVersion))
+}
+
+func TestCheckSharedNamespaces(t *testing.T) {
+	var buf bytes.Buffer
+	rtShared := *rt
+	rtShared.Log = zerolog.New(&buf)
+
+	spec := specki.NewSpec("/tmp/rootfs", "/bin/true")
+	specki.SetNamespace(spec, specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: "/proc/self/ns/net"})
+
+	require.NoError(t, rtShared.checkSpec(spec))
+	require.Contains(t, buf.String(), "container shares the network namespace with the runtime")
+	require.Contains(t, buf.String(), `"path":"/proc/self/ns/net"`)
+
+	rtShared.StrictSharedNamespaces = true
+	require.Error(t, rtShared.checkSpec(spec))
+
+	// A namespace that is not defined in the spec is not checked.
+	buf.Reset()
+	spec = specki.NewSpec("/tmp/rootfs", "/bin/true")
+	removeNamespace(spec, specs.NetworkNamespace)
+	require.NoError(t, rtShared.checkSpec(spec))
+	require.NotContains(t, buf.String(), "network namespace")
+}
+
+func TestConfigureNestedUserNamespace(t *testing.T) {
+	rtNested := *rt
+	rtNested.Log = zerolog.Nop()
+	rtNested.usernsConfigured = true
+	rtNested.uidMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	rtNested.gidMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}
+
+	newContainer := func(uidHost, gidHost uint32) *Container {
+		spec := specki.NewSpec("/tmp/rootfs", "/bin/true")
+		specki.SetNamespace(spec, specs.LinuxNamespace{Type: specs.UserNamespace})
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: uidHost, Size: 1000}}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: gidHost, Size: 1000}}
+		return &Container{ContainerConfig: &ContainerConfig{Spec: spec}}
+	}
+
+	// The runtime user namespace provides the spec mappings.
+	c := newContainer(100000, 200000)
+	require.NoError(t, configureUserNamespace(&rtNested, c))
+	require.False(t, isNamespaceEnabled(c.Spec, specs.UserNamespace))
+
+	// The nested user namespace maps a subrange of the runtime user namespace.
+	c = newContainer(110000, 210000)
+	require.NoError(t, configureUserNamespace(&rtNested, c))
+	require.True(t, isNamespaceEnabled(c.Spec, specs.UserNamespace))
+	require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 10000, Size: 1000}}, c.Spec.Linux.UIDMappings)
+	require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 10000, Size: 1000}}, c.Spec.Linux.GIDMappings)
+
+	// The spec maps ids that are not mapped into the runtime user namespace.
+	c = newContainer(1000, 210000)
+	require.Error(t, configureUserNamespace(&rtNested, c))
+}
+
+func TestCapabilitiesKeep(t *testing.T) {
+	rtCaps := *rt
+	c := &Container{ContainerConfig: &ContainerConfig{
+		Spec: specki.NewSpec("/rootfs", "/bin/true"),
+		Log:  rt.Log,
+	}}
+
+	// drop all capabilities by default
+	keep, ok := capabilitiesKeep(&rtCaps, c)
+	require.True(t, ok)
+	require.Equal(t, "none", keep)
+
+	rtCaps.KeepAllCapabilitiesIfUnset = true
+	_, ok = capabilitiesKeep(&rtCaps, c)
+	require.False(t, ok)
+
+	// annotation overrides the runtime setting
+	c.Spec.Annotations = map[string]string{keepAllCapabilitiesAnnotation: "false"}
+	keep, ok = capabilitiesKeep(&rtCaps, c)
+	require.True(t, ok)
+	require.Equal(t, "none", keep)
+
+	rtCaps.KeepAllCapabilitiesIfUnset = false
+	c.Spec.Annotations[keepAllCapabilitiesAnnotation] = "true"
+	_, ok = capabilitiesKeep(&rtCaps, c)
+	require.False(t, ok)
+
+	// the setting does not apply to containers with capabilities
+	c.Spec.Process.Capabilities = &specs.LinuxCapabilities{}
+	keep, ok = capabilitiesKeep(&rtCaps, c)
+	require.True(t, ok)
+	require.Equal(t, "none", keep)
+
+	c.Spec.Process.Capabilities.Permitted = []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"}
+	keep, ok = capabilitiesKeep(&rtCaps, c)
+	require.True(t, ok)
+	require.Equal(t, "chown net_bind_service", keep)
+}
+
+func TestCleanenv(t *testing.T) {
+	c := &Container{ContainerConfig: &ContainerConfig{Spec: &specs.Spec{Process: &specs.Process{}}}}
+	env := []string{"PATH=/bin", "OPTS=-Dfoo=bar", "HOME=/root", "OPTS=-Dfoo=baz", "PATH=/usr/bin"}
+
+	c.Spec.Process.Env = append([]string{}, env...)
+	cleanenv(c, true)
+	require.Equal(t, []string{"PATH=/usr/bin", "OPTS=-Dfoo=baz", "HOME=/root"}, c.Spec.Process.Env)
+
+	c.Spec.Process.Env = append([]string{}, env...)
+	cleanenv(c, false)
+	require.Equal(t, []string{"PATH=/bin", "OPTS=-Dfoo=bar", "HOME=/root"}, c.Spec.Process.Env)
+}
+
+func TestAcquireCreateSlot(t *testing.T) {
+	root, err := os.MkdirTemp("", "lxcri-test-create-slot")
+	require.NoError(t, err)
+	defer removeAll(t, root)
+
+	rtX := *rt
+	rtX.Root = root
+	rtX.MaxConcurrentCreates = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	s1, err := rtX.acquireCreateSlot(ctx)
+	require.NoError(t, err)
+	s2, err := rtX.acquireCreateSlot(ctx)
+	require.NoError(t, err)
+
+	// All slots are in use, so the create waits until the context is done.
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer waitCancel()
+	_, err = rtX.acquireCreateSlot(waitCtx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// A released slot can be acquired.
+	require.NoError(t, s1.Close())
+	s3, err := rtX.acquireCreateSlot(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s2.Close())
+	require.NoError(t, s3.Close())
+
+	// The number of creates is not limited.
+	rtX.MaxConcurrentCreates = 0
+	s, err := rtX.acquireCreateSlot(ctx)
+	require.NoError(t, err)
+	require.Nil(t, s)
+}
+
+func TestCreateSlotQueue(t *testing.T) {
+	root, err := os.MkdirTemp("", "lxcri-test-create-slot")
+	require.NoError(t, err)
+	defer removeAll(t, root)
+
+	rtX := *rt
+	rtX.Root = root
+	rtX.MaxConcurrentCreates = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slot, err := rtX.acquireCreateSlot(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond * 100)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			errs <- slot.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// All creates proceed, but no more than two at once.
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, maxActive)
+}
+
+func TestReadonlyRootfs(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Root.Readonly = true
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	// The mount destination is created before the rootfs is mounted read-only.
+	shared := t.TempDir()
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts, specki.BindMount(shared, "/shared/dir", "rw"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.DirExists(t, filepath.Join(cfg.Spec.Root.Path, "shared/dir"))
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	// lxcri-test panics (exit status 2) because the rootfs is read-only.
+	proc := specki.NewSpecProcess("/lxcri-test")
+	proc.Env = []string{"SLEEP=0", "CREATE_FILE=/file"}
+	pid, err := c.ExecDetached(proc, nil)
+	require.NoError(t, err)
+	status, err := c.WaitExec(pid)
+	require.NoError(t, err)
+	require.Equal(t, 2, status)
+	require.NoFileExists(t, filepath.Join(cfg.Spec.Root.Path, "file"))
+
+	// The bind mount is writable.
+	proc.Env = []string{"SLEEP=0", "CREATE_FILE=/shared/dir/file"}
+	pid, err = c.ExecDetached(proc, nil)
+	require.NoError(t, err)
+	status, err = c.WaitExec(pid)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+	require.FileExists(t, filepath.Join(shared, "file"))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestCheckReadonlyRootfs(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "proc"), 0755))
+
+	spec := specki.NewSpec(rootfs, "/bin/true")
+	spec.Root.Readonly = true
+	spec.Mounts = []specs.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		specki.BindMount("/nonexistent", "/optional", "optional"),
+	}
+	c := &Container{ContainerConfig: &ContainerConfig{ContainerID: filepath.Base(rootfs), Spec: spec, Log: zerolog.Nop()}}
+	var err error
+	c.LinuxContainer, err = lxc.NewContainer(c.ContainerID, filepath.Dir(rootfs))
+	require.NoError(t, err)
+	defer c.Release()
+
+	require.NoError(t, c.setConfigItem("lxc.rootfs.options", "rw"))
+	require.Error(t, checkReadonlyRootfs(c))
+
+	require.NoError(t, c.setConfigItem("lxc.rootfs.options", "ro"))
+	require.NoError(t, checkReadonlyRootfs(c))
+
+	spec.Mounts = append(spec.Mounts, specs.Mount{Destination: "/sys", Type: "sysfs", Source: "sysfs"})
+	require.Error(t, checkReadonlyRootfs(c))
+}
+
+func TestMaxContainers(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	root, err := os.MkdirTemp("", "lxcri-test-max-containers")
+	require.NoError(t, err)
+	defer removeAll(t, root)
+
+	rtX := *rt
+	rtX.Root = root
+	rtX.MaxContainers = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	for i := uint(0); i < rtX.MaxContainers; i++ {
+		cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+		defer removeAll(t, cfg.Spec.Root.Path)
+		c, err := rtX.Create(ctx, cfg)
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		defer rtX.Delete(ctx, c.ContainerID, true)
+		require.NoError(t, c.Release())
+	}
+
+	// The next create is rejected before the container is created.
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	c, err := rtX.Create(ctx, cfg)
+	require.True(t, errors.Is(err, ErrMaxContainers), err)
+	require.Nil(t, c)
+	require.NoDirExists(t, filepath.Join(root, cfg.ContainerID))
+
+	// A deleted container frees the slot.
+	ids, err := rtX.List()
+	require.NoError(t, err)
+	require.NoError(t, rtX.Delete(ctx, ids[0], true))
+	c, err = rtX.Create(ctx, cfg)
+	require.NoError(t, err)
+	defer rtX.Delete(ctx, c.ContainerID, true)
+	require.NoError(t, c.Release())
+}
+
+func TestLockMaxContainers(t *testing.T) {
+	rtX := *rt
+	rtX.Root = t.TempDir()
+	rtX.MaxContainers = 2
+
+	require.NoError(t, os.Mkdir(filepath.Join(rtX.Root, "c1"), 0777))
+	lock, err := rtX.lockMaxContainers()
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+
+	// A concurrent create waits until the container directory is created.
+	result := make(chan error, 1)
+	go func() {
+		lock2, err := rtX.lockMaxContainers()
+		if lock2 != nil {
+			lock2.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("lock was acquired concurrently: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(rtX.Root, "c2"), 0777))
+	require.NoError(t, lock.Close())
+
+	err = <-result
+	require.True(t, errors.Is(err, ErrMaxContainers), err)
+
+	// The number of containers is not limited.
+	rtX.MaxContainers = 0
+	lock, err = rtX.lockMaxContainers()
+	require.NoError(t, err)
+	require.Nil(t, lock)
+}
+
+func TestHookAnnotationEnv(t *testing.T) {
+	annotations := map[string]string{
+		"io.kubernetes.cri-o.CNI":                 "cni-config",
+		"org.linuxcontainers.lxcri.userns":        "1",
+		"org.linuxcontainers.lxcri.umask":         "0027",
+		"org.linuxcontainers.lxcri-other.ignored": "x",
+	}
+	require.Nil(t, hookAnnotationEnv(annotations, ""))
+	require.Empty(t, hookAnnotationEnv(annotations, "missing"))
+
+	env := hookAnnotationEnv(annotations, "io.kubernetes.cri-o.CNI, org.linuxcontainers.lxcri.*,org.linuxcontainers.lxcri.userns")
+	require.Equal(t, []string{
+		"LXCRI_ANNOTATION_IO_KUBERNETES_CRI_O_CNI=cni-config",
+		"LXCRI_ANNOTATION_ORG_LINUXCONTAINERS_LXCRI_UMASK=0027",
+		"LXCRI_ANNOTATION_ORG_LINUXCONTAINERS_LXCRI_USERNS=1",
+	}, env)
+
+	// Keys that map to the same variable name are passed once, the first key (sorted) wins.
+	annotations = map[string]string{"a_b": "underscore", "a.b": "dot", "a-b": "dash"}
+	env = hookAnnotationEnv(annotations, "a*")
+	require.Equal(t, []string{"LXCRI_ANNOTATION_A_B=dash"}, env)
+
+	// The prefix match requires the '*' suffix.
+	require.Empty(t, hookAnnotationEnv(annotations, "org.linuxcontainers.lxcri."))
+}
+
+func TestWithHookEnv(t *testing.T) {
+	hooks := []specs.Hook{
+		{Path: "/bin/true"},
+		{Path: "/bin/false", Env: []string{"PATH=/bin", "LXCRI_ANNOTATION_A=hook"}},
+	}
+	env := []string{"LXCRI_ANNOTATION_A=a", "LXCRI_ANNOTATION_B=b"}
+	withEnv := withHookEnv(hooks, env)
+	// A hook without env only gets the annotation variables.
+	require.Equal(t, env, withEnv[0].Env)
+	require.Equal(t, []string{"PATH=/bin", "LXCRI_ANNOTATION_A=hook", "LXCRI_ANNOTATION_B=b"}, withEnv[1].Env)
+
+	// The given hooks are not modified.
+	require.Nil(t, hooks[0].Env)
+	require.Equal(t, []string{"PATH=/bin", "LXCRI_ANNOTATION_A=hook"}, hooks[1].Env)
+}
+
+func TestHookAnnotations(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	rtX := *rt
+	rtX.HookAnnotations = "org.linuxcontainers.lxcri.test.*"
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	marker := filepath.Join(t.TempDir(), "env")
+	cfg.Spec.Annotations = map[string]string{"org.linuxcontainers.lxcri.test.cni": "cni-config"}
+	cfg.Spec.Hooks = &specs.Hooks{
+		CreateRuntime: []specs.Hook{
+			{Path: "/bin/sh", Args: []string{"sh", "-c", "echo $LXCRI_ANNOTATION_ORG_LINUXCONTAINERS_LXCRI_TEST_CNI > " + marker}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rtX.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	require.Equal(t, "cni-config\n", string(data))
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
@@ -0,0 +1,248 @@
+package lxcri
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var (
+	subuidFile = "/etc/subuid"
+	subgidFile = "/etc/subgid"
+
+	// uid and gid mappings of the runtime user namespace
+	uidMapFile = "/proc/self/uid_map"
+	gidMapFile = "/proc/self/gid_map"
+)
+
+// idRange is a range of subordinate ids allocated to a user.
+type idRange struct {
+	Start uint32
+	Size  uint32
+}
+
+func (r idRange) contains(start uint32, size uint32) bool {
+	return uint64(start) >= uint64(r.Start) &&
+		uint64(start)+uint64(size) <= uint64(r.Start)+uint64(r.Size)
+}
+
+// parseSubidFile parses the subordinate id ranges for the given user
+// from a subuid/subgid file (see subuid(5)). Entries match either
+// the user name or the numeric user id.
+func parseSubidFile(filename string, u *user.User) ([]idRange, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []idRange
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid entry %q", filename, n, line)
+		}
+		if parts[0] != u.Username && parts[0] != u.Uid {
+			continue
+		}
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid start id: %w", filename, n, err)
+		}
+		size, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid count: %w", filename, n, err)
+		}
+		ranges = append(ranges, idRange{Start: uint32(start), Size: uint32(size)})
+	}
+	return ranges, sc.Err()
+}
+
+// checkIDMappings checks that the host ids of each mapping are
+// either the given id or are within one of the subordinate id ranges.
+func checkIDMappings(kind string, mappings []specs.LinuxIDMapping, id uint32, ranges []idRange) error {
+	for _, m := range mappings {
+		if m.HostID == id && m.Size == 1 {
+			// An unprivileged user can always map its own id.
+			continue
+		}
+		allowed := false
+		for _, r := range ranges {
+			if r.contains(m.HostID, m.Size) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s mapping (containerID:%d hostID:%d size:%d) host range %d-%d is not within the subordinate %ss %v",
+				kind, m.ContainerID, m.HostID, m.Size, m.HostID, uint64(m.HostID)+uint64(m.Size)-1, kind, ranges)
+		}
+	}
+	return nil
+}
+
+// needsIDMapHelper returns true if the mappings can not be written
+// by an unprivileged process, which can only map its own id.
+func needsIDMapHelper(mappings []specs.LinuxIDMapping, id uint32) bool {
+	for _, m := range mappings {
+		if m.HostID != id || m.Size != 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIDMapHelper checks that the setuid helper binary (newuidmap/newgidmap)
+// that liblxc uses to write multi-range mappings is available in PATH.
+func checkIDMapHelper(name string) error {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s is required for unprivileged id mappings but was not found in PATH - install the uidmap (shadow-utils) package: %w", name, err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSetuid == 0 {
+		return fmt.Errorf("%s is required for unprivileged id mappings but is not setuid - reinstall the uidmap (shadow-utils) package", p)
+	}
+	return nil
+}
+
+// checkSubidMappings validates the uid and gid mappings of an
+// unprivileged runtime against the subordinate id ranges
+// allocated to the runtime user in /etc/subuid and /etc/subgid.
+// Otherwise the container start fails with an opaque error from newuidmap/newgidmap.
+// Mappings that span more than the users own id are written
+// by liblxc using the setuid newuidmap/newgidmap helpers, which must be installed.
+func checkSubidMappings(spec *specs.Spec) error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to lookup current user: %w", err)
+	}
+	if len(spec.Linux.UIDMappings) > 0 {
+		ranges, err := parseSubidFile(subuidFile, u)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load subordinate uids: %w", err)
+		}
+		if err := checkIDMappings("uid", spec.Linux.UIDMappings, uint32(os.Getuid()), ranges); err != nil {
+			return fmt.Errorf("%w (user %q in %s)", err, u.Username, subuidFile)
+		}
+		if needsIDMapHelper(spec.Linux.UIDMappings, uint32(os.Getuid())) {
+			if err := checkIDMapHelper("newuidmap"); err != nil {
+				return err
+			}
+		}
+	}
+	if len(spec.Linux.GIDMappings) > 0 {
+		ranges, err := parseSubidFile(subgidFile, u)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load subordinate gids: %w", err)
+		}
+		if err := checkIDMappings("gid", spec.Linux.GIDMappings, uint32(os.Getgid()), ranges); err != nil {
+			return fmt.Errorf("%w (user %q in %s)", err, u.Username, subgidFile)
+		}
+		if needsIDMapHelper(spec.Linux.GIDMappings, uint32(os.Getgid())) {
+			if err := checkIDMapHelper("newgidmap"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseIDMapFile parses the id mappings from a uid_map or gid_map file
+// (see user_namespaces(7)). The ContainerID of a mapping is the id
+// within the user namespace and the HostID is the id in the parent user namespace.
+func parseIDMapFile(filename string) ([]specs.LinuxIDMapping, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mappings []specs.LinuxIDMapping
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid mapping %q", filename, n, sc.Text())
+		}
+		var ids [3]uint32
+		for i, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid mapping: %w", filename, n, err)
+			}
+			ids[i] = uint32(id)
+		}
+		mappings = append(mappings, specs.LinuxIDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return mappings, sc.Err()
+}
+
+// cascadeIDMappings translates the host ids of the given mappings, which are ids
+// in the parent user namespace of the runtime, into ids of the runtime user namespace,
+// using the mappings of the runtime user namespace parent.
+// A mapping is split if its host range spans multiple parent mappings.
+// An error is returned if a host id is not mapped into the runtime user namespace.
+func cascadeIDMappings(mappings []specs.LinuxIDMapping, parent []specs.LinuxIDMapping) ([]specs.LinuxIDMapping, error) {
+	var cascaded []specs.LinuxIDMapping
+	for _, m := range mappings {
+		containerID := uint64(m.ContainerID)
+		hostID := uint64(m.HostID)
+		remaining := uint64(m.Size)
+		for remaining > 0 {
+			found := false
+			for _, p := range parent {
+				start, end := uint64(p.HostID), uint64(p.HostID)+uint64(p.Size)
+				if hostID < start || hostID >= end {
+					continue
+				}
+				size := end - hostID
+				if size > remaining {
+					size = remaining
+				}
+				cascaded = append(cascaded, specs.LinuxIDMapping{
+					ContainerID: uint32(containerID),
+					HostID:      uint32(uint64(p.ContainerID) + hostID - start),
+					Size:        uint32(size),
+				})
+				containerID += size
+				hostID += size
+				remaining -= size
+				found = true
+				break
+			}
+			if !found {
+				return nil, fmt.Errorf("host id %d of mapping (containerID:%d hostID:%d size:%d) is not mapped into the runtime user namespace",
+					hostID, m.ContainerID, m.HostID, m.Size)
+			}
+		}
+	}
+	return cascaded, nil
+}
+
+// isIdentityIDMapping returns true if all mappings map the ids to themselves.
+func isIdentityIDMapping(mappings []specs.LinuxIDMapping) bool {
+	for _, m := range mappings {
+		if m.ContainerID != m.HostID {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package lxcri
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSubidFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "subuid")
+	data := "# comment\nfoo:100000:65536\n1000:200000:1000\nbar:300000:65536\n"
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+
+	u := &user.User{Username: "foo", Uid: "1000"}
+	ranges, err := parseSubidFile(filename, u)
+	require.NoError(t, err)
+	require.Equal(t, []idRange{{100000, 65536}, {200000, 1000}}, ranges)
+
+	require.NoError(t, os.WriteFile(filename, []byte("foo:100000\n"), 0644))
+	_, err = parseSubidFile(filename, u)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ":1: invalid entry")
+}
+
+func TestCheckIDMappings(t *testing.T) {
+	ranges := []idRange{{100000, 65536}}
+
+	valid := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+	require.NoError(t, checkIDMappings("uid", valid, 1000, ranges))
+
+	outOfRange := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 65537},
+	}
+	err := checkIDMappings("uid", outOfRange, 1000, ranges)
+	require.Error(t, err)
+	require.Equal(t, "uid mapping (containerID:0 hostID:100000 size:65537) host range 100000-165536 is not within the subordinate uids [{100000 65536}]", err.Error())
+
+	// another user id is not allowed without a subordinate id range
+	err = checkIDMappings("gid", []specs.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}}, 1000, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "gid mapping (containerID:0 hostID:0 size:1)")
+}
+
+func TestNeedsIDMapHelper(t *testing.T) {
+	require.False(t, needsIDMapHelper([]specs.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}, 1000))
+	require.True(t, needsIDMapHelper([]specs.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 2}}, 1000))
+	require.True(t, needsIDMapHelper([]specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}, 1000))
+}
+
+func TestCheckIDMapHelper(t *testing.T) {
+	dir := t.TempDir()
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	require.NoError(t, os.Setenv("PATH", dir))
+
+	err := checkIDMapHelper("newuidmap")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "newuidmap is required for unprivileged id mappings but was not found in PATH")
+	require.Contains(t, err.Error(), "install the uidmap")
+
+	helper := filepath.Join(dir, "newuidmap")
+	require.NoError(t, os.WriteFile(helper, []byte("#!/bin/sh\n"), 0755))
+	err = checkIDMapHelper("newuidmap")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not setuid")
+
+	require.NoError(t, os.Chmod(helper, 0755|os.ModeSetuid))
+	require.NoError(t, checkIDMapHelper("newuidmap"))
+}
+
+func TestParseIDMapFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "uid_map")
+	data := "         0     100000      65536\n     65536       1000          1\n"
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+
+	mappings, err := parseIDMapFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+		{ContainerID: 65536, HostID: 1000, Size: 1},
+	}, mappings)
+
+	require.NoError(t, os.WriteFile(filename, []byte("0 100000\n"), 0644))
+	_, err = parseIDMapFile(filename)
+	require.Error(t, err)
+}
+
+func TestCascadeIDMappings(t *testing.T) {
+	// The runtime user namespace maps its ids 0-65535 to 100000-165535
+	// and its id 65536 to 1000 (in the parent namespace).
+	parent := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+		{ContainerID: 65536, HostID: 1000, Size: 1},
+	}
+
+	// The spec mappings are the mappings of the runtime namespace.
+	mappings, err := cascadeIDMappings(parent, parent)
+	require.NoError(t, err)
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 0, Size: 65536},
+		{ContainerID: 65536, HostID: 65536, Size: 1},
+	}, mappings)
+	require.True(t, isIdentityIDMapping(mappings))
+
+	// A nested namespace with a subrange and the mapped parent user.
+	mappings, err = cascadeIDMappings([]specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 110000, Size: 1000},
+		{ContainerID: 1000, HostID: 1000, Size: 1},
+	}, parent)
+	require.NoError(t, err)
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 10000, Size: 1000},
+		{ContainerID: 1000, HostID: 65536, Size: 1},
+	}, mappings)
+	require.False(t, isIdentityIDMapping(mappings))
+
+	// A host range that spans multiple parent mappings is split.
+	mappings, err = cascadeIDMappings([]specs.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 20}}, []specs.LinuxIDMapping{
+		{ContainerID: 100, HostID: 10, Size: 10},
+		{ContainerID: 0, HostID: 0, Size: 10},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 0, Size: 10},
+		{ContainerID: 10, HostID: 100, Size: 10},
+	}, mappings)
+
+	// Host ids that are not mapped into the runtime namespace.
+	_, err = cascadeIDMappings([]specs.LinuxIDMapping{{ContainerID: 0, HostID: 165000, Size: 1000}}, parent)
+	require.Error(t, err)
+}
+
+// TestNestedUserNamespace loads the mappings of a user namespace, that is created
+// by a child process, as preconfigured runtime user namespace and translates
+// the spec mappings with them.
+func TestNestedUserNamespace(t *testing.T) {
+	uidMap := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	gidMap := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	if os.Getuid() == 0 {
+		uidMap = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+		gidMap = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	}
+	// #nosec
+	cmd := exec.Command("/bin/sleep", "30")
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Cloneflags:  unix.CLONE_NEWUSER,
+		UidMappings: uidMap,
+		GidMappings: gidMap,
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("failed to create user namespace: %s", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	defer func(uid, gid string) {
+		uidMapFile, gidMapFile = uid, gid
+	}(uidMapFile, gidMapFile)
+	uidMapFile = fmt.Sprintf("/proc/%d/uid_map", cmd.Process.Pid)
+	gidMapFile = fmt.Sprintf("/proc/%d/gid_map", cmd.Process.Pid)
+
+	// The runtime user namespace mappings are the mappings of the spec,
+	// if the container does not require a nested user namespace.
+	runtimeUIDs := specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(uidMap[0].HostID), Size: uint32(uidMap[0].Size)}
+	runtimeGIDs := specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(gidMap[0].HostID), Size: uint32(gidMap[0].Size)}
+
+	rtNested := *rt
+	rtNested.usernsConfigured = true
+	require.NoError(t, rtNested.loadUserNamespaceMappings())
+	require.Equal(t, []specs.LinuxIDMapping{runtimeUIDs}, rtNested.uidMappings)
+	require.Equal(t, []specs.LinuxIDMapping{runtimeGIDs}, rtNested.gidMappings)
+
+	newContainer := func(uidMapping, gidMapping specs.LinuxIDMapping) *Container {
+		spec := specki.NewSpec("/tmp/rootfs", "/bin/true")
+		specki.SetNamespace(spec, specs.LinuxNamespace{Type: specs.UserNamespace})
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{uidMapping}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{gidMapping}
+		return &Container{ContainerConfig: &ContainerConfig{Spec: spec, Log: rt.Log}}
+	}
+
+	// The spec mappings are the mappings of the runtime user namespace,
+	// so the runtime user namespace is used by the container.
+	c := newContainer(runtimeUIDs, runtimeGIDs)
+	require.NoError(t, configureUserNamespace(&rtNested, c))
+	require.False(t, isNamespaceEnabled(c.Spec, specs.UserNamespace))
+
+	if os.Getuid() == 0 {
+		// The nested user namespace maps a subrange of the runtime user namespace.
+		c = newContainer(
+			specs.LinuxIDMapping{ContainerID: 0, HostID: 110000, Size: 1000},
+			specs.LinuxIDMapping{ContainerID: 0, HostID: 210000, Size: 1000})
+		require.NoError(t, configureUserNamespace(&rtNested, c))
+		require.True(t, isNamespaceEnabled(c.Spec, specs.UserNamespace))
+		require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 10000, Size: 1000}}, c.Spec.Linux.UIDMappings)
+		require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 10000, Size: 1000}}, c.Spec.Linux.GIDMappings)
+	}
+
+	// A spec with host ids that are not mapped into the runtime user namespace is rejected.
+	c = newContainer(specs.LinuxIDMapping{ContainerID: 0, HostID: 3000000000, Size: 1}, runtimeGIDs)
+	err := configureUserNamespace(&rtNested, c)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not mapped into the runtime user namespace")
+}
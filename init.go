@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/lxc/lxcri/pkg/specki"
@@ -48,7 +49,10 @@ func configureInit(rt *Runtime, c *Container) error {
 		return err
 	}
 
-	if runAsRuntimeUser(c.Spec) {
+	// lxcri-init runs as root (in the container) if it must set the process user.
+	setUserByInit := initSetsUser(rt, c)
+
+	if runAsRuntimeUser(c.Spec) && !setUserByInit {
 		if err := createFifo(c.syncFifoPath(), 0600); err != nil {
 			return fmt.Errorf("failed to create sync fifo: %w", err)
 		}
@@ -58,19 +62,26 @@ func configureInit(rt *Runtime, c *Container) error {
 		}
 	}
 
-	if err := configureInitUser(rt, c); err != nil {
+	if err := configureInitUser(rt, c, setUserByInit); err != nil {
 		return err
 	}
 
-	// bind mount lxcri-init into the container
+	if err := configureInitUmask(c); err != nil {
+		return err
+	}
+
+	// bind mount lxcri-init (or the alternative init) into the container
 	initCmdPath := c.RuntimePath("lxcri-init")
 	err := touchFile(initCmdPath, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create %s: %w", initCmdPath, err)
 	}
+	if rt.InitCmd != "" {
+		c.Log.Info().Str("init", rt.InitCmd).Msg("using alternative init")
+	}
 	initCmd := filepath.Join(initDir, "lxcri-init")
 	c.Spec.Mounts = append(c.Spec.Mounts, specs.Mount{
-		Source:      rt.libexec(ExecInit),
+		Source:      rt.initCmd(),
 		Destination: strings.TrimLeft(initCmd, "/"),
 		Type:        "bind",
 		//Options:     []string{"slave", "bind", "ro", "nosuid"},
@@ -79,6 +90,39 @@ func configureInit(rt *Runtime, c *Container) error {
 	return c.setConfigItem("lxc.init.cmd", initCmd)
 }
 
+const umaskAnnotation = "org.linuxcontainers.lxcri.umask"
+
+// configureInitUmask sets the process umask from the umask annotation
+// if the umask is not set in the spec. The umask is set by lxcri-init.
+func configureInitUmask(c *Container) error {
+	val, ok := c.Spec.Annotations[umaskAnnotation]
+	if !ok {
+		return nil
+	}
+	umask, err := parseUmask(val)
+	if err != nil {
+		return fmt.Errorf("invalid annotation %s: %w", umaskAnnotation, err)
+	}
+	if c.Spec.Process.User.Umask != nil {
+		c.Log.Warn().Str("annotation", val).Msgf("ignoring annotation %s - umask is set in spec.Process.User", umaskAnnotation)
+		return nil
+	}
+	c.Spec.Process.User.Umask = &umask
+	return nil
+}
+
+// parseUmask parses an octal umask value e.g 0022
+func parseUmask(s string) (uint32, error) {
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse umask %q: %w", s, err)
+	}
+	if umask > 0777 {
+		return 0, fmt.Errorf("umask %q out of range [0000-0777]", s)
+	}
+	return uint32(umask), nil
+}
+
 func touchFile(filePath string, perm os.FileMode) error {
 	// #nosec
 	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, perm)
@@ -88,8 +132,65 @@ func touchFile(filePath string, perm os.FileMode) error {
 	return err
 }
 
-func configureInitUser(rt *Runtime, c *Container) error {
-	if !rt.usernsConfigured {
+// supportsInitGroups returns true if liblxc supports lxc.init.groups.
+// It's a variable to mock the liblxc feature probe in tests.
+var supportsInitGroups = func(c *Container) bool {
+	return c.supportsConfigItem("lxc.init.groups")
+}
+
+// resolveGroupsAnnotation enables the resolution of the supplementary groups
+// of spec.Process.User.Username from the container /etc/group by lxcri-init.
+// The resolved groups are added to spec.Process.User.AdditionalGids.
+// NOTE this annotation is also evaluated by lxcri-init.
+const resolveGroupsAnnotation = "org.linuxcontainers.lxcri.groups.resolve"
+
+// initSetsUser returns true if lxcri-init must set the process user and
+// supplementary groups itself, because liblxc does not support lxc.init.groups,
+// or because the supplementary groups are resolved from the container /etc/group.
+// This requires that lxcri-init keeps the capabilities CAP_SETUID and CAP_SETGID.
+func initSetsUser(rt *Runtime, c *Container) bool {
+	resolveGroups := c.Spec.Annotations[resolveGroupsAnnotation] == "true"
+	if resolveGroups && c.Spec.Process.User.Username == "" {
+		c.Log.Warn().Msgf("ignoring annotation %s - spec.Process.User.Username is not set", resolveGroupsAnnotation)
+		resolveGroups = false
+	}
+	if !resolveGroups && (len(c.Spec.Process.User.AdditionalGids) == 0 || supportsInitGroups(c)) {
+		return false
+	}
+	if rt.Features.Capabilities && !(hasCapability(c.Spec, "CAP_SETUID") && hasCapability(c.Spec, "CAP_SETGID")) {
+		c.Log.Warn().Uints32("groups", c.Spec.Process.User.AdditionalGids).Bool("resolve", resolveGroups).
+			Msg("init must set the supplementary groups but CAP_SETUID/CAP_SETGID are not permitted - supplementary groups are dropped")
+		return false
+	}
+	if resolveGroups {
+		c.Log.Info().Str("user", c.Spec.Process.User.Username).Msg("supplementary groups are resolved and set by init")
+	} else {
+		c.Log.Info().Msg("lxc.init.groups is unsupported - process user and groups are set by init")
+	}
+	return true
+}
+
+func hasCapability(spec *specs.Spec, name string) bool {
+	if spec.Process.Capabilities == nil {
+		return false
+	}
+	for _, c := range spec.Process.Capabilities.Permitted {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func configureInitUser(rt *Runtime, c *Container, setUserByInit bool) error {
+	// The mappings of a nested user namespace (see configureNestedUserNamespace)
+	// are relative to the preconfigured user namespace.
+	if !rt.usernsConfigured || isNamespaceEnabled(c.Spec, specs.UserNamespace) {
+		if !rt.usernsConfigured && !rt.isPrivileged() {
+			if err := checkSubidMappings(c.Spec); err != nil {
+				return err
+			}
+		}
 		for _, m := range c.Spec.Linux.UIDMappings {
 			if err := c.setConfigItem("lxc.idmap", fmt.Sprintf("u %d %d %d", m.ContainerID, m.HostID, m.Size)); err != nil {
 				return err
@@ -102,6 +203,11 @@ func configureInitUser(rt *Runtime, c *Container) error {
 		}
 	}
 
+	if setUserByInit {
+		// see cmd/lxcri-init#setUser
+		return c.setConfigItem("lxc.environment", "LXCRI_INIT_SET_USER=1")
+	}
+
 	if err := c.setConfigItem("lxc.init.uid", fmt.Sprintf("%d", c.Spec.Process.User.UID)); err != nil {
 		return err
 	}
@@ -109,7 +215,7 @@ func configureInitUser(rt *Runtime, c *Container) error {
 		return err
 	}
 
-	if len(c.Spec.Process.User.AdditionalGids) > 0 && c.supportsConfigItem("lxc.init.groups") {
+	if len(c.Spec.Process.User.AdditionalGids) > 0 && supportsInitGroups(c) {
 		var b strings.Builder
 		for i, gid := range c.Spec.Process.User.AdditionalGids {
 			if i > 0 {
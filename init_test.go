@@ -0,0 +1,205 @@
+package lxcri
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+// NOTE This test is not parallel because it mocks supportsInitGroups.
+func TestInitGroupsFallback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	supported := supportsInitGroups
+	supportsInitGroups = func(c *Container) bool { return false }
+	defer func() { supportsInitGroups = supported }()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Process.User = specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{1234, 5678}}
+	cfg.Spec.Process.Capabilities = &specs.LinuxCapabilities{
+		Permitted: []string{"CAP_SETUID", "CAP_SETGID"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.Equal(t, "", c.getConfigItem("lxc.init.groups"))
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", c.LinuxContainer.InitPid()))
+	require.NoError(t, err)
+	var groups string
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Groups:") {
+			groups = strings.TrimSpace(strings.TrimPrefix(line, "Groups:"))
+		}
+	}
+	require.Equal(t, "1234 5678", groups)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestResolveGroups(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	etc := filepath.Join(cfg.Spec.Root.Path, "etc")
+	require.NoError(t, os.MkdirAll(etc, 0755))
+	group := "root:x:0:\nwheel:x:10:root,alice\ndev:x:2000:bob,alice\nother:x:3000:bob\n"
+	require.NoError(t, os.WriteFile(filepath.Join(etc, "group"), []byte(group), 0644))
+
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Process.User = specs.User{UID: 1000, GID: 1000, Username: "alice", AdditionalGids: []uint32{1234}}
+	cfg.Spec.Process.Capabilities = &specs.LinuxCapabilities{
+		Permitted: []string{"CAP_SETUID", "CAP_SETGID"},
+	}
+	cfg.Spec.Annotations = map[string]string{resolveGroupsAnnotation: "true"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", c.LinuxContainer.InitPid()))
+	require.NoError(t, err)
+	var groups string
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Groups:") {
+			groups = strings.TrimSpace(strings.TrimPrefix(line, "Groups:"))
+		}
+	}
+	require.Equal(t, "10 1234 2000", groups)
+}
+
+func TestParseUmask(t *testing.T) {
+	umask, err := parseUmask("0027")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0027), umask)
+
+	umask, err = parseUmask("22")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0022), umask)
+
+	_, err = parseUmask("0099")
+	require.Error(t, err)
+
+	_, err = parseUmask("1777")
+	require.Error(t, err)
+}
+
+func TestUmask(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	shared, err := os.MkdirTemp("", "lxcri-test-umask")
+	require.NoError(t, err)
+	defer removeAll(t, shared)
+
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts, specki.BindMount(shared, "/shared", "rw"))
+	cfg.Spec.Annotations = map[string]string{umaskAnnotation: "0027"}
+	cfg.Spec.Process.Env = []string{"SLEEP=0", "CREATE_FILE=/shared/file"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	err = c.waitMonitorStopped(ctx)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(shared, "file"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestInitCmd(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	// The stub init is a copy of lxcri-init.
+	initCmd := filepath.Join(t.TempDir(), "stub-init")
+	data, err := os.ReadFile(rt.libexec(ExecInit))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(initCmd, data, 0755))
+
+	rtInit := *rt
+	rtInit.InitCmd = initCmd
+	require.Equal(t, initCmd, rtInit.initCmd())
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rtInit.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	var mounted bool
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.HasPrefix(entry, initCmd+" ") {
+			mounted = true
+		}
+	}
+	require.True(t, mounted, "init %s is not mounted", initCmd)
+
+	err = rtInit.Start(ctx, c)
+	require.NoError(t, err)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestInitCmdDefault(t *testing.T) {
+	r := Runtime{LibexecDir: "/usr/libexec/lxcri"}
+	require.Equal(t, "/usr/libexec/lxcri/lxcri-init", r.initCmd())
+	r.InitCmd = "/opt/init"
+	require.Equal(t, "/opt/init", r.initCmd())
+}
@@ -1,15 +1,59 @@
 package lxcri
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// mountInfoFile is the mountinfo file used by mountOptions.
+var mountInfoFile = "/proc/self/mountinfo"
+
+// mountOptions returns the per-mount options of the topmost mount
+// on the given mountpoint, or nil if path is not a mountpoint.
+func mountOptions(path string) ([]string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(mountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f, path)
+}
+
+// parseMountInfo returns the per-mount options of the last entry
+// for the given mountpoint from the mountinfo data, see `man 5 proc`.
+func parseMountInfo(r io.Reader, path string) ([]string, error) {
+	var opts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+		if unescapeMountInfo(fields[4]) == path {
+			opts = strings.Split(fields[5], ",")
+		}
+	}
+	return opts, scanner.Err()
+}
+
+// unescapeMountInfo replaces the octal escape sequences
+// for space, tab, newline and backslash in a mountinfo field.
+func unescapeMountInfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
 func removeMountOptions(rt *Runtime, fs string, opts []string, unsupported ...string) []string {
 	supported := make([]string, 0, len(opts))
 	for _, opt := range opts {
@@ -39,6 +83,54 @@ func filterMountOptions(rt *Runtime, fs string, opts []string) []string {
 	return opts
 }
 
+// Policies for mounts with the same destination (see Runtime.DuplicateMounts).
+const (
+	// DuplicateMountsLastWins applies only the last mount (in spec order)
+	// for a destination and logs a warning for the dropped mounts.
+	DuplicateMountsLastWins = "last-wins"
+	// DuplicateMountsError fails the create if a destination is mounted more than once.
+	DuplicateMountsError = "error"
+)
+
+func checkDuplicateMountsPolicy(policy string) error {
+	switch policy {
+	case "", DuplicateMountsLastWins, DuplicateMountsError:
+		return nil
+	}
+	return fmt.Errorf("unsupported policy %q (supported policies: %s|%s)", policy, DuplicateMountsLastWins, DuplicateMountsError)
+}
+
+// dedupMounts applies the Runtime.DuplicateMounts policy to the container spec mounts
+// with the same destination. Destinations are compared as cleaned absolute paths,
+// e.g '/data', 'data' and '/data/' are the same destination.
+// The order of the remaining mounts is the order of the spec mounts.
+func dedupMounts(rt *Runtime, c *Container) error {
+	mounts := c.Spec.Mounts
+	last := make(map[string]int, len(mounts))
+	for i, ms := range mounts {
+		last[filepath.Join("/", ms.Destination)] = i
+	}
+	if len(last) == len(mounts) {
+		return nil
+	}
+
+	dedup := make([]specs.Mount, 0, len(last))
+	for i, ms := range mounts {
+		dest := filepath.Join("/", ms.Destination)
+		if last[dest] == i {
+			dedup = append(dedup, ms)
+			continue
+		}
+		if rt.DuplicateMounts == DuplicateMountsError {
+			return fmt.Errorf("duplicate mount destination %s", dest)
+		}
+		c.Log.Warn().Str("destination", dest).Str("source", ms.Source).Str("type", ms.Type).
+			Msg("mount is replaced by a later mount with the same destination")
+	}
+	c.Spec.Mounts = dedup
+	return nil
+}
+
 type mounts []specs.Mount
 
 func (m mounts) Len() int {
@@ -59,12 +151,26 @@ func configureMounts(rt *Runtime, c *Container) error {
 		return err
 	}
 
+	if err := dedupMounts(rt, c); err != nil {
+		return err
+	}
+
 	// Sort mounts by mount destination to handle nested mounts properly,
 	// since liblxc processes mounts in the given order.
-	sort.Sort(mounts(c.Spec.Mounts))
+	sort.Stable(mounts(c.Spec.Mounts))
+
+	cgroupns := isNamespaceEnabled(c.Spec, specs.CgroupNamespace)
 
 	for i := range c.Spec.Mounts {
 		ms := c.Spec.Mounts[i]
+		// A bind mount of the host cgroup filesystem shows the host cgroup root.
+		// Within a cgroup namespace a new cgroup2 filesystem is mounted instead,
+		// that shows the container cgroup as root.
+		if cgroupns && isCgroupBindMount(ms) && !keepCgroupBindMount(ms) {
+			rt.Log.Info().Str("source", ms.Source).Str("destination", ms.Destination).
+				Msg("replacing cgroup bind mount with cgroup2 mount in cgroup namespace")
+			ms = cgroupnsMount(ms)
+		}
 		if ms.Type == "cgroup" || ms.Type == "cgroup2" {
 			// TODO check if hieararchy is cgroup v2 only (unified mode)
 			ms.Type = "cgroup2"
@@ -78,6 +184,18 @@ func configureMounts(rt *Runtime, c *Container) error {
 			// since the container can mount the filesystems itself, and automounting can confuse the container.
 		}
 
+		if ms.Type == "sysfs" {
+			ms.Options = sysfsOptions(ms.Options)
+		}
+
+		if ms.Type == "proc" {
+			opts, err := procOptions(c.Spec, ms.Options)
+			if err != nil {
+				return err
+			}
+			ms.Options = opts
+		}
+
 		// TODO replace with symlink.FollowSymlinkInScope(filepath.Join(rootfs, "/etc/passwd"), rootfs) ?
 		// "github.com/docker/docker/pkg/symlink"
 		mountDest, err := resolveMountDestination(c.Spec.Root.Path, ms.Destination)
@@ -93,21 +211,253 @@ func configureMounts(rt *Runtime, c *Container) error {
 
 		ms.Destination = mountDest
 
+		if isBindMount(ms) {
+			src, err := resolveBindMountSource(c.Spec.Root.Path, ms.Source)
+			if err != nil {
+				return err
+			}
+			if src != ms.Source {
+				rt.Log.Debug().Str("source", ms.Source).Str("target", src).Msg("resolved bind mount source symlink")
+				ms.Source = src
+			}
+			ms.Options = bindOptions(rt, ms.Options)
+		}
+
 		if err := createMountDestination(c, &ms); err != nil {
 			return err
 		}
 
 		ms.Options = filterMountOptions(rt, ms.Type, ms.Options)
 
-		mnt := fmt.Sprintf("%s %s %s %s", ms.Source, ms.Destination, ms.Type, strings.Join(ms.Options, ","))
+		if ms.Type == "tmpfs" && rt.DefaultTmpfsSize != "" {
+			ms.Options = withDefaultTmpfsSize(ms.Options, rt.DefaultTmpfsSize)
+		}
 
-		if err := c.setConfigItem("lxc.mount.entry", mnt); err != nil {
+		if err := c.setConfigItem("lxc.mount.entry", mountEntry(ms)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// mountEntry returns the lxc.mount.entry value (fstab format) for the given mount.
+// liblxc translates the known VFS options (e.g noatime, nodiratime, relatime, sync)
+// to mount flags and passes the remaining options as filesystem data.
+func mountEntry(ms specs.Mount) string {
+	return fmt.Sprintf("%s %s %s %s", ms.Source, ms.Destination, ms.Type, strings.Join(atimeOptions(ms.Options), ","))
+}
+
+// atimeOptions keeps only the last of the mutually exclusive atime mode options.
+// liblxc combines all mount flags, whereas the last option wins in mount(8) and runc.
+func atimeOptions(opts []string) []string {
+	last := -1
+	for i, opt := range opts {
+		if opt == "noatime" || opt == "relatime" || opt == "strictatime" {
+			last = i
+		}
+	}
+	if last == -1 {
+		return opts
+	}
+	filtered := make([]string, 0, len(opts))
+	for i, opt := range opts {
+		if i != last && (opt == "noatime" || opt == "relatime" || opt == "strictatime") {
+			continue
+		}
+		filtered = append(filtered, opt)
+	}
+	return filtered
+}
+
+// sysfsOptions makes sysfs read-only (like runc), unless the mount
+// options explicitly request a writable sysfs with the 'rw' option.
+func sysfsOptions(opts []string) []string {
+	if containsString(opts, "rw") || containsString(opts, "ro") {
+		return opts
+	}
+	return append(opts, "ro")
+}
+
+// procHidepidAnnotation sets the hidepid option (e.g `2` or `invisible`)
+// of the container /proc mount, see `man 5 proc`.
+const procHidepidAnnotation = "org.linuxcontainers.lxcri.proc.hidepid"
+
+// procGIDAnnotation sets the gid option of the container /proc mount.
+// Members of the group are exempt from the hidepid restrictions.
+const procGIDAnnotation = "org.linuxcontainers.lxcri.proc.gid"
+
+// procOptions adds the hidepid and gid options from the annotations
+// to the given proc mount options. Options that are already set
+// by the spec mount take precedence.
+// liblxc passes the options as filesystem data to the proc mount.
+func procOptions(spec *specs.Spec, opts []string) ([]string, error) {
+	if val, ok := spec.Annotations[procHidepidAnnotation]; ok && !hasMountOption(opts, "hidepid") {
+		switch val {
+		case "0", "1", "2", "4", "off", "noaccess", "invisible", "ptraceable":
+		default:
+			return nil, fmt.Errorf("invalid value %q for annotation %s", val, procHidepidAnnotation)
+		}
+		opts = append(opts, "hidepid="+val)
+	}
+	if val, ok := spec.Annotations[procGIDAnnotation]; ok && !hasMountOption(opts, "gid") {
+		if _, err := strconv.ParseUint(val, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid value %q for annotation %s: %w", val, procGIDAnnotation, err)
+		}
+		opts = append(opts, "gid="+val)
+	}
+	return opts, nil
+}
+
+// hasMountOption returns true if opts contains the option name (with or without value).
+func hasMountOption(opts []string, name string) bool {
+	for _, opt := range opts {
+		if opt == name || strings.HasPrefix(opt, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// addDevptsMount adds a devpts mount to the spec of a container that
+// requests a terminal, unless a filesystem is mounted on /dev/pts.
+// It returns true if the mount was added.
+func addDevptsMount(spec *specs.Spec) bool {
+	if spec.Process == nil || !spec.Process.Terminal {
+		return false
+	}
+	for _, ms := range spec.Mounts {
+		if filepath.Clean(ms.Destination) == "/dev/pts" {
+			return false
+		}
+	}
+	opts := []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}
+	// The tty group (gid=5) can only be set if it is mapped into the user namespace.
+	if !isNamespaceEnabled(spec, specs.UserNamespace) || isContainerIDMapped(5, spec.Linux.GIDMappings) {
+		opts = append(opts, "gid=5")
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: "/dev/pts", Source: "devpts", Type: "devpts", Options: opts,
+	})
+	return true
+}
+
+func isContainerIDMapped(id uint32, idmaps []specs.LinuxIDMapping) bool {
+	for _, m := range idmaps {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaultTmpfsSize adds the size option to the given tmpfs mount options,
+// unless the size is already set.
+func withDefaultTmpfsSize(opts []string, size string) []string {
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, "size=") {
+			return opts
+		}
+	}
+	return append(opts, "size="+size)
+}
+
+// checkTmpfsSize checks that the given value is a valid tmpfs size option value.
+// The size is in bytes with an optional suffix k, m, g or % (see `man 5 tmpfs`).
+func checkTmpfsSize(size string) error {
+	num := strings.TrimRight(size, "kKmMgG%")
+	if len(size)-len(num) > 1 {
+		return fmt.Errorf("invalid tmpfs size %q: invalid suffix", size)
+	}
+	if _, err := strconv.ParseUint(num, 10, 64); err != nil {
+		return fmt.Errorf("invalid tmpfs size %q: %w", size, err)
+	}
+	return nil
+}
+
+// bindOptions makes the bind mount mode explicit for liblxc,
+// which translates 'bind' to MS_BIND and 'rbind' to MS_BIND|MS_REC.
+// A bind mount without 'bind' or 'rbind' option (e.g type 'bind') is
+// non-recursive (like runc), and 'rbind' takes precedence over 'bind'.
+func bindOptions(rt *Runtime, opts []string) []string {
+	if containsString(opts, "rbind") {
+		return removeMountOptions(rt, "bind", opts, "bind")
+	}
+	if containsString(opts, "bind") {
+		return opts
+	}
+	return append([]string{"bind"}, opts...)
+}
+
+func isBindMount(ms specs.Mount) bool {
+	return ms.Type == "bind" || containsString(ms.Options, "bind") || containsString(ms.Options, "rbind")
+}
+
+// resolveBindMountSource returns the real path of the bind mount source,
+// so that the symlink target is mounted and not the symlink itself.
+// A source within the container rootfs must not resolve to a path
+// outside of the rootfs, because the symlink is controlled by the container.
+// The source is returned unchanged if it does not exist.
+func resolveBindMountSource(rootfs string, source string) (string, error) {
+	src, err := filepath.EvalSymlinks(source)
+	if os.IsNotExist(err) {
+		return source, nil
+	}
+	if err != nil {
+		return source, fmt.Errorf("failed to resolve bind mount source %s: %w", source, err)
+	}
+	if isPathWithin(rootfs, source) && !isPathWithin(rootfs, src) {
+		return source, fmt.Errorf("bind mount source %s resolves to %s outside of container root %s", source, src, rootfs)
+	}
+	return src, nil
+}
+
+// isPathWithin returns true if p is dir or a path below dir.
+func isPathWithin(dir string, p string) bool {
+	dir = filepath.Clean(dir)
+	p = filepath.Clean(p)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// isCgroupBindMount returns true if the given mount is a
+// bind mount of the (host) cgroup filesystem.
+func isCgroupBindMount(ms specs.Mount) bool {
+	if !isBindMount(ms) {
+		return false
+	}
+	src := filepath.Clean(ms.Source)
+	return src == cgroupRoot || strings.HasPrefix(src, cgroupRoot+"/") ||
+		src == "/sys/fs/cgroup" || strings.HasPrefix(src, "/sys/fs/cgroup/")
+}
+
+// keepCgroupBindMount returns true if the given cgroup bind mount is an explicit
+// view of the host cgroup tree, e.g for a monitoring agent, and must not be
+// replaced by a cgroup2 mount within a cgroup namespace.
+// This is the case if the destination is not /sys/fs/cgroup or if the bind mount is read-only.
+// A writable bind mount of the host cgroup tree to /sys/fs/cgroup would let the container
+// modify cgroups outside of its own cgroup.
+func keepCgroupBindMount(ms specs.Mount) bool {
+	if filepath.Clean(ms.Destination) != "/sys/fs/cgroup" {
+		return true
+	}
+	return containsString(ms.Options, "ro")
+}
+
+// cgroupnsMount returns a cgroup2 filesystem mount for the given cgroup bind mount.
+func cgroupnsMount(ms specs.Mount) specs.Mount {
+	opts := make([]string, 0, len(ms.Options))
+	for _, opt := range ms.Options {
+		if opt != "bind" && opt != "rbind" {
+			opts = append(opts, opt)
+		}
+	}
+	return specs.Mount{
+		Destination: ms.Destination,
+		Type:        "cgroup2",
+		Source:      "cgroup2",
+		Options:     opts,
+	}
+}
+
 // createMountDestination creates non-existent mount destination paths.
 // This is required if rootfs is mounted readonly.
 // When the source is a file that should be bind mounted a destination file is created.
@@ -1,12 +1,19 @@
 package lxcri
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestResolveMountDestination_absolute(t *testing.T) {
@@ -90,3 +97,673 @@ func TestSliceDelete(t *testing.T) {
 	a1 := append(a[:2], a[2+1:]...)
 	require.Equal(t, a[:2], a1)
 }
+
+func TestCgroupnsMount(t *testing.T) {
+	bind := specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup", "ro")
+	require.True(t, isCgroupBindMount(bind))
+	require.False(t, isCgroupBindMount(specki.BindMount("/sys", "/sys")))
+	require.False(t, isCgroupBindMount(specs.Mount{Source: "cgroup2", Destination: "/sys/fs/cgroup", Type: "cgroup2"}))
+
+	ms := cgroupnsMount(bind)
+	require.Equal(t, "cgroup2", ms.Type)
+	require.Equal(t, "cgroup2", ms.Source)
+	require.Equal(t, "/sys/fs/cgroup", ms.Destination)
+	require.Equal(t, []string{"nosuid", "nodev", "relatime", "ro"}, ms.Options)
+}
+
+func TestCgroupNamespace(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	if !isNamespaceEnabled(cfg.Spec, specs.CgroupNamespace) {
+		cfg.Spec.Linux.Namespaces = append(cfg.Spec.Linux.Namespaces,
+			specs.LinuxNamespace{Type: specs.CgroupNamespace})
+	}
+	// A writable host cgroup bind mount is replaced.
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts, specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup", "rw"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	state, err := c.State()
+	require.NoError(t, err)
+	pid := state.SpecState.Pid
+	require.True(t, pid > 1)
+
+	// Read the cgroup of the container process from within the container cgroup namespace.
+	cgroup := make(chan string, 1)
+	go func() {
+		// The thread is not unlocked, so it is terminated when the goroutine exits.
+		runtime.LockOSThread()
+		fd, err := unix.Open(fmt.Sprintf("/proc/%d/ns/cgroup", pid), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			cgroup <- err.Error()
+			return
+		}
+		defer unix.Close(fd)
+		if err := unix.Setns(fd, unix.CLONE_NEWCGROUP); err != nil {
+			cgroup <- err.Error()
+			return
+		}
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err != nil {
+			cgroup <- err.Error()
+			return
+		}
+		cgroup <- string(data)
+	}()
+	require.Equal(t, "0::/\n", <-cgroup)
+
+	// The host cgroup bind mount is replaced with a cgroup2 mount.
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.Contains(entry, "sys/fs/cgroup ") {
+			require.True(t, strings.HasPrefix(entry, "cgroup2 "), entry)
+		}
+	}
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestKeepCgroupBindMount(t *testing.T) {
+	require.True(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup", "ro")))
+	require.True(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup/", "ro")))
+	require.True(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/host/sys/fs/cgroup", "rw")))
+	require.True(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/host/sys/fs/cgroup")))
+
+	require.False(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup")))
+	require.False(t, keepCgroupBindMount(specki.BindMount("/sys/fs/cgroup", "/sys/fs/cgroup/", "rw")))
+}
+
+func TestHostCgroupBindMount(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	if !isNamespaceEnabled(cfg.Spec, specs.CgroupNamespace) {
+		cfg.Spec.Linux.Namespaces = append(cfg.Spec.Linux.Namespaces,
+			specs.LinuxNamespace{Type: specs.CgroupNamespace})
+	}
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts,
+		specki.BindMount(cgroupRoot, "/sys/fs/cgroup", "ro"),
+		specki.BindMount(cgroupRoot, "/host/sys/fs/cgroup", "ro"),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	// The host cgroup bind mounts are not replaced with cgroup2 mounts.
+	n := 0
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.HasSuffix(strings.Fields(entry)[1], "sys/fs/cgroup") {
+			require.True(t, strings.HasPrefix(entry, cgroupRoot+" "), entry)
+			n++
+		}
+	}
+	require.Equal(t, 2, n)
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	// The host cgroup tree (including the container cgroup) is visible and read-only.
+	for _, dst := range []string{"sys/fs/cgroup", "host/sys/fs/cgroup"} {
+		p := filepath.Join(fmt.Sprintf("/proc/%d/root", c.LinuxContainer.InitPid()), dst)
+		var st unix.Statfs_t
+		require.NoError(t, unix.Statfs(p, &st))
+		require.True(t, st.Flags&unix.ST_RDONLY != 0, "%s is not read-only", dst)
+		_, err := os.Stat(filepath.Join(p, c.CgroupDir))
+		require.NoError(t, err)
+	}
+}
+
+func TestWithDefaultTmpfsSize(t *testing.T) {
+	opts := withDefaultTmpfsSize([]string{"rw", "nosuid"}, "64m")
+	require.Equal(t, []string{"rw", "nosuid", "size=64m"}, opts)
+
+	// an explicit size is not changed
+	opts = withDefaultTmpfsSize([]string{"rw", "size=1g"}, "64m")
+	require.Equal(t, []string{"rw", "size=1g"}, opts)
+}
+
+func TestCheckTmpfsSize(t *testing.T) {
+	for _, size := range []string{"65536", "64k", "64m", "1G", "50%"} {
+		require.NoError(t, checkTmpfsSize(size), size)
+	}
+	for _, size := range []string{"", "m", "64mb", "-1m", "1.5g"} {
+		require.Error(t, checkTmpfsSize(size), size)
+	}
+}
+
+func TestDefaultTmpfsSize(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts,
+		specs.Mount{Destination: "/dev/shm", Source: "shm", Type: "tmpfs", Options: []string{"rw", "nosuid"}},
+		specs.Mount{Destination: "/tmp", Source: "tmpfs", Type: "tmpfs", Options: []string{"rw", "size=1m"}},
+	)
+
+	rtTmpfs := *rt
+	rtTmpfs.DefaultTmpfsSize = "64m"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rtTmpfs.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	options := make(map[string]string)
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		fields := strings.Fields(entry)
+		require.Len(t, fields, 4, entry)
+		options[fields[1]] = fields[3]
+	}
+	require.Contains(t, options[filepath.Join(cfg.Spec.Root.Path, "dev/shm")], "size=64m")
+	require.Contains(t, options[filepath.Join(cfg.Spec.Root.Path, "tmp")], "size=1m")
+	require.NotContains(t, options[filepath.Join(cfg.Spec.Root.Path, "tmp")], "size=64m")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestResolveBindMountSource(t *testing.T) {
+	tmpdir := t.TempDir()
+	rootfs := filepath.Join(tmpdir, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "data"), 0755))
+	target := filepath.Join(tmpdir, "target")
+	require.NoError(t, os.WriteFile(target, []byte("hello"), 0644))
+
+	link := filepath.Join(tmpdir, "link")
+	require.NoError(t, os.Symlink(target, link))
+
+	src, err := resolveBindMountSource(rootfs, link)
+	require.NoError(t, err)
+	require.Equal(t, target, src)
+
+	// no symlink
+	src, err = resolveBindMountSource(rootfs, target)
+	require.NoError(t, err)
+	require.Equal(t, target, src)
+
+	// non-existent sources are handled by createMountDestination
+	src, err = resolveBindMountSource(rootfs, filepath.Join(tmpdir, "nonexistent"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(tmpdir, "nonexistent"), src)
+
+	// a symlink within the rootfs can resolve to a path within the rootfs
+	require.NoError(t, os.Symlink("data", filepath.Join(rootfs, "datalink")))
+	src, err = resolveBindMountSource(rootfs, filepath.Join(rootfs, "datalink"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(rootfs, "data"), src)
+
+	// but must not escape from the rootfs
+	require.NoError(t, os.Symlink(target, filepath.Join(rootfs, "escape")))
+	_, err = resolveBindMountSource(rootfs, filepath.Join(rootfs, "escape"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "outside of container root")
+}
+
+func TestBindMountSymlinkSource(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	tmpdir := t.TempDir()
+	target := filepath.Join(tmpdir, "target")
+	require.NoError(t, os.Mkdir(target, 0755))
+	link := filepath.Join(tmpdir, "link")
+	require.NoError(t, os.Symlink(target, link))
+
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts, specki.BindMount(link, "/data"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	var found bool
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.HasPrefix(entry, target+" ") {
+			found = true
+		}
+		require.False(t, strings.HasPrefix(entry, link+" "), entry)
+	}
+	require.True(t, found, "resolved bind mount source %s is not mounted", target)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestAddDevptsMount(t *testing.T) {
+	spec := specki.NewSpec("/rootfs", "/bin/sh")
+	require.False(t, addDevptsMount(spec), "not a terminal")
+
+	spec.Process.Terminal = true
+	require.True(t, addDevptsMount(spec))
+	ms := spec.Mounts[len(spec.Mounts)-1]
+	require.Equal(t, "/dev/pts", ms.Destination)
+	require.Equal(t, "devpts", ms.Type)
+	require.Equal(t, []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}, ms.Options)
+
+	// an existing mount is not replaced
+	n := len(spec.Mounts)
+	require.False(t, addDevptsMount(spec))
+	require.Len(t, spec.Mounts, n)
+
+	// the tty group is not mapped
+	spec = specki.NewRootlessSpec("/rootfs", []string{"/bin/sh"},
+		[]specs.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+		[]specs.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}})
+	spec.Mounts = spec.Mounts[:2] // only /proc and /dev
+	spec.Process.Terminal = true
+	require.True(t, addDevptsMount(spec))
+	ms = spec.Mounts[len(spec.Mounts)-1]
+	require.NotContains(t, ms.Options, "gid=5")
+}
+
+func TestTerminalDevpts(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Process.Terminal = true
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.ConsoleSocket = filepath.Join(cfg.Spec.Root.Path, "console.sock")
+
+	ptmx := receiveConsoleFd(t, cfg.ConsoleSocket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	fd := <-ptmx
+	require.True(t, fd > 0)
+	defer unix.Close(fd)
+
+	// the pty is usable
+	_, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	require.NoError(t, err)
+
+	var devpts bool
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		if strings.HasPrefix(entry, "devpts "+filepath.Join(cfg.Spec.Root.Path, "dev/pts")+" devpts ") {
+			devpts = true
+		}
+	}
+	require.True(t, devpts, "devpts is not mounted")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestSysfsOptions(t *testing.T) {
+	require.Equal(t, []string{"nosuid", "ro"}, sysfsOptions([]string{"nosuid"}))
+	require.Equal(t, []string{"ro"}, sysfsOptions(nil))
+	require.Equal(t, []string{"rw", "nosuid"}, sysfsOptions([]string{"rw", "nosuid"}))
+	require.Equal(t, []string{"ro", "nosuid"}, sysfsOptions([]string{"ro", "nosuid"}))
+}
+
+func TestProcOptions(t *testing.T) {
+	spec := specki.NewSpec("/tmp", "/bin/true")
+	opts, err := procOptions(spec, []string{"nosuid"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"nosuid"}, opts)
+
+	spec.Annotations = map[string]string{procHidepidAnnotation: "2", procGIDAnnotation: "1000"}
+	opts, err = procOptions(spec, []string{"nosuid"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"nosuid", "hidepid=2", "gid=1000"}, opts)
+
+	// The spec mount options take precedence.
+	opts, err = procOptions(spec, []string{"hidepid=invisible"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"hidepid=invisible", "gid=1000"}, opts)
+
+	spec.Annotations = map[string]string{procHidepidAnnotation: "3"}
+	_, err = procOptions(spec, nil)
+	require.Error(t, err)
+
+	spec.Annotations = map[string]string{procGIDAnnotation: "wheel"}
+	_, err = procOptions(spec, nil)
+	require.Error(t, err)
+}
+
+func TestProcHidepid(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Annotations = map[string]string{procHidepidAnnotation: "2"}
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	var procOpts string
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		fields := strings.Fields(entry)
+		require.Len(t, fields, 4, entry)
+		if fields[2] == "proc" {
+			procOpts = fields[3]
+		}
+	}
+	require.Contains(t, strings.Split(procOpts, ","), "hidepid=2")
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	// The option is applied to the proc mount of the container.
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/mountinfo", c.LinuxContainer.InitPid()))
+	require.NoError(t, err)
+	var found bool
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 6 && fields[4] == "/proc" && strings.Contains(line, " - proc ") {
+			found = strings.Contains(fields[len(fields)-1], "hidepid=")
+		}
+	}
+	require.True(t, found, "proc is not mounted with hidepid")
+}
+
+func TestProcHardening(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	require.Contains(t, cfg.Spec.Linux.ReadonlyPaths, "/proc/sys")
+	require.Contains(t, cfg.Spec.Linux.MaskedPaths, "/proc/kcore")
+
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	root := fmt.Sprintf("/proc/%d/root", c.LinuxContainer.InitPid())
+
+	// /proc/sys is read-only
+	var st unix.Statfs_t
+	require.NoError(t, unix.Statfs(filepath.Join(root, "proc/sys"), &st))
+	require.True(t, st.Flags&unix.ST_RDONLY != 0, "/proc/sys is not read-only")
+
+	// /proc/kcore is masked by /dev/null
+	info, err := os.Stat(filepath.Join(root, "proc/kcore"))
+	require.NoError(t, err)
+	require.True(t, info.Mode()&os.ModeCharDevice != 0, "/proc/kcore is not masked")
+	require.Equal(t, int64(0), info.Size())
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:31 / /tmp rw,nosuid,nodev shared:15 - tmpfs tmpfs rw
+40 35 8:1 /images/a /tmp/my\040rootfs rw,relatime shared:1 - ext4 /dev/sda1 rw
+41 40 0:45 / /tmp/my\040rootfs ro,relatime shared:20 - overlay overlay rw
+`
+	opts, err := parseMountInfo(strings.NewReader(mountinfo), "/tmp/my rootfs")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "relatime"}, opts)
+
+	opts, err = parseMountInfo(strings.NewReader(mountinfo), "/tmp/other")
+	require.NoError(t, err)
+	require.Nil(t, opts)
+
+	_, err = parseMountInfo(strings.NewReader("invalid line\n"), "/")
+	require.Error(t, err)
+}
+
+func TestMountpointRootfs(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	rootfs := cfg.Spec.Root.Path
+	require.NoError(t, unix.Mount(rootfs, rootfs, "", unix.MS_BIND, ""))
+	defer func() {
+		require.NoError(t, unix.Unmount(rootfs, unix.MNT_DETACH))
+	}()
+
+	opts, err := mountOptions(rootfs)
+	require.NoError(t, err)
+	require.NotNil(t, opts, "rootfs is not a mountpoint")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+	require.NoError(t, c.Delete(ctx, true))
+}
+
+func TestBindOptions(t *testing.T) {
+	require.Equal(t, []string{"bind", "ro"}, bindOptions(rt, []string{"ro"}))
+	require.Equal(t, []string{"bind"}, bindOptions(rt, nil))
+	require.Equal(t, []string{"ro", "bind"}, bindOptions(rt, []string{"ro", "bind"}))
+	require.Equal(t, []string{"rbind", "ro"}, bindOptions(rt, []string{"rbind", "ro"}))
+	require.Equal(t, []string{"rbind", "nosuid"}, bindOptions(rt, []string{"bind", "rbind", "nosuid"}))
+}
+
+func TestRbindSubmount(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	// The mount source contains a submount.
+	src, err := os.MkdirTemp("", "lxcri-test-rbind")
+	require.NoError(t, err)
+	defer removeAll(t, src)
+	sub := filepath.Join(src, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	require.NoError(t, unix.Mount("tmpfs", sub, "tmpfs", 0, "size=1m"))
+	defer func() {
+		require.NoError(t, unix.Unmount(sub, unix.MNT_DETACH))
+	}()
+	require.NoError(t, os.WriteFile(filepath.Join(sub, "file"), []byte("submount"), 0644))
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts,
+		specs.Mount{Source: src, Destination: "/rbind", Type: "bind", Options: []string{"rbind", "ro"}},
+		specs.Mount{Source: src, Destination: "/bind", Type: "bind", Options: []string{"ro"}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	root := fmt.Sprintf("/proc/%d/root", c.LinuxContainer.InitPid())
+
+	// The submount is visible in the recursive bind mount.
+	data, err := os.ReadFile(filepath.Join(root, "rbind/sub/file"))
+	require.NoError(t, err)
+	require.Equal(t, "submount", string(data))
+
+	// The submount is not visible in the non-recursive bind mount.
+	_, err = os.Stat(filepath.Join(root, "bind/sub/file"))
+	require.True(t, os.IsNotExist(err), err)
+}
+
+func TestMountEntry(t *testing.T) {
+	ms := specs.Mount{
+		Source:      "tmpfs",
+		Destination: "/var/lib/lxcri/rootfs/data",
+		Type:        "tmpfs",
+		Options:     []string{"rw", "noatime", "nodiratime", "sync", "mode=755", "size=65536k"},
+	}
+	require.Equal(t, "tmpfs /var/lib/lxcri/rootfs/data tmpfs rw,noatime,nodiratime,sync,mode=755,size=65536k", mountEntry(ms))
+
+	// The last atime mode option wins.
+	ms.Options = []string{"relatime", "nosuid", "noatime"}
+	require.Equal(t, "tmpfs /var/lib/lxcri/rootfs/data tmpfs nosuid,noatime", mountEntry(ms))
+}
+
+func TestAtimeOptions(t *testing.T) {
+	require.Equal(t, []string{"rw"}, atimeOptions([]string{"rw"}))
+	require.Equal(t, []string{"noatime", "nodiratime"}, atimeOptions([]string{"noatime", "nodiratime"}))
+	require.Equal(t, []string{"ro", "strictatime"}, atimeOptions([]string{"noatime", "ro", "relatime", "strictatime"}))
+}
+
+func TestDedupMounts(t *testing.T) {
+	rtX := *rt
+	spec := []specs.Mount{
+		specki.BindMount("/src1", "/data"),
+		specki.BindMount("/src2", "/other"),
+		specki.BindMount("/src3", "data/"),
+	}
+	newContainer := func(mounts []specs.Mount) *Container {
+		return &Container{ContainerConfig: &ContainerConfig{
+			Spec: &specs.Spec{Mounts: append([]specs.Mount(nil), mounts...)},
+			Log:  rt.Log,
+		}}
+	}
+
+	c := newContainer(spec)
+	require.NoError(t, dedupMounts(&rtX, c))
+	require.Len(t, c.Spec.Mounts, 2)
+	require.Equal(t, "/src2", c.Spec.Mounts[0].Source)
+	require.Equal(t, "/src3", c.Spec.Mounts[1].Source)
+
+	rtX.DuplicateMounts = DuplicateMountsError
+	c = newContainer(spec)
+	require.EqualError(t, dedupMounts(&rtX, c), "duplicate mount destination /data")
+	require.Equal(t, spec, c.Spec.Mounts)
+
+	// Mounts without duplicates are kept as is.
+	c = newContainer(spec[:2])
+	require.NoError(t, dedupMounts(&rtX, c))
+	require.Equal(t, spec[:2], c.Spec.Mounts)
+
+	require.NoError(t, checkDuplicateMountsPolicy(""))
+	require.NoError(t, checkDuplicateMountsPolicy(DuplicateMountsLastWins))
+	require.Error(t, checkDuplicateMountsPolicy("first-wins"))
+}
+
+func TestDuplicateMounts(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	src1 := t.TempDir()
+	src2 := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Mounts = append(cfg.Spec.Mounts,
+		specki.BindMount(src1, "/data"),
+		specki.BindMount(src2, "/data"),
+	)
+
+	// The last mount for /data is applied.
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	var sources []string
+	for _, entry := range c.LinuxContainer.ConfigItem("lxc.mount.entry") {
+		fields := strings.Fields(entry)
+		if strings.HasSuffix(fields[1], "/data") {
+			sources = append(sources, fields[0])
+		}
+	}
+	require.Equal(t, []string{src2}, sources)
+	require.NoError(t, c.Delete(ctx, true))
+
+	// The create fails with the error policy.
+	rtX := *rt
+	rtX.DuplicateMounts = DuplicateMountsError
+	cfg2 := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg2.Spec.Root.Path)
+	cfg2.Spec.Mounts = append(cfg2.Spec.Mounts,
+		specki.BindMount(src1, "/data"),
+		specki.BindMount(src2, "/data"),
+	)
+	c2, err := rtX.Create(ctx, cfg2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "duplicate mount destination /data")
+	if c2 != nil {
+		require.NoError(t, c2.Release())
+	}
+	require.NoError(t, rtX.Delete(ctx, cfg2.ContainerID, true))
+}
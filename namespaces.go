@@ -78,6 +78,17 @@ func isNamespaceEnabled(spec *specs.Spec, nsType specs.LinuxNamespaceType) bool
 	return false
 }
 
+// removeNamespace removes the namespace with the given type from the spec.
+func removeNamespace(spec *specs.Spec, nsType specs.LinuxNamespaceType) {
+	namespaces := spec.Linux.Namespaces[:0]
+	for _, n := range spec.Linux.Namespaces {
+		if n.Type != nsType {
+			namespaces = append(namespaces, n)
+		}
+	}
+	spec.Linux.Namespaces = namespaces
+}
+
 func getNamespace(spec *specs.Spec, nsType specs.LinuxNamespaceType) *specs.LinuxNamespace {
 	for _, n := range spec.Linux.Namespaces {
 		if n.Type == nsType {
@@ -116,8 +127,13 @@ func isNamespaceSharedWithRuntime(ns *specs.LinuxNamespace) (bool, error) {
 		return false, err
 	}
 
+	n, supported := namespaceMap[ns.Type]
+	if !supported {
+		return false, fmt.Errorf("unsupported namespace %s", ns.Type)
+	}
+
 	var stat1 unix.Stat_t
-	err = unix.Stat("/proc/self/ns/pid", &stat1)
+	err = unix.Stat("/proc/self/ns/"+n.Name, &stat1)
 	if err != nil {
 		return false, err
 	}
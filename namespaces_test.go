@@ -0,0 +1,87 @@
+package lxcri
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRemoveNamespace(t *testing.T) {
+	spec := specki.NewSpec("/rootfs", "/bin/true")
+	spec.Linux.Namespaces = []specs.LinuxNamespace{
+		{Type: specs.MountNamespace},
+		{Type: specs.PIDNamespace, Path: "/proc/1/ns/pid"},
+		{Type: specs.UTSNamespace},
+	}
+	removeNamespace(spec, specs.PIDNamespace)
+	require.Equal(t, []specs.LinuxNamespace{{Type: specs.MountNamespace}, {Type: specs.UTSNamespace}}, spec.Linux.Namespaces)
+}
+
+func TestIsNamespaceSharedWithRuntime(t *testing.T) {
+	yes, err := isNamespaceSharedWithRuntime(nil)
+	require.NoError(t, err)
+	require.True(t, yes)
+
+	yes, err = isNamespaceSharedWithRuntime(&specs.LinuxNamespace{Type: specs.UTSNamespace})
+	require.NoError(t, err)
+	require.False(t, yes)
+
+	yes, err = isNamespaceSharedWithRuntime(&specs.LinuxNamespace{Type: specs.UTSNamespace, Path: "/proc/self/ns/uts"})
+	require.NoError(t, err)
+	require.True(t, yes)
+
+	// the namespace path is compared with the runtime namespace of the same type
+	yes, err = isNamespaceSharedWithRuntime(&specs.LinuxNamespace{Type: specs.UTSNamespace, Path: "/proc/self/ns/ipc"})
+	require.NoError(t, err)
+	require.False(t, yes)
+}
+
+func TestExternalPIDNamespace(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	// The process that holds the external PID namespace e.g the pause container.
+	pause := exec.Command("/bin/sleep", "30")
+	pause.SysProcAttr = &unix.SysProcAttr{Cloneflags: unix.CLONE_NEWPID}
+	require.NoError(t, pause.Start())
+	defer func() {
+		pause.Process.Kill()
+		pause.Wait()
+	}()
+	pidns := fmt.Sprintf("/proc/%d/ns/pid", pause.Process.Pid)
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	specki.SetNamespace(cfg.Spec, specs.LinuxNamespace{Type: specs.PIDNamespace, Path: pidns})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	expected, err := os.Readlink(pidns)
+	require.NoError(t, err)
+	actual, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", c.LinuxContainer.InitPid()))
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
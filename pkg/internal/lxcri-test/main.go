@@ -45,6 +45,28 @@ func main() {
 		sec = n
 	}
 
+	if s, ok := os.LookupEnv("ALLOC_MB"); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			panic(err)
+		}
+		logf("allocating %d MiB", n)
+		mem := make([]byte, n<<20)
+		// touch every page to ensure the memory is actually allocated
+		for i := 0; i < len(mem); i += os.Getpagesize() {
+			mem[i] = 1
+		}
+	}
+
+	if p, ok := os.LookupEnv("CREATE_FILE"); ok {
+		logf("creating file %s", p)
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err != nil {
+			panic(err)
+		}
+		f.Close()
+	}
+
 	f, err := os.Open("/proc/self/mounts")
 	if err != nil {
 		panic(err)
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog"
 )
@@ -53,6 +54,58 @@ func OpenFile(name string, mode os.FileMode) (*os.File, error) {
 	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
 }
 
+// File is a log file that can be reopened, e.g after it was rotated.
+// It is safe for concurrent use.
+type File struct {
+	name string
+	mode os.FileMode
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenReopenableFile opens the log file name using OpenFile.
+func OpenReopenableFile(name string, mode os.FileMode) (*File, error) {
+	f, err := OpenFile(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &File{name: name, mode: mode, file: f}, nil
+}
+
+// Name returns the name of the log file.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Write writes p to the current log file.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen opens the log file again and closes the previously opened file.
+// A new file is created if the log file was moved away (e.g by logrotate).
+func (f *File) Reopen() error {
+	newFile, err := OpenFile(f.name, f.mode)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	oldFile := f.file
+	f.file = newFile
+	f.mu.Unlock()
+	return oldFile.Close()
+}
+
+// Close closes the log file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
 // ParseLevel is a wrapper for zerolog.ParseLevel
 func ParseLevel(level string) (zerolog.Level, error) {
 	return zerolog.ParseLevel(strings.ToLower(level))
@@ -69,5 +122,11 @@ func NewLogger(out io.Writer, level zerolog.Level) zerolog.Context {
 
 // ConsoleLogger returns a new zerlog.Logger suited for console usage (e.g unit tests)
 func ConsoleLogger(color bool, level zerolog.Level) zerolog.Context {
-	return zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: !color, TimeFormat: TimeFormat}).Level(level).With().Timestamp().Caller()
+	return NewConsoleLogger(os.Stderr, color, level)
+}
+
+// NewConsoleLogger returns a new zerolog.Context that writes human readable
+// (pretty) log output to out.
+func NewConsoleLogger(out io.Writer, color bool, level zerolog.Level) zerolog.Context {
+	return zerolog.New(zerolog.ConsoleWriter{Out: out, NoColor: !color, TimeFormat: TimeFormat}).Level(level).With().Timestamp().Caller()
 }
@@ -6,11 +6,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -173,6 +175,31 @@ var (
 		{Allow: true, Type: "c", Major: int64p(5), Minor: int64p(2), Access: "rwm"}, // ptmx
 		{Allow: true, Type: "c", Major: int64p(88), Access: "rwm"},                  // /dev/pts/{n}
 	}
+
+	// DefaultMaskedPaths are the paths masked by default (as in `runc spec`),
+	// because they expose sensitive host information.
+	DefaultMaskedPaths = []string{
+		"/proc/acpi",
+		"/proc/asound",
+		"/proc/kcore",
+		"/proc/keys",
+		"/proc/latency_stats",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/proc/sched_debug",
+		"/proc/scsi",
+		"/sys/firmware",
+	}
+
+	// DefaultReadonlyPaths are the paths made read-only by default (as in `runc spec`),
+	// because they allow to change kernel settings of the host.
+	DefaultReadonlyPaths = []string{
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	}
 )
 
 // AllowEssentialDevices adds and allows access to EssentialDevices which are required by the
@@ -215,9 +242,105 @@ func IsDeviceEnabled(spec *specs.Spec, dev specs.LinuxDevice) (bool, error) {
 	return false, nil
 }
 
+// Validate checks the given spec for missing required values
+// and for settings that are unsafe for a container.
+// Validate does not modify the spec.
+func Validate(spec *specs.Spec) error {
+	if spec.Root == nil {
+		return fmt.Errorf("spec.Root is nil")
+	}
+	if len(spec.Root.Path) == 0 {
+		return fmt.Errorf("empty spec.Root.Path")
+	}
+	if spec.Process == nil {
+		return fmt.Errorf("spec.Process is nil")
+	}
+	if len(spec.Process.Args) == 0 {
+		return fmt.Errorf("spec.Process.Args is empty")
+	}
+
+	var mntns *specs.LinuxNamespace
+	if spec.Linux != nil {
+		for i, ns := range spec.Linux.Namespaces {
+			if ns.Type == specs.MountNamespace {
+				mntns = &spec.Linux.Namespaces[i]
+				break
+			}
+		}
+	}
+	if mntns == nil {
+		return fmt.Errorf("container wants to share the host mount namespace (mount namespace is not defined)")
+	}
+	if mntns.Path != "" {
+		shared, err := isSameNamespace(mntns.Path, "/proc/self/ns/mnt")
+		if err != nil {
+			return fmt.Errorf("failed to check mount namespace: %w", err)
+		}
+		if shared {
+			return fmt.Errorf("container wants to share the host mount namespace %s", mntns.Path)
+		}
+	}
+	return nil
+}
+
+// isSameNamespace returns true if both namespace paths refer to the same namespace.
+// The device IDs and inode numbers of the namespace files are equal
+// for the same namespace (see `man 7 namespaces`).
+func isSameNamespace(a string, b string) (bool, error) {
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	statB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(statA, statB), nil
+}
+
+// ErrUnsupportedSpecVersion is the error returned by CheckSpecVersion
+// if the spec version is not supported.
+var ErrUnsupportedSpecVersion = errors.New("unsupported spec version")
+
+// CheckSpecVersion checks whether the given spec version (spec.Version)
+// is compatible with the spec version (specs.Version) of the runtime-spec package.
+// Compatible versions have the same major version and a minor version
+// that is lower or equal to specs.VersionMinor.
+// The patch version and pre-release suffix (e.g '-dev') are ignored.
+func CheckSpecVersion(version string) error {
+	major, minor, err := parseSpecVersion(version)
+	if err != nil {
+		return fmt.Errorf("%w %q: %s", ErrUnsupportedSpecVersion, version, err)
+	}
+	if major != specs.VersionMajor || minor > specs.VersionMinor {
+		return fmt.Errorf("%w %q (supported %d.0.0 - %s)", ErrUnsupportedSpecVersion, version, specs.VersionMajor, specs.Version)
+	}
+	return nil
+}
+
+func parseSpecVersion(version string) (major int, minor int, err error) {
+	if version == "" {
+		return 0, 0, fmt.Errorf("version is empty")
+	}
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("version must be in the format 'MAJOR.MINOR.PATCH'")
+	}
+	major, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid major version: %w", err)
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid minor version: %w", err)
+	}
+	return major, minor, nil
+}
+
 // LoadSpecJSON reads the JSON encoded OCI
 // spec from the given path.
 // This is a convenience function for the cli.
+// The spec version is not checked, see CheckSpecVersion.
 func LoadSpecJSON(p string) (*specs.Spec, error) {
 	spec := new(specs.Spec)
 	err := DecodeJSONFile(p, spec)
@@ -243,6 +366,8 @@ func LoadSpecStateJSON(filename string) (*specs.State, error) {
 // NewSpec returns a minimal spec.Spec instance, which is
 // required to run the given process within a container
 // using the given rootfs.
+// Sensitive paths in /proc and /sys are masked or made read-only
+// (see DefaultMaskedPaths and DefaultReadonlyPaths).
 // NOTE /proc and /dev folders must be present within the given rootfs.
 func NewSpec(rootfs string, cmd string, args ...string) *specs.Spec {
 	proc := NewSpecProcess(cmd, args...)
@@ -263,6 +388,8 @@ func NewSpec(rootfs string, cmd string, args ...string) *specs.Spec {
 			Resources: &specs.LinuxResources{
 				Devices: EssentialDevicesAllow,
 			},
+			MaskedPaths:   append([]string(nil), DefaultMaskedPaths...),
+			ReadonlyPaths: append([]string(nil), DefaultReadonlyPaths...),
 		},
 		Mounts: []specs.Mount{
 			{Destination: "/proc", Source: "proc", Type: "proc",
@@ -278,6 +405,46 @@ func NewSpec(rootfs string, cmd string, args ...string) *specs.Spec {
 	}
 }
 
+// NewRootlessSpec returns a spec.Spec instance for an unprivileged
+// container that runs the process args in a new user namespace
+// with the given uid and gid mappings.
+// In addition to the mounts from NewSpec it mounts /sys (read-only),
+// /dev/pts and /dev/shm.
+// NOTE /proc, /dev and /sys folders must be present within the given rootfs.
+func NewRootlessSpec(rootfs string, args []string, uidMappings []specs.LinuxIDMapping, gidMappings []specs.LinuxIDMapping) *specs.Spec {
+	var spec *specs.Spec
+	if len(args) > 0 {
+		spec = NewSpec(rootfs, args[0], args[1:]...)
+	} else {
+		spec = NewSpec(rootfs, "")
+		spec.Process.Args = nil
+	}
+
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+	spec.Linux.UIDMappings = uidMappings
+	spec.Linux.GIDMappings = gidMappings
+
+	spec.Mounts = append(spec.Mounts,
+		specs.Mount{Destination: "/sys", Source: "sysfs", Type: "sysfs",
+			Options: []string{"ro", "nosuid", "nodev", "noexec", "relatime"},
+		},
+		// The tty group (gid=5) may not be mapped, so the gid option is omitted.
+		specs.Mount{Destination: "/dev/pts", Source: "devpts", Type: "devpts",
+			Options: []string{"rw", "nosuid", "noexec", "relatime", "newinstance", "ptmxmode=0666", "mode=0620"},
+		},
+		specs.Mount{Destination: "/dev/shm", Source: "shm", Type: "tmpfs",
+			Options: []string{"rw", "nosuid", "nodev", "noexec", "relatime", "mode=1777", "size=65536k"},
+		},
+	)
+
+	spec.Process.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"TERM=xterm",
+	}
+	spec.Process.NoNewPrivileges = true
+	return spec
+}
+
 // NewSpecProcess creates a specs.Process instance
 // from the given command cmd and the command arguments args.
 func NewSpecProcess(cmd string, args ...string) *specs.Process {
@@ -330,16 +497,22 @@ func Getenv(env []string, key string) (string, bool) {
 	return "", false
 }
 
+// EnvKey returns the name of the given environment variable (KEY=value).
+// The value may contain '=' characters.
+func EnvKey(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
+}
+
 // Setenv adds the given variable to the environment env.
 // The variable is only added if it is not yet defined
 // or if overwrite is set to true.
+// An overwritten variable keeps its position in env.
 // Setenv returns the modified environment and
 // true if the variable is already defined or false otherwise.
 func Setenv(env []string, val string, overwrite bool) ([]string, bool) {
-	a := strings.Split(val, "=")
-	key := a[0]
+	key := EnvKey(val)
 	for i, kv := range env {
-		if strings.HasPrefix(kv, key+"=") {
+		if EnvKey(kv) == key {
 			if overwrite {
 				env[i] = val
 			}
@@ -349,6 +522,21 @@ func Setenv(env []string, val string, overwrite bool) ([]string, bool) {
 	return append(env, val), false
 }
 
+// SetNamespace replaces the namespace with the same type as ns
+// in spec.Linux.Namespaces or appends ns if there is none.
+func SetNamespace(spec *specs.Spec, ns specs.LinuxNamespace) {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	for i, n := range spec.Linux.Namespaces {
+		if n.Type == ns.Type {
+			spec.Linux.Namespaces[i] = ns
+			return
+		}
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, ns)
+}
+
 // BindMount returns a specs.Mount to bind mount src to dest.
 // The given mount options opts are merged with the predefined options
 // ("bind", "nosuid", "nodev", "relatime")
@@ -0,0 +1,86 @@
+package specki
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(NewSpec("/rootfs", "/bin/true")))
+
+	tests := []struct {
+		name   string
+		modify func(*specs.Spec)
+		err    string
+	}{
+		{"nil root", func(s *specs.Spec) { s.Root = nil }, "spec.Root is nil"},
+		{"empty root path", func(s *specs.Spec) { s.Root.Path = "" }, "empty spec.Root.Path"},
+		{"nil process", func(s *specs.Spec) { s.Process = nil }, "spec.Process is nil"},
+		{"empty args", func(s *specs.Spec) { s.Process.Args = nil }, "spec.Process.Args is empty"},
+		{"nil linux", func(s *specs.Spec) { s.Linux = nil }, "container wants to share the host mount namespace (mount namespace is not defined)"},
+		{"no mount namespace", func(s *specs.Spec) {
+			s.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.PIDNamespace}}
+		}, "container wants to share the host mount namespace (mount namespace is not defined)"},
+		{"host mount namespace", func(s *specs.Spec) {
+			SetNamespace(s, specs.LinuxNamespace{Type: specs.MountNamespace, Path: "/proc/self/ns/mnt"})
+		}, "container wants to share the host mount namespace /proc/self/ns/mnt"},
+		{"missing mount namespace path", func(s *specs.Spec) {
+			SetNamespace(s, specs.LinuxNamespace{Type: specs.MountNamespace, Path: "/nonexistent/ns/mnt"})
+		}, "failed to check mount namespace: stat /nonexistent/ns/mnt: no such file or directory"},
+	}
+
+	for _, tc := range tests {
+		spec := NewSpec("/rootfs", "/bin/true")
+		tc.modify(spec)
+		err := Validate(spec)
+		require.Error(t, err, tc.name)
+		require.Equal(t, tc.err, err.Error(), tc.name)
+	}
+}
+
+func TestCheckSpecVersion(t *testing.T) {
+	require.NoError(t, CheckSpecVersion(specs.Version))
+	require.NoError(t, CheckSpecVersion("1.0.0"))
+	require.NoError(t, CheckSpecVersion("1.0.2-dev"))
+
+	for _, v := range []string{"", "1.0", "a.0.0", "1.b.0", "0.5.0", "2.0.0", fmt.Sprintf("1.%d.0", specs.VersionMinor+1)} {
+		err := CheckSpecVersion(v)
+		require.Error(t, err, v)
+		require.True(t, errors.Is(err, ErrUnsupportedSpecVersion), v)
+	}
+
+	err := CheckSpecVersion("2.0.0")
+	require.Equal(t, fmt.Sprintf("unsupported spec version \"2.0.0\" (supported 1.0.0 - %s)", specs.Version), err.Error())
+}
+
+func TestSetenv(t *testing.T) {
+	env := []string{"A=1", "OPTS=--foo=bar", "B=2"}
+
+	// The value may contain '='.
+	env, exist := Setenv(env, "OPTS=--foo=baz=1", true)
+	require.True(t, exist)
+	require.Equal(t, []string{"A=1", "OPTS=--foo=baz=1", "B=2"}, env)
+
+	env, exist = Setenv(env, "A=3", false)
+	require.True(t, exist)
+	require.Equal(t, []string{"A=1", "OPTS=--foo=baz=1", "B=2"}, env)
+
+	// A variable with a key prefix is a different variable.
+	env, exist = Setenv(env, "OPTS_X=1", true)
+	require.False(t, exist)
+	require.Equal(t, []string{"A=1", "OPTS=--foo=baz=1", "B=2", "OPTS_X=1"}, env)
+
+	val, ok := Getenv(env, "OPTS")
+	require.True(t, ok)
+	require.Equal(t, "--foo=baz=1", val)
+}
+
+func TestEnvKey(t *testing.T) {
+	require.Equal(t, "A", EnvKey("A=b=c"))
+	require.Equal(t, "A", EnvKey("A="))
+	require.Equal(t, "A", EnvKey("A"))
+}
@@ -3,11 +3,18 @@ package lxcri
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	//"syscall"
 	"time"
 
@@ -26,6 +33,10 @@ const (
 	// BundleConfigFile is the name of the OCI container bundle config file.
 	// The content is the JSON encoded specs.Spec.
 	BundleConfigFile = "config.json"
+
+	// CreateSpecFile is the name of the file in the container runtime directory
+	// with the (unmodified) JSON encoded specs.Spec passed to Runtime.Create.
+	CreateSpecFile = "create.json"
 )
 
 // Required runtime executables loaded from Runtime.LibexecDir
@@ -39,11 +50,37 @@ var (
 	ExecInit = "lxcri-init"
 
 	defaultLibexecDir = "/usr/libexec/lxcri"
+
+	// StateVersion is the version of the container runtime state format (lxcri.json).
+	// It must be incremented if the format changes incompatibly.
+	StateVersion = 1
+)
+
+var (
+	// Version is the lxcri version.
+	// It is set at build time and stamped into the runtime state of created containers.
+	Version = "undefined"
 )
 
 var (
 	// ErrNotExist is returned if the container (runtime dir) does not exist.
 	ErrNotExist = fmt.Errorf("container does not exist")
+
+	// ErrIncompatibleRuntime is returned by Runtime.Load if the container
+	// runtime state was written in a different StateVersion.
+	ErrIncompatibleRuntime = fmt.Errorf("container was created by an incompatible runtime")
+
+	// ErrInitExited is returned by Runtime.Start if the container
+	// init process has exited before the container process was started.
+	ErrInitExited = fmt.Errorf("container init process exited")
+
+	// ErrCgroupNotEmpty is returned by Runtime.Create if the container cgroup
+	// already contains processes, e.g from another container.
+	ErrCgroupNotEmpty = fmt.Errorf("container cgroup is not empty")
+
+	// ErrMaxContainers is returned by Runtime.Create if the number of containers
+	// in the runtime root has reached Runtime.MaxContainers.
+	ErrMaxContainers = fmt.Errorf("maximum number of containers reached")
 )
 
 // RuntimeFeatures are (security) features supported by the Runtime.
@@ -87,6 +124,12 @@ type Runtime struct {
 
 	specs.Hooks `json:",omitempty"`
 
+	// HookAnnotations is a comma separated list of spec annotation keys
+	// that are passed as environment variables to all OCI hooks (see hookAnnotationEnv).
+	// A key with the suffix '*' matches all annotations with the key prefix,
+	// e.g 'org.linuxcontainers.lxcri.*'.
+	HookAnnotations string `json:",omitempty"`
+
 	// Environment passed to `lxcri-start`
 	env []string
 
@@ -97,22 +140,136 @@ type Runtime struct {
 	// The user namespace must then be dropped from the namespace list, since
 	// user detection at runtime using os.Getuid() or os.Geteuid() will not work.
 	usernsConfigured bool
+	// uidMappings and gidMappings are the mappings of the preconfigured user namespace.
+	uidMappings []specs.LinuxIDMapping
+	gidMappings []specs.LinuxIDMapping
 
 	LogConfig LogConfig
 	Timeouts  Timeouts
 
 	ConfigPath string `json:"-"`
 
+	// BackupConfigDir is the directory where a copy of the container spec
+	// and the liblxc container config is written to by Create.
+	// The backups are kept after the container is deleted, unless DeleteBackupConfig is set.
+	// This is useful for debugging. Backups are not written if the value is empty.
 	BackupConfigDir string `json:",omitempty"`
+	// BackupConfigMaxCount is the maximum number of container backups
+	// in BackupConfigDir. The backups of the oldest containers are removed.
+	// The number is not limited if the value is 0.
+	BackupConfigMaxCount uint `json:",omitempty"`
+	// BackupConfigMaxAge is the maximum age in seconds of a container backup
+	// in BackupConfigDir. The age is not limited if the value is 0.
+	BackupConfigMaxAge uint `json:",omitempty"`
+	// DeleteBackupConfig removes the container backup from BackupConfigDir in Runtime.Delete.
+	DeleteBackupConfig bool `json:",omitempty"`
+
+	// KeepCgroup disables the deletion of the container cgroup in Runtime.Delete.
+	// This is useful for post-mortem debugging (e.g memory.events, cpu.stat).
+	// Kept cgroups must be removed with Runtime.Prune.
+	KeepCgroup bool `json:",omitempty"`
+
+	// DefaultSeccompProfile is the path to an OCI seccomp profile (JSON)
+	// that is applied to containers without a seccomp profile in the spec,
+	// if the seccomp feature is enabled.
+	DefaultSeccompProfile string `json:",omitempty"`
+
+	// SeccompProfileDir is the directory that contains the seccomp profiles (JSON)
+	// that can be referenced by the seccomp profile annotation.
+	SeccompProfileDir string `json:",omitempty"`
+
+	// InitCmd is the path to an alternative container init executable.
+	// The default init is lxcri-init from the LibexecDir.
+	// The init is bind mounted into the container and set as lxc.init.cmd,
+	// so it must be statically linked and it must implement the
+	// lxcri-init protocol (see cmd/lxcri-init).
+	InitCmd string `json:",omitempty"`
+
+	// DefaultTmpfsSize is the size (e.g '64m') of tmpfs mounts without a size option.
+	// The kernel default size of a tmpfs is half of the host memory.
+	DefaultTmpfsSize string `json:",omitempty"`
+
+	// DuplicateMounts is the policy for spec mounts with the same destination,
+	// either DuplicateMountsLastWins (the default if empty) or DuplicateMountsError.
+	// liblxc applies all mounts in the given order, so that a later mount
+	// shadows the previous mounts on the same destination.
+	DuplicateMounts string `json:",omitempty"`
+
+	// CreateCwd creates the process working directory (spec.Process.Cwd)
+	// if it does not exist in the rootfs. Otherwise Create fails early.
+	CreateCwd bool `json:",omitempty"`
+
+	// KeepAllCapabilitiesIfUnset keeps all capabilities for containers
+	// without capabilities (spec.Process.Capabilities is nil), instead of
+	// dropping all capabilities. This is the legacy behaviour of some runtimes.
+	KeepAllCapabilitiesIfUnset bool `json:",omitempty"`
+
+	// StrictSpecVersion rejects containers with an incompatible spec version
+	// (spec.Version), instead of logging a warning.
+	StrictSpecVersion bool `json:",omitempty"`
+
+	// StrictSharedNamespaces rejects containers that join a cgroup, IPC,
+	// network or UTS namespace of the runtime by path (spec.Linux.Namespaces[].Path),
+	// instead of logging a warning.
+	StrictSharedNamespaces bool `json:",omitempty"`
+
+	// MaxConcurrentCreates limits the number of concurrent Runtime.Create calls
+	// across all runtime processes that share the runtime Root.
+	// Creates beyond the limit wait for a free slot until their context is done.
+	// The number is not limited if the value is 0.
+	MaxConcurrentCreates uint `json:",omitempty"`
+
+	// MaxContainers limits the number of containers in the runtime Root.
+	// Runtime.Create returns ErrMaxContainers if the limit is reached.
+	// The limit is enforced for concurrent creates of all runtime processes
+	// that share the runtime Root.
+	// The number is not limited if the value is 0.
+	MaxContainers uint `json:",omitempty"`
+
+	// LoadApparmorProfiles enables loading the apparmor profile file
+	// referenced by the container annotation org.linuxcontainers.lxcri.apparmor.profile-file.
+	// Loaded profiles are unloaded by Runtime.Delete. It requires root privileges.
+	LoadApparmorProfiles bool `json:",omitempty"`
+
+	// GenerateApparmorProfiles generates and loads a baseline apparmor profile
+	// with the name of the container profile (spec.Process.ApparmorProfile),
+	// if no profile with this name is loaded. This is useful on hosts without
+	// the standard container profiles. Generated profiles are unloaded by Runtime.Delete.
+	// It requires root privileges.
+	GenerateApparmorProfiles bool `json:",omitempty"`
+
+	// KillSequence is the sequence of signals used by Runtime.Stop and by
+	// Runtime.Delete with force to stop the container processes, e.g 'SIGTERM:10s,SIGINT:5s'.
+	// The steps are separated by a comma. Each step is a signal (name or number)
+	// and the duration to wait for the container to stop, before the next step is applied.
+	// The container is killed with SIGKILL if it is still running after the last step.
+	// The container is killed with SIGKILL immediately if the value is empty.
+	// The total duration of the sequence must be less than the delete timeout.
+	KillSequence string `json:",omitempty"`
+	killSeq      []killStep
+
+	// SpecHooks are called in Runtime.Create, in the given order,
+	// to modify the container spec, e.g to inject mounts or adjust resources.
+	// They are called after the spec was validated and before
+	// the container is configured, so the runtime defaults (e.g the default mounts
+	// and annotations added by lxcri) are applied after the spec hooks
+	// and are not visible to them.
+	// The modified spec is validated again after all spec hooks were called.
+	// An error returned by a spec hook aborts Runtime.Create.
+	SpecHooks []func(*specs.Spec) error `json:"-"`
 }
 
 // LogConfig is the runtime log configuration.
 type LogConfig struct {
-	file *os.File
+	file *log.File
 
 	LogFile   string `json:",omitempty"`
 	LogLevel  string `json:",omitempty"`
 	Timestamp string `json:",omitempty"`
+	// LogFormat is the format of the runtime log output (json|console).
+	// It is independent of the log destination (LogFile or LogConsole).
+	// The default is console if LogConsole is enabled and json otherwise.
+	LogFormat string `json:",omitempty"`
 
 	LogConsole bool              `json:"-"`
 	LogContext map[string]string `json:"-"`
@@ -123,16 +280,86 @@ type LogConfig struct {
 
 // Timeouts are the timeouts for the Runtime API methods
 type Timeouts struct {
-	CreateTimeout uint `json:",omitempty"`
-	StartTimeout  uint `json:",omitempty"`
-	KillTimeout   uint `json:",omitempty"`
-	DeleteTimeout uint `json:",omitempty"`
+	CreateTimeout Timeout `json:",omitempty"`
+	StartTimeout  Timeout `json:",omitempty"`
+	KillTimeout   Timeout `json:",omitempty"`
+	DeleteTimeout Timeout `json:",omitempty"`
+}
+
+// Timeout is a timeout duration that is parsed from a Go duration
+// string (e.g "500ms", "2m") or, for backwards compatibility,
+// from a bare number of seconds (e.g "60").
+// Timeout implements the flag.Value interface.
+type Timeout time.Duration
+
+// ParseTimeout parses a Timeout from the given string.
+func ParseTimeout(s string) (Timeout, error) {
+	s = strings.TrimSpace(s)
+	if sec, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return Timeout(time.Duration(sec) * time.Second), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", s, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must not be negative", s)
+	}
+	return Timeout(d), nil
+}
+
+// Duration returns the timeout as time.Duration.
+func (t Timeout) Duration() time.Duration {
+	return time.Duration(t)
+}
+
+// String returns the timeout as Go duration string.
+func (t Timeout) String() string {
+	return time.Duration(t).String()
+}
+
+// Set parses the timeout from s.
+func (t *Timeout) Set(s string) error {
+	v, err := ParseTimeout(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// MarshalJSON encodes the timeout as Go duration string.
+func (t Timeout) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON decodes the timeout from a Go duration string
+// or from a number of seconds.
+func (t *Timeout) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var sec uint
+		if err := json.Unmarshal(data, &sec); err != nil {
+			return fmt.Errorf("invalid timeout %s", data)
+		}
+		*t = Timeout(time.Duration(sec) * time.Second)
+		return nil
+	}
+	return t.Set(s)
 }
 
 func (rt *Runtime) libexec(name string) string {
 	return filepath.Join(rt.LibexecDir, name)
 }
 
+// initCmd returns the path to the container init executable.
+func (rt *Runtime) initCmd() string {
+	if rt.InitCmd != "" {
+		return rt.InitCmd
+	}
+	return rt.libexec(ExecInit)
+}
+
 func (rt *Runtime) hasCapability(s string) bool {
 	c, exist := capability.Parse(s)
 	if !exist {
@@ -168,6 +395,11 @@ func (rt *Runtime) Init() error {
 	}
 
 	_, rt.usernsConfigured = os.LookupEnv("_CONTAINERS_USERNS_CONFIGURED")
+	if rt.usernsConfigured {
+		if err := rt.loadUserNamespaceMappings(); err != nil {
+			return errorf("preconfigured user namespace: %w", err)
+		}
+	}
 
 	caps, err := capability.NewPid2(0)
 	if err != nil {
@@ -180,11 +412,32 @@ func (rt *Runtime) Init() error {
 
 	rt.keepEnv("HOME", "XDG_RUNTIME_DIR", "PATH", "LISTEN_FDS")
 
-	err = canExecute(rt.libexec(ExecStart), rt.libexec(ExecHook), rt.libexec(ExecInit))
+	err = canExecute(rt.libexec(ExecStart), rt.libexec(ExecHook), rt.initCmd())
 	if err != nil {
 		return errorf("access check failed: %w", err)
 	}
 
+	if rt.BackupConfigDir != "" {
+		if err := checkBackupConfigDir(rt.BackupConfigDir); err != nil {
+			return err
+		}
+	}
+
+	if rt.DefaultTmpfsSize != "" {
+		if err := checkTmpfsSize(rt.DefaultTmpfsSize); err != nil {
+			return errorf("invalid default tmpfs size: %w", err)
+		}
+	}
+
+	if err := checkDuplicateMountsPolicy(rt.DuplicateMounts); err != nil {
+		return errorf("invalid duplicate mounts policy: %w", err)
+	}
+
+	rt.killSeq, err = parseKillSequence(rt.KillSequence)
+	if err != nil {
+		return errorf("invalid kill sequence: %w", err)
+	}
+
 	if err := isFilesystem("/proc", "proc"); err != nil {
 		return errorf("procfs not mounted on /proc: %w", err)
 	}
@@ -207,12 +460,71 @@ func (rt *Runtime) Init() error {
 		rt.Log.Warn().Msgf("liblxc runtime version >= 4.0.9 is required for lxc.init.groups support (was %s)", lxc.Version())
 	}
 
+	if err := rt.checkFeatures(); err != nil {
+		return err
+	}
+
 	rt.Hooks.CreateContainer = []specs.Hook{
 		{Path: rt.libexec(ExecHookBuiltin)},
 	}
 	return nil
 }
 
+// featureProbes report whether liblxc and the host support a runtime feature.
+// The probes are variables to mock them in tests.
+var featureProbes = struct {
+	Cgroup2       func() bool
+	CgroupDevices func() bool
+	Seccomp       func() bool
+	Apparmor      func() bool
+}{
+	Cgroup2:       func() bool { return lxc.HasAPIExtension("cgroup2") },
+	CgroupDevices: func() bool { return lxc.HasAPIExtension("cgroup2_devices") },
+	Seccomp:       seccompSupported,
+	Apparmor:      apparmorSupported,
+}
+
+// checkFeatures returns an error if liblxc does not support cgroup2,
+// which is required. The requested RuntimeFeatures that are not supported
+// are disabled with a warning.
+func (rt *Runtime) checkFeatures() error {
+	if !featureProbes.Cgroup2() {
+		return errorf("liblxc does not support cgroup2 (api extension 'cgroup2' is missing)")
+	}
+	if rt.Features.CgroupDevices && !featureProbes.CgroupDevices() {
+		rt.Log.Warn().Msg("liblxc does not support the cgroup2 device controller - disabling feature")
+		rt.Features.CgroupDevices = false
+	}
+	if rt.Features.Seccomp && !featureProbes.Seccomp() {
+		rt.Log.Warn().Msg("seccomp is not supported by the kernel - disabling feature")
+		rt.Features.Seccomp = false
+	}
+	if rt.Features.Apparmor && !featureProbes.Apparmor() {
+		rt.Log.Warn().Msg("apparmor is not enabled - disabling feature")
+		rt.Features.Apparmor = false
+	}
+	return nil
+}
+
+// seccompSupported returns true if the kernel supports seccomp filters.
+func seccompSupported() bool {
+	// PR_GET_SECCOMP fails with EINVAL if the kernel is built without CONFIG_SECCOMP.
+	_, err := unix.PrctlRetInt(unix.PR_GET_SECCOMP, 0, 0, 0, 0)
+	return err == nil
+}
+
+// apparmorSupported returns true if apparmor is enabled.
+func apparmorSupported() bool {
+	enabled, err := os.ReadFile(apparmorEnabledFile)
+	return err == nil && strings.TrimSpace(string(enabled)) == "Y"
+}
+
+// Runtime log formats (see LogConfig.LogFormat)
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
 // ConfigureLogger creates the logger instance for the Runtime.
 // The ContainerLogFile is set to /dev/stderr if LogConsole is enabled.
 // ConfigureLogger is already called from Init.
@@ -228,10 +540,21 @@ func (rt *Runtime) ConfigureLogger() error {
 		rt.Log.Info().Msgf("reconfigure logger - closing current log file %s", oldLogFile.Name())
 	}
 
-	var logCtx zerolog.Context
+	format := rt.LogConfig.LogFormat
+	if format == "" {
+		format = LogFormatJSON
+		if rt.LogConfig.LogConsole {
+			format = LogFormatConsole
+		}
+	}
+	if format != LogFormatJSON && format != LogFormatConsole {
+		return fmt.Errorf("invalid log format %q (supported formats: %s|%s)", format, LogFormatJSON, LogFormatConsole)
+	}
+
+	var out io.Writer
 	if rt.LogConfig.LogConsole {
-		// TODO use console logger if filepath is /dev/stdout or /dev/stderr ?
-		logCtx = log.ConsoleLogger(true, level)
+		out = os.Stderr
+		rt.LogConfig.file = nil
 		// FIXME not a good idea to change the configuration here
 		// NOTE don't use stdout because commands that output JSON (state, inspect)
 		// will output the JSON to stdout. Any other output messes up the JSON,
@@ -241,12 +564,20 @@ func (rt *Runtime) ConfigureLogger() error {
 		if err := os.MkdirAll(filepath.Dir(rt.LogConfig.LogFile), 0750); err != nil {
 			return err
 		}
-		l, err := log.OpenFile(rt.LogConfig.LogFile, 0600)
+		l, err := log.OpenReopenableFile(rt.LogConfig.LogFile, 0600)
 		if err != nil {
 			return fmt.Errorf("failed to open log file %q: %w", rt.LogConfig.LogFile, err)
 		}
 		rt.LogConfig.file = l
-		logCtx = log.NewLogger(rt.LogConfig.file, level)
+		out = l
+	}
+
+	var logCtx zerolog.Context
+	if format == LogFormatConsole {
+		// Colors are only useful for terminal output.
+		logCtx = log.NewConsoleLogger(out, rt.LogConfig.LogConsole, level)
+	} else {
+		logCtx = log.NewLogger(out, level)
 	}
 	for k, v := range rt.LogConfig.LogContext {
 		logCtx = logCtx.Str(k, v)
@@ -263,27 +594,141 @@ func (rt *Runtime) ConfigureLogger() error {
 	return nil
 }
 
+// ReopenLogFile reopens the runtime log file, e.g after it was rotated.
+// It is a noop if the runtime logs to the console.
+// NOTE The container log file (LogConfig.ContainerLogFile) is written by the
+// liblxc container process and is not reopened.
+func (rt *Runtime) ReopenLogFile() error {
+	if rt.LogConfig.file == nil {
+		return nil
+	}
+	if err := rt.LogConfig.file.Reopen(); err != nil {
+		return fmt.Errorf("failed to reopen log file %q: %w", rt.LogConfig.file.Name(), err)
+	}
+	rt.Log.Debug().Msgf("reopened log file %s", rt.LogConfig.file.Name())
+	return nil
+}
+
+// ReopenLogFileOnSignal reopens the runtime log file (see ReopenLogFile)
+// when the process receives the signal SIGHUP, until ctx is done.
+// It is used by long running processes to support external log rotation (e.g logrotate).
+func (rt *Runtime) ReopenLogFileOnSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				if err := rt.ReopenLogFile(); err != nil {
+					rt.Log.Error().Err(err).Msg("failed to reopen log file")
+				}
+			}
+		}
+	}()
+}
+
+// loadUserNamespaceMappings loads the id mappings of the preconfigured
+// user namespace of the runtime (see uidMapFile and gidMapFile).
+// The spec id mappings are translated with these mappings (see configureNestedUserNamespace).
+func (rt *Runtime) loadUserNamespaceMappings() error {
+	uidMappings, err := parseIDMapFile(uidMapFile)
+	if err != nil {
+		return fmt.Errorf("failed to load runtime uid mappings: %w", err)
+	}
+	gidMappings, err := parseIDMapFile(gidMapFile)
+	if err != nil {
+		return fmt.Errorf("failed to load runtime gid mappings: %w", err)
+	}
+	rt.uidMappings, rt.gidMappings = uidMappings, gidMappings
+	return nil
+}
+
+// checkLibexecVersion checks that the runtime executables
+// in LibexecDir report the given version (`--version`).
+// This detects partial upgrades, where lxcri was upgraded
+// but the runtime executables were not.
+// The check is skipped if the version is undefined (e.g for development builds).
+// The reported versions are cached (see libexecVersionOf), so the executables
+// are only executed again if they were modified.
+func (rt *Runtime) checkLibexecVersion(ctx context.Context, version string) error {
+	if version == "undefined" {
+		return nil
+	}
+	for _, name := range []string{ExecStart, ExecHook, ExecHookBuiltin, ExecInit} {
+		p := rt.libexec(name)
+		v, err := libexecVersionOf(ctx, p)
+		if err != nil {
+			return fmt.Errorf("failed to get version of %s: %w", p, err)
+		}
+		if v != version {
+			return fmt.Errorf("%s version %q does not match runtime version %q", p, v, version)
+		}
+	}
+	return nil
+}
+
+// libexecVersion is the version reported by a runtime executable.
+type libexecVersion struct {
+	modTime time.Time
+	size    int64
+	version string
+}
+
+// libexecVersions caches the libexecVersion of the runtime executables by path.
+var libexecVersions sync.Map
+
+// libexecVersionOf returns the version reported by the executable p (`--version`).
+// The cached version is returned as long as the modification time
+// and the size of the executable are unchanged.
+func libexecVersionOf(ctx context.Context, p string) (string, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if val, ok := libexecVersions.Load(p); ok {
+		cached := val.(libexecVersion)
+		if cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			return cached.version, nil
+		}
+	}
+	// #nosec
+	out, err := exec.CommandContext(ctx, p, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	v := strings.TrimSpace(string(out))
+	libexecVersions.Store(p, libexecVersion{modTime: info.ModTime(), size: info.Size(), version: v})
+	return v, nil
+}
+
 func (rt *Runtime) checkConfig(cfg *ContainerConfig) error {
 	if len(cfg.ContainerID) == 0 {
 		return errorf("missing container ID")
 	}
+	if cfg.ConsoleSocket != "" && cfg.ConsoleSocketFile != nil {
+		return errorf("console socket path and file are mutually exclusive")
+	}
 	return rt.checkSpec(cfg.Spec)
 }
 
 func (rt *Runtime) checkSpec(spec *specs.Spec) error {
-	if spec.Root == nil {
-		return errorf("spec.Root is nil")
-	}
-	if len(spec.Root.Path) == 0 {
-		return errorf("empty spec.Root.Path")
+	if spec.Linux == nil {
+		rt.Log.Info().Msg("spec.Linux is nil defaulting to empty spec.Linux")
+		spec.Linux = &specs.Linux{}
 	}
 
-	if spec.Process == nil {
-		return errorf("spec.Process is nil")
+	if err := specki.Validate(spec); err != nil {
+		return errorf("invalid spec: %w", err)
 	}
 
-	if len(spec.Process.Args) == 0 {
-		return errorf("specs.Process.Args is empty")
+	if err := specki.CheckSpecVersion(spec.Version); err != nil {
+		if rt.StrictSpecVersion {
+			return errorf("invalid spec: %w", err)
+		}
+		rt.Log.Warn().Str("version", spec.Version).Msgf("%s", err)
 	}
 
 	if spec.Process.Cwd == "" {
@@ -291,22 +736,54 @@ func (rt *Runtime) checkSpec(spec *specs.Spec) error {
 		spec.Process.Cwd = "/"
 	}
 
-	yes, err := isNamespaceSharedWithRuntime(getNamespace(spec, specs.MountNamespace))
-	if err != nil {
-		return errorf("failed to mount namespace: %s", err)
-	}
-	if yes {
-		return errorf("container wants to share the runtimes mount namespace")
-	}
-
 	// It should be best practise not to do so, but there are containers that
 	// want to share the runtimes PID namespaces. e.g sonobuoy/sonobuoy-systemd-logs-daemon-set
-	yes, err = isNamespaceSharedWithRuntime(getNamespace(spec, specs.PIDNamespace))
+	yes, err := isNamespaceSharedWithRuntime(getNamespace(spec, specs.PIDNamespace))
 	if err != nil {
 		return errorf("failed to check PID namespace: %s", err)
 	}
 	if yes {
 		rt.Log.Warn().Msg("container shares the PID namespace with the runtime")
+		// The container inherits the PID namespace of the runtime,
+		// so there is nothing to clone or join.
+		removeNamespace(spec, specs.PIDNamespace)
+	}
+	if err := rt.checkSharedNamespaces(spec); err != nil {
+		return err
+	}
+	return rt.checkSysctls(spec)
+}
+
+// sharedNamespaceTypes are the namespaces checked by checkSharedNamespaces.
+var sharedNamespaceTypes = []specs.LinuxNamespaceType{
+	specs.CgroupNamespace,
+	specs.IPCNamespace,
+	specs.NetworkNamespace,
+	specs.UTSNamespace,
+}
+
+// checkSharedNamespaces checks whether the container joins a namespace
+// of the runtime by path, which is most likely a misconfiguration
+// that allows the container to interfere with the host.
+// Namespaces that are not defined in the spec are shared with the runtime
+// on purpose (e.g the host network) and are not checked.
+func (rt *Runtime) checkSharedNamespaces(spec *specs.Spec) error {
+	for _, nsType := range sharedNamespaceTypes {
+		ns := getNamespace(spec, nsType)
+		if ns == nil || ns.Path == "" {
+			continue
+		}
+		yes, err := isNamespaceSharedWithRuntime(ns)
+		if err != nil {
+			return errorf("failed to check %s namespace: %w", nsType, err)
+		}
+		if !yes {
+			continue
+		}
+		if rt.StrictSharedNamespaces {
+			return errorf("container shares the %s namespace %s with the runtime", nsType, ns.Path)
+		}
+		rt.Log.Warn().Str("path", ns.Path).Msgf("container shares the %s namespace with the runtime", nsType)
 	}
 	return nil
 }
@@ -336,12 +813,47 @@ func (rt *Runtime) Load(containerID string) (*Container, error) {
 		},
 		runtimeDir: dir,
 	}
+	// lxcri.json is written after the monitor process was started.
+	// Create may have failed before, so the container must be loaded
+	// from the remaining runtime state to be able to delete it.
+	if _, err := os.Stat(c.RuntimePath("lxcri.json")); os.IsNotExist(err) {
+		if err := c.loadIncomplete(containerID); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
 	if err := c.load(); err != nil {
 		return nil, err
 	}
+	if err := rt.checkRuntimeIdentity(c); err != nil {
+		if err := c.Release(); err != nil {
+			rt.Log.Error().Msgf("failed to release container: %s", err)
+		}
+		return nil, err
+	}
 	return c, nil
 }
 
+// checkRuntimeIdentity checks that the runtime state of the given container
+// was written in the same StateVersion. Containers created by a runtime
+// with a different Version or LibexecDir are accepted with a warning,
+// so that they can still be managed (e.g deleted) after a runtime upgrade.
+// Containers created before the state version was recorded are accepted.
+func (rt *Runtime) checkRuntimeIdentity(c *Container) error {
+	if c.StateVersion != 0 && c.StateVersion != StateVersion {
+		return fmt.Errorf("%w: state version %d does not match runtime state version %d", ErrIncompatibleRuntime, c.StateVersion, StateVersion)
+	}
+	if c.RuntimeVersion != Version {
+		c.Log.Warn().Str("version", c.RuntimeVersion).Str("runtime-version", Version).
+			Msg("container was created by a different runtime version")
+	}
+	if c.RuntimeLibexecDir != rt.LibexecDir {
+		c.Log.Warn().Str("libexec", c.RuntimeLibexecDir).Str("runtime-libexec", rt.LibexecDir).
+			Msg("container was created by a runtime with a different libexec dir")
+	}
+	return nil
+}
+
 // Start starts the given container.
 // Start simply unblocks the init process `lxcri-init`,
 // which then executes the container process.
@@ -353,34 +865,71 @@ func (rt *Runtime) Start(ctx context.Context, c *Container) error {
 	if err != nil {
 		return errorf("failed to get container state: %w", err)
 	}
-	if state.SpecState.Status != specs.StateCreated {
+	switch state.SpecState.Status {
+	case specs.StateCreated, specs.StateCreating:
+		// Start waits until init is ready (see Container.start).
+	case specs.StateStopped:
+		return fmt.Errorf("%w before start", ErrInitExited)
+	default:
 		return fmt.Errorf("invalid container state. expected %q, but was %q", specs.StateCreated, state.SpecState.Status)
 	}
 
+	start := time.Now()
 	err = c.start(ctx)
 	if err != nil {
 		return err
 	}
+	logPhase(rt.Log, "start", start)
+	checkRootfsReadonlyMounted(c)
 
 	if c.Spec.Hooks != nil {
-		state, err := c.State()
-		if err != nil {
-			return errorf("failed to get container state: %w", err)
-		}
-		specki.RunHooks(ctx, &state.SpecState, c.Spec.Hooks.Poststart, true)
+		// A failing poststart hook must not fail the start operation,
+		// because the container process is already running.
+		start = time.Now()
+		runHooksWarnOnError(ctx, c, "poststart", c.Spec.Hooks.Poststart)
+		logPhase(rt.Log, "poststart-hooks", start)
 	}
 	return nil
 }
 
+// runHooksWarnOnError runs all the given hooks and logs a warning for each failed hook.
+// From the OCI runtime spec: If a poststart or poststop hook fails,
+// the runtime MUST log a warning, but the remaining hooks and lifecycle continue.
+func runHooksWarnOnError(ctx context.Context, c *Container, name string, hooks []specs.Hook) {
+	if len(hooks) == 0 {
+		return
+	}
+	state, err := c.State()
+	if err != nil {
+		c.Log.Warn().Err(err).Msgf("failed to get container state - skipping %s hooks", name)
+		return
+	}
+	stateJSON, err := json.Marshal(state.SpecState)
+	if err != nil {
+		c.Log.Warn().Err(err).Msgf("failed to serialize container state - skipping %s hooks", name)
+		return
+	}
+	for i, h := range hooks {
+		c.Log.Debug().Int("index", i).Str("path", h.Path).Msgf("running %s hook", name)
+		if err := specki.RunHook(ctx, stateJSON, h); err != nil {
+			c.Log.Warn().Err(err).Int("index", i).Str("path", h.Path).Msgf("%s hook failed", name)
+		}
+	}
+}
+
 func (rt *Runtime) runStartCmd(ctx context.Context, c *Container) (err error) {
 	// #nosec
 	cmd := exec.Command(rt.libexec(ExecStart), c.LinuxContainer.Name(), rt.Root, c.ConfigFilePath())
 	cmd.Env = rt.env // environment variables required for liblxc
 	cmd.Dir = c.Spec.Root.Path
-	//cmd.SysProcAttr = &syscall.SysProcAttr{}
-	//cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 100000, Gid: 100000}
-
-	if c.ConsoleSocket == "" && !c.Spec.Process.Terminal {
+	// The monitor process runs in a new session (and process group),
+	// so that it is not affected by signals sent to the process group
+	// of the caller (e.g conmon) and survives the runtime process.
+	// NOTE pty.StartWithSize (see runStartCmdConsole) sets Setsid as well.
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+
+	hasConsoleSocket := c.ConsoleSocket != "" || c.ConsoleSocketFile != nil
+	if !hasConsoleSocket && !c.Spec.Process.Terminal {
 		// Inherit stdio from calling process (conmon).
 		// lxc.console.path must be set to 'none' or stdio of init process is replaced with a PTY by lxc
 		if err := c.setConfigItem("lxc.console.path", "none"); err != nil {
@@ -391,6 +940,21 @@ func (rt *Runtime) runStartCmd(ctx context.Context, c *Container) (err error) {
 		cmd.Stderr = os.Stderr
 	}
 
+	if c.ContainerConfig.ConsoleLog != "" {
+		if !hasConsoleSocket {
+			return errorf("console log %q requires a console socket", c.ContainerConfig.ConsoleLog)
+		}
+		// The liblxc monitor process forwards the container console
+		// to the PTY sent to the console socket and additionally
+		// writes the console output to the log file.
+		// Unlike a duplicated PTY master fd, which would compete
+		// with the console socket consumer for the PTY output,
+		// the monitor process tees the output and there is no fd to clean up.
+		if err := c.setConfigItem("lxc.console.logfile", c.ContainerConfig.ConsoleLog); err != nil {
+			return err
+		}
+	}
+
 	// NOTE any config change via clxc.setConfigItem
 	// must be done before calling SaveConfigFile
 	err = c.LinuxContainer.SaveConfigFile(c.ConfigFilePath())
@@ -399,12 +963,17 @@ func (rt *Runtime) runStartCmd(ctx context.Context, c *Container) (err error) {
 	}
 
 	if rt.BackupConfigDir != "" {
-		exec.Command("cp", c.ConfigFilePath(), filepath.Join(rt.BackupConfigDir, c.ContainerID+".config")).Run()
+		if err := rt.backupConfigFile(c); err != nil {
+			return err
+		}
 	}
 
 	rt.Log.Debug().Msg("starting lxc monitor process")
-	if c.ConsoleSocket != "" {
-		err = rt.runStartCmdConsole(ctx, cmd, c.ConsoleSocket)
+	start := time.Now()
+	if c.ConsoleSocketFile != nil {
+		err = rt.runStartCmdConsoleFile(ctx, cmd, c.ConsoleSocketFile, c.Spec.Process.ConsoleSize)
+	} else if c.ConsoleSocket != "" {
+		err = rt.runStartCmdConsole(ctx, cmd, c.ConsoleSocket, c.Spec.Process.ConsoleSize)
 	} else {
 		err = cmd.Start()
 	}
@@ -416,6 +985,7 @@ func (rt *Runtime) runStartCmd(ctx context.Context, c *Container) (err error) {
 	c.CreatedAt = time.Now()
 	c.Pid = cmd.Process.Pid
 	rt.Log.Info().Int("pid", cmd.Process.Pid).Msg("monitor process started")
+	logPhase(rt.Log, "monitor", start)
 
 	p := c.RuntimePath("lxcri.json")
 	err = specki.EncodeJSONFile(p, c, os.O_EXCL|os.O_CREATE, 0440)
@@ -427,17 +997,37 @@ func (rt *Runtime) runStartCmd(ctx context.Context, c *Container) (err error) {
 	defer cancel()
 
 	rt.Log.Debug().Msg("waiting for init")
+	start = time.Now()
 	if err := c.waitCreated(ctx); err != nil {
-		return err
+		return c.withLogTail(err)
 	}
+	logPhase(rt.Log, "wait-created", start)
 
 	return nil
 }
 
-func (rt *Runtime) runStartCmdConsole(ctx context.Context, cmd *exec.Cmd, consoleSocket string) error {
+// createErrorLogSize is the maximum size of the liblxc log output
+// that is appended to a create error by Container.withLogTail.
+const createErrorLogSize = 4096
+
+// withLogTail appends the recent liblxc log output of the container to err.
+// The monitor process (lxcri-start) stderr is inherited by the container process,
+// so the liblxc log is the only source for the cause of a failed container start.
+func (c *Container) withLogTail(err error) error {
+	tail, tailErr := logTail(c.LogFile, c.ContainerID, createErrorLogSize)
+	if tailErr != nil {
+		c.Log.Warn().Err(tailErr).Str("file", c.LogFile).Msg("failed to read container log")
+		return err
+	}
+	if tail == "" {
+		return err
+	}
+	return fmt.Errorf("%w\n--- container log %s ---\n%s", err, c.LogFile, tail)
+}
+
+func (rt *Runtime) runStartCmdConsole(ctx context.Context, cmd *exec.Cmd, consoleSocket string, consoleSize *specs.Box) error {
 	rt.Log.Debug().Msgf("running command in console %s", consoleSocket)
-	dialer := net.Dialer{}
-	c, err := dialer.DialContext(ctx, "unix", consoleSocket)
+	c, err := rt.dialConsoleSocket(ctx, consoleSocket)
 	if err != nil {
 		return fmt.Errorf("connecting to console socket failed: %w", err)
 	}
@@ -454,12 +1044,67 @@ func (rt *Runtime) runStartCmdConsole(ctx context.Context, cmd *exec.Cmd, consol
 			return fmt.Errorf("failed to set connection deadline: %w", err)
 		}
 	}
+	return rt.startConsole(cmd, conn, consoleSize)
+}
+
+// runStartCmdConsoleFile is like runStartCmdConsole but uses
+// the given connected console socket file instead of dialing a socket path.
+func (rt *Runtime) runStartCmdConsoleFile(ctx context.Context, cmd *exec.Cmd, consoleSocket *os.File, consoleSize *specs.Box) error {
+	rt.Log.Debug().Int("fd", int(consoleSocket.Fd())).Msg("running command in console socket file")
+	conn, err := consoleSocketConn(consoleSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return fmt.Errorf("failed to set connection deadline: %w", err)
+		}
+	}
+	return rt.startConsole(cmd, conn, consoleSize)
+}
+
+// consoleSocketConn returns a connection for the given file,
+// which must be a unix socket. The file is not closed.
+func consoleSocketConn(f *os.File) (*net.UnixConn, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, fmt.Errorf("failed to stat console socket fd %d: %w", f.Fd(), err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		return nil, fmt.Errorf("console socket fd %d is not a socket", f.Fd())
+	}
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid console socket fd %d: %w", f.Fd(), err)
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("console socket fd %d: expected a unix connection but was %T", f.Fd(), c)
+	}
+	return conn, nil
+}
 
+// startConsole starts the given command with a new pty and sends the
+// pty master file descriptor over the given console socket connection.
+// If sending the file descriptor fails, the started command is killed,
+// because the container console would be unusable.
+func (rt *Runtime) startConsole(cmd *exec.Cmd, conn *net.UnixConn, consoleSize *specs.Box) error {
 	sockFile, err := conn.File()
 	if err != nil {
 		return fmt.Errorf("failed to get file from unix connection: %w", err)
 	}
-	ptmx, err := pty.Start(cmd)
+	defer sockFile.Close()
+
+	var winsize *pty.Winsize
+	if consoleSize != nil {
+		rt.Log.Debug().Uint("height", consoleSize.Height).Uint("width", consoleSize.Width).Msg("set console size")
+		winsize = &pty.Winsize{Rows: uint16(consoleSize.Height), Cols: uint16(consoleSize.Width)}
+	}
+	ptmx, err := pty.StartWithSize(cmd, winsize)
 	if err != nil {
 		return fmt.Errorf("failed to start with pty: %w", err)
 	}
@@ -472,11 +1117,46 @@ func (rt *Runtime) runStartCmdConsole(ctx context.Context, cmd *exec.Cmd, consol
 	// Don't know whether 'terminal' is the right data to send, but conmon doesn't care anyway.
 	err = unix.Sendmsg(int(sockFile.Fd()), []byte("terminal"), oob, nil, 0)
 	if err != nil {
+		ptmx.Close()
+		if err := cmd.Process.Kill(); err != nil {
+			rt.Log.Warn().Err(err).Int("pid", cmd.Process.Pid).Msg("failed to kill process")
+		}
+		// Reap the process (the exit status is the kill signal).
+		_ = cmd.Wait()
 		return fmt.Errorf("failed to send console fd: %w", err)
 	}
 	return ptmx.Close()
 }
 
+const (
+	consoleSocketDialAttempts = 10
+	consoleSocketDialInterval = time.Millisecond * 50
+)
+
+// dialConsoleSocket connects to the console socket.
+// The caller (e.g conmon) may not yet have created the socket,
+// so connecting is retried a bounded number of times
+// if the socket does not exist (ENOENT) or is not yet listening (ECONNREFUSED).
+func (rt *Runtime) dialConsoleSocket(ctx context.Context, consoleSocket string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	for attempt := 1; ; attempt++ {
+		c, err := dialer.DialContext(ctx, "unix", consoleSocket)
+		if err == nil {
+			return c, nil
+		}
+		rt.Log.Trace().Err(err).Int("attempt", attempt).Str("socket", consoleSocket).Msg("connect to console socket")
+		if attempt >= consoleSocketDialAttempts ||
+			!(errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ECONNREFUSED)) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(consoleSocketDialInterval):
+		}
+	}
+}
+
 // Kill sends the signal signum to the container init process.
 func (rt *Runtime) Kill(ctx context.Context, c *Container, signum unix.Signal) error {
 	state, err := c.ContainerState()
@@ -489,27 +1169,154 @@ func (rt *Runtime) Kill(ctx context.Context, c *Container, signum unix.Signal) e
 	return c.kill(ctx, signum)
 }
 
+// Stop stops the container processes with the signals from KillSequence
+// and waits until the container is stopped.
+// The container is killed with unix.SIGKILL if KillSequence is empty
+// or if the container is still running after the last step.
+// Stopping a stopped container is a noop.
+func (rt *Runtime) Stop(ctx context.Context, c *Container) error {
+	state, err := c.ContainerState()
+	if err != nil {
+		return err
+	}
+	if state == specs.StateStopped {
+		return nil
+	}
+	if err := c.stop(ctx, rt.killSeq); err != nil {
+		return errorf("failed to stop container: %w", err)
+	}
+	return c.waitMonitorStopped(ctx)
+}
+
 // Delete removes the container from the runtime directory.
 // The container must be stopped or force must be set to true.
 // If the container is not stopped but force is set to true,
-// the container will be killed with unix.SIGKILL.
+// the container is stopped with the signals from KillSequence
+// (see Runtime.Stop).
 func (rt *Runtime) Delete(ctx context.Context, containerID string, force bool) error {
 	rt.Log.Info().Bool("force", force).Str("cid", containerID).Msg("delete container")
 	c, err := rt.Load(containerID)
 	if err == ErrNotExist {
 		return err
 	}
+	// Never remove the runtime dir of a container owned by another runtime.
+	if errors.Is(err, ErrIncompatibleRuntime) {
+		return err
+	}
 	if err != nil {
 		// NOTE hooks won't run in this case
 		rt.Log.Warn().Msgf("deleting runtime dir for unloadable container: %s", err)
-		return os.RemoveAll(filepath.Join(rt.Root, containerID))
+		if err := os.RemoveAll(filepath.Join(rt.Root, containerID)); err != nil {
+			return err
+		}
+		rt.deleteBackupConfig(containerID)
+		return nil
+	}
+
+	// The profile copy is removed with the runtime directory.
+	aaprofile, _ := os.ReadFile(c.RuntimePath(apparmorProfileCopy))
+
+	keepCgroup := rt.KeepCgroup
+	if keepCgroup {
+		if err := rt.recordKeptCgroup(c); err != nil {
+			rt.Log.Error().Msgf("failed to record kept cgroup - cgroup is deleted: %s", err)
+			keepCgroup = false
+		}
+	}
+	if err := c.delete(ctx, force, keepCgroup, rt.killSeq); err != nil {
+		return err
+	}
+	if aaprofile != nil {
+		if err := rt.unloadApparmorProfile(containerID, aaprofile); err != nil {
+			rt.Log.Warn().Err(err).Msg("failed to unload apparmor profile")
+		}
+	}
+	rt.deleteBackupConfig(containerID)
+	return nil
+}
+
+func (rt *Runtime) deleteBackupConfig(containerID string) {
+	if rt.BackupConfigDir == "" || !rt.DeleteBackupConfig {
+		return
+	}
+	if err := rt.removeBackupConfig(containerID); err != nil {
+		rt.Log.Warn().Err(err).Msg("failed to remove backup config")
+	}
+}
+
+// keptCgroupsDir is the hidden directory within the runtime root
+// that records the cgroups kept by Runtime.Delete.
+func (rt *Runtime) keptCgroupsDir() string {
+	return filepath.Join(rt.Root, ".kept-cgroups")
+}
+
+func (rt *Runtime) recordKeptCgroup(c *Container) error {
+	if err := os.MkdirAll(rt.keptCgroupsDir(), 0700); err != nil {
+		return err
+	}
+	p := filepath.Join(rt.keptCgroupsDir(), c.ContainerID)
+	return os.WriteFile(p, []byte(c.CgroupDir), 0600)
+}
+
+// Prune deletes the container cgroups kept by Runtime.Delete (see Runtime.KeepCgroup).
+// Cgroups that are still populated are skipped.
+func (rt *Runtime) Prune(ctx context.Context) error {
+	dir := rt.keptCgroupsDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+
+	var pruneErr error
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			rt.Log.Error().Str("file", p).Msgf("failed to read kept cgroup: %s", err)
+			if pruneErr == nil {
+				pruneErr = err
+			}
+			continue
+		}
+		cgroupDir := string(data)
+		log := rt.Log.With().Str("cid", e.Name()).Str("cgroup", cgroupDir).Logger()
 
-	return c.Delete(ctx, force)
+		ev, err := parseCgroupEvents(filepath.Join(cgroupRoot, cgroupDir, "cgroup.events"))
+		if err == nil && ev.populated {
+			log.Warn().Msg("skip populated cgroup")
+			continue
+		}
+		if err == nil {
+			err = deleteCgroup(cgroupDir)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Error().Msgf("failed to delete cgroup: %s", err)
+			if pruneErr == nil {
+				pruneErr = err
+			}
+			continue
+		}
+		log.Info().Msg("pruned cgroup")
+		if err := os.Remove(p); err != nil && pruneErr == nil {
+			pruneErr = err
+		}
+	}
+	return pruneErr
 }
 
 // Delete removes the container from the runtime directory.
 func (c *Container) Delete(ctx context.Context, force bool) error {
+	return c.delete(ctx, force, false, nil)
+}
+
+func (c *Container) delete(ctx context.Context, force bool, keepCgroup bool, killSeq []killStep) error {
+	defer c.invalidateState()
 	defer func() {
 		if err := c.Release(); err != nil {
 			c.Log.Error().Msgf("failed to release container: %s", err)
@@ -519,12 +1326,13 @@ func (c *Container) Delete(ctx context.Context, force bool) error {
 	if err != nil {
 		return err
 	}
+	start := time.Now()
 	if state != specs.StateStopped {
 		c.Log.Debug().Msgf("delete state:%s", state)
 		if !force {
 			return errorf("container is not not stopped (current state %s)", state)
 		}
-		if err := c.kill(ctx, unix.SIGKILL); err != nil {
+		if err := c.stop(ctx, killSeq); err != nil {
 			return errorf("failed to kill container: %w", err)
 		}
 	}
@@ -532,17 +1340,26 @@ func (c *Container) Delete(ctx context.Context, force bool) error {
 	if err := c.waitMonitorStopped(ctx); err != nil {
 		c.Log.Error().Msgf("failed to stop monitor process %d: %s", c.Pid, err)
 	}
+	logPhase(c.Log, "stop", start)
+	c.invalidateState()
+
+	if c.oomKilled() {
+		c.Log.Warn().Msg("container process was killed by the OOM killer")
+	}
 
 	// From OCI runtime spec
 	// "Note that resources associated with the container, but not
 	// created by this container, MUST NOT be deleted."
 	// The *lxc.Container is created with `rootfs.managed=0`,
 	// so calling *lxc.Container.Destroy will not delete container resources.
+	start = time.Now()
 	if err := c.LinuxContainer.Destroy(); err != nil {
 		return fmt.Errorf("failed to destroy container: %w", err)
 	}
+	logPhase(c.Log, "destroy", start)
 
 	// the monitor might be part of the cgroup so wait for it to exit
+	start = time.Now()
 	eventsFile := filepath.Join(cgroupRoot, c.CgroupDir, "cgroup.events")
 	err = pollCgroupEvents(ctx, eventsFile, func(ev cgroupEvents) bool {
 		return !ev.populated
@@ -552,17 +1369,22 @@ func (c *Container) Delete(ctx context.Context, force bool) error {
 		c.Log.Warn().Msgf("failed to wait until cgroup.events populated=0: %s", err)
 	}
 
-	err = deleteCgroup(c.CgroupDir)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete cgroup: %s", err)
+	if keepCgroup {
+		c.Log.Warn().Str("cgroup", c.CgroupDir).Msg("keeping container cgroup")
+	} else {
+		err = deleteCgroup(c.CgroupDir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete cgroup: %s", err)
+		}
 	}
+	// A kept cgroup is not deleted by a create that reuses the cgroup.
+	c.removeOwnedCgroup()
+	logPhase(c.Log, "cgroup", start)
 
 	if c.Spec.Hooks != nil {
-		state, err := c.State()
-		if err != nil {
-			return errorf("failed to get container state: %w", err)
-		}
-		specki.RunHooks(ctx, &state.SpecState, c.Spec.Hooks.Poststop, true)
+		start = time.Now()
+		runHooksWarnOnError(ctx, c, "poststop", c.Spec.Hooks.Poststop)
+		logPhase(c.Log, "poststop-hooks", start)
 	}
 
 	return os.RemoveAll(c.RuntimePath())
@@ -589,6 +1411,38 @@ func (rt *Runtime) List() ([]string, error) {
 	return visible, nil
 }
 
+// lockMaxContainers acquires an exclusive lock on the max containers lock file
+// in the runtime root and returns ErrMaxContainers if the number of containers
+// in the runtime root has reached MaxContainers.
+// The container directory must be created before the lock is released by closing
+// the returned file, so that the limit also applies to concurrent creates
+// of all runtime processes with the same root.
+// No lock file is returned if the number of containers is not limited.
+func (rt *Runtime) lockMaxContainers() (*os.File, error) {
+	if rt.MaxContainers == 0 {
+		return nil, nil
+	}
+	p := filepath.Join(rt.Root, ".max-containers.lock")
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errorf("failed to open max containers lock file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errorf("failed to lock max containers lock file %s: %w", p, err)
+	}
+	ids, err := rt.List()
+	if err != nil {
+		f.Close()
+		return nil, errorf("failed to list containers: %w", err)
+	}
+	if uint(len(ids)) >= rt.MaxContainers {
+		f.Close()
+		return nil, errorf("%w (limit %d)", ErrMaxContainers, rt.MaxContainers)
+	}
+	return f, nil
+}
+
 // DefaultRuntime is the default Runtime configuration.
 var DefaultRuntime = Runtime{
 	Root:          "/run/lxcri",
@@ -609,10 +1463,10 @@ var DefaultRuntime = Runtime{
 	},
 
 	Timeouts: Timeouts{
-		CreateTimeout: 60,
-		StartTimeout:  30,
-		KillTimeout:   10,
-		DeleteTimeout: 10,
+		CreateTimeout: Timeout(time.Minute),
+		StartTimeout:  Timeout(time.Second * 30),
+		KillTimeout:   Timeout(time.Second * 10),
+		DeleteTimeout: Timeout(time.Second * 10),
 	},
 }
 
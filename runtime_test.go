@@ -2,9 +2,15 @@ package lxcri
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -67,6 +73,57 @@ func newConfig(t *testing.T, cmd string, args ...string) *ContainerConfig {
 	return &cfg
 }
 
+// setRootlessIDMappings maps the container root user to an unprivileged host user
+// if the tests do not run as root.
+func setRootlessIDMappings(cfg *ContainerConfig) {
+	if os.Getuid() == 0 {
+		return
+	}
+	cfg.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 20000, Size: 65536},
+	}
+	cfg.Spec.Linux.GIDMappings = []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 20000, Size: 65536},
+	}
+}
+
+// receiveConsoleFd listens on the given console socket path and returns
+// a channel that receives the pty master fd sent by the runtime, or -1 on error.
+func receiveConsoleFd(t *testing.T, socket string) <-chan int {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	ptmx := make(chan int, 1)
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			ptmx <- -1
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 32)
+		oob := make([]byte, unix.CmsgSpace(4))
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			ptmx <- -1
+			return
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) == 0 {
+			ptmx <- -1
+			return
+		}
+		fds, err := unix.ParseUnixRights(&msgs[0])
+		if err != nil || len(fds) == 0 {
+			ptmx <- -1
+			return
+		}
+		ptmx <- fds[0]
+	}()
+	return ptmx
+}
+
 func TestEmptyNamespaces(t *testing.T) {
 	t.Parallel()
 
@@ -127,14 +184,7 @@ func TestNonEmptyCgroup(t *testing.T) {
 	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
 	defer removeAll(t, cfg.Spec.Root.Path)
 
-	if os.Getuid() != 0 {
-		cfg.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
-			{ContainerID: 0, HostID: 20000, Size: 65536},
-		}
-		cfg.Spec.Linux.GIDMappings = []specs.LinuxIDMapping{
-			{ContainerID: 0, HostID: 20000, Size: 65536},
-		}
-	}
+	setRootlessIDMappings(cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
@@ -151,17 +201,11 @@ func TestNonEmptyCgroup(t *testing.T) {
 
 	cfg2.Spec.Linux.CgroupsPath = cfg.Spec.Linux.CgroupsPath
 
-	if os.Getuid() != 0 {
-		cfg2.Spec.Linux.UIDMappings = []specs.LinuxIDMapping{
-			{ContainerID: 0, HostID: 20000, Size: 65536},
-		}
-		cfg2.Spec.Linux.GIDMappings = []specs.LinuxIDMapping{
-			{ContainerID: 0, HostID: 20000, Size: 65536},
-		}
-	}
+	setRootlessIDMappings(cfg2)
 
 	c2, err := rt.Create(ctx, cfg2)
 	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrCgroupNotEmpty), err)
 	t.Logf("expected create error: %s", err)
 
 	err = c.Delete(ctx, true)
@@ -253,3 +297,749 @@ func testRuntime(t *testing.T, rt *Runtime, cfg *ContainerConfig) {
 	err = c.Delete(ctx, true)
 	require.NoError(t, err)
 }
+
+func TestLoadIncompatibleRuntime(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp(rt.Root, "lxcri-test")
+	require.NoError(t, err)
+	defer removeAll(t, dir)
+	id := filepath.Base(dir)
+
+	c := &Container{
+		ContainerConfig: &ContainerConfig{
+			ContainerID: id,
+			Spec:        specki.NewSpec("/", "/bin/true"),
+		},
+		StateVersion:      StateVersion,
+		RuntimeVersion:    "0.0.0-other",
+		RuntimeLibexecDir: "/other/libexec",
+		runtimeDir:        dir,
+	}
+	err = touchFile(c.ConfigFilePath(), 0640)
+	require.NoError(t, err)
+	err = specki.EncodeJSONFile(c.RuntimePath("lxcri.json"), c, os.O_EXCL|os.O_CREATE, 0640)
+	require.NoError(t, err)
+
+	// A container created by a different runtime version is loaded,
+	// so that it can be managed after a runtime upgrade.
+	loaded, err := rt.Load(id)
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0-other", loaded.RuntimeVersion)
+	require.NoError(t, loaded.Release())
+
+	c.StateVersion = StateVersion + 1
+	err = specki.EncodeJSONFile(c.RuntimePath("lxcri.json"), c, os.O_TRUNC, 0440)
+	require.NoError(t, err)
+
+	_, err = rt.Load(id)
+	require.True(t, errors.Is(err, ErrIncompatibleRuntime))
+	t.Logf("expected load error: %s", err)
+
+	// The runtime directory of an incompatible container must not be removed.
+	err = rt.Delete(context.Background(), id, true)
+	require.True(t, errors.Is(err, ErrIncompatibleRuntime))
+	require.DirExists(t, dir)
+}
+
+func TestDeleteKeepCgroup(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	setRootlessIDMappings(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtKeep := *rt
+	rtKeep.KeepCgroup = true
+
+	c, err := rtKeep.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	cgroupDir := filepath.Join(cgroupRoot, c.CgroupDir)
+
+	err = c.Release()
+	require.NoError(t, err)
+
+	err = rtKeep.Delete(ctx, cfg.ContainerID, true)
+	require.NoError(t, err)
+	require.DirExists(t, cgroupDir)
+
+	err = rtKeep.Prune(ctx)
+	require.NoError(t, err)
+	require.NoDirExists(t, cgroupDir)
+}
+
+func TestOOMKilled(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Annotations = map[string]string{
+		rawConfigItemAnnotationPrefix + "lxc.cgroup2.memory.max":      "32M",
+		rawConfigItemAnnotationPrefix + "lxc.cgroup2.memory.swap.max": "0",
+	}
+	cfg.Spec.Process.Env = []string{"ALLOC_MB=128"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	// poll the state like the kubelet does
+	var state *State
+	for {
+		state, err = c.State()
+		require.NoError(t, err)
+		if state.SpecState.Status == specs.StateStopped {
+			break
+		}
+		require.NoError(t, ctx.Err())
+		time.Sleep(time.Millisecond * 10)
+	}
+	require.True(t, state.OOMKilled)
+
+	// the OOM kill is persisted after the cgroup is removed
+	err = c.waitMonitorStopped(ctx)
+	require.NoError(t, err)
+	state, err = c.State()
+	require.NoError(t, err)
+	require.True(t, state.OOMKilled)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestEmptyLinux(t *testing.T) {
+	t.Parallel()
+
+	spec := specki.NewSpec("/", "/bin/true")
+	spec.Linux = nil
+	// The empty spec.Linux has no mount namespace.
+	err := rt.checkSpec(spec)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mount namespace is not defined")
+	require.Equal(t, &specs.Linux{}, spec.Linux)
+}
+
+func TestEmptyLinuxCreate(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Linux = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// Without spec.Linux no namespaces are defined,
+	// so the mount namespace would be shared with the runtime.
+	c, err := rt.Create(ctx, cfg)
+	require.Error(t, err)
+	t.Logf("create error: %s", err)
+	require.Nil(t, c)
+	require.NotNil(t, cfg.Spec.Linux)
+	require.Empty(t, cfg.Spec.Linux.Namespaces)
+	require.Nil(t, cfg.Spec.Linux.Resources)
+
+	// The defaulted spec.Linux only lacks a mount namespace.
+	cfg2 := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg2.Spec.Root.Path)
+	cfg2.Spec.Linux = nil
+	require.Error(t, rt.checkSpec(cfg2.Spec))
+	cfg2.Spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.MountNamespace}}
+
+	c, err = rt.Create(ctx, cfg2)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreated, state.SpecState.Status)
+	require.NoError(t, c.Delete(ctx, true))
+}
+
+func TestWaitRunning(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	running := make(chan error, 1)
+	go func() {
+		running <- c.WaitRunning(ctx)
+	}()
+
+	select {
+	case err := <-running:
+		t.Fatalf("WaitRunning returned before start: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	err = <-running
+	require.NoError(t, err)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestConsoleSize(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Process.Terminal = true
+	cfg.Spec.Process.ConsoleSize = &specs.Box{Height: 40, Width: 120}
+	cfg.ConsoleSocket = filepath.Join(cfg.Spec.Root.Path, "console.sock")
+
+	ptmx := receiveConsoleFd(t, cfg.ConsoleSocket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	fd := <-ptmx
+	require.True(t, fd > 0)
+	defer unix.Close(fd)
+
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	require.NoError(t, err)
+	require.Equal(t, uint16(40), ws.Row)
+	require.Equal(t, uint16(120), ws.Col)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestCheckLibexecVersion(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "lxcri-test-libexec")
+	require.NoError(t, err)
+	defer removeAll(t, dir)
+
+	writeStub := func(name string, version string) {
+		script := fmt.Sprintf("#!/bin/sh\necho %s\n", version)
+		err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+		require.NoError(t, err)
+	}
+	for _, name := range []string{ExecStart, ExecHook, ExecHookBuiltin, ExecInit} {
+		writeStub(name, "1.0.0")
+	}
+
+	rtStub := Runtime{LibexecDir: dir}
+	ctx := context.Background()
+
+	require.NoError(t, rtStub.checkLibexecVersion(ctx, "1.0.0"))
+	require.NoError(t, rtStub.checkLibexecVersion(ctx, "undefined"))
+
+	// The cached version is used if the executable is unmodified.
+	initPath := filepath.Join(dir, ExecInit)
+	info, err := os.Stat(initPath)
+	require.NoError(t, err)
+	writeStub(ExecInit, "X.X.X")
+	require.NoError(t, os.Chtimes(initPath, info.ModTime(), info.ModTime()))
+	require.NoError(t, rtStub.checkLibexecVersion(ctx, "1.0.0"))
+
+	// partial upgrade
+	writeStub(ExecInit, "0.9.0")
+	mtime := info.ModTime().Add(time.Second)
+	require.NoError(t, os.Chtimes(initPath, mtime, mtime))
+	err = rtStub.checkLibexecVersion(ctx, "1.0.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ExecInit)
+	t.Logf("expected version error: %s", err)
+}
+
+func TestDialConsoleSocketRetry(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "lxcri-test-console")
+	require.NoError(t, err)
+	defer removeAll(t, dir)
+
+	consoleSocket := filepath.Join(dir, "console.sock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// The socket is created after the first connection attempts have failed.
+	listening := make(chan *net.UnixListener, 1)
+	go func() {
+		time.Sleep(consoleSocketDialInterval * 3)
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: consoleSocket, Net: "unix"})
+		if err != nil {
+			t.Log(err)
+		}
+		listening <- l
+	}()
+
+	c, err := rt.dialConsoleSocket(ctx, consoleSocket)
+	require.NoError(t, err)
+	c.Close()
+
+	l := <-listening
+	require.NotNil(t, l)
+	l.Close()
+}
+
+func TestDialConsoleSocketAttempts(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := rt.dialConsoleSocket(ctx, "/nonexistent/console.sock")
+	require.Error(t, err)
+	require.True(t, errors.Is(err, unix.ENOENT))
+}
+
+func TestStartConsoleSendFailure(t *testing.T) {
+	countFds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	// The peer of the console socket connection is closed,
+	// so sending the pty file descriptor fails.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	require.NoError(t, unix.Close(fds[1]))
+	f := os.NewFile(uintptr(fds[0]), "console")
+	c, err := net.FileConn(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	defer c.Close()
+
+	fdsBefore := countFds()
+
+	cmd := exec.Command("sleep", "30")
+	err = rt.startConsole(cmd, c.(*net.UnixConn), nil)
+	require.Error(t, err)
+	t.Logf("expected console error: %s", err)
+
+	// The started process is killed and reaped.
+	require.NotNil(t, cmd.ProcessState)
+	require.False(t, cmd.ProcessState.Success())
+	require.Equal(t, unix.ESRCH, unix.Kill(cmd.Process.Pid, 0))
+
+	// The pty and the socket file are closed.
+	require.Equal(t, fdsBefore, countFds())
+}
+
+func TestStartConsoleFile(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer unix.Close(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "console-socket")
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, rt.runStartCmdConsoleFile(ctx, cmd, f, nil))
+	defer func() {
+		require.NoError(t, cmd.Process.Kill())
+		_ = cmd.Wait()
+	}()
+
+	// The pty master fd is sent to the peer of the console socket.
+	buf := make([]byte, 64)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(fds[1], buf, oob, 0)
+	require.NoError(t, err)
+	require.Equal(t, "terminal", string(buf[:n]))
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	ptyFds, err := unix.ParseUnixRights(&msgs[0])
+	require.NoError(t, err)
+	require.Len(t, ptyFds, 1)
+	defer unix.Close(ptyFds[0])
+
+	_, err = unix.IoctlGetTermios(ptyFds[0], unix.TCGETS)
+	require.NoError(t, err, "received fd is not a terminal")
+}
+
+func TestConsoleSocketConn(t *testing.T) {
+	f, err := os.CreateTemp("", "lxcri-test-console")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = consoleSocketConn(f)
+	require.Error(t, err)
+
+	// An UDP socket is not a unix socket.
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	sock := os.NewFile(uintptr(fd), "udp")
+	defer sock.Close()
+	_, err = consoleSocketConn(sock)
+	require.Error(t, err)
+}
+
+func TestConsoleLog(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	cfg.Spec.Process.Terminal = true
+	cfg.Spec.Process.Env = append(cfg.Spec.Process.Env, "SLEEP=1")
+	cfg.ConsoleSocket = filepath.Join(cfg.Spec.Root.Path, "console.sock")
+	cfg.ConsoleLog = filepath.Join(cfg.Spec.Root.Path, "console.log")
+
+	ptmx := receiveConsoleFd(t, cfg.ConsoleSocket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	fd := <-ptmx
+	require.True(t, fd > 0)
+	console := os.NewFile(uintptr(fd), "ptmx")
+	defer console.Close()
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	// read the console output from the socket consumer side
+	var out []byte
+	buf := make([]byte, 1024)
+	for !strings.Contains(string(out), "begin") {
+		n, err := console.Read(buf)
+		require.NoError(t, err)
+		out = append(out, buf[:n]...)
+	}
+
+	// The follow reader returns io.EOF when the monitor process has exited
+	// and the console log is complete.
+	r, err := c.ReadConsoleLog(true)
+	require.NoError(t, err)
+	log, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Contains(t, string(log), "begin")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestDeleteIncomplete(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=0"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	err = c.waitMonitorStopped(ctx)
+	require.NoError(t, err)
+	cgroupDir := filepath.Join(cgroupRoot, c.CgroupDir)
+	require.NoError(t, c.Release())
+
+	// simulate a create that failed before lxcri.json was written
+	err = os.Remove(c.RuntimePath("lxcri.json"))
+	require.NoError(t, err)
+
+	err = rt.Delete(ctx, c.ContainerID, true)
+	require.NoError(t, err)
+
+	_, err = os.Stat(c.RuntimePath())
+	require.True(t, os.IsNotExist(err), "runtime directory was not removed")
+	_, err = os.Stat(cgroupDir)
+	require.True(t, os.IsNotExist(err), "cgroup was not removed")
+}
+
+func TestPoststartHookFailure(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+
+	marker := filepath.Join(t.TempDir(), "poststart")
+	cfg.Spec.Hooks = &specs.Hooks{
+		Poststart: []specs.Hook{
+			{Path: "/bin/false"},
+			// The remaining hooks are executed after a failed hook.
+			{Path: "/bin/touch", Args: []string{"touch", marker}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	err = rt.Start(ctx, c)
+	require.NoError(t, err)
+
+	require.FileExists(t, marker)
+
+	state, err := c.State()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state.SpecState.Status)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestReopenLogFileOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "lxcri.log")
+
+	rtLog := Runtime{LogConfig: LogConfig{LogFile: logFile, LogLevel: "info"}}
+	require.NoError(t, rtLog.ConfigureLogger())
+	defer rtLog.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtLog.ReopenLogFileOnSignal(ctx)
+
+	rtLog.Log.Info().Msg("before rotate")
+
+	// simulate logrotate
+	rotated := logFile + ".1"
+	require.NoError(t, os.Rename(logFile, rotated))
+	require.NoError(t, unix.Kill(os.Getpid(), unix.SIGHUP))
+
+	// The signal is handled asynchronously.
+	var data []byte
+	for i := 0; i < 100; i++ {
+		rtLog.Log.Info().Msg("after rotate")
+		data, _ = os.ReadFile(logFile)
+		if strings.Contains(string(data), "after rotate") {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	require.Contains(t, string(data), "after rotate")
+	require.NotContains(t, string(data), "before rotate")
+
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "before rotate")
+}
+
+func TestMonitorSession(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	// The monitor process is the leader of a new session and process group.
+	pgid, err := unix.Getpgid(c.Pid)
+	require.NoError(t, err)
+	require.Equal(t, c.Pid, pgid)
+	require.NotEqual(t, unix.Getpgrp(), pgid)
+
+	sid, err := unix.Getsid(c.Pid)
+	require.NoError(t, err)
+	require.Equal(t, c.Pid, sid)
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestCreateErrorLogTail(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	logFile := filepath.Join(cfg.Spec.Root.Path, "..", cfg.ContainerID+".log")
+	defer os.Remove(logFile)
+	cfg.LogFile = logFile
+	cfg.LogLevel = "error"
+
+	// liblxc fails to apply the invalid limit and the monitor process exits.
+	cfg.Spec.Linux.Resources = &specs.LinuxResources{
+		Unified: map[string]string{"pids.max": "invalid"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--- container log "+logFile+" ---")
+	require.Contains(t, err.Error(), "lxc "+cfg.ContainerID+" ")
+
+	require.NoError(t, c.Delete(ctx, true))
+}
+
+// NOTE This test is not parallel because it mocks featureProbes.
+func TestCheckFeatures(t *testing.T) {
+	probes := featureProbes
+	defer func() { featureProbes = probes }()
+
+	supported := func() bool { return true }
+	unsupported := func() bool { return false }
+
+	featureProbes.Cgroup2 = supported
+	featureProbes.CgroupDevices = supported
+	featureProbes.Apparmor = supported
+	featureProbes.Seccomp = unsupported
+
+	// Seccomp is disabled, the other features are kept.
+	rtX := *rt
+	rtX.Features = RuntimeFeatures{Seccomp: true, Apparmor: true, CgroupDevices: true, Capabilities: true}
+	require.NoError(t, rtX.checkFeatures())
+	require.Equal(t, RuntimeFeatures{Seccomp: false, Apparmor: true, CgroupDevices: true, Capabilities: true}, rtX.Features)
+
+	// A disabled feature is not probed.
+	featureProbes.Seccomp = func() bool {
+		t.Fatal("unexpected seccomp probe")
+		return false
+	}
+	rtX.Features = RuntimeFeatures{}
+	require.NoError(t, rtX.checkFeatures())
+
+	// cgroup2 support is required.
+	featureProbes.Cgroup2 = unsupported
+	require.Error(t, rtX.checkFeatures())
+}
+
+func TestLogFormat(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "lxcri.log")
+
+	// JSON output to the log file.
+	rtLog := Runtime{LogConfig: LogConfig{LogFile: logFile, LogLevel: "info", LogFormat: LogFormatJSON}}
+	require.NoError(t, rtLog.ConfigureLogger())
+	rtLog.Log.Info().Msg("json to file")
+	require.NoError(t, rtLog.Release())
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &entry))
+	require.Equal(t, "json to file", entry["m"])
+
+	// Pretty output to stderr.
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	require.NoError(t, err)
+	defer stderr.Close()
+	origStderr := os.Stderr
+	os.Stderr = stderr
+	rtLog = Runtime{LogConfig: LogConfig{LogConsole: true, LogLevel: "info", LogFormat: LogFormatConsole}}
+	err = rtLog.ConfigureLogger()
+	os.Stderr = origStderr
+	require.NoError(t, err)
+	rtLog.Log.Info().Msg("console to stderr")
+
+	data, err = os.ReadFile(stderr.Name())
+	require.NoError(t, err)
+	require.Contains(t, string(data), "console to stderr")
+	require.Error(t, json.Unmarshal(data, &entry))
+
+	rtLog.LogConfig.LogFormat = "xml"
+	require.Error(t, rtLog.ConfigureLogger())
+}
+
+func TestParseTimeout(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"1500ms": time.Millisecond * 1500,
+		"2m":     time.Minute * 2,
+		"60":     time.Second * 60,
+		"0":      0,
+	} {
+		timeout, err := ParseTimeout(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, timeout.Duration(), s)
+	}
+
+	for _, s := range []string{"", "-1s", "10x", "1.5"} {
+		_, err := ParseTimeout(s)
+		require.Error(t, err, s)
+	}
+
+	// Timeouts in the config file are either durations or seconds.
+	var timeouts Timeouts
+	require.NoError(t, json.Unmarshal([]byte(`{"CreateTimeout": "1500ms", "StartTimeout": 30, "KillTimeout": "10"}`), &timeouts))
+	require.Equal(t, Timeouts{
+		CreateTimeout: Timeout(time.Millisecond * 1500),
+		StartTimeout:  Timeout(time.Second * 30),
+		KillTimeout:   Timeout(time.Second * 10),
+	}, timeouts)
+
+	data, err := json.Marshal(timeouts)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"CreateTimeout": "1.5s", "StartTimeout": "30s", "KillTimeout": "10s"}`, string(data))
+}
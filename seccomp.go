@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/lxc/lxcri/pkg/specki"
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
@@ -21,9 +23,111 @@ var seccompAction = map[specs.LinuxSeccompAction]string{
 	//specs.ActKillProcess: "kill_process",
 }
 
-// Note seccomp flags (see `man 2 seccomp`) are currently not supported
+// Seccomp filter flags (see `man 2 seccomp`)
+const (
+	seccompFlagTsync     specs.LinuxSeccompFlag = "SECCOMP_FILTER_FLAG_TSYNC"
+	seccompFlagLog       specs.LinuxSeccompFlag = "SECCOMP_FILTER_FLAG_LOG"
+	seccompFlagSpecAllow specs.LinuxSeccompFlag = "SECCOMP_FILTER_FLAG_SPEC_ALLOW"
+)
+
+// checkSeccompFlags checks the given seccomp filter flags.
+// liblxc loads the seccomp filter in the single threaded container init process,
+// so SECCOMP_FILTER_FLAG_TSYNC is implied.
+// The liblxc seccomp policy has no equivalent for SECCOMP_FILTER_FLAG_LOG and
+// SECCOMP_FILTER_FLAG_SPEC_ALLOW. Dropping them does not weaken the filter,
+// so they are ignored with a warning. Unknown flags are rejected.
+func checkSeccompFlags(rt *Runtime, flags []specs.LinuxSeccompFlag) error {
+	for _, flag := range flags {
+		switch flag {
+		case seccompFlagTsync:
+			rt.Log.Debug().Str("flag", string(flag)).Msg("seccomp flag is implied")
+		case seccompFlagLog, seccompFlagSpecAllow:
+			rt.Log.Warn().Str("flag", string(flag)).Msg("seccomp flag is not supported by liblxc - ignored")
+		default:
+			return fmt.Errorf("unknown seccomp flag %q", flag)
+		}
+	}
+	return nil
+}
+
+const seccompProfileAnnotation = "org.linuxcontainers.lxcri.seccomp.profile"
+
+func configureSeccomp(rt *Runtime, c *Container) error {
+	if name, ok := c.Spec.Annotations[seccompProfileAnnotation]; ok {
+		// The annotation must not weaken the seccomp profile from the spec.
+		if c.Spec.Linux.Seccomp != nil {
+			return fmt.Errorf("annotation %s is not allowed if the spec defines a seccomp profile", seccompProfileAnnotation)
+		}
+		filename, err := rt.seccompProfilePath(name)
+		if err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", seccompProfileAnnotation, err)
+		}
+		seccomp, err := loadSeccompProfile(filename)
+		if err != nil {
+			return err
+		}
+		rt.Log.Info().Str("profile", filename).Msg("using seccomp profile from annotation")
+		c.Spec.Linux.Seccomp = seccomp
+	}
+
+	if c.Spec.Linux.Seccomp == nil && rt.DefaultSeccompProfile != "" {
+		seccomp, err := loadSeccompProfile(rt.DefaultSeccompProfile)
+		if err != nil {
+			return err
+		}
+		rt.Log.Info().Str("profile", rt.DefaultSeccompProfile).Msg("spec has no seccomp profile - using default seccomp profile")
+		c.Spec.Linux.Seccomp = seccomp
+	}
+
+	if c.Spec.Linux.Seccomp == nil || len(c.Spec.Linux.Seccomp.Syscalls) == 0 {
+		return nil
+	}
+	profilePath := c.RuntimePath("seccomp.conf")
+	if err := writeSeccompProfile(rt, profilePath, c.Spec.Linux.Seccomp); err != nil {
+		return err
+	}
+	return c.setConfigItem("lxc.seccomp.profile", profilePath)
+}
+
+// seccompProfilePath returns the path of the seccomp profile with the given name.
+// The name is a path relative to SeccompProfileDir.
+// The returned path (with symlinks resolved) must be within SeccompProfileDir.
+func (rt *Runtime) seccompProfilePath(name string) (string, error) {
+	if rt.SeccompProfileDir == "" {
+		return "", fmt.Errorf("seccomp profile dir is not configured")
+	}
+	dir, err := filepath.EvalSymlinks(rt.SeccompProfileDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve seccomp profile dir: %w", err)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve seccomp profile %q: %w", name, err)
+	}
+	if !strings.HasPrefix(p, dir+"/") {
+		return "", fmt.Errorf("seccomp profile %q is not within the seccomp profile dir %s", name, rt.SeccompProfileDir)
+	}
+	return p, nil
+}
+
+// loadSeccompProfile loads an OCI seccomp profile (specs.LinuxSeccomp) from the given JSON file.
+func loadSeccompProfile(filename string) (*specs.LinuxSeccomp, error) {
+	var seccomp specs.LinuxSeccomp
+	if err := specki.DecodeJSONFile(filename, &seccomp); err != nil {
+		return nil, fmt.Errorf("failed to load seccomp profile: %w", err)
+	}
+	if _, err := defaultAction(&seccomp); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", filename, err)
+	}
+	return &seccomp, nil
+}
+
 // https://github.com/opencontainers/runtime-spec/blob/v1.0.2/config-linux.md#seccomp
-func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error {
+func writeSeccompProfile(rt *Runtime, profilePath string, seccomp *specs.LinuxSeccomp) error {
+	if err := checkSeccompFlags(rt, seccomp.Flags); err != nil {
+		return err
+	}
+
 	// #nosec
 	profile, err := os.OpenFile(profilePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0440)
 	if err != nil {
@@ -43,16 +147,19 @@ func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error
 	}
 	fmt.Fprintf(w, "allowlist %s\n", action)
 
+	rules, err := seccompRules(rt, seccomp.Syscalls)
+	if err != nil {
+		return err
+	}
+
 	platformArchs, err := seccompArchs(seccomp)
 	if err != nil {
 		return fmt.Errorf("failed to detect platform architecture: %w", err)
 	}
 	for _, arch := range platformArchs {
 		fmt.Fprintf(w, "[%s]\n", arch)
-		for _, sc := range seccomp.Syscalls {
-			if err := writeSeccompSyscall(w, sc); err != nil {
-				return err
-			}
+		for _, r := range rules {
+			fmt.Fprintln(w, r)
 		}
 	}
 	// ensure profile is written to disk without errors
@@ -101,11 +208,33 @@ func seccompArchs(seccomp *specs.LinuxSeccomp) ([]string, error) {
 	return archs, nil
 }
 
-func writeSeccompSyscall(w *bufio.Writer, sc specs.LinuxSyscall) error {
-	for _, name := range sc.Names {
+// seccompRule is a single liblxc seccomp rule.
+type seccompRule struct {
+	name   string
+	action string
+	// arg is the formatted argument comparison (optional)
+	arg string
+}
+
+func (r seccompRule) String() string {
+	if r.arg == "" {
+		return r.name + " " + r.action
+	}
+	return r.name + " " + r.action + " " + r.arg
+}
+
+// seccompRules converts the given syscalls to liblxc seccomp rules.
+// Rules for the same syscall (and argument comparison) are de-duplicated.
+// If the actions of duplicate rules conflict, the last defined action wins.
+// The rules are returned in the order they are first defined.
+func seccompRules(rt *Runtime, syscalls []specs.LinuxSyscall) ([]seccompRule, error) {
+	rules := make([]seccompRule, 0, len(syscalls))
+	index := make(map[string]int, len(syscalls))
+
+	for _, sc := range syscalls {
 		action, ok := seccompAction[sc.Action]
 		if !ok {
-			return fmt.Errorf("unsupported seccomp action: %s", sc.Action)
+			return nil, fmt.Errorf("unsupported seccomp action: %s", sc.Action)
 		}
 
 		if sc.Action == specs.ActErrno {
@@ -116,19 +245,37 @@ func writeSeccompSyscall(w *bufio.Writer, sc specs.LinuxSyscall) error {
 			action = fmt.Sprintf("%s %d", action, ret)
 		}
 
-		if len(sc.Args) == 0 {
-			fmt.Fprintf(w, "%s %s\n", name, action)
-		} else {
-			// Only write a single argument per line - this is required when the same arg.Index is used multiple times.
-			// from `man 7 seccomp_rule_add_exact_array`
-			// "When adding syscall argument comparisons to the filter it is important to remember
-			// that while it is possible to have multiple comparisons in a single rule,
-			// you can only compare each argument once in a single rule.
-			// In other words, you can not have multiple comparisons of the 3rd syscall argument in a single rule."
+		// Only write a single argument per line - this is required when the same arg.Index is used multiple times.
+		// from `man 7 seccomp_rule_add_exact_array`
+		// "When adding syscall argument comparisons to the filter it is important to remember
+		// that while it is possible to have multiple comparisons in a single rule,
+		// you can only compare each argument once in a single rule.
+		// In other words, you can not have multiple comparisons of the 3rd syscall argument in a single rule."
+		args := []string{""}
+		if len(sc.Args) > 0 {
+			args = args[0:0]
 			for _, arg := range sc.Args {
-				fmt.Fprintf(w, "%s %s [%d,%d,%s,%d]\n", name, action, arg.Index, arg.Value, arg.Op, arg.ValueTwo)
+				args = append(args, fmt.Sprintf("[%d,%d,%s,%d]", arg.Index, arg.Value, arg.Op, arg.ValueTwo))
+			}
+		}
+
+		for _, name := range sc.Names {
+			for _, arg := range args {
+				r := seccompRule{name: name, action: action, arg: arg}
+				key := name + " " + arg
+				i, exist := index[key]
+				if !exist {
+					index[key] = len(rules)
+					rules = append(rules, r)
+					continue
+				}
+				if rules[i].action != action {
+					rt.Log.Warn().Str("syscall", name).Str("arg", arg).
+						Msgf("conflicting seccomp actions %q and %q - using %q", rules[i].action, action, action)
+				}
+				rules[i].action = action
 			}
 		}
 	}
-	return nil
+	return rules, nil
 }
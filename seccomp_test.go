@@ -0,0 +1,217 @@
+package lxcri
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeccompRulesConflict(t *testing.T) {
+	errnoRet := uint(1)
+	syscalls := []specs.LinuxSyscall{
+		{Names: []string{"read", "write"}, Action: specs.ActAllow},
+		{Names: []string{"read"}, Action: specs.ActErrno, ErrnoRet: &errnoRet},
+		{Names: []string{"write"}, Action: specs.ActAllow},
+		{Names: []string{"close"}, Action: specs.ActAllow,
+			Args: []specs.LinuxSeccompArg{{Index: 0, Value: 1, Op: specs.OpEqualTo}}},
+		{Names: []string{"close"}, Action: specs.ActKill,
+			Args: []specs.LinuxSeccompArg{{Index: 0, Value: 2, Op: specs.OpEqualTo}}},
+	}
+
+	rt := Runtime{}
+	rules, err := seccompRules(&rt, syscalls)
+	require.NoError(t, err)
+
+	lines := make([]string, len(rules))
+	for i, r := range rules {
+		lines[i] = r.String()
+	}
+	require.Equal(t, []string{
+		"read errno 1",
+		"write allow",
+		"close allow [0,1,SCMP_CMP_EQ,0]",
+		"close kill [0,2,SCMP_CMP_EQ,0]",
+	}, lines)
+}
+
+func TestWriteSeccompProfile(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		// flags without liblxc equivalent do not modify the policy
+		Flags: []specs.LinuxSeccompFlag{seccompFlagTsync, seccompFlagLog},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read"}, Action: specs.ActErrno},
+			{Names: []string{"read"}, Action: specs.ActAllow},
+		},
+	}
+
+	rt := Runtime{}
+	p := filepath.Join(tmpdir, "seccomp.conf")
+	err := writeSeccompProfile(&rt, p, seccomp)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(p)
+	require.NoError(t, err)
+	arch, err := seccompArchs(seccomp)
+	require.NoError(t, err)
+	require.Equal(t, "2\nallowlist errno 0\n["+arch[0]+"]\nread allow\n", string(data))
+
+	// The profile is not written if a flag is unknown.
+	seccomp.Flags = append(seccomp.Flags, "SECCOMP_FILTER_FLAG_NOSUCHFLAG")
+	p2 := filepath.Join(tmpdir, "seccomp2.conf")
+	err = writeSeccompProfile(&rt, p2, seccomp)
+	require.EqualError(t, err, `unknown seccomp flag "SECCOMP_FILTER_FLAG_NOSUCHFLAG"`)
+	require.NoFileExists(t, p2)
+}
+
+func TestCheckSeccompFlags(t *testing.T) {
+	rt := Runtime{}
+	require.NoError(t, checkSeccompFlags(&rt, nil))
+	require.NoError(t, checkSeccompFlags(&rt, []specs.LinuxSeccompFlag{
+		seccompFlagTsync,
+		seccompFlagLog,
+		seccompFlagSpecAllow,
+	}))
+	err := checkSeccompFlags(&rt, []specs.LinuxSeccompFlag{seccompFlagTsync, "SECCOMP_FILTER_FLAG_NOSUCHFLAG"})
+	require.Error(t, err)
+}
+
+func TestLoadSeccompProfile(t *testing.T) {
+	dir := t.TempDir()
+
+	p := filepath.Join(dir, "profile.json")
+	err := os.WriteFile(p, []byte(`{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read"],"action":"SCMP_ACT_ALLOW"}]}`), 0600)
+	require.NoError(t, err)
+	seccomp, err := loadSeccompProfile(p)
+	require.NoError(t, err)
+	require.Equal(t, specs.ActErrno, seccomp.DefaultAction)
+	require.Len(t, seccomp.Syscalls, 1)
+
+	err = os.WriteFile(p, []byte(`{"defaultAction":"SCMP_ACT_INVALID"}`), 0600)
+	require.NoError(t, err)
+	_, err = loadSeccompProfile(p)
+	require.Error(t, err)
+
+	_, err = loadSeccompProfile(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	setRootlessIDMappings(cfg)
+	require.Nil(t, cfg.Spec.Linux.Seccomp)
+
+	profile := filepath.Join(cfg.Spec.Root.Path, "seccomp.json")
+	err := os.WriteFile(profile, []byte(`{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["kexec_load"],"action":"SCMP_ACT_ERRNO"}]}`), 0600)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtDefault := *rt
+	rtDefault.Features.Seccomp = true
+	rtDefault.DefaultSeccompProfile = profile
+
+	c, err := rtDefault.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	require.Equal(t, c.RuntimePath("seccomp.conf"), c.getConfigItem("lxc.seccomp.profile"))
+	data, err := os.ReadFile(c.RuntimePath("seccomp.conf"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "kexec_load errno 0")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestSeccompProfilePath(t *testing.T) {
+	dir := t.TempDir()
+
+	profileDir := filepath.Join(dir, "profiles")
+	require.NoError(t, os.MkdirAll(filepath.Join(profileDir, "sub"), 0755))
+	for _, p := range []string{"outside.json", "profiles/default.json", "profiles/sub/strict.json"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p), []byte("{}"), 0600))
+	}
+	require.NoError(t, os.Symlink("../outside.json", filepath.Join(profileDir, "link.json")))
+
+	rtProfile := Runtime{}
+	_, err := rtProfile.seccompProfilePath("default.json")
+	require.Error(t, err, "profile dir is not configured")
+
+	rtProfile.SeccompProfileDir = profileDir
+	p, err := rtProfile.seccompProfilePath("default.json")
+	require.NoError(t, err)
+	require.Equal(t, "default.json", filepath.Base(p))
+
+	_, err = rtProfile.seccompProfilePath("sub/strict.json")
+	require.NoError(t, err)
+
+	for _, name := range []string{"../outside.json", "sub/../../outside.json", "link.json", "missing.json", "", "."} {
+		_, err = rtProfile.seccompProfilePath(name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestSeccompProfileAnnotation(t *testing.T) {
+	t.Parallel()
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+
+	setRootlessIDMappings(cfg)
+
+	profileDir, err := os.MkdirTemp("", "lxcri-test-seccomp")
+	require.NoError(t, err)
+	defer removeAll(t, profileDir)
+
+	err = os.WriteFile(filepath.Join(profileDir, "profile.json"),
+		[]byte(`{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["kexec_load"],"action":"SCMP_ACT_ERRNO"}]}`), 0600)
+	require.NoError(t, err)
+
+	cfg.Spec.Annotations = map[string]string{seccompProfileAnnotation: "profile.json"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// use a copy, because the runtime is shared by parallel tests
+	rtProfile := *rt
+	rtProfile.Features.Seccomp = true
+	rtProfile.SeccompProfileDir = profileDir
+
+	c, err := rtProfile.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	data, err := os.ReadFile(c.RuntimePath("seccomp.conf"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "kexec_load errno 0")
+
+	err = c.Delete(ctx, true)
+	require.NoError(t, err)
+}
+
+func TestSeccompProfileAnnotationSpecProfile(t *testing.T) {
+	spec := specki.NewSpec("/tmp", "/bin/true")
+	spec.Linux.Seccomp = &specs.LinuxSeccomp{DefaultAction: specs.ActErrno}
+	spec.Annotations = map[string]string{seccompProfileAnnotation: "profile.json"}
+	c := &Container{ContainerConfig: &ContainerConfig{Spec: spec}}
+
+	err := configureSeccomp(rt, c)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), seccompProfileAnnotation)
+	require.Equal(t, specs.ActErrno, c.Spec.Linux.Seccomp.DefaultAction)
+}
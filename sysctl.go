@@ -0,0 +1,71 @@
+package lxcri
+
+import (
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ipcSysctls are the sysctls of the ipc namespace (see `man 7 ipc_namespaces`).
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// sysctlNamespace returns the namespace of the given sysctl
+// or false if the sysctl is not namespaced.
+func sysctlNamespace(key string) (specs.LinuxNamespaceType, bool) {
+	key = strings.ReplaceAll(key, "/", ".")
+	switch {
+	case ipcSysctls[key], strings.HasPrefix(key, "fs.mqueue."):
+		return specs.IPCNamespace, true
+	case strings.HasPrefix(key, "net."):
+		return specs.NetworkNamespace, true
+	case key == "kernel.hostname", key == "kernel.domainname":
+		return specs.UTSNamespace, true
+	}
+	return "", false
+}
+
+// checkSysctls checks that the namespaced sysctls from the spec are applied
+// within a namespace of the container.
+// liblxc writes the sysctls (lxc.sysctl) from the container process
+// after the namespaces were created or joined, so a sysctl is applied
+// to the namespaces of the container. If the container does not have
+// its own namespace, the sysctl would change the value of the runtime (host) namespace.
+func (rt *Runtime) checkSysctls(spec *specs.Spec) error {
+	for key := range spec.Linux.Sysctl {
+		nsType, ok := sysctlNamespace(key)
+		if !ok {
+			rt.Log.Warn().Str("sysctl", key).Msg("sysctl is not namespaced and changes the host value")
+			continue
+		}
+		ns := getNamespace(spec, nsType)
+		if ns == nil {
+			return errorf("sysctl %q requires a %s namespace", key, nsType)
+		}
+		yes, err := isNamespaceSharedWithRuntime(ns)
+		if err != nil {
+			return errorf("failed to check %s namespace: %w", nsType, err)
+		}
+		if yes {
+			return errorf("sysctl %q is not allowed in the %s namespace of the runtime", key, nsType)
+		}
+	}
+	return nil
+}
+
+func configureSysctls(c *Container) error {
+	for key, val := range c.Spec.Linux.Sysctl {
+		if err := c.setConfigItem("lxc.sysctl."+key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package lxcri
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lxc/lxcri/pkg/specki"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSysctlNamespace(t *testing.T) {
+	for key, expected := range map[string]specs.LinuxNamespaceType{
+		"net.ipv4.ping_group_range": specs.NetworkNamespace,
+		"net/ipv4/ip_forward":       specs.NetworkNamespace,
+		"kernel.shmmax":             specs.IPCNamespace,
+		"fs.mqueue.msg_max":         specs.IPCNamespace,
+		"kernel.hostname":           specs.UTSNamespace,
+	} {
+		nsType, ok := sysctlNamespace(key)
+		require.True(t, ok, key)
+		require.Equal(t, expected, nsType, key)
+	}
+
+	for _, key := range []string{"kernel.pid_max", "vm.overcommit_memory", "fs.file-max"} {
+		_, ok := sysctlNamespace(key)
+		require.False(t, ok, key)
+	}
+}
+
+func TestCheckSysctls(t *testing.T) {
+	var buf bytes.Buffer
+	rtSysctl := *rt
+	rtSysctl.Log = zerolog.New(&buf)
+
+	spec := specki.NewSpec("/tmp/rootfs", "/bin/true")
+	spec.Linux.Sysctl = map[string]string{
+		"net.ipv4.ping_group_range": "0 2147483647",
+		"vm.overcommit_memory":      "1",
+	}
+	require.NoError(t, rtSysctl.checkSysctls(spec))
+	require.Contains(t, buf.String(), "sysctl is not namespaced")
+
+	// The network sysctl would change the host network namespace.
+	removeNamespace(spec, specs.NetworkNamespace)
+	require.Error(t, rtSysctl.checkSysctls(spec))
+
+	specki.SetNamespace(spec, specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: "/proc/self/ns/net"})
+	require.Error(t, rtSysctl.checkSysctls(spec))
+}
+
+func TestSysctlNetNamespace(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skipf("This tests only runs as root")
+	}
+
+	cfg := newConfig(t, filepath.Join(rt.LibexecDir, "lxcri-test"))
+	defer removeAll(t, cfg.Spec.Root.Path)
+	require.True(t, isNamespaceEnabled(cfg.Spec, specs.NetworkNamespace))
+	cfg.Spec.Process.Env = []string{"SLEEP=30"}
+	cfg.Spec.Linux.Sysctl = map[string]string{"net.ipv4.ping_group_range": "1000 2000"}
+
+	hostValue, err := os.ReadFile("/proc/sys/net/ipv4/ping_group_range")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := rt.Create(ctx, cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Delete(ctx, true))
+	}()
+
+	require.NoError(t, rt.Start(ctx, c))
+	require.NoError(t, c.WaitRunning(ctx))
+
+	// /proc/sys/net shows the values of the network namespace of the reading thread.
+	val, err := readInNetns(fmt.Sprintf("/proc/%d/ns/net", c.LinuxContainer.InitPid()), "/proc/sys/net/ipv4/ping_group_range")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1000", "2000"}, strings.Fields(string(val)))
+
+	// The host value is unchanged.
+	val, err = os.ReadFile("/proc/sys/net/ipv4/ping_group_range")
+	require.NoError(t, err)
+	require.Equal(t, string(hostValue), string(val))
+}
+
+// readInNetns reads the file from a thread that joined the given network namespace.
+// The goroutine exits with the thread locked, so the thread is terminated
+// and not reused by other goroutines.
+func readInNetns(netns string, filename string) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := os.Open(netns)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer ns.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			ch <- result{err: err}
+			return
+		}
+		data, err := os.ReadFile(filename)
+		ch <- result{data, err}
+	}()
+	res := <-ch
+	return res.data, res.err
+}
@@ -6,10 +6,19 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
+	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
 )
 
+// logPhase logs the duration of an operation phase, measured from start,
+// at debug level. It helps to find out which phase of a slow operation
+// (e.g create) takes the most time.
+func logPhase(log zerolog.Logger, phase string, start time.Time) {
+	log.Debug().Str("phase", phase).Dur("duration", time.Since(start)).Msg("phase completed")
+}
+
 func canExecute(cmds ...string) error {
 	for _, c := range cmds {
 		if err := unix.Access(c, unix.X_OK); err != nil {
@@ -25,6 +34,8 @@ func fsMagic(fsName string) int64 {
 		return unix.PROC_SUPER_MAGIC
 	case "cgroup2", "cgroup2fs":
 		return unix.CGROUP2_SUPER_MAGIC
+	case "cgroup":
+		return unix.CGROUP_SUPER_MAGIC
 	default:
 		return -1
 	}
@@ -53,9 +64,67 @@ func nullTerminatedString(data []byte) string {
 	return string(data[:i])
 }
 
+// logTailReadSize is the size of the chunk read from the end of a log file by logTail.
+const logTailReadSize = 64 << 10
+
+// logTail returns the lines of the given liblxc log file that contain
+// the given container name, from the last logTailReadSize bytes of the file.
+// The result is limited to the last max bytes (whole lines).
+// An empty string is returned if filename is not a regular file (e.g /dev/stderr).
+func logTail(filename string, name string, max int) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil
+	}
+	offset := info.Size() - logTailReadSize
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return "", err
+	}
+
+	// liblxc prefixes each log line with 'lxc <name> '
+	prefix := []byte("lxc " + name + " ")
+	var lines [][]byte
+	size := 0
+	all := bytes.Split(data, []byte{'\n'})
+	for i := len(all) - 1; i >= 0; i-- {
+		line := all[i]
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		if size+len(line)+1 > max {
+			break
+		}
+		size += len(line) + 1
+		lines = append([][]byte{line}, lines...)
+	}
+	return string(bytes.Join(lines, []byte{'\n'})), nil
+}
+
 func errorf(sfmt string, args ...interface{}) error {
 	bin := filepath.Base(os.Args[0])
 	_, file, line, _ := runtime.Caller(1)
 	prefix := fmt.Sprintf("[%s:%s:%d] ", bin, filepath.Base(file), line)
 	return fmt.Errorf(prefix+sfmt, args...)
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
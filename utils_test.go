@@ -0,0 +1,65 @@
+package lxcri
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogPhase(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf).Level(zerolog.DebugLevel)
+
+	logPhase(log, "rootfs", time.Now().Add(-time.Second))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "debug", entry[zerolog.LevelFieldName])
+	require.Equal(t, "rootfs", entry["phase"])
+	require.Contains(t, entry, "duration")
+	require.GreaterOrEqual(t, entry["duration"].(float64), float64(1000))
+
+	// Timing is not logged above debug level.
+	buf.Reset()
+	logPhase(log.Level(zerolog.InfoLevel), "rootfs", time.Now())
+	require.Empty(t, buf.String())
+}
+
+func TestLogTail(t *testing.T) {
+	f, err := os.CreateTemp("", "lxcri-test-log")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`lxc c1 20210101 ERROR start - start.c:1 - first
+lxc c2 20210101 ERROR start - start.c:2 - other container
+lxc c1 20210101 ERROR start - start.c:3 - second
+lxc c1 20210101 ERROR start - start.c:4 - third
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	tail, err := logTail(f.Name(), "c1", 4096)
+	require.NoError(t, err)
+	require.Equal(t, `lxc c1 20210101 ERROR start - start.c:1 - first
+lxc c1 20210101 ERROR start - start.c:3 - second
+lxc c1 20210101 ERROR start - start.c:4 - third`, tail)
+
+	// only whole lines are returned
+	tail, err = logTail(f.Name(), "c1", 60)
+	require.NoError(t, err)
+	require.Equal(t, "lxc c1 20210101 ERROR start - start.c:4 - third", tail)
+
+	tail, err = logTail(f.Name(), "c3", 4096)
+	require.NoError(t, err)
+	require.Empty(t, tail)
+
+	// not a regular file
+	tail, err = logTail("/dev/null", "c1", 4096)
+	require.NoError(t, err)
+	require.Empty(t, tail)
+}